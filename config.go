@@ -12,6 +12,10 @@ type config struct {
 	StorageType    string `envconfig:"STORAGE_ADAPTER" default:"redis"`
 	NumLines       int    `envconfig:"NUMBER_OF_LINES" default:"1000"`
 	AggregatorType string `envconfig:"AGGREGATOR_TYPE" default:"nsq"`
+	RetentionFile  string `envconfig:"RETENTION_FILE" default:""`
+	TailBuffer     int    `envconfig:"TAIL_BUFFER_LINES" default:"100"`
+	TailHistory    int    `envconfig:"TAIL_HISTORY_LINES" default:"100"`
+	TailIdle       int    `envconfig:"TAIL_HISTORY_IDLE_SECONDS" default:"300"`
 }
 
 func parseConfig(appName string) (*config, error) {
@@ -2,18 +2,99 @@ package log
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/deis/logger/storage"
 )
 
-// NewAggregator returns a pointer to an appropriate implementation of the Aggregator interface, as
-// determined by the aggregatorType string it is passed.
-func NewAggregator(aggregatorType string, storageAdapter storage.Adapter) (Aggregator, error) {
-	if aggregatorType == "noop" {
+// AggregatorConfig is the configuration every aggregator is created with. Settings specific to an
+// aggregator are read from the environment by its factory.
+type AggregatorConfig struct {
+	// StorageAdapter is where aggregated log messages are written to
+	StorageAdapter storage.Adapter
+	// Identity tells which app aggregated log messages are written for
+	Identity *AppIdentity
+	// Format renders aggregated log messages as the lines written
+	Format *LineFormat
+	// Broker, if set, passes aggregated log messages on to the clients tailing their app
+	Broker *Broker
+}
+
+// AggregatorFactory returns a new aggregator for the given configuration
+type AggregatorFactory func(AggregatorConfig) (Aggregator, error)
+
+var (
+	factoriesMutex sync.RWMutex
+	factories      = make(map[string]AggregatorFactory)
+)
+
+func init() {
+	Register("noop", func(cfg AggregatorConfig) (Aggregator, error) {
 		return newNoopAggregator(), nil
+	})
+	Register("nsq", func(cfg AggregatorConfig) (Aggregator, error) {
+		return newNSQAggregator(cfg), nil
+	})
+}
+
+// Register makes an aggregator available to NewAggregator under the given name. Aggregators built
+// outside of this package register themselves from an init function of a package compiled into
+// the binary. Registering a nil factory or the same name twice panics.
+func Register(name string, factory AggregatorFactory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	if factory == nil {
+		panic("log: Register factory is nil")
+	}
+	if _, ok := factories[name]; ok {
+		panic("log: Register called twice for aggregator " + name)
+	}
+	factories[name] = factory
+}
+
+// Aggregators returns the sorted names of the registered aggregators
+func Aggregators() []string {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewAggregator returns a pointer to an appropriate implementation of the Aggregator interface, as
+// determined by the aggregatorType string it is passed. Aggregated messages are published to the
+// broker, if it isn't nil.
+func NewAggregator(aggregatorType string, storageAdapter storage.Adapter, broker *Broker) (Aggregator, error) {
+	factoriesMutex.RLock()
+	factory, ok := factories[aggregatorType]
+	factoriesMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unrecognized aggregator type: '%s'", aggregatorType)
+	}
+	cfg, err := ParseConfig(appName)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := NewAppIdentity(cfg)
+	if err != nil {
+		return nil, err
+	}
+	format, err := NewLineFormat(cfg.LogFormat, cfg.ControllerFormat)
+	if err != nil {
+		return nil, err
 	}
-	if aggregatorType == "nsq" {
-		return newNSQAggregator(storageAdapter), nil
+	aggregator, err := factory(AggregatorConfig{
+		StorageAdapter: storageAdapter,
+		Identity:       identity,
+		Format:         format,
+		Broker:         broker,
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("Unrecognized aggregator type: '%s'", aggregatorType)
+	return aggregator, nil
 }
@@ -1,9 +1,12 @@
 package log
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"testing"
+
+	"github.com/deis/logger/storage"
 )
 
 type stubStorageAdapter struct {
@@ -12,15 +15,19 @@ type stubStorageAdapter struct {
 func (a *stubStorageAdapter) Start() {
 }
 
-func (a *stubStorageAdapter) Write(app string, message string) error {
+func (a *stubStorageAdapter) Write(ctx context.Context, app string, message string) error {
 	return nil
 }
 
-func (a *stubStorageAdapter) Read(app string, lines int, process string) ([]string, error) {
-	return []string{}, nil
+func (a *stubStorageAdapter) Read(ctx context.Context, app string, opts storage.ReadOptions) (*storage.Page, error) {
+	return &storage.Page{}, nil
+}
+
+func (a *stubStorageAdapter) Apps(context.Context) ([]storage.AppInfo, error) {
+	return []storage.AppInfo{}, nil
 }
 
-func (a *stubStorageAdapter) Destroy(app string) error {
+func (a *stubStorageAdapter) Destroy(ctx context.Context, app string) error {
 	return nil
 }
 
@@ -32,14 +39,14 @@ func (a *stubStorageAdapter) Stop() {
 }
 
 func TestGetUsingInvalidValues(t *testing.T) {
-	_, err := NewAggregator("bogus", &stubStorageAdapter{})
+	_, err := NewAggregator("bogus", &stubStorageAdapter{}, nil)
 	if err == nil || err.Error() != fmt.Sprintf("Unrecognized aggregator type: '%s'", "bogus") {
 		t.Error("Did not receive expected error message")
 	}
 }
 
 func TestNSQBasedAggregator(t *testing.T) {
-	a, err := NewAggregator("nsq", &stubStorageAdapter{})
+	a, err := NewAggregator("nsq", &stubStorageAdapter{}, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -49,3 +56,26 @@ func TestNSQBasedAggregator(t *testing.T) {
 		t.Errorf("Expected a %s, but got a %s", expected, aType)
 	}
 }
+
+func TestRegister(t *testing.T) {
+	var cfg AggregatorConfig
+	Register("test-registered", func(c AggregatorConfig) (Aggregator, error) {
+		cfg = c
+		return newNoopAggregator(), nil
+	})
+	defer func() {
+		factoriesMutex.Lock()
+		delete(factories, "test-registered")
+		factoriesMutex.Unlock()
+	}()
+	storageAdapter := &stubStorageAdapter{}
+	if _, err := NewAggregator("test-registered", storageAdapter, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.StorageAdapter != storageAdapter {
+		t.Error("Expected the factory to be passed the storage adapter")
+	}
+	if names := Aggregators(); !reflect.DeepEqual(names, []string{"noop", "nsq", "test-registered"}) {
+		t.Errorf("unexpected aggregators: %v", names)
+	}
+}
@@ -0,0 +1,270 @@
+package log
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Published is an aggregated message as passed on to the subscribers of its app
+type Published struct {
+	// ID identifies the message among those of its app, for subscribers to resume after it
+	ID string
+	// Line holds the fields of the message
+	Line *Line
+	// Rendered is the message rendered in the configured format, as it is stored
+	Rendered string
+	seq      uint64
+}
+
+// Broker passes the messages aggregated for an app on to the clients tailing its logs. Publishing
+// never blocks: every subscriber has a bounded buffer, and messages that don't fit are dropped and
+// counted for the subscriber to report. The latest messages of apps being tailed are kept, so that
+// clients that reconnect can resume where they left off, until the app was left untailed for
+// historyIdle.
+type Broker struct {
+	bufferSize  int
+	historySize int
+	historyIdle time.Duration
+	// epoch tells the IDs of messages published by this broker from those of a previous process,
+	// whose sequence numbers are reused
+	epoch   string
+	streams uint64
+	// mutex guards the map of streams, and every stream has a mutex of its own. The broker's mutex
+	// is taken first when both are held.
+	mutex sync.RWMutex
+	apps  map[string]*appStream
+}
+
+// appStream holds the subscribers and the latest messages of an app
+type appStream struct {
+	// epoch tells the IDs of messages of this stream from those of the app's previous streams
+	epoch       string
+	seq         uint64
+	history     []Published
+	subscribers map[*Subscription]struct{}
+	// closed counts the subscriptions closed, so that a stream is only dropped if it wasn't
+	// subscribed to since it became idle
+	closed uint64
+	mutex  sync.Mutex
+}
+
+// NewBroker returns a broker buffering up to bufferSize messages for every subscriber, and keeping
+// the latest historySize messages of every app being tailed until it was left untailed for
+// historyIdle
+func NewBroker(bufferSize int, historySize int, historyIdle time.Duration) *Broker {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	return &Broker{
+		bufferSize:  bufferSize,
+		historySize: historySize,
+		historyIdle: historyIdle,
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		apps:        make(map[string]*appStream),
+	}
+}
+
+// Subscription receives the messages published for an app from the moment it subscribed. It must
+// be closed once done with.
+type Subscription struct {
+	// dropped counts the messages dropped since the count was last taken, and notify is signaled
+	// when it grows. It comes first to be 64-bit aligned for atomic operations.
+	dropped  uint64
+	notify   chan struct{}
+	broker   *Broker
+	app      string
+	stream   *appStream
+	messages chan Published
+}
+
+// subscribe returns a subscription to the stream of an app, creating the stream if needed, and
+// calls locked with the stream locked
+func (b *Broker) subscribe(app string, locked func(*appStream)) *Subscription {
+	b.mutex.Lock()
+	stream, ok := b.apps[app]
+	if !ok {
+		stream = &appStream{epoch: b.newEpoch(), subscribers: make(map[*Subscription]struct{})}
+		b.apps[app] = stream
+	}
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	b.mutex.Unlock()
+	s := &Subscription{
+		broker:   b,
+		app:      app,
+		stream:   stream,
+		messages: make(chan Published, b.bufferSize),
+		notify:   make(chan struct{}, 1),
+	}
+	stream.subscribers[s] = struct{}{}
+	if locked != nil {
+		locked(stream)
+	}
+	return s
+}
+
+// newEpoch returns the epoch of a new stream
+func (b *Broker) newEpoch() string {
+	return fmt.Sprintf("%s.%d", b.epoch, atomic.AddUint64(&b.streams, 1))
+}
+
+// Subscribe returns a subscription to the messages published for an app
+func (b *Broker) Subscribe(app string) *Subscription {
+	return b.subscribe(app, nil)
+}
+
+// SubscribeAfter returns a subscription to the messages published for an app along with the kept
+// messages published after the one with the given ID, and the number of messages published since
+// that are no longer kept. It returns false if the ID isn't that of a message that can be resumed
+// after, such as one of another broker or one whose app's messages are no longer kept, in which
+// case no messages are returned.
+func (b *Broker) SubscribeAfter(app string, id string) (*Subscription, []Published, uint64, bool) {
+	var kept []Published
+	var missed uint64
+	var ok bool
+	s := b.subscribe(app, func(stream *appStream) {
+		var last uint64
+		if last, ok = stream.parseID(id); !ok || last > stream.seq {
+			ok = false
+			return
+		}
+		for _, message := range stream.history {
+			if message.seq > last {
+				kept = append(kept, message)
+			}
+		}
+		missed = stream.seq - last - uint64(len(kept))
+	})
+	return s, kept, missed, ok
+}
+
+// parseID returns the sequence number of a message of the stream with the given ID
+func (stream *appStream) parseID(id string) (uint64, bool) {
+	i := strings.LastIndex(id, "-")
+	if i < 0 || id[:i] != stream.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	return seq, err == nil
+}
+
+// Publish passes a message on to the subscribers of an app, dropping it for those whose buffer is
+// full. Messages of apps that aren't being tailed, and weren't recently, are neither passed on nor
+// kept.
+func (b *Broker) Publish(app string, message Published) {
+	b.mutex.RLock()
+	stream, ok := b.apps[app]
+	b.mutex.RUnlock()
+	if !ok {
+		return
+	}
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.seq++
+	message.seq = stream.seq
+	message.ID = fmt.Sprintf("%s-%d", stream.epoch, stream.seq)
+	if b.historySize > 0 {
+		stream.history = append(stream.history, message)
+		if len(stream.history) > b.historySize {
+			stream.history = stream.history[len(stream.history)-b.historySize:]
+		}
+	}
+	for s := range stream.subscribers {
+		select {
+		case s.messages <- message:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			select {
+			case s.notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Forget drops the kept messages of an app, such as one whose logs were destroyed, so that they
+// can't be resumed after. Subscriptions to the app stay open.
+func (b *Broker) Forget(app string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	stream, ok := b.apps[app]
+	if !ok {
+		return
+	}
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if len(stream.subscribers) == 0 {
+		delete(b.apps, app)
+		return
+	}
+	stream.epoch, stream.seq, stream.history = b.newEpoch(), 0, nil
+}
+
+// drop drops the stream of an app if it is still idle since its subscription numbered closed was
+func (b *Broker) drop(app string, stream *appStream, closed uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if b.apps[app] == stream && len(stream.subscribers) == 0 && stream.closed == closed {
+		delete(b.apps, app)
+	}
+}
+
+// Subscribers returns the number of subscriptions to the messages of an app
+func (b *Broker) Subscribers(app string) int {
+	b.mutex.RLock()
+	stream, ok := b.apps[app]
+	b.mutex.RUnlock()
+	if !ok {
+		return 0
+	}
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	return len(stream.subscribers)
+}
+
+// Messages returns the channel receiving the published messages. It is closed along with the
+// subscription.
+func (s *Subscription) Messages() <-chan Published {
+	return s.messages
+}
+
+// Dropped returns a channel signaled when messages were dropped because the buffer was full
+func (s *Subscription) Dropped() <-chan struct{} {
+	return s.notify
+}
+
+// TakeDropped returns the number of messages dropped since it was last called
+func (s *Subscription) TakeDropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+// Close stops the subscription. Once an app has no subscriptions left, its messages are kept for
+// the broker's historyIdle, in case its clients reconnect, and are then dropped.
+func (s *Subscription) Close() {
+	stream := s.stream
+	stream.mutex.Lock()
+	if _, ok := stream.subscribers[s]; !ok {
+		stream.mutex.Unlock()
+		return
+	}
+	delete(stream.subscribers, s)
+	close(s.messages)
+	stream.closed++
+	idle, closed := len(stream.subscribers) == 0, stream.closed
+	stream.mutex.Unlock()
+	if !idle {
+		return
+	}
+	b := s.broker
+	if b.historySize <= 0 || b.historyIdle <= 0 {
+		b.drop(s.app, stream, closed)
+		return
+	}
+	time.AfterFunc(b.historyIdle, func() { b.drop(s.app, stream, closed) })
+}
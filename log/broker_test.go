@@ -0,0 +1,142 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker(t *testing.T) {
+	b := NewBroker(2, 0, time.Minute)
+	foo, bar := b.Subscribe("foo"), b.Subscribe("bar")
+	defer bar.Close()
+	b.Publish("foo", Published{Rendered: "first"})
+	b.Publish("baz", Published{Rendered: "nobody listens"})
+	assert.Equal(t, "first", (<-foo.Messages()).Rendered)
+	select {
+	case p := <-bar.Messages():
+		t.Errorf("expected no message for bar, got %q", p.Rendered)
+	default:
+	}
+	// messages that don't fit in a subscriber's buffer are dropped and counted
+	for _, rendered := range []string{"second", "third", "fourth", "fifth"} {
+		b.Publish("foo", Published{Rendered: rendered})
+	}
+	select {
+	case <-foo.Dropped():
+	default:
+		t.Error("expected to be told about dropped messages")
+	}
+	assert.Equal(t, uint64(2), foo.TakeDropped())
+	assert.Equal(t, uint64(0), foo.TakeDropped())
+	assert.Equal(t, "second", (<-foo.Messages()).Rendered)
+	assert.Equal(t, "third", (<-foo.Messages()).Rendered)
+	foo.Close()
+	foo.Close()
+	_, open := <-foo.Messages()
+	assert.False(t, open, "expected the messages of a closed subscription to be closed")
+	assert.Equal(t, 0, b.Subscribers("foo"))
+	assert.Equal(t, 1, b.Subscribers("bar"))
+}
+
+func TestProcessMessagePublishes(t *testing.T) {
+	cfg := newTestAggregatorConfig(t, &stubStorageAdapter{})
+	cfg.Broker = NewBroker(10, 0, time.Minute)
+	s := cfg.Broker.Subscribe("api")
+	defer s.Close()
+	message := newTestMessage("tenant-a", map[string]string{"app": "api", "type": "web", "version": "v2"})
+	assert.NoError(t, processMessage(message, cfg))
+	p := <-s.Messages()
+	assert.Equal(t, defaultLineFormat.Format("api", message), p.Rendered)
+	assert.Equal(t, "web", p.Line.Process)
+	assert.Equal(t, "tenant-a", p.Line.Kubernetes.Namespace)
+}
+
+func TestBrokerSubscribeAfter(t *testing.T) {
+	b := NewBroker(10, 2, time.Minute)
+	var ids []string
+	for _, rendered := range []string{"first", "second", "third"} {
+		s := b.Subscribe("foo")
+		b.Publish("foo", Published{Rendered: rendered})
+		ids = append(ids, (<-s.Messages()).ID)
+		s.Close()
+	}
+	// the latest two messages are kept
+	s, kept, missed, ok := b.SubscribeAfter("foo", ids[0])
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0), missed)
+	assert.Equal(t, []string{"second", "third"}, []string{kept[0].Rendered, kept[1].Rendered})
+	b.Publish("foo", Published{Rendered: "fourth"})
+	assert.Equal(t, "fourth", (<-s.Messages()).Rendered)
+	s.Close()
+	s, kept, missed, ok = b.SubscribeAfter("foo", ids[0])
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), missed, "expected the second message to be reported as missed")
+	assert.Len(t, kept, 2)
+	s.Close()
+	s, kept, missed, ok = b.SubscribeAfter("foo", ids[2])
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0), missed)
+	assert.Len(t, kept, 1)
+	s.Close()
+	// IDs of another broker, such as one running before a restart, can't be resumed after
+	for _, id := range []string{NewBroker(10, 2, time.Minute).epoch + "-1", "bogus", ids[0] + "0"} {
+		s, kept, _, ok = b.SubscribeAfter("foo", id)
+		assert.False(t, ok, "expected not to resume after %q", id)
+		assert.Empty(t, kept)
+		s.Close()
+	}
+}
+
+// kept returns the apps whose messages the broker keeps
+func (b *Broker) kept() []string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	apps := []string{}
+	for app := range b.apps {
+		apps = append(apps, app)
+	}
+	return apps
+}
+
+func TestBrokerDropsIdleApps(t *testing.T) {
+	b := NewBroker(10, 2, 50*time.Millisecond)
+	// the messages of apps nobody tails aren't kept
+	b.Publish("bar", Published{Rendered: "nobody listens"})
+	assert.Empty(t, b.kept())
+	s := b.Subscribe("foo")
+	b.Publish("foo", Published{Rendered: "first"})
+	id := (<-s.Messages()).ID
+	b.Publish("foo", Published{Rendered: "second"})
+	s.Close()
+	// clients reconnecting soon after resume where they left off
+	s, kept, _, ok := b.SubscribeAfter("foo", id)
+	assert.True(t, ok)
+	assert.Len(t, kept, 1)
+	s.Close()
+	assert.Eventually(t, func() bool { return len(b.kept()) == 0 }, time.Second, 10*time.Millisecond)
+	s, kept, _, ok = b.SubscribeAfter("foo", id)
+	assert.False(t, ok, "expected not to resume after the messages of an idle app were dropped")
+	assert.Empty(t, kept)
+	s.Close()
+}
+
+func TestBrokerForget(t *testing.T) {
+	b := NewBroker(10, 2, time.Minute)
+	s := b.Subscribe("foo")
+	defer s.Close()
+	b.Publish("foo", Published{Rendered: "first"})
+	id := (<-s.Messages()).ID
+	b.Forget("foo")
+	other, kept, _, ok := b.SubscribeAfter("foo", id)
+	assert.False(t, ok, "expected not to resume after a forgotten message")
+	assert.Empty(t, kept)
+	other.Close()
+	// subscriptions stay open
+	b.Publish("foo", Published{Rendered: "second"})
+	assert.Equal(t, "second", (<-s.Messages()).Rendered)
+	s.Close()
+	b.Forget("foo")
+	assert.Empty(t, b.kept())
+}
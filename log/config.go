@@ -23,8 +23,13 @@ type Config struct {
 	NSQChannel         string `envconfig:"NSQ_CHANNEL" default:"consume"`
 	NSQHandlerCount    int    `envconfig:"NSQ_HANDLER_COUNT" default:"30"`
 	StopTimeoutSeconds int    `envconfig:"AGGREGATOR_STOP_TIMEOUT_SEC" default:"1"`
-	KubeConfigPath     string `envconfig:"KUBE_CONFIG_PATH" default:"~/.kube/config"`
-	KubeContextName    string `envconfig:"KUBE_CONTEXT_NAME" default:"stag"`
+	AppIdentity        string `envconfig:"DEIS_LOGGER_APP_IDENTITY" default:"label"`
+	AppLabel           string `envconfig:"DEIS_LOGGER_APP_LABEL" default:"app"`
+	AppSeparator       string `envconfig:"DEIS_LOGGER_APP_SEPARATOR" default:"."`
+	AppTemplate        string `envconfig:"DEIS_LOGGER_APP_TEMPLATE" default:""`
+	UnidentifiedApp    string `envconfig:"DEIS_LOGGER_UNIDENTIFIED_APP" default:""`
+	LogFormat          string `envconfig:"DEIS_LOGGER_LOG_FORMAT" default:""`
+	ControllerFormat   string `envconfig:"DEIS_LOGGER_CONTROLLER_LOG_FORMAT" default:""`
 }
 
 func (c Config) nsqURL() string {
@@ -0,0 +1,239 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/deis/logger/storage"
+)
+
+const (
+	// DefaultLogFormat renders the messages of apps as "<time> <app>[<type>.<version>.<pod>]: <log>"
+	DefaultLogFormat = `{{formatTime "` + timeFormat + `" .Time}} {{.App}}[{{.Process}}.{{.Version}}{{if .PodSuffix}}.{{.PodSuffix}}{{end}}]: {{.Text}}`
+	// DefaultControllerLogFormat renders the messages of the controller as
+	// "<time> deis[controller]: <level> <text>"
+	DefaultControllerLogFormat = `{{formatTime "` + timeFormat + `" .Time}} deis[controller]: {{.Level}} {{.Text}}`
+)
+
+// storedLineRegex matches lines rendered by the default formats
+var storedLineRegex = regexp.MustCompile(`(?s)^(\S+) ([^\s\[]+)\[([^\]]*)\]: (.*)$`)
+
+// Line is what log format templates are executed on: a message along with the fields derived from
+// it. Every field of the message, such as .Stream or .Kubernetes.Namespace, can be used.
+type Line struct {
+	Message
+	// App is the app the message belongs to, as named by the app identity
+	App string
+	// Process, Version and PodSuffix are the type and version labels of the pod and the random
+	// suffix of its name
+	Process   string
+	Version   string
+	PodSuffix string
+	// Controller is set for messages of the controller, whose Level is that of the message
+	Controller bool
+	Level      string
+	// Text is what was logged, without the level of controller messages
+	Text string
+}
+
+// newLine derives the fields of a line from a message belonging to an app
+func newLine(message *Message, app string) *Line {
+	l := &Line{Message: *message, App: app}
+	if fromController(message) {
+		m := controllerRegex.FindStringSubmatch(message.Log)
+		l.Controller, l.Level, l.Text = true, m[1], strings.Trim(m[4], " ")
+		return l
+	}
+	labels := message.Kubernetes.Labels
+	l.Process, l.Version, l.Text = labels["type"], labels["version"], message.Log
+	if p := podRegex.FindStringSubmatch(message.Kubernetes.PodName); len(p) > 0 {
+		l.PodSuffix = p[len(p)-1]
+	}
+	return l
+}
+
+// ParseLine recovers the fields of a line stored in one of the default formats, or returns false if
+// it isn't in either. Only the fields that the line holds are set.
+func ParseLine(stored string) (*Line, bool) {
+	m := storedLineRegex.FindStringSubmatch(stored)
+	if m == nil {
+		return nil, false
+	}
+	t, err := time.Parse(timeFormat, m[1])
+	if err != nil {
+		return nil, false
+	}
+	l := &Line{Message: Message{Time: t, Log: m[4]}, Text: m[4]}
+	if m[2] == "deis" && m[3] == "controller" {
+		l.Controller = true
+		if fields := strings.SplitN(m[4], " ", 2); len(fields) == 2 {
+			l.Level, l.Text = fields[0], fields[1]
+		}
+		return l, true
+	}
+	l.App = m[2]
+	tag := strings.SplitN(m[3], ".", 3)
+	l.Process = tag[0]
+	if len(tag) > 1 {
+		l.Version = tag[1]
+	}
+	if len(tag) > 2 {
+		l.PodSuffix = tag[2]
+	}
+	l.Kubernetes.Labels = map[string]string{"app": l.App, "type": l.Process, "version": l.Version}
+	return l, true
+}
+
+// StoredLine recovers the fields of a stored line of an app from the metadata stored along with it,
+// if it isn't nil, and from the line if it is in one of the default formats. The text of lines in
+// other formats is the whole line. It returns false if neither holds any field.
+func StoredLine(app string, stored string, metadata *storage.Metadata) (*Line, bool) {
+	l, ok := ParseLine(stored)
+	if metadata == nil {
+		return l, ok
+	}
+	if !ok {
+		l = &Line{Message: Message{Log: stored}, Text: stored}
+	}
+	l.App = app
+	if !metadata.Time.IsZero() {
+		l.Time = metadata.Time
+	}
+	k := &l.Kubernetes
+	k.Namespace, k.PodName, k.ContainerName = metadata.Namespace, metadata.Pod, metadata.Container
+	if p := podRegex.FindStringSubmatch(metadata.Pod); len(p) > 0 {
+		l.PodSuffix = p[len(p)-1]
+	}
+	if !l.Controller {
+		l.Process, l.Version = metadata.Process, metadata.Version
+		k.Labels = map[string]string{"app": app, "type": l.Process, "version": l.Version}
+	}
+	l.Stream = metadata.Stream
+	return l, true
+}
+
+// LineFormat renders messages as log lines with a template for the messages of apps and another
+// for those of the controller
+type LineFormat struct {
+	app        *template.Template
+	controller *template.Template
+}
+
+// NewLineFormat returns the format rendering lines with the given templates. Empty templates stand
+// for the default ones.
+func NewLineFormat(appFormat string, controllerFormat string) (*LineFormat, error) {
+	if appFormat == "" {
+		appFormat = DefaultLogFormat
+	}
+	if controllerFormat == "" {
+		controllerFormat = DefaultControllerLogFormat
+	}
+	f := new(LineFormat)
+	var err error
+	if f.app, err = parseLineTemplate(appFormat); err != nil {
+		return nil, err
+	}
+	if f.controller, err = parseLineTemplate(controllerFormat); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// defaultLineFormat renders lines with the default templates
+var defaultLineFormat, _ = NewLineFormat("", "")
+
+// parseLineTemplate parses a format, making sure that it can be executed on a line so that lines
+// aren't lost to a typo
+func parseLineTemplate(format string) (*template.Template, error) {
+	t, err := template.New("line").Funcs(lineFuncs).Option("missingkey=zero").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid log format: %s", err)
+	}
+	if err := t.Execute(ioutil.Discard, &Line{Message: Message{Time: time.Now()}}); err != nil {
+		return nil, fmt.Errorf("Invalid log format: %s", err)
+	}
+	return t, nil
+}
+
+// Format renders a message belonging to an app with the template matching its kind
+func (f *LineFormat) Format(app string, message *Message) string {
+	return f.format(newLine(message, app))
+}
+
+func (f *LineFormat) format(l *Line) string {
+	if l.Controller {
+		return render(f.controller, l)
+	}
+	return render(f.app, l)
+}
+
+// Render renders a line with the app template, which per request formats expect to be given
+// controller lines as well
+func (f *LineFormat) Render(l *Line) string {
+	return render(f.app, l)
+}
+
+func render(t *template.Template, l *Line) string {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, l); err != nil {
+		// the template was checked when parsed, so only data dependent errors get here
+		return fmt.Sprintf("%s %s", l.Time.Format(timeFormat), l.Text)
+	}
+	return buf.String()
+}
+
+// lineFuncs are the helpers available to log format templates
+var lineFuncs = template.FuncMap{
+	// formatTime formats a time with a Go layout, e.g. {{formatTime "15:04:05" .Time}}
+	"formatTime": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	// inZone returns a time in a time zone of the IANA database, e.g.
+	// {{.Time | inZone "Europe/Paris" | formatTime "15:04:05"}}
+	"inZone": func(zone string, t time.Time) (time.Time, error) {
+		loc, err := loadLocation(zone)
+		if err != nil {
+			return t, err
+		}
+		return t.In(loc), nil
+	},
+	// truncate shortens text to at most n characters, e.g. {{truncate 200 .Text}}
+	"truncate": func(n int, s string) string {
+		if n < 0 {
+			n = 0
+		}
+		for i := range s {
+			if n == 0 {
+				return s[:i]
+			}
+			n--
+		}
+		return s
+	},
+}
+
+// locations caches the time zones loaded by templates, which are executed for every message
+var locations = struct {
+	byName map[string]*time.Location
+	mutex  sync.Mutex
+}{byName: make(map[string]*time.Location)}
+
+func loadLocation(zone string) (*time.Location, error) {
+	locations.mutex.Lock()
+	defer locations.mutex.Unlock()
+	if loc, ok := locations.byName[zone]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, err
+	}
+	locations.byName[zone] = loc
+	return loc, nil
+}
@@ -0,0 +1,53 @@
+package log
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineFormat(t *testing.T) {
+	message := newTestMessage("tenant-a", map[string]string{"app": "api", "type": "web", "version": "v2"})
+	message.Time = time.Date(2016, 10, 18, 20, 29, 38, 0, time.UTC)
+	message.Stream = "stderr"
+	controller := new(Message)
+	assert.NoError(t, json.Unmarshal([]byte(validControllerMessage), controller))
+	controller.Time = message.Time
+	assert.Equal(t, "2016-10-18T20:29:38+00:00 api[web.v2.nzf60]: test message", defaultLineFormat.Format("api", message))
+	assert.Equal(t, "2016-10-18T20:29:38+00:00 deis[controller]: INFO admin deployed 2fd9226", defaultLineFormat.Format("foo", controller))
+	format, err := NewLineFormat(
+		`{{.Time | inZone "America/New_York" | formatTime "15:04:05"}} {{.Kubernetes.Namespace}}/{{.App}} {{.Stream}}: {{truncate 4 .Text}}`,
+		`{{.Level}}: {{.Text}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "16:29:38 tenant-a/api stderr: test", format.Format("api", message))
+	assert.Equal(t, "INFO: admin deployed 2fd9226", format.Format("foo", controller))
+}
+
+func TestParseLine(t *testing.T) {
+	message := newTestMessage("tenant-a", map[string]string{"app": "api", "type": "web", "version": "v2"})
+	message.Time = time.Date(2016, 10, 18, 20, 29, 38, 0, time.FixedZone("", -7*3600))
+	l, ok := ParseLine(defaultLineFormat.Format("api", message))
+	assert.True(t, ok)
+	assert.True(t, l.Time.Equal(message.Time))
+	assert.Equal(t, []string{"api", "web", "v2", "nzf60", "test message"}, []string{l.App, l.Process, l.Version, l.PodSuffix, l.Text})
+	assert.Equal(t, defaultLineFormat.Format("api", message), defaultLineFormat.Render(l))
+	l, ok = ParseLine("2016-10-18T20:29:38+00:00 deis[controller]: INFO admin deployed 2fd9226")
+	assert.True(t, ok)
+	assert.True(t, l.Controller)
+	assert.Equal(t, []string{"INFO", "admin deployed 2fd9226"}, []string{l.Level, l.Text})
+	for _, line := range []string{"test message", "yesterday foo[web.v2]: test message"} {
+		_, ok := ParseLine(line)
+		assert.False(t, ok, "expected %q not to be parsed", line)
+	}
+}
+
+func TestInvalidLineFormats(t *testing.T) {
+	for _, format := range []string{"{{.Time", "{{.Pod}}", `{{.Time | inZone "Mars/Olympus"}}`, "{{truncate .Text}}"} {
+		_, err := NewLineFormat(format, "")
+		assert.Error(t, err, "expected %q to be invalid", format)
+		_, err = NewLineFormat("", format)
+		assert.Error(t, err, "expected %q to be invalid", format)
+	}
+}
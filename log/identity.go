@@ -0,0 +1,105 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+)
+
+// Strategies for naming the app the logs of a pod belong to
+const (
+	// labelIdentity names apps after a pod label, which is how Workflow names its apps
+	labelIdentity = "label"
+	// namespaceIdentity names apps after the namespace of their pods
+	namespaceIdentity = "namespace"
+	// namespaceLabelIdentity names apps after both, so equally labeled pods of different namespaces
+	// don't share their logs
+	namespaceLabelIdentity = "namespace-label"
+	// templateIdentity names apps with a text/template executed on the Kubernetes fields of a message
+	templateIdentity = "template"
+)
+
+// AppIdentity tells which app the messages of a pod belong to
+type AppIdentity struct {
+	strategy     string
+	label        string
+	separator    string
+	template     *template.Template
+	unidentified string
+}
+
+// NewAppIdentity returns the app identity configured by the environment
+func NewAppIdentity(cfg *Config) (*AppIdentity, error) {
+	i := &AppIdentity{
+		strategy:     cfg.AppIdentity,
+		label:        cfg.AppLabel,
+		separator:    cfg.AppSeparator,
+		unidentified: cfg.UnidentifiedApp,
+	}
+	switch i.strategy {
+	case labelIdentity, namespaceIdentity:
+	case namespaceLabelIdentity:
+		if i.separator == "" || strings.Contains(i.separator, "/") {
+			return nil, fmt.Errorf("Invalid app separator: %q", i.separator)
+		}
+	case templateIdentity:
+		if strings.TrimSpace(cfg.AppTemplate) == "" {
+			return nil, fmt.Errorf("The app template can't be empty")
+		}
+		var err error
+		if i.template, err = template.New("app").Option("missingkey=zero").Parse(cfg.AppTemplate); err != nil {
+			return nil, fmt.Errorf("Invalid app template: %s", err)
+		}
+		// Templates naming unknown fields only fail once executed, so they're tried on a sample
+		if err := i.template.Execute(ioutil.Discard, Kubernetes{}); err != nil {
+			return nil, fmt.Errorf("Invalid app template: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid app identity: %s", i.strategy)
+	}
+	if i.label == "" && (i.strategy == labelIdentity || i.strategy == namespaceLabelIdentity) {
+		return nil, fmt.Errorf("The app label can't be empty")
+	}
+	if strings.Contains(i.unidentified, "/") {
+		return nil, fmt.Errorf("Invalid unidentified app: %q", i.unidentified)
+	}
+	return i, nil
+}
+
+// App returns the app a message belongs to, or false if it is to be dropped. Messages of pods
+// without an identity go to the catch-all app, if there is one. Apps are named in URLs and file
+// names, so identities holding a slash are ignored. Controller messages name their app, which in
+// Workflow is also the namespace of its pods.
+func (i *AppIdentity) App(message *Message) (string, bool) {
+	k := message.Kubernetes
+	if fromController(message) {
+		app := getApplicationFromControllerMessage(message)
+		k = Kubernetes{Namespace: app, Labels: map[string]string{i.label: app}}
+	}
+	app := i.identify(k)
+	if app == "" || strings.Contains(app, "/") {
+		return i.unidentified, i.unidentified != ""
+	}
+	return app, true
+}
+
+func (i *AppIdentity) identify(k Kubernetes) string {
+	switch i.strategy {
+	case namespaceIdentity:
+		return k.Namespace
+	case namespaceLabelIdentity:
+		if k.Namespace == "" || k.Labels[i.label] == "" {
+			return ""
+		}
+		return k.Namespace + i.separator + k.Labels[i.label]
+	case templateIdentity:
+		var buf bytes.Buffer
+		if err := i.template.Execute(&buf, k); err != nil {
+			return ""
+		}
+		return strings.TrimSpace(buf.String())
+	}
+	return k.Labels[i.label]
+}
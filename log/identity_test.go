@@ -0,0 +1,129 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/deis/logger/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestAppIdentity returns the default app identity, changed by configure if it isn't nil
+func newTestAppIdentity(t *testing.T, configure func(*Config)) *AppIdentity {
+	cfg, err := ParseConfig(appName)
+	assert.NoError(t, err)
+	if configure != nil {
+		configure(cfg)
+	}
+	identity, err := NewAppIdentity(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func newTestMessage(namespace string, labels map[string]string) *Message {
+	return &Message{Log: "test message", Kubernetes: Kubernetes{
+		Namespace:     namespace,
+		PodName:       "api-web-845861952-nzf60",
+		ContainerName: "api-web",
+		Labels:        labels,
+	}}
+}
+
+func TestAppIdentities(t *testing.T) {
+	labeled := newTestMessage("tenant-a", map[string]string{"app": "api", "team": "payments"})
+	unlabeled := newTestMessage("tenant-a", map[string]string{"team": "payments"})
+	controller := new(Message)
+	assert.NoError(t, json.Unmarshal([]byte(validControllerMessage), controller))
+	for _, test := range []struct {
+		strategy   string
+		template   string
+		labeled    string
+		unlabeled  string
+		controller string
+	}{
+		{strategy: labelIdentity, labeled: "api", controller: "foo"},
+		{strategy: namespaceIdentity, labeled: "tenant-a", unlabeled: "tenant-a", controller: "foo"},
+		{strategy: namespaceLabelIdentity, labeled: "tenant-a.api", controller: "foo.foo"},
+		{strategy: templateIdentity, template: `{{.Labels.team}}-{{.Labels.app}}`, labeled: "payments-api", unlabeled: "payments-", controller: "-foo"},
+		{strategy: templateIdentity, template: `{{.Labels.app}}`, labeled: "api", controller: "foo"},
+	} {
+		identity := newTestAppIdentity(t, func(cfg *Config) {
+			cfg.AppIdentity = test.strategy
+			cfg.AppTemplate = test.template
+		})
+		for message, expected := range map[*Message]string{labeled: test.labeled, unlabeled: test.unlabeled, controller: test.controller} {
+			app, ok := identity.App(message)
+			assert.Equal(t, expected, app, "unexpected app for the %s identity", test.strategy)
+			assert.Equal(t, expected != "", ok, "unexpected identification for the %s identity", test.strategy)
+		}
+	}
+}
+
+func TestAppIdentityKeepsNamespacesApart(t *testing.T) {
+	identity := newTestAppIdentity(t, func(cfg *Config) { cfg.AppIdentity = namespaceLabelIdentity })
+	a, _ := identity.App(newTestMessage("tenant-a", map[string]string{"app": "api"}))
+	b, _ := identity.App(newTestMessage("tenant-b", map[string]string{"app": "api"}))
+	assert.NotEqual(t, a, b)
+}
+
+func TestLinesNamedAfterIdentity(t *testing.T) {
+	a, err := storage.NewRingBufferAdapter(10)
+	assert.NoError(t, err)
+	identity := newTestAppIdentity(t, func(cfg *Config) { cfg.AppIdentity = namespaceIdentity })
+	cfg := AggregatorConfig{StorageAdapter: a, Identity: identity, Format: defaultLineFormat, Broker: NewBroker(10, 0, time.Minute)}
+	s := cfg.Broker.Subscribe("tenant-a")
+	defer s.Close()
+	assert.NoError(t, processMessage(newTestMessage("tenant-a", map[string]string{"app": "api", "type": "web"}), cfg))
+	p := <-s.Messages()
+	assert.Equal(t, "tenant-a", p.Line.App)
+	l, ok := ParseLine(p.Rendered)
+	assert.True(t, ok)
+	assert.Equal(t, "tenant-a", l.App)
+}
+
+func TestUnidentifiedApp(t *testing.T) {
+	a, err := storage.NewRingBufferAdapter(10)
+	assert.NoError(t, err)
+	unlabeled := newTestMessage("tenant-a", nil)
+	// messages without an app are dropped by default
+	assert.NoError(t, processMessage(unlabeled, newTestAggregatorConfig(t, a)))
+	apps, err := a.Apps(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, apps)
+	identity := newTestAppIdentity(t, func(cfg *Config) { cfg.UnidentifiedApp = "unidentified" })
+	assert.NoError(t, processMessage(unlabeled, AggregatorConfig{StorageAdapter: a, Identity: identity, Format: defaultLineFormat}))
+	page, err := a.Read(context.Background(), "unidentified", storage.ReadOptions{Lines: 10})
+	assert.NoError(t, err)
+	assert.Len(t, page.Lines, 1)
+	// identities holding a slash can't be named in URLs
+	identity = newTestAppIdentity(t, func(cfg *Config) {
+		cfg.AppIdentity = templateIdentity
+		cfg.AppTemplate = "{{.Namespace}}/{{.Labels.app}}"
+	})
+	_, ok := identity.App(newTestMessage("tenant-a", map[string]string{"app": "api"}))
+	assert.False(t, ok)
+}
+
+func TestInvalidAppIdentities(t *testing.T) {
+	for _, configure := range []func(*Config){
+		func(cfg *Config) { cfg.AppIdentity = "pod" },
+		func(cfg *Config) { cfg.AppLabel = "" },
+		func(cfg *Config) { cfg.AppIdentity, cfg.AppSeparator = namespaceLabelIdentity, "" },
+		func(cfg *Config) { cfg.AppIdentity, cfg.AppSeparator = namespaceLabelIdentity, "/" },
+		func(cfg *Config) { cfg.AppIdentity, cfg.AppTemplate = templateIdentity, "{{.Namespace" },
+		func(cfg *Config) { cfg.AppIdentity, cfg.AppTemplate = templateIdentity, "" },
+		func(cfg *Config) { cfg.AppIdentity, cfg.AppTemplate = templateIdentity, " " },
+		func(cfg *Config) { cfg.AppIdentity, cfg.AppTemplate = templateIdentity, "{{.Pod}}" },
+		func(cfg *Config) { cfg.UnidentifiedApp = "logs/unidentified" },
+	} {
+		cfg, err := ParseConfig(appName)
+		assert.NoError(t, err)
+		configure(cfg)
+		_, err = NewAppIdentity(cfg)
+		assert.Error(t, err, "expected an invalid app identity: %+v", cfg)
+	}
+}
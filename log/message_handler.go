@@ -1,10 +1,9 @@
 package log
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"regexp"
-	"strings"
 
 	"github.com/deis/logger/storage"
 	"github.com/vmihailenco/msgpack"
@@ -22,7 +21,7 @@ var (
 	podRegex        = regexp.MustCompile(podPattern)
 )
 
-func handle(rawMessage []byte, storageAdapter storage.Adapter) error {
+func handle(rawMessage []byte, cfg AggregatorConfig) error {
 	message := new(Message)
 	if err := json.Unmarshal(rawMessage, message); err != nil {
 		message := new(MessageWithDockerString)
@@ -30,10 +29,10 @@ func handle(rawMessage []byte, storageAdapter storage.Adapter) error {
 			return err
 		}
 	}
-	return processMessage(message, storageAdapter)
+	return processMessage(message, cfg)
 }
 
-func handleMsgPack(rawMessage []byte, storageAdapter storage.Adapter) error {
+func handleMsgPack(rawMessage []byte, cfg AggregatorConfig) error {
 	message := new(Message)
 	if err := msgpack.Unmarshal(rawMessage, message); err != nil {
 		message := new(MessageWithDockerString)
@@ -41,50 +40,46 @@ func handleMsgPack(rawMessage []byte, storageAdapter storage.Adapter) error {
 			return err
 		}
 	}
-	return processMessage(message, storageAdapter)
+	return processMessage(message, cfg)
 }
 
-func processMessage(message *Message, storageAdapter storage.Adapter) error {
-	if fromController(message) {
-		storageAdapter.Write(getApplicationFromControllerMessage(message), buildControllerLogMessage(message))
-	} else {
-		labels := message.Kubernetes.Labels
-		storageAdapter.Write(labels["app"], buildApplicationLogMessage(message))
+// processMessage stores a message, rendered as a line, under the app it belongs to and publishes it
+// to the clients tailing the app. Messages without an app are dropped unless there is a catch-all
+// app.
+func processMessage(message *Message, cfg AggregatorConfig) error {
+	app, ok := cfg.Identity.App(message)
+	if !ok {
+		return nil
 	}
-	return nil
-}
-
-// HandleJSONTail handles the tail of json messages
-func HandleJSONTail(rawMessage []byte) (string, string) {
-	message := new(Message)
-	if err := json.Unmarshal(rawMessage, message); err != nil {
-		message := new(MessageWithDockerString)
-		if err := json.Unmarshal(rawMessage, message); err != nil {
-			return "", ""
-		}
+	if !fromController(message) {
+		applyRetention(app, message, cfg.StorageAdapter)
 	}
-	return processTailMessage(message)
-}
-
-// HandleMsgPackTail deals with tail for msgpack messages
-func HandleMsgPackTail(rawMessage []byte) (string, string) {
-	message := new(Message)
-	if err := msgpack.Unmarshal(rawMessage, message); err != nil {
-		message := new(MessageWithDockerString)
-		if err := msgpack.Unmarshal(rawMessage, message); err != nil {
-			return "", ""
-		}
+	l := newLine(message, app)
+	rendered := cfg.Format.format(l)
+	storage.WriteWithMetadata(context.Background(), cfg.StorageAdapter, app, rendered, metadataFromMessage(message))
+	if cfg.Broker != nil {
+		cfg.Broker.Publish(app, Published{Line: l, Rendered: rendered})
 	}
-	return processTailMessage(message)
+	return nil
 }
 
-func processTailMessage(message *Message) (string, string) {
-
+// metadataFromMessage returns the metadata stored along with the line of a message. The process
+// type of controller messages is "controller", as in the default format, rather than that of the
+// controller's pod.
+func metadataFromMessage(message *Message) storage.Metadata {
+	metadata := storage.Metadata{
+		Time:      message.Time,
+		Namespace: message.Kubernetes.Namespace,
+		Pod:       message.Kubernetes.PodName,
+		Container: message.Kubernetes.ContainerName,
+		Process:   message.Kubernetes.Labels["type"],
+		Version:   message.Kubernetes.Labels["version"],
+		Stream:    message.Stream,
+	}
 	if fromController(message) {
-		return getApplicationFromControllerMessage(message), buildControllerLogMessage(message)
+		metadata.Process, metadata.Version = "controller", ""
 	}
-	labels := message.Kubernetes.Labels
-	return labels["app"], buildApplicationLogMessage(message)
+	return metadata
 }
 
 func fromController(message *Message) bool {
@@ -98,27 +93,3 @@ func fromController(message *Message) bool {
 func getApplicationFromControllerMessage(message *Message) string {
 	return controllerRegex.FindStringSubmatch(message.Log)[3]
 }
-
-func buildControllerLogMessage(message *Message) string {
-	l := controllerRegex.FindStringSubmatch(message.Log)
-	return fmt.Sprintf("%s deis[controller]: %s %s",
-		message.Time.Format(timeFormat),
-		l[1],
-		strings.Trim(l[4], " "))
-}
-
-func buildApplicationLogMessage(message *Message) string {
-	p := podRegex.FindStringSubmatch(message.Kubernetes.PodName)
-	tag := fmt.Sprintf(
-		"%s.%s",
-		message.Kubernetes.Labels["type"],
-		message.Kubernetes.Labels["version"])
-	if len(p) > 0 {
-		tag = fmt.Sprintf("%s.%s", tag, p[len(p)-1])
-	}
-	return fmt.Sprintf("%s %s[%s]: %s",
-		message.Time.Format(timeFormat),
-		message.Kubernetes.Labels["app"],
-		tag,
-		message.Log)
-}
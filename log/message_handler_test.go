@@ -1,8 +1,13 @@
 package log
 
 import (
+	"context"
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/deis/logger/storage"
 	"github.com/stretchr/testify/assert"
@@ -24,6 +29,12 @@ var (
 	badjson = `{"log":}`
 )
 
+// newTestAggregatorConfig returns the default configuration of an aggregator writing to a storage
+// adapter
+func newTestAggregatorConfig(t *testing.T, a storage.Adapter) AggregatorConfig {
+	return AggregatorConfig{StorageAdapter: a, Identity: newTestAppIdentity(t, nil), Format: defaultLineFormat}
+}
+
 func TestValidControllerMessage(t *testing.T) {
 	message := new(Message)
 	err := json.Unmarshal([]byte(validControllerMessage), message)
@@ -50,7 +61,7 @@ func TestBuildControllerLogMessageFromValidMessage(t *testing.T) {
 	message := new(Message)
 	err := json.Unmarshal([]byte(validControllerMessage), message)
 	assert.NoError(t, err, "error occured parsing log message")
-	expected := buildControllerLogMessage(message)
+	expected := defaultLineFormat.Format("foo", message)
 	assert.Equal(t, expected,
 		"2016-10-18T20:29:38+00:00 deis[controller]: INFO admin deployed 2fd9226",
 		"failed to build controller log")
@@ -60,7 +71,7 @@ func TestBuildApplicationLogMessageFromValidMessage(t *testing.T) {
 	message := new(Message)
 	err := json.Unmarshal([]byte(validAppMessage), message)
 	assert.NoError(t, err, "error occured parsing log message")
-	expected := buildApplicationLogMessage(message)
+	expected := defaultLineFormat.Format("foo", message)
 	assert.Equal(t, expected,
 		"2016-10-18T20:29:38+00:00 foo[web.v2.nzf60]: test message",
 		"failed to build application log")
@@ -70,7 +81,7 @@ func TestBuildApplicationLogMessageFromInvalidMessage(t *testing.T) {
 	message := new(Message)
 	err := json.Unmarshal([]byte(badPodNameMessage), message)
 	assert.NoError(t, err, "error occured parsing log message")
-	expected := buildApplicationLogMessage(message)
+	expected := defaultLineFormat.Format("foo", message)
 	assert.Equal(t, expected,
 		"2016-10-18T20:29:38+00:00 foo[web.v2]: test message",
 		"failed to build application log")
@@ -79,10 +90,10 @@ func TestBuildApplicationLogMessageFromInvalidMessage(t *testing.T) {
 func TestHandleValidAppMessage(t *testing.T) {
 	a, err := storage.NewRingBufferAdapter(1)
 	assert.NoError(t, err, "error creating ring buffer")
-	err = handle([]byte(validAppMessage), a)
+	err = handle([]byte(validAppMessage), newTestAggregatorConfig(t, a))
 	assert.NoError(t, err, "error occured storing log message")
-	expected, _ := a.Read("foo", 1, "cmd")
-	assert.Equal(t, expected[0],
+	expected, _ := a.Read(context.Background(), "foo", storage.ReadOptions{Lines: 1, Process: "cmd"})
+	assert.Equal(t, expected.Lines[0],
 		"2016-10-18T20:29:38+00:00 foo[web.v2.nzf60]: test message",
 		"failed to aquire application log message")
 }
@@ -90,10 +101,10 @@ func TestHandleValidAppMessage(t *testing.T) {
 func TestHandleValidControllerMessage(t *testing.T) {
 	a, err := storage.NewRingBufferAdapter(1)
 	assert.NoError(t, err, "error creating ring buffer")
-	err = handle([]byte(validControllerMessage), a)
+	err = handle([]byte(validControllerMessage), newTestAggregatorConfig(t, a))
 	assert.NoError(t, err, "error occured storing log message")
-	expected, _ := a.Read("foo", 1, "cmd")
-	assert.Equal(t, expected[0],
+	expected, _ := a.Read(context.Background(), "foo", storage.ReadOptions{Lines: 1, Process: "cmd"})
+	assert.Equal(t, expected.Lines[0],
 		"2016-10-18T20:29:38+00:00 deis[controller]: INFO admin deployed 2fd9226",
 		"failed to aquire controller log message")
 }
@@ -101,17 +112,52 @@ func TestHandleValidControllerMessage(t *testing.T) {
 func TestHandleInvalidAppMessage(t *testing.T) {
 	a, err := storage.NewRingBufferAdapter(1)
 	assert.NoError(t, err, "error creating ring buffer")
-	err = handle([]byte(validAppMessage), a)
+	err = handle([]byte(validAppMessage), newTestAggregatorConfig(t, a))
 	assert.NoError(t, err, "error occured storing log message")
-	expected, _ := a.Read("foo", 1, "cmd")
-	assert.Equal(t, expected[0],
+	expected, _ := a.Read(context.Background(), "foo", storage.ReadOptions{Lines: 1, Process: "cmd"})
+	assert.Equal(t, expected.Lines[0],
 		"2016-10-18T20:29:38+00:00 foo[web.v2.nzf60]: test message",
 		"failed to aquire application log message")
 }
 
+func TestProcessMessageStoresMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logger")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("DEIS_LOGGER_BOLT_PATH", filepath.Join(dir, "logger.db"))
+	defer os.Unsetenv("DEIS_LOGGER_BOLT_PATH")
+	os.Setenv("DEIS_LOGGER_METADATA_ADAPTERS", "bolt")
+	defer os.Unsetenv("DEIS_LOGGER_METADATA_ADAPTERS")
+	a, err := storage.NewBoltAdapter(10)
+	assert.NoError(t, err)
+	a.Start()
+	defer a.Stop()
+	cfg := newTestAggregatorConfig(t, a)
+	// a format without a timestamp or process type
+	cfg.Format, err = NewLineFormat("{{.Stream}}: {{.Text}}", "")
+	assert.NoError(t, err)
+	for _, raw := range []string{validAppMessage, validControllerMessage} {
+		message := new(Message)
+		assert.NoError(t, json.Unmarshal([]byte(raw), message))
+		message.Time = time.Date(2016, 10, 18, 20, 29, 38, 0, time.UTC)
+		assert.NoError(t, processMessage(message, cfg))
+	}
+	page, err := a.Read(context.Background(), "foo", storage.ReadOptions{Lines: 10, Process: "web", Since: time.Date(2016, 10, 18, 0, 0, 0, 0, time.UTC)})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"stderr: test message"}, page.Lines)
+	if assert.NotNil(t, page.LineMetadata(0)) {
+		assert.Equal(t, "foo-web-845861952-nzf60", page.LineMetadata(0).Pod)
+		assert.Equal(t, "foo-web", page.LineMetadata(0).Container)
+		assert.Equal(t, "stderr", page.LineMetadata(0).Stream)
+	}
+	page, err = a.Read(context.Background(), "foo", storage.ReadOptions{Lines: 10, Process: "controller"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2016-10-18T20:29:38+00:00 deis[controller]: INFO admin deployed 2fd9226"}, page.Lines)
+}
+
 func TestHandleInvalidControllerMessage(t *testing.T) {
 	a, err := storage.NewRingBufferAdapter(1)
 	assert.NoError(t, err, "error creating ring buffer")
-	err = handle([]byte(badjson), a)
+	err = handle([]byte(badjson), newTestAggregatorConfig(t, a))
 	assert.Error(t, err, "no error occured parsing json")
 }
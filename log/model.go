@@ -36,6 +36,7 @@ type Kubernetes struct {
 	PodName       string            `json:"pod_name" msgpack:"pod_name"`
 	ContainerName string            `json:"container_name" msgpack:"container_name"`
 	Labels        map[string]string `json:"labels" msgpack:"labels"`
+	Annotations   map[string]string `json:"annotations" msgpack:"annotations"`
 	Host          string            `json:"host" msgpack:"host"`
 }
 
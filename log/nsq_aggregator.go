@@ -6,8 +6,6 @@ import (
 	"time"
 
 	nsq "github.com/nsqio/go-nsq"
-
-	"github.com/deis/logger/storage"
 )
 
 type nsqAggregator struct {
@@ -17,10 +15,10 @@ type nsqAggregator struct {
 	handler   nsq.HandlerFunc
 }
 
-func newNSQAggregator(storageAdapter storage.Adapter) Aggregator {
+func newNSQAggregator(cfg AggregatorConfig) Aggregator {
 	return &nsqAggregator{
 		handler: nsq.HandlerFunc(func(msg *nsq.Message) error {
-			if err := handle(msg.Body, storageAdapter); err != nil {
+			if err := handle(msg.Body, cfg); err != nil {
 				msg.Requeue(-1)
 				return newErrNSQHandleFailed(err)
 			}
@@ -10,7 +10,7 @@ import (
 func TestAggregator(t *testing.T) {
 	storageAdapter, err := storage.NewAdapter("memory", 100)
 	assert.NoError(t, err)
-	aggregator, err := NewAggregator("nsq", storageAdapter)
+	aggregator, err := NewAggregator("nsq", storageAdapter, nil)
 	assert.NoError(t, err)
 	err = aggregator.Listen()
 	assert.NoError(t, err)
@@ -0,0 +1,84 @@
+package log
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/deis/logger/storage"
+)
+
+// Pod labels or annotations that override the limits of the logs kept for an app. Annotations
+// take precedence over labels.
+const (
+	retentionLinesKey  = "logger.deis.io/retention-lines"
+	retentionBytesKey  = "logger.deis.io/retention-bytes"
+	retentionMaxAgeKey = "logger.deis.io/retention-max-age"
+)
+
+// appliedRetentions holds the retention values last read from every app's pods, so that the
+// storage adapter is only told about changes
+var appliedRetentions = struct {
+	values map[string][3]string
+	mutex  sync.Mutex
+}{values: make(map[string][3]string)}
+
+// applyRetention overrides the limits of the logs kept for an app with those set by the labels
+// and annotations of the pod a message came from. Pods without them leave the app's retention as
+// it is.
+func applyRetention(app string, message *Message, storageAdapter storage.Adapter) {
+	values := [3]string{
+		podValue(message, retentionLinesKey),
+		podValue(message, retentionBytesKey),
+		podValue(message, retentionMaxAgeKey),
+	}
+	if values == [3]string{} {
+		return
+	}
+	appliedRetentions.mutex.Lock()
+	defer appliedRetentions.mutex.Unlock()
+	if appliedRetentions.values[app] == values {
+		return
+	}
+	// Invalid values are remembered too, so that they are only reported once
+	appliedRetentions.values[app] = values
+	retention, err := parseRetention(values)
+	if err == nil {
+		err = storage.SetRetention(storageAdapter, app, retention)
+	}
+	if err != nil {
+		log.Printf("Error setting the retention of %s from pod %s: %s", app, message.Kubernetes.PodName, err)
+	}
+}
+
+// podValue returns the value of a pod's annotation, or of its label if it has no such annotation
+func podValue(message *Message, key string) string {
+	if value, ok := message.Kubernetes.Annotations[key]; ok {
+		return value
+	}
+	return message.Kubernetes.Labels[key]
+}
+
+// parseRetention parses the values of the lines, bytes and maximum age labels or annotations
+func parseRetention(values [3]string) (storage.Retention, error) {
+	var retention storage.Retention
+	var err error
+	if values[0] != "" {
+		if retention.Lines, err = strconv.Atoi(values[0]); err != nil {
+			return retention, fmt.Errorf("Invalid %s: %s", retentionLinesKey, values[0])
+		}
+	}
+	if values[1] != "" {
+		if retention.Bytes, err = strconv.ParseInt(values[1], 10, 64); err != nil {
+			return retention, fmt.Errorf("Invalid %s: %s", retentionBytesKey, values[1])
+		}
+	}
+	if values[2] != "" {
+		if retention.MaxAge, err = time.ParseDuration(values[2]); err != nil {
+			return retention, fmt.Errorf("Invalid %s: %s", retentionMaxAgeKey, values[2])
+		}
+	}
+	return retention, retention.Validate()
+}
@@ -0,0 +1,62 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deis/logger/storage"
+)
+
+func TestApplyRetention(t *testing.T) {
+	a, err := storage.NewRingBufferAdapter(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := a.(storage.RetentionSetter)
+	message := &Message{Kubernetes: Kubernetes{
+		PodName: "retained-web-845861952-nzf60",
+		Labels: map[string]string{
+			"app":             "retained",
+			retentionLinesKey: "10",
+		},
+		Annotations: map[string]string{
+			retentionLinesKey:  "20",
+			retentionMaxAgeKey: "24h",
+		},
+	}}
+	applyRetention("retained", message, a)
+	// Annotations take precedence over labels
+	if retention := rs.Retention("retained"); retention != (storage.Retention{Lines: 20, MaxAge: 24 * time.Hour}) {
+		t.Errorf("unexpected retention: %+v", retention)
+	}
+	// Pods without retention labels or annotations leave an app's retention as it is
+	applyRetention("retained", &Message{}, a)
+	if retention := rs.Retention("retained"); retention.Lines != 20 {
+		t.Errorf("expected the retention to be unchanged, got %+v", retention)
+	}
+	message.Kubernetes.Annotations = nil
+	applyRetention("retained", message, a)
+	if retention := rs.Retention("retained"); retention != (storage.Retention{Lines: 10}) {
+		t.Errorf("unexpected retention: %+v", retention)
+	}
+	message.Kubernetes.Labels[retentionBytesKey] = "lots"
+	applyRetention("retained", message, a)
+	if retention := rs.Retention("retained"); retention != (storage.Retention{Lines: 10}) {
+		t.Errorf("expected invalid values to be ignored, got %+v", retention)
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	retention, err := parseRetention([3]string{"100", "1048576", "1h30m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retention != (storage.Retention{Lines: 100, Bytes: 1048576, MaxAge: 90 * time.Minute}) {
+		t.Errorf("unexpected retention: %+v", retention)
+	}
+	for _, values := range [][3]string{{"ten", "", ""}, {"", "1MB", ""}, {"", "", "a day"}, {"-1", "", ""}} {
+		if _, err := parseRetention(values); err == nil {
+			t.Errorf("expected an error parsing %q", values)
+		}
+	}
+}
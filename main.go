@@ -3,6 +3,7 @@ package main
 import (
 	l "log"
 	"net/http"
+	"time"
 
 	_ "net/http/pprof"
 
@@ -21,10 +22,22 @@ func main() {
 	if err != nil {
 		l.Fatal("Error creating storage adapter: ", err)
 	}
+	if cfg.RetentionFile != "" {
+		retentions, err := storage.ReadRetentionFile(cfg.RetentionFile)
+		if err != nil {
+			l.Fatal("Error reading retention overrides: ", err)
+		}
+		for app, retention := range retentions {
+			if err := storage.SetRetention(storageAdapter, app, retention); err != nil {
+				l.Fatalf("Error setting the retention of %s: %s", app, err)
+			}
+		}
+	}
 	storageAdapter.Start()
 	defer storageAdapter.Stop()
 
-	aggregator, err := log.NewAggregator(cfg.AggregatorType, storageAdapter)
+	broker := log.NewBroker(cfg.TailBuffer, cfg.TailHistory, time.Duration(cfg.TailIdle)*time.Second)
+	aggregator, err := log.NewAggregator(cfg.AggregatorType, storageAdapter, broker)
 	if err != nil {
 		l.Fatal("Error creating log aggregator: ", err)
 	}
@@ -35,7 +48,7 @@ func main() {
 	defer aggregator.Stop()
 	l.Println("Log aggregator running")
 
-	weblogServer := weblog.NewServer(storageAdapter)
+	weblogServer := weblog.NewServer(storageAdapter, broker)
 	weblogServer.Start()
 	defer weblogServer.Close()
 	l.Printf("Weblog server serving at %s\n", weblogServer.URL)
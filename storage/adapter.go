@@ -1,11 +1,374 @@
 package storage
 
-// Adapter is an interface for pluggable components that store log messages.
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Adapter is an interface for pluggable components that store log messages. Writes, reads, app
+// listings and destroys are abandoned once their context is done.
 type Adapter interface {
 	Start()
-	Write(string, string) error
-	Read(string, int, string) ([]string, error)
-	Destroy(string) error
+	Write(context.Context, string, string) error
+	Read(context.Context, string, ReadOptions) (*Page, error)
+	Apps(context.Context) ([]AppInfo, error)
+	Destroy(context.Context, string) error
 	Reopen() error
 	Stop()
 }
+
+// ReadOptions selects the log lines returned by Adapter.Read.
+type ReadOptions struct {
+	// Lines is the maximum number of lines to return. Unless After is set, the most recent matching
+	// lines are returned.
+	Lines int
+	// Process limits the lines to those of a single process type, if set.
+	Process string
+	// Since and Until limit the lines to those logged at or after Since and before Until. A zero
+	// value leaves that end of the time range open.
+	Since time.Time
+	Until time.Time
+	// Before and After are cursors taken from a previously read page. Before limits the lines to
+	// those preceding the line it points at. After limits them to those following it and returns the
+	// oldest matching lines instead, so new lines can be polled for. At most one of them may be set.
+	Before string
+	After  string
+	// Query limits the lines to those containing it, or matching it as a regular expression if
+	// Regexp is set. IgnoreCase makes either match case-insensitive. Lines limits the number of
+	// matching lines, not the number of lines scanned for them.
+	Query      string
+	Regexp     bool
+	IgnoreCase bool
+	// Context is the number of lines preceding and following every matching line that are returned
+	// along with it, in addition to the matching lines
+	Context int
+}
+
+// AppInfo describes the logs stored for an app, as returned by Adapter.Apps. Adapters that can't
+// tell the number or size of an app's lines without reading all of them leave Lines and Bytes
+// zero, and those that can't tell when an app was last written to leave LastWrite zero.
+type AppInfo struct {
+	Name      string
+	Lines     int64
+	Bytes     int64
+	LastWrite time.Time
+}
+
+// mergeApps appends the apps of others that apps doesn't describe yet
+func mergeApps(apps []AppInfo, others []AppInfo) []AppInfo {
+	merged := append([]AppInfo{}, apps...)
+	seen := make(map[string]bool, len(apps))
+	for _, app := range apps {
+		seen[app.Name] = true
+	}
+	for _, app := range others {
+		if !seen[app.Name] {
+			seen[app.Name] = true
+			merged = append(merged, app)
+		}
+	}
+	return merged
+}
+
+// Page is a page of log lines, oldest first, as returned by Adapter.Read
+type Page struct {
+	Lines []string
+	// Metadata holds the metadata stored along with each line, which is nil for lines stored
+	// without, such as those written by Write
+	Metadata []*Metadata
+	// Cursors holds an opaque cursor for each line, pointing at it
+	Cursors []string
+	// ids holds the ID of the write that stored each line, which is empty for lines stored without.
+	// It is nil if no line has one.
+	ids []string
+}
+
+// Before returns a cursor for reading the lines preceding the page
+func (p *Page) Before() string {
+	if len(p.Cursors) == 0 {
+		return ""
+	}
+	return p.Cursors[0]
+}
+
+// After returns a cursor for reading the lines following the page
+func (p *Page) After() string {
+	if len(p.Cursors) == 0 {
+		return ""
+	}
+	return p.Cursors[len(p.Cursors)-1]
+}
+
+// LineMetadata returns the metadata stored along with the i-th line of the page, or nil if there
+// is none
+func (p *Page) LineMetadata(i int) *Metadata {
+	if i < 0 || i >= len(p.Metadata) {
+		return nil
+	}
+	return p.Metadata[i]
+}
+
+// add appends a stored line, which is split into the line, its metadata and its write ID if it is
+// a record
+func (p *Page) add(stored string, cursor string) {
+	line, metadata, id := splitRecordID(stored)
+	p.addRecord(line, metadata, id, cursor)
+}
+
+func (p *Page) addLine(line string, metadata *Metadata, cursor string) {
+	p.addRecord(line, metadata, "", cursor)
+}
+
+func (p *Page) addRecord(line string, metadata *Metadata, id string, cursor string) {
+	// pages built without metadata are given it once a line has some
+	for len(p.Metadata) < len(p.Lines) {
+		p.Metadata = append(p.Metadata, nil)
+	}
+	if id != "" && p.ids == nil {
+		p.ids = make([]string, len(p.Lines), len(p.Lines)+1)
+	}
+	if p.ids != nil {
+		p.ids = append(p.ids, id)
+	}
+	p.Lines = append(p.Lines, line)
+	p.Metadata = append(p.Metadata, metadata)
+	p.Cursors = append(p.Cursors, cursor)
+}
+
+// lineID returns the ID of the write that stored the i-th line of the page, or an empty string if
+// there is none
+func (p *Page) lineID(i int) string {
+	if i < 0 || i >= len(p.ids) {
+		return ""
+	}
+	return p.ids[i]
+}
+
+// slice trims the page to its lines from i up to j
+func (p *Page) slice(i int, j int) {
+	if len(p.Metadata) == len(p.Lines) {
+		p.Metadata = p.Metadata[i:j]
+	} else {
+		p.Metadata = nil
+	}
+	if len(p.ids) == len(p.Lines) {
+		p.ids = p.ids[i:j]
+	} else {
+		p.ids = nil
+	}
+	p.Lines, p.Cursors = p.Lines[i:j], p.Cursors[i:j]
+}
+
+// limit trims the page to n lines, keeping the oldest lines if oldest is set and the most recent
+// ones otherwise
+func (p *Page) limit(n int, oldest bool) {
+	if n < 0 {
+		n = 0
+	}
+	if len(p.Lines) <= n {
+		return
+	}
+	if oldest {
+		p.slice(0, n)
+	} else {
+		p.slice(len(p.Lines)-n, len(p.Lines))
+	}
+}
+
+// reverse reverses the order of the page's lines, for adapters that read them newest first
+func (p *Page) reverse() {
+	reverseStrings(p.Lines)
+	reverseStrings(p.Cursors)
+	reverseStrings(p.ids)
+	for i, j := 0, len(p.Metadata)-1; i < j; i, j = i+1, j-1 {
+		p.Metadata[i], p.Metadata[j] = p.Metadata[j], p.Metadata[i]
+	}
+}
+
+// tagCursors prefixes the page's cursors with the given tag, so that adapters composed of others
+// can tell which of them a cursor belongs to
+func (p *Page) tagCursors(tag string) {
+	for i, cursor := range p.Cursors {
+		p.Cursors[i] = tag + ":" + cursor
+	}
+}
+
+// untagCursor splits a cursor that was prefixed by Page.tagCursors into its tag and the cursor of
+// the adapter that returned it
+func untagCursor(cursor string) (string, string, error) {
+	i := strings.IndexByte(cursor, ':')
+	if i < 0 {
+		return "", "", newErrInvalidArgument("Invalid cursor: %s", cursor)
+	}
+	return cursor[:i], cursor[i+1:], nil
+}
+
+// seqLine is a line along with its position in an app's sequence of lines
+type seqLine struct {
+	seq  int64
+	line string
+}
+
+// selectPage returns a page of the given lines, ordered by their sequence numbers, that matches the
+// options' time range, query and cursors. Cursors are the lines' sequence numbers.
+func selectPage(lines []seqLine, opts ReadOptions) (*Page, error) {
+	before, after := int64(math.MaxInt64), int64(math.MinInt64)
+	var err error
+	if opts.Before != "" {
+		if before, err = strconv.ParseInt(opts.Before, 10, 64); err != nil {
+			return nil, newErrInvalidArgument("Invalid cursor: %s", opts.Before)
+		}
+	}
+	if opts.After != "" {
+		if after, err = strconv.ParseInt(opts.After, 10, 64); err != nil {
+			return nil, newErrInvalidArgument("Invalid cursor: %s", opts.After)
+		}
+	}
+	g, err := newGrepper(opts)
+	if err != nil {
+		return nil, err
+	}
+	scan := func(l seqLine) {
+		if l.seq > after && l.seq < before && opts.lineInTimeRange(l.line) {
+			g.add(l.line, strconv.FormatInt(l.seq, 10))
+		}
+	}
+	if opts.After != "" {
+		for i := 0; i < len(lines) && !g.done(); i++ {
+			scan(lines[i])
+		}
+		return g.page, nil
+	}
+	for i := len(lines) - 1; i >= 0 && !g.done(); i-- {
+		scan(lines[i])
+	}
+	g.page.reverse()
+	return g.page, nil
+}
+
+// timeBounded reports whether the options limit lines to a time range
+func (o ReadOptions) timeBounded() bool {
+	return !o.Since.IsZero() || !o.Until.IsZero()
+}
+
+// inTimeRange reports whether a line logged at t is within the options' time range
+func (o ReadOptions) inTimeRange(t time.Time) bool {
+	if !o.Since.IsZero() && t.Before(o.Since) {
+		return false
+	}
+	if !o.Until.IsZero() && !t.Before(o.Until) {
+		return false
+	}
+	return true
+}
+
+// lineInTimeRange reports whether a stored log line is within the options' time range. When the
+// options are time bounded, lines without a timestamp never are.
+func (o ReadOptions) lineInTimeRange(line string) bool {
+	if !o.timeBounded() {
+		return true
+	}
+	t, ok := timeFromLine(line)
+	return ok && o.inTimeRange(t)
+}
+
+// timeFromLine returns the time a stored log line was logged at: the time stored along with it, or
+// else the timestamp its formatted line starts with
+func timeFromLine(stored string) (time.Time, bool) {
+	line, metadata := splitRecord(stored)
+	if metadata != nil && !metadata.Time.IsZero() {
+		return metadata.Time, true
+	}
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, line[:i])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Metadata describes where a log message came from.
+type Metadata struct {
+	Time      time.Time
+	Namespace string
+	Pod       string
+	Container string
+	Process   string
+	Version   string
+	Stream    string
+}
+
+// MetadataWriter is implemented by storage adapters that make use of a log message's metadata in
+// addition to the message itself.
+type MetadataWriter interface {
+	WriteWithMetadata(ctx context.Context, app string, message string, metadata Metadata) error
+}
+
+// WriteWithMetadata adds a log message to the given storage adapter, passing its metadata along if
+// the adapter is a MetadataWriter.
+func WriteWithMetadata(ctx context.Context, a Adapter, app string, message string, metadata Metadata) error {
+	if mw, ok := a.(MetadataWriter); ok {
+		return mw.WriteWithMetadata(ctx, app, message, metadata)
+	}
+	return a.Write(ctx, app, message)
+}
+
+// SyncWriter is implemented by storage adapters that send writes in the background, to write a log
+// message and return once it is stored, or storing it failed.
+type SyncWriter interface {
+	WriteSync(ctx context.Context, app string, message string, metadata Metadata) error
+}
+
+// WriteSync adds a log message to the given storage adapter and returns once it is stored, if the
+// adapter is a SyncWriter. Other adapters are written to with WriteWithMetadata.
+func WriteSync(ctx context.Context, a Adapter, app string, message string, metadata Metadata) error {
+	if sw, ok := a.(SyncWriter); ok {
+		return sw.WriteSync(ctx, app, message, metadata)
+	}
+	return WriteWithMetadata(ctx, a, app, message, metadata)
+}
+
+// HealthChecker is implemented by storage adapters whose writes can succeed while the backend they
+// store logs in is unreachable, such as those sending writes in the background.
+type HealthChecker interface {
+	Healthy(ctx context.Context) error
+}
+
+// Healthy reports whether the given storage adapter's backend can be reached, assuming that it can
+// if the adapter isn't a HealthChecker.
+func Healthy(ctx context.Context, a Adapter) error {
+	if hc, ok := a.(HealthChecker); ok {
+		return hc.Healthy(ctx)
+	}
+	return nil
+}
+
+// StatusReporter is implemented by storage adapters whose state is worth reporting on /healthz, such
+// as whether a circuit breaker is open.
+type StatusReporter interface {
+	Status() map[string]interface{}
+}
+
+// Status describes the state of the given storage adapter, or returns nil if the adapter isn't a
+// StatusReporter.
+func Status(a Adapter) map[string]interface{} {
+	if sr, ok := a.(StatusReporter); ok {
+		return sr.Status()
+	}
+	return nil
+}
+
+// withTimeout returns a context that is done once the given one is or, if the timeout is
+// positive, once it has elapsed
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// readLines returns the lines of a page read from a storage adapter
+func readLines(page *Page, err error) ([]string, error) {
+	if page == nil {
+		return nil, err
+	}
+	return page.Lines, err
+}
+
+func TestSelectPage(t *testing.T) {
+	lines := make([]seqLine, 10)
+	for i := range lines {
+		lines[i] = seqLine{seq: int64(i + 1), line: fmt.Sprintf("message %d", i+1)}
+	}
+	tests := []struct {
+		opts     ReadOptions
+		expected []string
+	}{
+		{ReadOptions{Lines: 2}, []string{"9", "10"}},
+		{ReadOptions{Lines: 2, Before: "9"}, []string{"7", "8"}},
+		{ReadOptions{Lines: 2, After: "3"}, []string{"4", "5"}},
+		{ReadOptions{Lines: 5, After: "8"}, []string{"9", "10"}},
+		{ReadOptions{Lines: 5, Before: "1"}, nil},
+	}
+	for _, test := range tests {
+		page, err := selectPage(lines, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(page.Cursors, test.expected) {
+			t.Errorf("selectPage(%+v): expected cursors %v, got %v", test.opts, test.expected, page.Cursors)
+		}
+	}
+	if _, err := selectPage(lines, ReadOptions{Lines: 2, Before: "soon"}); err == nil {
+		t.Error("expected an error for an invalid cursor")
+	}
+}
+
+func TestPageCursors(t *testing.T) {
+	page := &Page{}
+	if page.Before() != "" || page.After() != "" {
+		t.Error("expected no cursors for an empty page")
+	}
+	page.add("first", "1")
+	page.add("second", "2")
+	page.tagCursors("0-memory")
+	if page.Before() != "0-memory:1" || page.After() != "0-memory:2" {
+		t.Errorf("unexpected cursors: %s, %s", page.Before(), page.After())
+	}
+	tag, cursor, err := untagCursor("0-tiered:hot:1")
+	if err != nil || tag != "0-tiered" || cursor != "hot:1" {
+		t.Errorf("unexpected untagged cursor: %s, %s, %v", tag, cursor, err)
+	}
+	if _, _, err := untagCursor("1"); err == nil {
+		t.Error("expected an error for an untagged cursor")
+	}
+}
+
+func TestPageIDs(t *testing.T) {
+	page := &Page{}
+	page.add(newRecord("first", "1", Metadata{}), "1")
+	page.add("second", "2")
+	page.add(newRecord("third", "3", Metadata{}), "3")
+	page.reverse()
+	page.limit(2, true)
+	if !reflect.DeepEqual(page.Lines, []string{"third", "second"}) || page.lineID(0) != "3" || page.lineID(1) != "" {
+		t.Errorf("unexpected lines and IDs: %v, %v", page.Lines, page.ids)
+	}
+}
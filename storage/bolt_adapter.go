@@ -0,0 +1,593 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltLinesBucket     = []byte("lines")
+	boltProcessesBucket = []byte("processes")
+	// matches the process type in lines of the form "<time> <app>[<type>.<version>.<pod>]: <log>"
+	processRegex = regexp.MustCompile(`^\S+ [^\s\[]+\[([^\].]+)`)
+)
+
+// boltKey returns a key that sorts lines by the time they were written and, for lines written at
+// the same time, by sequence number
+func boltKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+func boltKeyID(key []byte) string {
+	return fmt.Sprintf("%d-%d", binary.BigEndian.Uint64(key[:8]), binary.BigEndian.Uint64(key[8:]))
+}
+
+func parseBoltKeyID(id string) ([]byte, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return nil, newErrInvalidArgument("Invalid line ID: %s", id)
+	}
+	ts, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, newErrInvalidArgument("Invalid line ID: %s", id)
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, newErrInvalidArgument("Invalid line ID: %s", id)
+	}
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], ts)
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key, nil
+}
+
+// processFromLine returns the process type of a stored log line: the one stored along with it, or
+// else the one its formatted line carries. It returns an empty string if the line has none.
+func processFromLine(stored string) string {
+	line, metadata := splitRecord(stored)
+	if metadata != nil && metadata.Process != "" {
+		return metadata.Process
+	}
+	m := processRegex.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+type boltAdapter struct {
+	started   bool
+	retention *retentions
+	config    *boltConfig
+	seq       uint64
+	stopCh    chan struct{}
+	codec     *lineCodec
+	recorder  recorder
+	// db is replaced when the database is compacted, so every access must hold at least a read lock
+	db    *bolt.DB
+	mutex sync.RWMutex
+}
+
+// NewBoltAdapter returns a storage adapter that keeps up to bufferSize lines per app in an
+// embedded, on-disk bbolt database.
+func NewBoltAdapter(bufferSize int) (Adapter, error) {
+	if bufferSize <= 0 {
+		return nil, fmt.Errorf("Invalid buffer size: %d", bufferSize)
+	}
+	cfg, err := parseBoltConfig(appName)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := newLineCodecFromConfig(false)
+	if err != nil {
+		return nil, err
+	}
+	recorder, err := newRecorderFromConfig("bolt")
+	if err != nil {
+		return nil, err
+	}
+	db, err := openBoltDB(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &boltAdapter{
+		retention: newRetentions(Retention{Lines: bufferSize, MaxAge: cfg.RetentionMaxAge}),
+		config:    cfg,
+		db:        db,
+		stopCh:    make(chan struct{}),
+		codec:     codec,
+		recorder:  recorder,
+	}, nil
+}
+
+func openBoltDB(path string) (*bolt.DB, error) {
+	return bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+}
+
+// Start the storage adapter. Retention is enforced and the database compacted periodically in the
+// background. Invocations of this function are not concurrency safe and multiple serialized
+// invocations have no effect.
+func (a *boltAdapter) Start() {
+	if !a.started {
+		a.started = true
+		go func() {
+			var retentionCh, compactionCh <-chan time.Time
+			if a.config.RetentionInterval > 0 {
+				ticker := time.NewTicker(a.config.RetentionInterval)
+				defer ticker.Stop()
+				retentionCh = ticker.C
+			}
+			if a.config.CompactionInterval > 0 {
+				ticker := time.NewTicker(a.config.CompactionInterval)
+				defer ticker.Stop()
+				compactionCh = ticker.C
+			}
+			for {
+				select {
+				case <-a.stopCh:
+					return
+				case <-retentionCh:
+					if err := a.enforceRetention(); err != nil {
+						log.Printf("Error enforcing retention: %s", err)
+					}
+				case <-compactionCh:
+					if err := a.compact(); err != nil {
+						log.Printf("Error compacting %s: %s", a.config.Path, err)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Write adds a log message to an app-specific bucket, indexing it by process type if it has one.
+// The message is compressed and encrypted first if that is configured.
+func (a *boltAdapter) Write(ctx context.Context, app string, message string) error {
+	return a.write(app, "", message)
+}
+
+// WriteWithMetadata adds a log message to an app-specific bucket, along with its metadata if that is
+// configured, encrypting it with the key of the namespace it was logged in if its app has none
+func (a *boltAdapter) WriteWithMetadata(ctx context.Context, app string, message string, metadata Metadata) error {
+	return a.write(app, metadata.Namespace, a.recorder.record(message, metadata))
+}
+
+func (a *boltAdapter) write(app string, namespace string, message string) error {
+	key := boltKey(time.Now(), atomic.AddUint64(&a.seq, 1))
+	process := processFromLine(message)
+	message, err := a.codec.encode(app, namespace, message)
+	if err == errShredded {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	// Batch coalesces concurrent writes into a single transaction
+	return a.db.Batch(func(tx *bolt.Tx) error {
+		appBucket, err := tx.CreateBucketIfNotExists([]byte(app))
+		if err != nil {
+			return err
+		}
+		lines, err := appBucket.CreateBucketIfNotExists(boltLinesBucket)
+		if err != nil {
+			return err
+		}
+		if err := lines.Put(key, []byte(message)); err != nil {
+			return err
+		}
+		if process == "" {
+			return nil
+		}
+		processes, err := appBucket.CreateBucketIfNotExists(boltProcessesBucket)
+		if err != nil {
+			return err
+		}
+		index, err := processes.CreateBucketIfNotExists([]byte(process))
+		if err != nil {
+			return err
+		}
+		return index.Put(key, []byte{})
+	})
+}
+
+// Read retrieves a specified number of log lines from an app-specific bucket, optionally limited
+// to a single process type and to a time range using the timestamps lines start with and searched
+// for the query. Cursors are the IDs of the lines' keys. Compressed and encrypted lines are decoded,
+// and skipped if they can't be.
+func (a *boltAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	if opts.Lines <= 0 {
+		return &Page{}, nil
+	}
+	var cursorKey, sinceKey []byte
+	var err error
+	if opts.Before != "" {
+		cursorKey, err = parseBoltKeyID(opts.Before)
+	} else if opts.After != "" {
+		cursorKey, err = parseBoltKeyID(opts.After)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Since.IsZero() {
+		sinceKey = boltKey(opts.Since, 0)
+	}
+	g, err := newGrepper(opts)
+	if err != nil {
+		return nil, err
+	}
+	err = a.view(func(tx *bolt.Tx) error {
+		linesBucket, index := boltBuckets(tx, app, opts.Process)
+		if index == nil {
+			return nil
+		}
+		collect := func(k []byte, v []byte) {
+			if opts.Process != "" {
+				v = linesBucket.Get(k)
+			}
+			if line, ok := a.codec.decode(app, string(v)); ok && opts.lineInTimeRange(line) {
+				g.add(line, boltKeyID(k))
+			}
+		}
+		c := index.Cursor()
+		if opts.After != "" {
+			k, v := c.Seek(cursorKey)
+			if k != nil && bytes.Equal(k, cursorKey) {
+				k, v = c.Next()
+			}
+			for ; k != nil && !g.done() && ctx.Err() == nil; k, v = c.Next() {
+				collect(k, v)
+			}
+			return nil
+		}
+		k, v := c.Last()
+		if opts.Before != "" {
+			if k, v = c.Seek(cursorKey); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil && !g.done() && ctx.Err() == nil; k, v = c.Prev() {
+			// Lines are stored after they were logged, so no older key holds a line logged since
+			if sinceKey != nil && bytes.Compare(k, sinceKey) < 0 {
+				break
+			}
+			collect(k, v)
+		}
+		g.page.reverse()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the scan stops early once the read is abandoned
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(g.page.Lines) == 0 {
+		return nil, newErrNotFound(app)
+	}
+	return g.page, nil
+}
+
+// ReadAfter retrieves up to count log lines written after the line with the given ID
+func (a *boltAdapter) ReadAfter(ctx context.Context, app string, id string, count int) ([]StreamEntry, error) {
+	if count <= 0 {
+		return []StreamEntry{}, nil
+	}
+	var after []byte
+	if id != "" {
+		var err error
+		if after, err = parseBoltKeyID(id); err != nil {
+			return nil, err
+		}
+	}
+	entries := []StreamEntry{}
+	err := a.view(func(tx *bolt.Tx) error {
+		linesBucket, _ := boltBuckets(tx, app, "")
+		if linesBucket == nil {
+			return nil
+		}
+		c := linesBucket.Cursor()
+		k, v := c.First()
+		if after != nil {
+			k, v = c.Seek(after)
+			if k != nil && bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && len(entries) < count; k, v = c.Next() {
+			if line, ok := a.codec.decode(app, string(v)); ok {
+				entry := StreamEntry{ID: boltKeyID(k)}
+				entry.Line, entry.Metadata = splitRecord(line)
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ReadRange retrieves up to count of the most recent log lines written between start and end
+func (a *boltAdapter) ReadRange(ctx context.Context, app string, start time.Time, end time.Time, count int) ([]StreamEntry, error) {
+	if count <= 0 {
+		return []StreamEntry{}, nil
+	}
+	startKey := boltKey(start, 0)
+	endKey := boltKey(end, ^uint64(0))
+	entries := []StreamEntry{}
+	err := a.view(func(tx *bolt.Tx) error {
+		linesBucket, _ := boltBuckets(tx, app, "")
+		if linesBucket == nil {
+			return nil
+		}
+		c := linesBucket.Cursor()
+		k, v := c.Seek(endKey)
+		if k == nil {
+			k, v = c.Last()
+		} else if bytes.Compare(k, endKey) > 0 {
+			k, v = c.Prev()
+		}
+		for ; k != nil && bytes.Compare(k, startKey) >= 0 && len(entries) < count; k, v = c.Prev() {
+			if line, ok := a.codec.decode(app, string(v)); ok {
+				entry := StreamEntry{ID: boltKeyID(k)}
+				entry.Line, entry.Metadata = splitRecord(line)
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries)/2 - 1; i >= 0; i-- {
+		opp := len(entries) - 1 - i
+		entries[i], entries[opp] = entries[opp], entries[i]
+	}
+	return entries, nil
+}
+
+// Apps describes the lines held by every app-specific bucket. The time of an app's last write is
+// taken from its newest key.
+func (a *boltAdapter) Apps(ctx context.Context) ([]AppInfo, error) {
+	apps := []AppInfo{}
+	err := a.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(app []byte, appBucket *bolt.Bucket) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			linesBucket := appBucket.Bucket(boltLinesBucket)
+			if linesBucket == nil {
+				return nil
+			}
+			info := AppInfo{Name: string(app)}
+			c := linesBucket.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				info.Lines++
+				info.Bytes += int64(len(v))
+			}
+			if k, _ := c.Last(); k != nil {
+				info.LastWrite = time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+			}
+			apps = append(apps, info)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+// SetRetention overrides the limits of the lines kept in an app-specific bucket. Lines beyond the
+// new limits are deleted right away.
+func (a *boltAdapter) SetRetention(app string, retention Retention) error {
+	if err := retention.limits("bolt", true, true, true); err != nil {
+		return err
+	}
+	a.retention.set(app, retention)
+	return a.update(func(tx *bolt.Tx) error {
+		appBucket := tx.Bucket([]byte(app))
+		if appBucket == nil {
+			return nil
+		}
+		return a.expire(app, appBucket, a.retention.get(app), time.Now())
+	})
+}
+
+// Retention returns the limits of the lines kept in an app-specific bucket
+func (a *boltAdapter) Retention(app string) Retention {
+	return a.retention.get(app)
+}
+
+// Destroy deletes stored logs for the specified application
+func (a *boltAdapter) Destroy(ctx context.Context, app string) error {
+	return a.update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(app)) == nil {
+			return nil
+		}
+		return tx.DeleteBucket([]byte(app))
+	})
+}
+
+// Reopen the storage adapter-- in the case of this implementation, a no-op
+func (a *boltAdapter) Reopen() error {
+	return nil
+}
+
+// Stop the storage adapter and close the underlying database. Additional reads and writes may not
+// be performed after stopping.
+func (a *boltAdapter) Stop() {
+	close(a.stopCh)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err := a.db.Close(); err != nil {
+		log.Printf("Error closing %s: %s", a.config.Path, err)
+	}
+}
+
+// enforceRetention deletes, for every app, the oldest lines beyond its retention limits
+func (a *boltAdapter) enforceRetention() error {
+	now := time.Now()
+	return a.update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(app []byte, appBucket *bolt.Bucket) error {
+			return a.expire(string(app), appBucket, a.retention.get(string(app)), now)
+		})
+	})
+}
+
+// expire deletes the oldest lines of an app-specific bucket beyond the given retention. Lines are
+// counted newest first, so once a line is beyond a limit every older line is too. Lines are decoded
+// to find the process index they are in, and removed from every index if they can't be.
+func (a *boltAdapter) expire(app string, appBucket *bolt.Bucket, retention Retention, now time.Time) error {
+	linesBucket := appBucket.Bucket(boltLinesBucket)
+	if linesBucket == nil {
+		return nil
+	}
+	var cutoff []byte
+	if retention.MaxAge > 0 {
+		cutoff = boltKey(now.Add(-retention.MaxAge), 0)
+	}
+	var lines int
+	var size int64
+	var expiredKeys [][]byte
+	var expiredProcesses []string
+	c := linesBucket.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		lines++
+		size += int64(len(v))
+		if (retention.Lines > 0 && lines > retention.Lines) ||
+			(retention.Bytes > 0 && size > retention.Bytes) ||
+			(cutoff != nil && bytes.Compare(k, cutoff) < 0) {
+			expiredKeys = append(expiredKeys, append([]byte{}, k...))
+			process := ""
+			if line, ok := a.codec.decode(app, string(v)); ok {
+				process = processFromLine(line)
+			}
+			expiredProcesses = append(expiredProcesses, process)
+		}
+	}
+	processes := appBucket.Bucket(boltProcessesBucket)
+	var processNames []string
+	if processes != nil {
+		processes.ForEach(func(process, _ []byte) error {
+			processNames = append(processNames, string(process))
+			return nil
+		})
+	}
+	for i, k := range expiredKeys {
+		if err := linesBucket.Delete(k); err != nil {
+			return err
+		}
+		if processes == nil {
+			continue
+		}
+		indexes := []string{expiredProcesses[i]}
+		if indexes[0] == "" {
+			indexes = processNames
+		}
+		for _, process := range indexes {
+			if index := processes.Bucket([]byte(process)); index != nil {
+				if err := index.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// compact rewrites the database into a new file so that space freed by retention is returned to
+// the filesystem
+func (a *boltAdapter) compact() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	select {
+	case <-a.stopCh:
+		// the database has been closed by Stop
+		return nil
+	default:
+	}
+	tmpPath := a.config.Path + ".compact"
+	dst, err := openBoltDB(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, a.db, 0); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := a.db.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(tmpPath, a.config.Path)
+	// Whether or not the rename succeeded, there is a valid database at the original path
+	db, err := openBoltDB(a.config.Path)
+	if err != nil {
+		return err
+	}
+	a.db = db
+	return renameErr
+}
+
+func (a *boltAdapter) view(fn func(*bolt.Tx) error) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.db.View(fn)
+}
+
+func (a *boltAdapter) update(fn func(*bolt.Tx) error) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.db.Update(fn)
+}
+
+// boltBuckets returns the bucket holding an app's lines along with the bucket that indexes the
+// lines of the requested process. Without a process, the index is the lines bucket itself.
+func boltBuckets(tx *bolt.Tx, app string, process string) (*bolt.Bucket, *bolt.Bucket) {
+	appBucket := tx.Bucket([]byte(app))
+	if appBucket == nil {
+		return nil, nil
+	}
+	linesBucket := appBucket.Bucket(boltLinesBucket)
+	if linesBucket == nil || process == "" {
+		return linesBucket, linesBucket
+	}
+	processes := appBucket.Bucket(boltProcessesBucket)
+	if processes == nil {
+		return linesBucket, nil
+	}
+	return linesBucket, processes.Bucket([]byte(process))
+}
+
+func reverseStrings(s []string) {
+	for i := len(s)/2 - 1; i >= 0; i-- {
+		opp := len(s) - 1 - i
+		s[i], s[opp] = s[opp], s[i]
+	}
+}
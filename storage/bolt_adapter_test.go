@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestBoltAdapter(t *testing.T, bufferSize int) (*boltAdapter, func()) {
+	dir, err := ioutil.TempDir("", "bolt-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("DEIS_LOGGER_BOLT_PATH", path.Join(dir, "logger.db"))
+	defer os.Unsetenv("DEIS_LOGGER_BOLT_PATH")
+	sa, err := NewBoltAdapter(bufferSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, ok := sa.(*boltAdapter)
+	if !ok {
+		t.Fatalf("returned adapter was not a boltAdapter")
+	}
+	return a, func() {
+		a.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltReadFromNonExistingApp(t *testing.T) {
+	a, cleanup := newTestBoltAdapter(t, 10)
+	defer cleanup()
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if messages != nil {
+		t.Error("Expected no messages, but got some")
+	}
+	if err == nil || err.Error() != fmt.Sprintf("Could not find logs for '%s'", app) {
+		t.Error("Did not receive expected error message")
+	}
+}
+
+func TestBoltWithBadBufferSizes(t *testing.T) {
+	for _, size := range []int{-1, 0} {
+		a, err := NewBoltAdapter(size)
+		if a != nil {
+			t.Error("Expected no storage adapter, but got one")
+		}
+		if err == nil || err.Error() != fmt.Sprintf("Invalid buffer size: %d", size) {
+			t.Error("Did not receive expected error message")
+		}
+	}
+}
+
+func TestBoltLogs(t *testing.T) {
+	a, cleanup := newTestBoltAdapter(t, 10)
+	defer cleanup()
+	for i := 0; i < 5; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	// Read more logs than there are
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 8}))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(messages) != 5 {
+		t.Errorf("only expected 5 log messages, got %d", len(messages))
+	}
+	// Read fewer logs than there are; should get the 3 MOST RECENT logs
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 3}))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(messages) != 3 {
+		t.Errorf("only expected 3 log messages, got %d", len(messages))
+	}
+	for i := 0; i < 3; i++ {
+		expectedMessage := fmt.Sprintf("message %d", i+2)
+		if messages[i] != expectedMessage {
+			t.Errorf("expected: \"%s\", got \"%s\"", expectedMessage, messages[i])
+		}
+	}
+}
+
+func TestBoltLogsWithProcess(t *testing.T) {
+	a, cleanup := newTestBoltAdapter(t, 10)
+	defer cleanup()
+	lines := []string{
+		"2016-10-18T20:29:38+00:00 foo[web.v2.nzf60]: first",
+		"2016-10-18T20:29:39+00:00 foo[worker.v2.abcde]: second",
+		"2016-10-18T20:29:40+00:00 foo[web.v2.nzf60]: third",
+	}
+	for _, line := range lines {
+		if err := a.Write(context.Background(), app, line); err != nil {
+			t.Error(err)
+		}
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10, Process: "web"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0] != lines[0] || messages[1] != lines[2] {
+		t.Errorf("expected only the web lines, got %v", messages)
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10, Process: "cmd"}); err == nil {
+		t.Error("expected an error reading a process without logs")
+	}
+}
+
+func TestBoltTimeRange(t *testing.T) {
+	a, cleanup := newTestBoltAdapter(t, 10)
+	defer cleanup()
+	lines := []string{
+		"2016-10-18T20:29:38+00:00 foo[web.v2.nzf60]: first",
+		"2016-10-18T20:29:39+00:00 foo[worker.v2.abcde]: second",
+		"2016-10-18T20:29:40+00:00 foo[web.v2.nzf60]: third",
+		"2016-10-18T20:29:41+00:00 foo[web.v2.nzf60]: fourth",
+	}
+	for _, line := range lines {
+		if err := a.Write(context.Background(), app, line); err != nil {
+			t.Error(err)
+		}
+	}
+	since, _ := time.Parse(time.RFC3339, "2016-10-18T20:29:39Z")
+	until, _ := time.Parse(time.RFC3339, "2016-10-18T20:29:41Z")
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10, Since: since, Until: until}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0] != lines[1] || messages[1] != lines[2] {
+		t.Errorf("expected the second and third lines, got %v", messages)
+	}
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10, Process: "web", Since: since}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0] != lines[2] || messages[1] != lines[3] {
+		t.Errorf("expected the third and fourth lines, got %v", messages)
+	}
+	// Lines are never logged after they were stored
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10, Since: time.Now().Add(time.Hour)}); err == nil {
+		t.Error("expected an error reading a time range without logs")
+	}
+}
+
+func TestBoltCursors(t *testing.T) {
+	a, cleanup := newTestBoltAdapter(t, 10)
+	defer cleanup()
+	for i := 0; i < 6; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	page, err := a.Read(context.Background(), app, ReadOptions{Lines: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 3, Before: page.Before()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"message 1", "message 2", "message 3"}) {
+		t.Errorf("unexpected messages before the last page: %v", page.Lines)
+	}
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 10, After: page.After()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"message 4", "message 5"}) {
+		t.Errorf("unexpected messages after the page: %v", page.Lines)
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10, After: page.After()}); err == nil {
+		t.Error("expected an error reading after the last line")
+	}
+}
+
+func TestBoltReadAfterAndRange(t *testing.T) {
+	a, cleanup := newTestBoltAdapter(t, 10)
+	defer cleanup()
+	if err := a.Write(context.Background(), app, "before"); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	entries, err := a.ReadRange(context.Background(), app, start, time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Line != "message 0" {
+		t.Fatalf("expected the 3 lines written during the range, got %v", entries)
+	}
+	entries, err = a.ReadAfter(context.Background(), app, entries[0].ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Line != "message 1" || entries[1].Line != "message 2" {
+		t.Errorf("expected the 2 lines written after the first, got %v", entries)
+	}
+}
+
+func TestBoltRetention(t *testing.T) {
+	a, cleanup := newTestBoltAdapter(t, 3)
+	defer cleanup()
+	for i := 0; i < 5; i++ {
+		line := fmt.Sprintf("2016-10-18T20:29:38+00:00 foo[web.v2.nzf60]: message %d", i)
+		if err := a.Write(context.Background(), app, line); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := a.enforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10, Process: "web"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 {
+		t.Errorf("expected 3 retained log messages, got %d", len(messages))
+	}
+	// Expire everything by age
+	a.retention.defaults.MaxAge = time.Nanosecond
+	if err := a.enforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10}); err == nil {
+		t.Error("expected all logs to have expired")
+	}
+}
+
+func TestBoltSetRetention(t *testing.T) {
+	a, cleanup := newTestBoltAdapter(t, 10)
+	defer cleanup()
+	for i := 0; i < 5; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+		if err := a.Write(context.Background(), "other", fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	// Lines beyond an app's new limits are deleted right away
+	if err := a.SetRetention(app, Retention{Bytes: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if retention := a.Retention(app); retention != (Retention{Lines: 10, Bytes: 20}) {
+		t.Errorf("expected the override to be merged with the defaults, got %+v", retention)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(messages, []string{"message 3", "message 4"}) {
+		t.Errorf("expected the 2 newest lines to fit in 20 bytes, got %v", messages)
+	}
+	if err := a.SetRetention(app, Retention{Lines: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if messages, _ := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10})); len(messages) != 1 {
+		t.Errorf("expected 1 retained line, got %v", messages)
+	}
+	if messages, _ := readLines(a.Read(context.Background(), "other", ReadOptions{Lines: 10})); len(messages) != 5 {
+		t.Errorf("expected the retention of other apps to be unchanged, got %v", messages)
+	}
+	if err := a.SetRetention(app, Retention{Lines: -1}); err == nil {
+		t.Error("expected an error for a negative limit")
+	}
+}
+
+func TestBoltCompactAndDestroy(t *testing.T) {
+	a, cleanup := newTestBoltAdapter(t, 10)
+	defer cleanup()
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
+		t.Error(err)
+	}
+	if err := a.compact(); err != nil {
+		t.Fatal(err)
+	}
+	// Logs should survive compaction
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 1}); err != nil {
+		t.Error(err)
+	}
+	if err := a.Destroy(context.Background(), app); err != nil {
+		t.Error(err)
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 1}); err == nil {
+		t.Error("expected logs to have been destroyed")
+	}
+}
+
+func TestBoltApps(t *testing.T) {
+	a, cleanup := newTestBoltAdapter(t, 10)
+	defer cleanup()
+	before := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	apps, err := a.Apps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 || apps[0].Name != app || apps[0].Lines != 4 || apps[0].Bytes != 36 || apps[0].LastWrite.Before(before) {
+		t.Errorf("unexpected apps: %+v", apps)
+	}
+}
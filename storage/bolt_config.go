@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type boltConfig struct {
+	Path                      string `envconfig:"DEIS_LOGGER_BOLT_PATH" default:"/data/logs/logger.db"`
+	RetentionMaxAgeSeconds    int    `envconfig:"DEIS_LOGGER_BOLT_RETENTION_MAX_AGE_SECONDS" default:"0"`
+	RetentionIntervalSeconds  int    `envconfig:"DEIS_LOGGER_BOLT_RETENTION_INTERVAL_SECONDS" default:"60"`
+	CompactionIntervalSeconds int    `envconfig:"DEIS_LOGGER_BOLT_COMPACTION_INTERVAL_SECONDS" default:"3600"`
+	RetentionMaxAge           time.Duration
+	RetentionInterval         time.Duration
+	CompactionInterval        time.Duration
+}
+
+func parseBoltConfig(appName string) (*boltConfig, error) {
+	ret := new(boltConfig)
+	if err := envconfig.Process(appName, ret); err != nil {
+		return nil, err
+	}
+	ret.RetentionMaxAge = time.Duration(ret.RetentionMaxAgeSeconds) * time.Second
+	ret.RetentionInterval = time.Duration(ret.RetentionIntervalSeconds) * time.Second
+	ret.CompactionInterval = time.Duration(ret.CompactionIntervalSeconds) * time.Second
+	return ret, nil
+}
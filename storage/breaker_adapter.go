@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	breakerPrimary  = "primary"
+	breakerFallback = "fallback"
+	// breakerWriteTimeout bounds every write to the primary adapter, so a primary that hangs fails
+	breakerWriteTimeout = 5 * time.Second
+	// breakerHealthInterval is how long a primary sending writes in the background is trusted to be
+	// healthy after checking that it is
+	breakerHealthInterval = time.Second
+)
+
+type breakerState int
+
+const (
+	// breakerClosed sends operations to the primary adapter
+	breakerClosed breakerState = iota
+	// breakerOpen sends operations to the fallback adapter
+	breakerOpen
+	// breakerHalfOpen is the state of an open breaker while an operation probes the primary adapter
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerAdapter is a circuit breaker in front of a primary adapter. Once a number of consecutive
+// operations on the primary fail, the breaker opens and writes and reads are served by a fallback
+// adapter instead, so a failing primary doesn't hold up the consumption of logs. Once the probe
+// interval has passed, a single operation probes the primary and closes the breaker if it succeeds.
+type breakerAdapter struct {
+	primary       Adapter
+	fallback      Adapter
+	maxFailures   int
+	probeInterval time.Duration
+	writeTimeout  time.Duration
+	mutex         sync.Mutex
+	state         breakerState
+	// healthyAt is the time the primary was last found to be healthy
+	healthyAt time.Time
+	// failures counts the consecutive operations on the primary that failed
+	failures int
+	// since is the time the breaker last opened or closed
+	since   time.Time
+	lastErr error
+}
+
+// NewBreakerAdapter returns a storage adapter that opens a circuit breaker after the given number
+// of consecutive failures of the primary adapter, serving writes and reads from the fallback adapter
+// until probing the primary, once every probe interval, succeeds. Lines written while the breaker
+// is open stay in the fallback adapter and are read from it if the primary has none for an app.
+func NewBreakerAdapter(primary Adapter, fallback Adapter, failures int, probeInterval time.Duration) (Adapter, error) {
+	if failures <= 0 {
+		return nil, fmt.Errorf("Invalid number of failures opening the circuit breaker: %d", failures)
+	}
+	return &breakerAdapter{
+		primary:       primary,
+		fallback:      fallback,
+		maxFailures:   failures,
+		probeInterval: probeInterval,
+		writeTimeout:  breakerWriteTimeout,
+		since:         time.Now(),
+	}, nil
+}
+
+func newBreakerAdapterFromConfig(numLines int) (Adapter, error) {
+	cfg, err := parseBreakerConfig(appName)
+	if err != nil {
+		return nil, err
+	}
+	for _, adapterType := range []string{cfg.Adapter, cfg.FallbackAdapter} {
+		if adapterType == "breaker" {
+			return nil, fmt.Errorf("Invalid storage adapter type behind the circuit breaker: %s", adapterType)
+		}
+	}
+	primary, err := NewAdapter(cfg.Adapter, numLines)
+	if err != nil {
+		return nil, err
+	}
+	fallback, err := NewAdapter(cfg.FallbackAdapter, numLines)
+	if err != nil {
+		return nil, err
+	}
+	return NewBreakerAdapter(primary, fallback, cfg.Failures, cfg.ProbeInterval)
+}
+
+// usePrimary reports whether an operation is to be tried on the primary adapter. While the breaker
+// is open, the first operation after the probe interval has passed probes the primary, provided
+// that it is healthy.
+func (a *breakerAdapter) usePrimary(ctx context.Context) bool {
+	a.mutex.Lock()
+	switch {
+	case a.state == breakerClosed:
+		a.mutex.Unlock()
+		return true
+	case a.state == breakerHalfOpen || time.Since(a.since) < a.probeInterval:
+		a.mutex.Unlock()
+		return false
+	}
+	a.state = breakerHalfOpen
+	a.mutex.Unlock()
+	if err := Healthy(ctx, a.primary); err != nil {
+		a.failed(ctx, err)
+		return false
+	}
+	a.mutex.Lock()
+	a.healthyAt = time.Now()
+	a.mutex.Unlock()
+	return true
+}
+
+// healthy checks the health of a primary adapter that sends writes in the background, since its
+// writes succeed even when its backend can't be reached. While it is healthy, it is checked once
+// every health interval at most.
+func (a *breakerAdapter) healthy(ctx context.Context) error {
+	if _, ok := a.primary.(HealthChecker); !ok {
+		return nil
+	}
+	a.mutex.Lock()
+	recent := time.Since(a.healthyAt) < breakerHealthInterval
+	a.mutex.Unlock()
+	if recent {
+		return nil
+	}
+	if err := Healthy(ctx, a.primary); err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	a.healthyAt = time.Now()
+	a.mutex.Unlock()
+	return nil
+}
+
+// succeeded closes the breaker after an operation on the primary adapter succeeded
+func (a *breakerAdapter) succeeded() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.failures = 0
+	if a.state != breakerClosed {
+		a.state = breakerClosed
+		a.since = time.Now()
+		metrics.Add("breaker.closed", 1)
+		log.Printf("Closed the circuit breaker, the %s storage adapter is used again", breakerPrimary)
+	}
+}
+
+// failed counts an operation on the primary adapter that failed, opening the breaker once too many
+// did. Operations abandoned by their caller aren't counted.
+func (a *breakerAdapter) failed(ctx context.Context, err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if ctx.Err() != nil {
+		if a.state == breakerHalfOpen {
+			// the probe was inconclusive, so the next operation probes again
+			a.state = breakerOpen
+		}
+		return
+	}
+	metrics.Add("breaker.primary_errors", 1)
+	a.failures++
+	a.lastErr = err
+	if a.state == breakerHalfOpen || a.failures >= a.maxFailures {
+		if a.state == breakerClosed {
+			metrics.Add("breaker.opened", 1)
+			log.Printf("Opened the circuit breaker after %d failures, using the %s storage adapter: %s", a.failures, breakerFallback, err)
+		}
+		a.state = breakerOpen
+		a.since = time.Now()
+	}
+}
+
+// breakerFailure reports whether an error of the primary adapter counts towards opening the
+// breaker. Errors caused by a request, rather than by the adapter, don't.
+func breakerFailure(err error) bool {
+	switch err.(type) {
+	case ErrNotFound, ErrInvalidArgument:
+		return false
+	}
+	return true
+}
+
+// Start both adapters
+func (a *breakerAdapter) Start() {
+	a.primary.Start()
+	a.fallback.Start()
+}
+
+// Write adds a log message to the primary adapter, or to the fallback adapter if the breaker is
+// open or the write fails. Writes to the primary fail if it is unhealthy or they time out.
+func (a *breakerAdapter) Write(ctx context.Context, app string, message string) error {
+	return a.write(ctx, func(ctx context.Context, adapter Adapter) error {
+		return adapter.Write(ctx, app, message)
+	})
+}
+
+// WriteWithMetadata adds a log message to the primary or the fallback adapter, passing its metadata
+// along if the adapter makes use of it
+func (a *breakerAdapter) WriteWithMetadata(ctx context.Context, app string, message string, metadata Metadata) error {
+	return a.write(ctx, func(ctx context.Context, adapter Adapter) error {
+		return WriteWithMetadata(ctx, adapter, app, message, metadata)
+	})
+}
+
+func (a *breakerAdapter) write(ctx context.Context, write func(context.Context, Adapter) error) error {
+	if a.usePrimary(ctx) {
+		primaryCtx, cancel := context.WithTimeout(ctx, a.writeTimeout)
+		err := a.healthy(primaryCtx)
+		if err == nil {
+			err = write(primaryCtx, a.primary)
+		}
+		cancel()
+		if err == nil {
+			a.succeeded()
+			return nil
+		}
+		// only the caller abandoning the write keeps it from counting as a failure
+		a.failed(ctx, err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	metrics.Add("breaker.fallback_writes", 1)
+	return write(ctx, a.fallback)
+}
+
+// Read retrieves a specified number of log lines from the primary adapter, or from the fallback
+// adapter if the breaker is open, the read fails or the primary has no lines for the app. Cursors
+// are tagged with the adapter that returned them and reads with a cursor are served by that adapter.
+func (a *breakerAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	if cursor := opts.Before + opts.After; cursor != "" {
+		name, cursor, err := untagCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Before != "" {
+			opts.Before = cursor
+		} else {
+			opts.After = cursor
+		}
+		switch name {
+		case breakerPrimary:
+			return a.read(ctx, a.primary, name, app, opts)
+		case breakerFallback:
+			return a.read(ctx, a.fallback, name, app, opts)
+		}
+		return nil, newErrInvalidArgument("Invalid cursor: %s", opts.Before+opts.After)
+	}
+	if a.usePrimary(ctx) {
+		page, err := a.read(ctx, a.primary, breakerPrimary, app, opts)
+		if err == nil || !breakerFailure(err) {
+			a.succeeded()
+			if _, ok := err.(ErrNotFound); !ok {
+				return page, err
+			}
+		} else {
+			a.failed(ctx, err)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		}
+	}
+	metrics.Add("breaker.fallback_reads", 1)
+	return a.read(ctx, a.fallback, breakerFallback, app, opts)
+}
+
+func (a *breakerAdapter) read(ctx context.Context, adapter Adapter, name string, app string, opts ReadOptions) (*Page, error) {
+	page, err := adapter.Read(ctx, app, opts)
+	if err != nil {
+		return nil, err
+	}
+	page.tagCursors(name)
+	return page, nil
+}
+
+// Apps describes the apps of the primary adapter, unless the breaker is open, and those of the
+// fallback adapter
+func (a *breakerAdapter) Apps(ctx context.Context) ([]AppInfo, error) {
+	apps := []AppInfo{}
+	if a.usePrimary(ctx) {
+		primaryApps, err := a.primary.Apps(ctx)
+		if err != nil {
+			a.failed(ctx, err)
+		} else {
+			a.succeeded()
+			apps = primaryApps
+		}
+	}
+	fallbackApps, err := a.fallback.Apps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return mergeApps(apps, fallbackApps), nil
+}
+
+// SetRetention overrides the limits of the lines kept for an app by both adapters, if they can keep
+// a different amount of logs for every app
+func (a *breakerAdapter) SetRetention(app string, retention Retention) error {
+	set := false
+	var firstErr error
+	for _, adapter := range []Adapter{a.primary, a.fallback} {
+		rs, ok := adapter.(RetentionSetter)
+		if !ok {
+			continue
+		}
+		set = true
+		if err := rs.SetRetention(app, retention); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if !set {
+		return newErrInvalidArgument("Neither storage adapter can keep a different amount of logs for every app")
+	}
+	return firstErr
+}
+
+// Retention returns the limits of the lines kept for an app by the primary adapter, or by the
+// fallback adapter if only it can keep a different amount of logs for every app
+func (a *breakerAdapter) Retention(app string) Retention {
+	for _, adapter := range []Adapter{a.primary, a.fallback} {
+		if rs, ok := adapter.(RetentionSetter); ok {
+			return rs.Retention(app)
+		}
+	}
+	return Retention{}
+}
+
+// Destroy deletes stored logs for the specified application from both adapters, whatever the state
+// of the breaker
+func (a *breakerAdapter) Destroy(ctx context.Context, app string) error {
+	err := a.primary.Destroy(ctx, app)
+	if fallbackErr := a.fallback.Destroy(ctx, app); err == nil {
+		err = fallbackErr
+	}
+	return err
+}
+
+// Reopen both adapters
+func (a *breakerAdapter) Reopen() error {
+	err := a.primary.Reopen()
+	if fallbackErr := a.fallback.Reopen(); err == nil {
+		err = fallbackErr
+	}
+	return err
+}
+
+// Stop both adapters
+func (a *breakerAdapter) Stop() {
+	a.primary.Stop()
+	a.fallback.Stop()
+}
+
+// Status describes the state of the circuit breaker
+func (a *breakerAdapter) Status() map[string]interface{} {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	status := map[string]interface{}{
+		"state":    a.state.String(),
+		"failures": a.failures,
+		"since":    a.since.UTC().Format(time.RFC3339),
+	}
+	if a.lastErr != nil {
+		status["last_error"] = a.lastErr.Error()
+	}
+	return map[string]interface{}{"breaker": status}
+}
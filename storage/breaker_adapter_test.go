@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBreakerAdapter(t *testing.T, primary Adapter, failures int, probeInterval time.Duration) (*breakerAdapter, Adapter) {
+	fallback := newTestRingBufferAdapter(t, 10)
+	a, err := NewBreakerAdapter(primary, fallback, failures, probeInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start()
+	return a.(*breakerAdapter), fallback
+}
+
+func breakerStateOf(a *breakerAdapter) string {
+	return a.Status()["breaker"].(map[string]interface{})["state"].(string)
+}
+
+func TestBreakerOpensAfterFailures(t *testing.T) {
+	primary := &flakyAdapter{Adapter: newTestRingBufferAdapter(t, 10), failing: 1}
+	a, fallback := newTestBreakerAdapter(t, primary, 3, time.Hour)
+	defer a.Stop()
+	writeWAL(t, a, "first", "second")
+	if state := breakerStateOf(a); state != "closed" {
+		t.Errorf("Expected the breaker to be closed after 2 failures, got %s", state)
+	}
+	writeWAL(t, a, "third")
+	if state := breakerStateOf(a); state != "open" {
+		t.Errorf("Expected the breaker to be open after 3 failures, got %s", state)
+	}
+	// failed writes and those made while the breaker is open go to the fallback
+	writeWAL(t, a, "fourth")
+	expected := []string{"first", "second", "third", "fourth"}
+	if messages, err := readLines(fallback.Read(context.Background(), app, ReadOptions{Lines: 10})); err != nil || !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected the fallback to hold %v, got %v (%v)", expected, messages, err)
+	}
+	atomic.StoreInt32(&primary.failing, 0)
+	page, err := a.Read(context.Background(), app, ReadOptions{Lines: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, expected) || !strings.HasPrefix(page.Before(), "fallback:") {
+		t.Errorf("Expected %v to be read from the fallback, got %v with cursors %v", expected, page.Lines, page.Cursors)
+	}
+	if messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10, Before: page.After()})); err != nil || !reflect.DeepEqual(messages, expected[:3]) {
+		t.Errorf("Expected the cursor to be read from the fallback, got %v (%v)", messages, err)
+	}
+}
+
+func TestBreakerProbesAndCloses(t *testing.T) {
+	primary := &flakyAdapter{Adapter: newTestRingBufferAdapter(t, 10), failing: 1}
+	a, _ := newTestBreakerAdapter(t, primary, 1, 20*time.Millisecond)
+	defer a.Stop()
+	writeWAL(t, a, "first")
+	atomic.StoreInt32(&primary.failing, 0)
+	writeWAL(t, a, "second")
+	if state := breakerStateOf(a); state != "open" {
+		t.Errorf("Expected the breaker to stay open until the probe interval passed, got %s", state)
+	}
+	time.Sleep(30 * time.Millisecond)
+	writeWAL(t, a, "third")
+	if state := breakerStateOf(a); state != "closed" {
+		t.Errorf("Expected a successful probe to close the breaker, got %s", state)
+	}
+	if messages, err := readLines(primary.Read(context.Background(), app, ReadOptions{Lines: 10})); err != nil || !reflect.DeepEqual(messages, []string{"third"}) {
+		t.Errorf("Expected the probe to be written to the primary, got %v (%v)", messages, err)
+	}
+	// the primary has lines of the app again, so those left in the fallback aren't read
+	if messages, _ := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10})); !reflect.DeepEqual(messages, []string{"third"}) {
+		t.Errorf("Expected the primary to be read, got %v", messages)
+	}
+}
+
+func TestBreakerProbesHealth(t *testing.T) {
+	primary := &flakyAdapter{Adapter: newTestRingBufferAdapter(t, 10), failing: 1, unhealthy: 1}
+	a, _ := newTestBreakerAdapter(t, primary, 1, 10*time.Millisecond)
+	defer a.Stop()
+	writeWAL(t, a, "first")
+	atomic.StoreInt32(&primary.failing, 0)
+	time.Sleep(20 * time.Millisecond)
+	writeWAL(t, a, "second")
+	if state := breakerStateOf(a); state != "open" {
+		t.Errorf("Expected an unhealthy primary to keep the breaker open, got %s", state)
+	}
+	atomic.StoreInt32(&primary.unhealthy, 0)
+	time.Sleep(20 * time.Millisecond)
+	writeWAL(t, a, "third")
+	if state := breakerStateOf(a); state != "closed" {
+		t.Errorf("Expected a healthy primary to close the breaker, got %s", state)
+	}
+}
+
+func TestBreakerIgnoresRequestErrors(t *testing.T) {
+	a, _ := newTestBreakerAdapter(t, newTestRingBufferAdapter(t, 10), 1, time.Hour)
+	defer a.Stop()
+	if _, err := a.Read(context.Background(), "not-found", ReadOptions{Lines: 10}); err == nil {
+		t.Error("Expected reading an app without logs to fail")
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10, Before: "elsewhere:1"}); err == nil {
+		t.Error("Expected reading an invalid cursor to fail")
+	}
+	if state := breakerStateOf(a); state != "closed" {
+		t.Errorf("Expected the breaker to stay closed, got %s", state)
+	}
+}
+
+// hangingAdapter blocks writes until they are abandoned
+type hangingAdapter struct {
+	Adapter
+}
+
+func (a hangingAdapter) Write(ctx context.Context, app string, message string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestBreakerBoundsWrites(t *testing.T) {
+	a, fallback := newTestBreakerAdapter(t, hangingAdapter{newTestRingBufferAdapter(t, 10)}, 1, time.Hour)
+	defer a.Stop()
+	a.writeTimeout = 10 * time.Millisecond
+	writeWAL(t, a, "first")
+	if state := breakerStateOf(a); state != "open" {
+		t.Errorf("Expected a write timing out to open the breaker, got %s", state)
+	}
+	if messages, err := readLines(fallback.Read(context.Background(), app, ReadOptions{Lines: 10})); err != nil || !reflect.DeepEqual(messages, []string{"first"}) {
+		t.Errorf("Expected the write to go to the fallback, got %v (%v)", messages, err)
+	}
+}
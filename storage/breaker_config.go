@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type breakerConfig struct {
+	Adapter              string `envconfig:"DEIS_LOGGER_BREAKER_ADAPTER" default:"redis"`
+	FallbackAdapter      string `envconfig:"DEIS_LOGGER_BREAKER_FALLBACK_ADAPTER" default:"memory"`
+	Failures             int    `envconfig:"DEIS_LOGGER_BREAKER_FAILURES" default:"5"`
+	ProbeIntervalSeconds int    `envconfig:"DEIS_LOGGER_BREAKER_PROBE_INTERVAL_SECONDS" default:"10"`
+	ProbeInterval        time.Duration
+}
+
+func parseBreakerConfig(appName string) (*breakerConfig, error) {
+	ret := new(breakerConfig)
+	if err := envconfig.Process(appName, ret); err != nil {
+		return nil, err
+	}
+	ret.ProbeInterval = time.Duration(ret.ProbeIntervalSeconds) * time.Second
+	return ret, nil
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// lineMarker starts every line that was compressed or encrypted, followed by a byte telling how
+	// the rest of the line is encoded. Log lines are text and don't start with a NUL byte, so lines
+	// without the marker are read as they are, and lines written with and without compression or
+	// encryption can be mixed while either is rolled out or back.
+	lineMarker = '\x00'
+	// zstdFormat is followed by a zstd frame
+	zstdFormat = 'z'
+	// encryptedFormat is followed by a line sealed by a keyring, itself compressed or not
+	encryptedFormat = 'e'
+	// textFormatShift turns a format into the one used by backends storing lines of text, which is
+	// followed by the rest of the line encoded in base64
+	textFormatShift = 'a' - 'A'
+)
+
+// errShredded is returned when encoding a line of an app or namespace that was shredded. Writes
+// drop such lines rather than storing them unencrypted.
+var errShredded = errors.New("the logs of the app were shredded")
+
+// lineCodec compresses and encrypts log lines one at a time, as they are written, and decodes them
+// as they are read. Lines are only stored compressed if that makes them smaller, and encrypted if
+// there is a key for their app.
+type lineCodec struct {
+	// encoder is nil if lines aren't compressed, as lines that were compressed are still read
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	// keyring is nil if no encryption keys are configured
+	keyring *keyring
+	// text is set for backends that store lines of text
+	text bool
+}
+
+// newLineCodecFromConfig returns a codec compressing and encrypting lines as configured by the
+// environment
+func newLineCodecFromConfig(text bool) (*lineCodec, error) {
+	compression, err := parseCompressionConfig(appName)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := parseEncryptionConfig(appName)
+	if err != nil {
+		return nil, err
+	}
+	return newLineCodec(compression, encryption, text)
+}
+
+func newLineCodec(compression *compressionConfig, encryption *encryptionConfig, text bool) (*lineCodec, error) {
+	c := &lineCodec{text: text}
+	var err error
+	if c.encoder, c.decoder, err = newZstd(compression); err != nil {
+		return nil, err
+	}
+	if c.keyring, err = newKeyring(encryption); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// encode returns a line of an app the way it is to be stored. The namespace it was logged in, if
+// known, selects its encryption key if its app has none. Lines of shredded apps and namespaces
+// return errShredded.
+func (c *lineCodec) encode(app string, namespace string, line string) (string, error) {
+	var key *encryptionKey
+	if c.keyring != nil {
+		var shredded bool
+		if key, shredded = c.keyring.key(app, namespace); shredded {
+			metrics.Add("codec.shredded_lines", 1)
+			return "", errShredded
+		}
+	}
+	data := []byte(line)
+	if c.encoder != nil {
+		compressed := append([]byte{lineMarker, zstdFormat}, c.encoder.EncodeAll(data, nil)...)
+		size := len(compressed)
+		if c.text && key == nil {
+			size = 2 + base64.RawStdEncoding.EncodedLen(size-2)
+		}
+		if size < len(data) {
+			data = compressed
+		}
+	}
+	if key != nil {
+		sealed, err := c.keyring.seal(key, app, data)
+		if err != nil {
+			return "", err
+		}
+		data = append([]byte{lineMarker, encryptedFormat}, sealed...)
+	}
+	if c.text && len(data) > 1 && data[0] == lineMarker && (data[1] == zstdFormat || data[1] == encryptedFormat) {
+		encoded := make([]byte, 2+base64.RawStdEncoding.EncodedLen(len(data)-2))
+		encoded[0], encoded[1] = lineMarker, data[1]-textFormatShift
+		base64.RawStdEncoding.Encode(encoded[2:], data[2:])
+		data = encoded
+	}
+	return string(data), nil
+}
+
+// decode returns a stored line of an app the way it was written, or false if it can't be decoded,
+// such as a line encrypted with a key that was destroyed
+func (c *lineCodec) decode(app string, stored string) (string, bool) {
+	if len(stored) < 2 || stored[0] != lineMarker {
+		return stored, true
+	}
+	data := []byte(stored)
+	if c.text && (data[1] == zstdFormat-textFormatShift || data[1] == encryptedFormat-textFormatShift) {
+		decoded, err := base64.RawStdEncoding.DecodeString(stored[2:])
+		if err != nil {
+			return c.decodeError()
+		}
+		data = append([]byte{lineMarker, data[1] + textFormatShift}, decoded...)
+	}
+	if data[1] == encryptedFormat {
+		if c.keyring == nil {
+			return c.decodeError()
+		}
+		opened, err := c.keyring.open(app, data[2:])
+		if err != nil {
+			return c.decodeError()
+		}
+		data = opened
+	}
+	if len(data) > 1 && data[0] == lineMarker && data[1] == zstdFormat {
+		decompressed, err := c.decoder.DecodeAll(data[2:], nil)
+		if err != nil {
+			return c.decodeError()
+		}
+		data = decompressed
+	}
+	return string(data), true
+}
+
+func (c *lineCodec) decodeError() (string, bool) {
+	metrics.Add("codec.decode_errors", 1)
+	return "", false
+}
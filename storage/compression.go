@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMagic starts dictionaries trained by "zstd --train"
+const zstdMagic = 0xEC30A437
+
+// newZstd returns the zstd encoder configured, or nil if lines aren't compressed, along with a
+// decoder. The first of the configured dictionaries is used to compress lines, and the others to
+// decompress lines compressed with them, so lines compressed before compression was turned off are
+// still read.
+func newZstd(cfg *compressionConfig) (*zstd.Encoder, *zstd.Decoder, error) {
+	var encoderDict zstd.EOption
+	var decoderDicts []zstd.DOption
+	for i, dictPath := range cfg.Dictionaries {
+		encoderOpt, decoderOpt, err := loadZstdDictionary(strings.TrimSpace(dictPath))
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == 0 {
+			encoderDict = encoderOpt
+		}
+		decoderDicts = append(decoderDicts, decoderOpt)
+	}
+	decoder, err := zstd.NewReader(nil, decoderDicts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch cfg.Algorithm {
+	case "none":
+		return nil, decoder, nil
+	case "zstd":
+	default:
+		return nil, nil, fmt.Errorf("Invalid compression algorithm: %s", cfg.Algorithm)
+	}
+	ok, level := zstd.EncoderLevelFromString(cfg.Level)
+	if !ok {
+		return nil, nil, fmt.Errorf("Invalid zstd compression level: %s", cfg.Level)
+	}
+	opts := []zstd.EOption{zstd.WithEncoderLevel(level)}
+	if encoderDict != nil {
+		opts = append(opts, encoderDict)
+	}
+	encoder, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encoder, decoder, nil
+}
+
+// loadZstdDictionary loads a dictionary trained by "zstd --train" or, failing that, uses the file's
+// content as a static dictionary. Static dictionaries are identified by a checksum of their content.
+func loadZstdDictionary(dictPath string) (zstd.EOption, zstd.DOption, error) {
+	content, err := ioutil.ReadFile(dictPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(content) >= 4 && binary.LittleEndian.Uint32(content) == zstdMagic {
+		return zstd.WithEncoderDict(content), zstd.WithDecoderDicts(content), nil
+	}
+	if len(content) == 0 {
+		return nil, nil, fmt.Errorf("The zstd dictionary %s is empty", dictPath)
+	}
+	// IDs below 32768 and from 2^31 up are reserved
+	id := 32768 + crc32.ChecksumIEEE(content)%(1<<31-32768)
+	return zstd.WithEncoderDictRaw(id, content), zstd.WithDecoderDictRaw(id, content), nil
+}
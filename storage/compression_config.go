@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"github.com/kelseyhightower/envconfig"
+)
+
+type compressionConfig struct {
+	Algorithm    string   `envconfig:"DEIS_LOGGER_COMPRESSION" default:"none"`
+	Level        string   `envconfig:"DEIS_LOGGER_COMPRESSION_LEVEL" default:"default"`
+	Dictionaries []string `envconfig:"DEIS_LOGGER_COMPRESSION_DICTIONARIES" default:""`
+}
+
+func parseCompressionConfig(appName string) (*compressionConfig, error) {
+	ret := new(compressionConfig)
+	if err := envconfig.Process(appName, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const compressibleLine = "2017-01-01T00:00:00Z test-app[web.1]: GET /healthz 200 GET /healthz 200 GET /healthz 200 GET /healthz 200"
+
+func newTestLineCodec(t *testing.T, text bool, algorithm string, dictionaries ...string) *lineCodec {
+	c, err := newLineCodec(&compressionConfig{Algorithm: algorithm, Level: "default", Dictionaries: dictionaries}, &encryptionConfig{}, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func encodeLine(t *testing.T, c *lineCodec, line string) string {
+	stored, err := c.encode(app, "", line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+// writeTestDictionary writes a static dictionary to a temporary directory, returning its path
+func writeTestDictionary(t *testing.T, dir string, name string, content string) string {
+	dictPath := path.Join(dir, name)
+	if err := ioutil.WriteFile(dictPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dictPath
+}
+
+func TestLineCodecRoundTrip(t *testing.T) {
+	for _, text := range []bool{false, true} {
+		c := newTestLineCodec(t, text, "zstd")
+		stored := encodeLine(t, c, compressibleLine)
+		if len(stored) >= len(compressibleLine) || stored[0] != lineMarker {
+			t.Errorf("Expected %q to be compressed, got %q", compressibleLine, stored)
+		}
+		if text && strings.ContainsAny(stored, "\n") {
+			t.Errorf("Expected a line of text, got %q", stored)
+		}
+		if line, ok := c.decode(app, stored); !ok || line != compressibleLine {
+			t.Errorf("Expected %q, got %q", compressibleLine, line)
+		}
+		// lines that don't get smaller are stored as they are
+		if stored := encodeLine(t, c, "short"); stored != "short" {
+			t.Errorf("Expected a short line to be stored uncompressed, got %q", stored)
+		}
+	}
+}
+
+func TestLineCodecMixedLines(t *testing.T) {
+	compressed := encodeLine(t, newTestLineCodec(t, false, "zstd"), compressibleLine)
+	// lines compressed before compression was turned off are still read
+	c := newTestLineCodec(t, false, "none")
+	if stored := encodeLine(t, c, compressibleLine); stored != compressibleLine {
+		t.Errorf("Expected an uncompressed line, got %q", stored)
+	}
+	for _, stored := range []string{compressed, compressibleLine} {
+		if line, ok := c.decode(app, stored); !ok || line != compressibleLine {
+			t.Errorf("Expected %q, got %q", compressibleLine, line)
+		}
+	}
+}
+
+func TestLineCodecDictionaries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compression-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := writeTestDictionary(t, dir, "old", strings.Repeat(compressibleLine+"\n", 10))
+	current := writeTestDictionary(t, dir, "current", "GET /healthz 200 "+compressibleLine)
+	withoutDictionary := encodeLine(t, newTestLineCodec(t, false, "zstd"), compressibleLine)
+	withOld := encodeLine(t, newTestLineCodec(t, false, "zstd", old), compressibleLine)
+	if len(withOld) >= len(withoutDictionary) {
+		t.Errorf("Expected a dictionary to compress %q better than %d bytes, got %d", compressibleLine, len(withoutDictionary), len(withOld))
+	}
+	// the dictionaries following the first one are kept for lines compressed with them
+	c := newTestLineCodec(t, false, "zstd", current, old)
+	for _, stored := range []string{withoutDictionary, withOld, encodeLine(t, c, compressibleLine)} {
+		if line, ok := c.decode(app, stored); !ok || line != compressibleLine {
+			t.Errorf("Expected %q, got %q", compressibleLine, line)
+		}
+	}
+	if _, ok := newTestLineCodec(t, false, "zstd", current).decode(app, withOld); ok {
+		t.Error("Expected a line compressed with a dictionary that isn't configured not to be decoded")
+	}
+}
+
+func TestLineCodecConfig(t *testing.T) {
+	for _, cfg := range []compressionConfig{
+		{Algorithm: "gzip", Level: "default"},
+		{Algorithm: "zstd", Level: "maximum"},
+		{Algorithm: "zstd", Level: "default", Dictionaries: []string{"/does/not/exist"}},
+	} {
+		if _, err := newLineCodec(&cfg, &encryptionConfig{}, false); err == nil {
+			t.Errorf("Expected %+v to be invalid", cfg)
+		}
+	}
+}
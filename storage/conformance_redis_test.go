@@ -0,0 +1,64 @@
+// +build testredis
+
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	r "gopkg.in/redis.v3"
+)
+
+// realRedis runs commands against the redis configured by DEIS_LOGGER_REDIS_SERVICE_HOST and
+// DEIS_LOGGER_REDIS_SERVICE_PORT
+type realRedis struct {
+	*r.Client
+}
+
+func (c realRedis) Do(args ...string) (interface{}, error) {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+	cmd := r.NewCmd(values...)
+	c.Process(cmd)
+	return cmd.Result()
+}
+
+// useRealRedis empties the real redis, so that tests sharing it start from scratch, returning it
+func useRealRedis(t *testing.T) realRedis {
+	port := os.Getenv("DEIS_LOGGER_REDIS_SERVICE_PORT")
+	if port == "" {
+		port = "6379"
+	}
+	c := realRedis{r.NewClient(&r.Options{
+		Addr:     fmt.Sprintf("%s:%s", os.Getenv("DEIS_LOGGER_REDIS_SERVICE_HOST"), port),
+		Password: os.Getenv("DEIS_LOGGER_REDIS_PASSWORD"),
+	})}
+	if err := c.FlushDb().Err(); err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestRedisScripts runs the redis adapter's tests against a real redis, rather than the Go
+// stand-ins for its scripts the other tests use, so the scripts it ships are tested too
+func TestRedisScripts(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s redisServer)
+	}{
+		{"conformance", func(t *testing.T, s redisServer) { testConformanceRedis(t) }},
+		{"compressed", func(t *testing.T, s redisServer) { testConformanceRedisCompressed(t) }},
+		{"keys", testRedisKeys},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := useRealRedis(t)
+			defer s.Close()
+			test.test(t, s)
+		})
+	}
+}
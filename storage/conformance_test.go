@@ -0,0 +1,646 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deis/logger/storage"
+	"github.com/deis/logger/storage/storagetest"
+)
+
+// cleanupAdapter runs a cleanup function once its adapter is stopped
+type cleanupAdapter struct {
+	storage.Adapter
+	cleanup func()
+}
+
+func (a cleanupAdapter) Stop() {
+	a.Adapter.Stop()
+	a.cleanup()
+}
+
+func (a cleanupAdapter) WriteWithMetadata(ctx context.Context, app string, message string, metadata storage.Metadata) error {
+	return storage.WriteWithMetadata(ctx, a.Adapter, app, message, metadata)
+}
+
+func newStarted(t *testing.T, a storage.Adapter, err error) storage.Adapter {
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start()
+	return a
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "conformance-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// useTempLogRoot points the file adapter at a new temporary directory, returning a function that
+// removes it
+func useTempLogRoot(t *testing.T) func() {
+	dir := tempDir(t)
+	storage.SetLogRoot(dir)
+	return func() { os.RemoveAll(dir) }
+}
+
+func TestConformanceRingBuffer(t *testing.T) {
+	defer storeMetadata()()
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, lines int) storage.Adapter {
+			a, err := storage.NewRingBufferAdapter(lines)
+			return newStarted(t, a, err)
+		},
+		Metadata: true,
+	})
+}
+
+func TestConformanceFile(t *testing.T) {
+	defer storeMetadata()()
+	defer useTempLogRoot(t)()
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, lines int) storage.Adapter {
+			a, err := storage.NewFileAdapter()
+			return newStarted(t, a, err)
+		},
+		Unbounded: true,
+		Metadata:  true,
+	})
+}
+
+// useCompression turns on the compression of lines, with a static dictionary of lines like those
+// the suite writes, returning a function that turns it off
+func useCompression(t *testing.T) func() {
+	dir := tempDir(t)
+	dictionary := path.Join(dir, "dictionary")
+	lines := strings.Join([]string{
+		storagetest.Line("storagetest-order", "web", "message 0"),
+		storagetest.Line("storagetest-concurrency", "worker", "message 1 of writer 2"),
+	}, "\n")
+	if err := ioutil.WriteFile(dictionary, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unsetenv := setenv(map[string]string{
+		"DEIS_LOGGER_COMPRESSION":              "zstd",
+		"DEIS_LOGGER_COMPRESSION_DICTIONARIES": dictionary,
+	})
+	return func() {
+		unsetenv()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestConformanceFileCompressed(t *testing.T) {
+	defer storeMetadata()()
+	defer useTempLogRoot(t)()
+	defer useCompression(t)()
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, lines int) storage.Adapter {
+			a, err := storage.NewFileAdapter()
+			return newStarted(t, a, err)
+		},
+		Unbounded: true,
+		Metadata:  true,
+	})
+}
+
+func TestConformanceBolt(t *testing.T) {
+	defer storeMetadata()()
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, lines int) storage.Adapter {
+			dir := tempDir(t)
+			os.Setenv("DEIS_LOGGER_BOLT_PATH", path.Join(dir, "logger.db"))
+			defer os.Unsetenv("DEIS_LOGGER_BOLT_PATH")
+			a, err := storage.NewBoltAdapter(lines)
+			a = newStarted(t, a, err)
+			return cleanupAdapter{a, func() { os.RemoveAll(dir) }}
+		},
+		// lines are trimmed periodically
+		Unbounded: true,
+		Processes: true,
+		Metadata:  true,
+	})
+}
+
+func TestConformanceTiered(t *testing.T) {
+	defer storeMetadata()()
+	defer useTempLogRoot(t)()
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, lines int) storage.Adapter {
+			cold, err := storage.NewFileAdapter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, err := storage.NewTieredAdapter(lines, cold)
+			return newStarted(t, a, err)
+		},
+		Unbounded: true,
+		Metadata:  true,
+	})
+}
+
+func TestConformanceMulti(t *testing.T) {
+	defer storeMetadata()()
+	defer useTempLogRoot(t)()
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, lines int) storage.Adapter {
+			a, err := storage.NewMultiAdapter([]string{"memory", "file"}, lines)
+			return newStarted(t, a, err)
+		},
+		Metadata: true,
+	})
+}
+
+func TestConformanceBreaker(t *testing.T) {
+	defer storeMetadata()()
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, lines int) storage.Adapter {
+			primary, err := storage.NewRingBufferAdapter(lines)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fallback, err := storage.NewRingBufferAdapter(lines)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, err := storage.NewBreakerAdapter(primary, fallback, 5, time.Second)
+			return newStarted(t, a, err)
+		},
+		Metadata: true,
+	})
+}
+
+// redisPushStandIn is a Go stand-in for the redis adapter's push script
+func redisPushStandIn(call func(...string) (interface{}, error), keys []string, args []string) (interface{}, error) {
+	exists, err := call("EXISTS", keys[1])
+	if err != nil {
+		return nil, err
+	}
+	if exists == int64(0) {
+		n, err := call("LLEN", keys[0])
+		if err != nil {
+			return nil, err
+		}
+		if typ, err := call("TYPE", keys[2]); err != nil {
+			return nil, err
+		} else if typ == storagetest.Status("string") {
+			if n, err = call("GET", keys[2]); err != nil {
+				return nil, err
+			}
+			if _, err := call("DEL", keys[2]); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := call("SET", keys[1], fmt.Sprint(n)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := call("RPUSH", keys[0], args[0]); err != nil {
+		return nil, err
+	}
+	return call("INCR", keys[1])
+}
+
+// redisReadStandIn is a Go stand-in for the redis adapter's read script
+func redisReadStandIn(call func(...string) (interface{}, error), keys []string, args []string) (interface{}, error) {
+	reply, err := call("LLEN", keys[0])
+	if err != nil {
+		return nil, err
+	}
+	n := reply.(int64)
+	if reply, err = call("GET", keys[1]); err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		if typ, err := call("TYPE", keys[2]); err != nil {
+			return nil, err
+		} else if typ == storagetest.Status("string") {
+			if reply, err = call("GET", keys[2]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	seq := n
+	if reply != nil {
+		seq, _ = strconv.ParseInt(reply.(string), 10, 64)
+	}
+	first := seq - n + 1
+	chunk, _ := strconv.ParseInt(args[2], 10, 64)
+	var from, to int64
+	if args[0] == "after" {
+		cursor, _ := strconv.ParseInt(args[1], 10, 64)
+		if from = cursor + 1 - first; from < 0 {
+			from = 0
+		}
+		to = from + chunk - 1
+	} else {
+		to = n - 1
+		if args[1] != "" {
+			cursor, _ := strconv.ParseInt(args[1], 10, 64)
+			if cursor-1-first < to {
+				to = cursor - 1 - first
+			}
+		}
+		if from = to - chunk + 1; from < 0 {
+			from = 0
+		}
+	}
+	if to < from {
+		return []interface{}{first + from, []interface{}{}}, nil
+	}
+	lines, err := call("LRANGE", keys[0], fmt.Sprint(from), fmt.Sprint(to))
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{first + from, lines}, nil
+}
+
+// newRedis starts a redis stand-in running Go stand-ins for the redis adapter's scripts, and
+// configures the redis adapters to use it, returning a function that unsets their configuration
+func newRedis(t *testing.T) (*storagetest.Redis, func()) {
+	s, err := storagetest.NewRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.HandleScript(storage.RedisPushScript, redisPushStandIn)
+	s.HandleScript(storage.RedisReadScript, redisReadStandIn)
+	s.HandleScript(storage.RedisInfoScript, func(call func(...string) (interface{}, error), keys []string, args []string) (interface{}, error) {
+		if typ, err := call("TYPE", keys[0]); err != nil || typ != storagetest.Status("list") {
+			return []interface{}{}, err
+		}
+		bytes, _ := call("MEMORY", "USAGE", keys[0])
+		if _, ok := bytes.(int64); !ok {
+			bytes = int64(0)
+		}
+		lines, err := call("LLEN", keys[0])
+		if err != nil {
+			return nil, err
+		}
+		last, err := call("LINDEX", keys[0], "-1")
+		if err != nil {
+			return nil, err
+		}
+		if last == nil {
+			last = ""
+		}
+		return []interface{}{lines, bytes, last}, nil
+	})
+	// other tests may leave the rest of the configuration set to empty strings
+	return s, setenv(map[string]string{
+		"DEIS_LOGGER_REDIS_SERVICE_HOST":             s.Host(),
+		"DEIS_LOGGER_REDIS_SERVICE_PORT":             strconv.Itoa(s.Port()),
+		"DEIS_LOGGER_REDIS_PASSWORD":                 "",
+		"DEIS_LOGGER_REDIS_DB":                       "0",
+		"DEIS_LOGGER_REDIS_PIPELINE_LENGTH":          "50",
+		"DEIS_LOGGER_REDIS_PIPELINE_TIMEOUT_SECONDS": "1",
+	})
+}
+
+// storeMetadata has every adapter that can store the metadata of lines along with them do so,
+// returning a function that turns it off
+func storeMetadata() func() {
+	return setenv(map[string]string{
+		"DEIS_LOGGER_METADATA_ADAPTERS": "memory,file,bolt,redis,redis-streams,s3",
+	})
+}
+
+// setenv sets environment variables, returning a function that restores their previous values
+func setenv(env map[string]string) func() {
+	previous := map[string]*string{}
+	for key, value := range env {
+		if old, ok := os.LookupEnv(key); ok {
+			previous[key] = &old
+		} else {
+			previous[key] = nil
+		}
+		os.Setenv(key, value)
+	}
+	return func() {
+		for key, old := range previous {
+			if old != nil {
+				os.Setenv(key, *old)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	}
+}
+
+// flushTimeout bounds how long flushRedis waits for the redis adapters to send their pipelines
+const flushTimeout = 10 * time.Second
+
+// flushRedis waits for the redis adapters to send their pipelines, which they do every second,
+// by writing a line to an app of its own and polling until it can be read. Pipelines are sent in
+// the order lines are written, so every line written before it can be read too.
+func flushRedis(t *testing.T, a storage.Adapter) {
+	app := fmt.Sprintf("storagetest-flush-%d", time.Now().UnixNano())
+	defer a.Destroy(context.Background(), app)
+	if err := a.Write(context.Background(), app, "flushed"); err != nil {
+		t.Fatalf("writing to %s: %s", app, err)
+	}
+	for deadline := time.Now().Add(flushTimeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if page, err := a.Read(context.Background(), app, storage.ReadOptions{Lines: 1}); err == nil && len(page.Lines) == 1 {
+			return
+		}
+	}
+	t.Fatalf("the redis pipelines weren't sent within %s", flushTimeout)
+}
+
+// redisServer runs commands against the redis the redis adapters are configured to use
+type redisServer interface {
+	Do(args ...string) (interface{}, error)
+}
+
+func TestConformanceRedis(t *testing.T) {
+	s, unsetenv := newRedis(t)
+	defer s.Close()
+	defer unsetenv()
+	testConformanceRedis(t)
+}
+
+func testConformanceRedis(t *testing.T) {
+	defer storeMetadata()()
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, lines int) storage.Adapter {
+			a, err := storage.NewRedisStorageAdapter(lines)
+			return newStarted(t, a, err)
+		},
+		Flush:    flushRedis,
+		Metadata: true,
+	})
+}
+
+func TestRedisKeys(t *testing.T) {
+	s, unsetenv := newRedis(t)
+	defer s.Close()
+	defer unsetenv()
+	testRedisKeys(t, s)
+}
+
+func testRedisKeys(t *testing.T, s redisServer) {
+	a, err := storage.NewRedisStorageAdapter(10)
+	a = newStarted(t, a, err)
+	defer a.Stop()
+	// the counters of apps don't collide with apps named like them, and redis losing its scripts
+	// doesn't lose lines
+	for i, app := range []string{"foo:seq", "foo", "logger"} {
+		if i > 0 {
+			if _, err := s.Do("SCRIPT", "FLUSH"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, line := range []string{"1", "2"} {
+			if err := a.Write(context.Background(), app, line); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushRedis(t, a)
+	}
+	for _, app := range []string{"foo:seq", "foo", "logger"} {
+		page, err := a.Read(context.Background(), app, storage.ReadOptions{Lines: 10})
+		if err != nil {
+			t.Fatalf("reading %s: %s", app, err)
+		}
+		if !reflect.DeepEqual(page.Lines, []string{"1", "2"}) || !reflect.DeepEqual(page.Cursors, []string{"1", "2"}) {
+			t.Errorf("unexpected page of %s: %+v", app, page)
+		}
+	}
+	// destroying an app leaves the app named like the key its lines used to be counted at
+	if err := a.Destroy(context.Background(), "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Read(context.Background(), "foo:seq", storage.ReadOptions{Lines: 10}); err != nil {
+		t.Errorf("reading foo:seq after destroying foo: %s", err)
+	}
+	// lines counted at the key they used to be counted at are counted on from there
+	for _, cmd := range [][]string{{"RPUSH", "bar", "1"}, {"SET", "bar:seq", "100"}} {
+		if _, err := s.Do(cmd...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Write(context.Background(), "bar", "2"); err != nil {
+		t.Fatal(err)
+	}
+	flushRedis(t, a)
+	page, err := a.Read(context.Background(), "bar", storage.ReadOptions{Lines: 10})
+	if err != nil {
+		t.Fatalf("reading bar: %s", err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"1", "2"}) || !reflect.DeepEqual(page.Cursors, []string{"100", "101"}) {
+		t.Errorf("unexpected page of bar: %+v", page)
+	}
+	if err := a.Destroy(context.Background(), "bar"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConformanceRedisCompressed(t *testing.T) {
+	s, unsetenv := newRedis(t)
+	defer s.Close()
+	defer unsetenv()
+	testConformanceRedisCompressed(t)
+}
+
+func testConformanceRedisCompressed(t *testing.T) {
+	defer useCompression(t)()
+	testConformanceRedis(t)
+}
+
+func TestConformanceRedisStreams(t *testing.T) {
+	defer storeMetadata()()
+	s, unsetenv := newRedis(t)
+	defer s.Close()
+	defer unsetenv()
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, lines int) storage.Adapter {
+			a, err := storage.NewRedisStreamsAdapter(lines)
+			return newStarted(t, a, err)
+		},
+		Flush: flushRedis,
+		// streams are trimmed approximately
+		Unbounded: true,
+		Metadata:  true,
+	})
+}
+
+// lineRegexp matches a line's timestamp, pod, process type and message
+var lineRegexp = regexp.MustCompile(`^(\S+) [^\s\[]+\[(([^\].]+)[^\]]*)\]: (.*)$`)
+
+func TestBreakerRedisDown(t *testing.T) {
+	s, unsetenv := newRedis(t)
+	defer unsetenv()
+	primary, err := storage.NewRedisStorageAdapter(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback, err := storage.NewRingBufferAdapter(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := storage.NewBreakerAdapter(primary, fallback, 3, time.Hour)
+	a = newStarted(t, a, err)
+	defer a.Stop()
+	if err := a.Write(context.Background(), "foo", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// writes to redis are only queued, so the breaker opens as redis can't be reached
+	s.Close()
+	state := ""
+	for deadline := time.Now().Add(5 * time.Second); state != "open" && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err := a.Write(context.Background(), "foo", "2"); err != nil {
+			t.Fatal(err)
+		}
+		state = storage.Status(a)["breaker"].(map[string]interface{})["state"].(string)
+	}
+	if state != "open" {
+		t.Fatalf("expected the breaker to open once redis went down, got %s", state)
+	}
+	page, err := a.Read(context.Background(), "foo", storage.ReadOptions{Lines: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"2"}) || !strings.HasPrefix(page.Before(), "fallback:") {
+		t.Errorf("expected the lines written since redis went down to be read from the fallback, got %+v", page)
+	}
+}
+
+func TestWALRedisAcks(t *testing.T) {
+	s, unsetenv := newRedis(t)
+	defer s.Close()
+	defer unsetenv()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	// pipelines are sent hourly, so lines are only read once the log sent them synchronously
+	defer setenv(map[string]string{
+		"DEIS_LOGGER_REDIS_PIPELINE_TIMEOUT_SECONDS": "3600",
+		"DEIS_LOGGER_WAL_ADAPTER":                    "redis",
+		"DEIS_LOGGER_WAL_PATH":                       dir,
+		"DEIS_LOGGER_WAL_RETRY_INTERVAL_SECONDS":     "1",
+	})()
+	var failing, refused int32 = 1, 0
+	s.HandleScript(storage.RedisPushScript, func(call func(...string) (interface{}, error), keys []string, args []string) (interface{}, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			atomic.AddInt32(&refused, 1)
+			return nil, errors.New("OOM command not allowed when used memory > 'maxmemory'")
+		}
+		return redisPushStandIn(call, keys, args)
+	})
+	a, err := storage.NewAdapter("wal", 10)
+	a = newStarted(t, a, err)
+	defer a.Stop()
+	lines := []string{"1", "2", "3"}
+	for _, line := range lines {
+		if err := a.Write(context.Background(), "foo", line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the lines redis refused are replayed again once it stores them
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&refused) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the write-ahead log didn't replay its lines")
+		}
+	}
+	atomic.StoreInt32(&failing, 0)
+	var page *storage.Page
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if page, err = a.Read(context.Background(), "foo", storage.ReadOptions{Lines: 10}); err == nil && reflect.DeepEqual(page.Lines, lines) {
+			return
+		}
+	}
+	t.Fatalf("expected the lines %v to be replayed, got %+v (%v)", lines, page, err)
+}
+
+func TestConformanceElasticsearch(t *testing.T) {
+	s := storagetest.NewElasticsearch()
+	defer s.Close()
+	defer setenv(map[string]string{
+		"DEIS_LOGGER_ELASTICSEARCH_SERVICE_HOST": s.Host(),
+		"DEIS_LOGGER_ELASTICSEARCH_SERVICE_PORT": strconv.Itoa(s.Port()),
+	})()
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, lines int) storage.Adapter {
+			a, err := storage.NewESStorageAdapter()
+			return newStarted(t, a, err)
+		},
+		// lines are indexed the way the fluentd kubernetes plugin indexes them
+		Write: func(a storage.Adapter, app string, line string) error {
+			match := lineRegexp.FindStringSubmatch(line)
+			if match == nil {
+				return fmt.Errorf("unexpected line %q", line)
+			}
+			s.Index("deis-"+app, map[string]interface{}{
+				"@timestamp": match[1],
+				"log":        match[4],
+				"kubernetes": map[string]interface{}{
+					"labels":    map[string]interface{}{"app": app},
+					"pod":       map[string]interface{}{"name": match[2]},
+					"container": map[string]interface{}{"name": app + "-" + match[3]},
+				},
+			})
+			return nil
+		},
+		// the lines searched are as many as are read
+		Unbounded: true,
+		Processes: true,
+		ReadOnly:  true,
+	})
+}
+
+func TestElasticsearchRetention(t *testing.T) {
+	s := storagetest.NewElasticsearch()
+	defer s.Close()
+	defer setenv(map[string]string{
+		"DEIS_LOGGER_ELASTICSEARCH_SERVICE_HOST":              s.Host(),
+		"DEIS_LOGGER_ELASTICSEARCH_SERVICE_PORT":              strconv.Itoa(s.Port()),
+		"DEIS_LOGGER_ELASTICSEARCH_RETENTION_MAX_AGE_SECONDS": "3600",
+	})()
+	a, err := storage.NewESStorageAdapter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for _, app := range []string{"foo", "bar"} {
+		for i, age := range []time.Duration{3 * time.Hour, 30 * time.Minute, time.Minute} {
+			s.Index("deis-"+app, map[string]interface{}{
+				"@timestamp": now.Add(-age).Format(time.RFC3339Nano),
+				"log":        fmt.Sprintf("message %d", i),
+				"kubernetes": map[string]interface{}{
+					"labels": map[string]interface{}{"app": app},
+					"pod":    map[string]interface{}{"name": app + "-web-v2-nzf60"},
+				},
+			})
+		}
+	}
+	if err := storage.SetRetention(a, "bar", storage.Retention{MaxAge: 10 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SetRetention(a, "bar", storage.Retention{Lines: 10}); err == nil {
+		t.Error("expected an error for a retention limiting lines")
+	}
+	if err := storage.EnforceElasticsearchRetention(a); err != nil {
+		t.Fatal(err)
+	}
+	for app, expected := range map[string]int{"foo": 2, "bar": 1} {
+		page, err := a.Read(context.Background(), app, storage.ReadOptions{Lines: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Lines) != expected {
+			t.Errorf("expected %d lines of %s to be kept, got %v", expected, app, page.Lines)
+		}
+	}
+}
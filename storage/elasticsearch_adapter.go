@@ -5,15 +5,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"reflect"
+	"net/http"
+	"strings"
+	"time"
 
 	"gopkg.in/olivere/elastic.v5"
 )
 
+// esMaxApps is the maximum number of apps listed by a terms aggregation
+const esMaxApps = 10000
+
 type elasticsearchAdapter struct {
-	started       bool
-	esClient      *elastic.Client
-	indexTemplate string
+	started           bool
+	esClient          *elastic.Client
+	indexTemplate     string
+	timeout           time.Duration
+	retention         *retentions
+	retentionInterval time.Duration
+	stopCh            chan struct{}
 }
 
 // NewESStorageAdapter returns a pointer to a new instance of a elasticsearch-based storage.Adapter.
@@ -30,44 +39,112 @@ func NewESStorageAdapter() (Adapter, error) {
 		panic(err)
 	}
 	res := &elasticsearchAdapter{
-		started:       false,
-		esClient:      client,
-		indexTemplate: cfg.IndexTemplate,
+		started:           false,
+		esClient:          client,
+		indexTemplate:     cfg.IndexTemplate,
+		timeout:           cfg.Timeout,
+		retention:         newRetentions(Retention{MaxAge: cfg.RetentionMaxAge}),
+		retentionInterval: cfg.RetentionInterval,
+		stopCh:            make(chan struct{}),
 	}
 	return res, nil
 }
 
-// Start the storage adapter. Invocations of this function are not concurrency safe and multiple
-// serialized invocations have no effect.
+// Start the storage adapter. Documents older than the maximum age of their app are deleted
+// periodically in the background. Invocations of this function are not concurrency safe and
+// multiple serialized invocations have no effect.
 func (a *elasticsearchAdapter) Start() {
+	if !a.started {
+		a.started = true
+		if a.retentionInterval <= 0 {
+			return
+		}
+		go func() {
+			ticker := time.NewTicker(a.retentionInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-a.stopCh:
+					return
+				case <-ticker.C:
+					if err := a.enforceRetention(context.Background()); err != nil {
+						log.Printf("Error enforcing retention: %s", err)
+					}
+				}
+			}
+		}()
+	}
 }
 
-// Write adds a log message to to an app-specific list in redis using ring-buffer-like semantics
-func (a *elasticsearchAdapter) Write(app string, messageBody string) error {
+// Write is a no-op; lines are shipped to elasticsearch by the log collector rather than the logger
+func (a *elasticsearchAdapter) Write(ctx context.Context, app string, messageBody string) error {
 	return nil
 }
 
-// Read retrieves a specified number of log lines from an app-specific list in redis
-func (a *elasticsearchAdapter) Read(app string, lines int, process string) ([]string, error) {
-	ctx := context.Background()
+// Read retrieves a specified number of log lines from the app's index in elasticsearch. Documents
+// are filtered by the app label, or by container name for a process type, and by their @timestamp,
+// and are paged by search_after on their timestamp and uid, which make up cursors. The query is run
+// as a query_string query against the analyzed log field, so matching is case-insensitive and by
+// terms rather than by substrings. Context lines can't be read.
+func (a *elasticsearchAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	if opts.Context != 0 {
+		return nil, newErrInvalidArgument("Context lines are not supported by the elasticsearch storage adapter")
+	}
 	termQuery := elastic.NewTermQuery("kubernetes.labels.app", app)
-	if process != "" {
-		termQuery = elastic.NewTermQuery("kubernetes.container.name", fmt.Sprintf("%s-%s", app, process))
+	if opts.Process != "" {
+		termQuery = elastic.NewTermQuery("kubernetes.container.name", fmt.Sprintf("%s-%s", app, opts.Process))
 	}
-	searchResult, err := a.esClient.Search().
+	query := elastic.NewBoolQuery().Filter(termQuery)
+	if opts.timeBounded() {
+		rangeQuery := elastic.NewRangeQuery("@timestamp")
+		if !opts.Since.IsZero() {
+			rangeQuery = rangeQuery.Gte(opts.Since.Format(time.RFC3339Nano))
+		}
+		if !opts.Until.IsZero() {
+			rangeQuery = rangeQuery.Lt(opts.Until.Format(time.RFC3339Nano))
+		}
+		query = query.Filter(rangeQuery)
+	}
+	if opts.Query != "" {
+		query = query.Must(elastic.NewQueryStringQuery(esQueryString(opts)).DefaultField("log"))
+	}
+	// Reading after a cursor pages forward, every other read pages backward from the newest lines
+	ascending := opts.After != ""
+	search := a.esClient.Search().
 		Index(fmt.Sprintf(a.indexTemplate, app)).
-		Query(termQuery).
-		Sort("@timestamp", false).
-		Size(lines).
-		Do(ctx)
+		Query(query).
+		Sort("@timestamp", ascending).
+		Sort("_uid", ascending).
+		Size(opts.Lines)
+	if cursor := opts.Before + opts.After; cursor != "" {
+		var sortValues []interface{}
+		decoder := json.NewDecoder(strings.NewReader(cursor))
+		decoder.UseNumber()
+		if err := decoder.Decode(&sortValues); err != nil || len(sortValues) != 2 {
+			return nil, newErrInvalidArgument("Invalid cursor: %s", cursor)
+		}
+		search = search.SearchAfter(sortValues...)
+	}
+	searchCtx, cancel := withTimeout(ctx, a.timeout)
+	defer cancel()
+	searchResult, err := search.Do(searchCtx)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
-		return nil, err
+		return nil, esError(app, err)
 	}
 
-	results := []string{}
+	page := &Page{}
+	if searchResult.Hits == nil {
+		return nil, newErrNotFound(app)
+	}
 	var logStr string
-	for _, item := range searchResult.Each(reflect.TypeOf(map[string]interface{}{})) {
-		t := item.(map[string]interface{})
+	for _, hit := range searchResult.Hits.Hits {
+		t := map[string]interface{}{}
+		if err := json.Unmarshal(*hit.Source, &t); err != nil {
+			return nil, err
+		}
 		if v, ok := t["log"]; ok {
 			logStr = v.(string)
 		} else if v, ok := t["json"]; ok {
@@ -80,22 +157,160 @@ func (a *elasticsearchAdapter) Read(app string, lines int, process string) ([]st
 		kubernetes := t["kubernetes"].(map[string]interface{})
 		pod := kubernetes["pod"].(map[string]interface{})
 		name := pod["name"].(string)
-		results = append(results, fmt.Sprintf("%s %s[%s]: %s", t["@timestamp"].(string), app, name, logStr))
+		// the sort values of a hit are where a search after it continues
+		cursor, err := json.Marshal(hit.Sort)
+		if err != nil {
+			return nil, err
+		}
+		line := fmt.Sprintf("%s %s[%s]: %s", t["@timestamp"].(string), app, name, logStr)
+		page.addLine(line, esMetadata(t), string(cursor))
+	}
+	if !ascending {
+		page.reverse()
+	}
+
+	if len(page.Lines) > 0 {
+		return page, nil
+	}
+	return nil, newErrNotFound(app)
+}
+
+// esMetadata returns the metadata of the message a document was indexed from
+func esMetadata(doc map[string]interface{}) *Metadata {
+	field := func(path ...string) string {
+		var v interface{} = doc
+		for _, name := range path {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return ""
+			}
+			v = m[name]
+		}
+		s, _ := v.(string)
+		return s
+	}
+	t, _ := time.Parse(time.RFC3339Nano, field("@timestamp"))
+	return &Metadata{
+		Time:      t,
+		Namespace: field("kubernetes", "namespace_name"),
+		Pod:       field("kubernetes", "pod", "name"),
+		Container: field("kubernetes", "container", "name"),
+		Process:   field("kubernetes", "labels", "type"),
+		Version:   field("kubernetes", "labels", "version"),
+		Stream:    field("stream"),
+	}
+}
+
+// Apps lists the apps with documents in any of the app-specific indices using a terms aggregation,
+// along with their number of lines and the time of their newest line. The size of their lines is
+// not counted.
+func (a *elasticsearchAdapter) Apps(ctx context.Context) ([]AppInfo, error) {
+	agg := elastic.NewTermsAggregation().
+		Field("kubernetes.labels.app").
+		Size(esMaxApps).
+		SubAggregation("last_write", elastic.NewMaxAggregation().Field("@timestamp"))
+	ctx, cancel := withTimeout(ctx, a.timeout)
+	defer cancel()
+	searchResult, err := a.esClient.Search().
+		Index(fmt.Sprintf(a.indexTemplate, "*")).
+		Size(0).
+		Aggregation("apps", agg).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return []AppInfo{}, nil
+	}
+	if err != nil {
+		return nil, esError("", err)
+	}
+	apps := []AppInfo{}
+	terms, ok := searchResult.Aggregations.Terms("apps")
+	if !ok {
+		return apps, nil
+	}
+	for _, bucket := range terms.Buckets {
+		info := AppInfo{Name: fmt.Sprint(bucket.Key), Lines: bucket.DocCount}
+		// dates are aggregated as milliseconds since the epoch
+		if max, ok := bucket.Max("last_write"); ok && max.Value != nil {
+			info.LastWrite = time.Unix(0, int64(*max.Value)*int64(time.Millisecond))
+		}
+		apps = append(apps, info)
+	}
+	return apps, nil
+}
+
+// esError classifies an error returned by elasticsearch. An app without an index has no logs.
+func esError(app string, err error) error {
+	if elastic.IsNotFound(err) {
+		return newErrNotFound(app)
+	}
+	if e, ok := err.(*elastic.Error); ok {
+		switch e.Status {
+		case http.StatusTooManyRequests:
+			return newErrQuotaExceeded("elasticsearch", err)
+		case http.StatusBadRequest:
+			// such as a query_string query that can't be parsed
+			return newErrInvalidArgument("Invalid query: %s", err)
+		}
+	}
+	return newErrUnavailable("elasticsearch", err)
+}
+
+// esQueryString returns the query_string query for the options' query, either as a regular
+// expression or as a phrase
+func esQueryString(opts ReadOptions) string {
+	if opts.Regexp {
+		return "/" + strings.Replace(opts.Query, "/", "\\/", -1) + "/"
 	}
-	// reversing
-	for i := len(results)/2 - 1; i >= 0; i-- {
-		opp := len(results) - 1 - i
-		results[i], results[opp] = results[opp], results[i]
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(opts.Query) + `"`
+}
+
+// SetRetention overrides the maximum age of the documents kept for an app. Elasticsearch can't
+// limit the number or size of an app's documents.
+func (a *elasticsearchAdapter) SetRetention(app string, retention Retention) error {
+	if err := retention.limits("elasticsearch", false, false, true); err != nil {
+		return err
 	}
+	a.retention.set(app, retention)
+	return nil
+}
+
+// Retention returns the limits of the documents kept for an app
+func (a *elasticsearchAdapter) Retention(app string) Retention {
+	return a.retention.get(app)
+}
 
-	if len(results) > 0 {
-		return results, nil
+// enforceRetention deletes, for every app with a maximum age, the documents of its index that are
+// older than that with a delete-by-query request
+func (a *elasticsearchAdapter) enforceRetention(ctx context.Context) error {
+	if !a.retention.expires() {
+		return nil
+	}
+	apps, err := a.Apps(ctx)
+	if err != nil {
+		return err
 	}
-	return nil, fmt.Errorf("Could not find logs for '%s'", app)
+	now := time.Now()
+	for _, app := range apps {
+		maxAge := a.retention.get(app.Name).MaxAge
+		if maxAge <= 0 {
+			continue
+		}
+		query := elastic.NewBoolQuery().Filter(
+			elastic.NewTermQuery("kubernetes.labels.app", app.Name),
+			elastic.NewRangeQuery("@timestamp").Lt(now.Add(-maxAge).Format(time.RFC3339Nano)),
+		)
+		deleteCtx, cancel := withTimeout(ctx, a.timeout)
+		_, err := a.esClient.DeleteByQuery(fmt.Sprintf(a.indexTemplate, app.Name)).Query(query).Do(deleteCtx)
+		cancel()
+		if err != nil && !elastic.IsNotFound(err) {
+			return esError(app.Name, err)
+		}
+	}
+	return nil
 }
 
-// Destroy deletes an app-specific list from redis
-func (a *elasticsearchAdapter) Destroy(app string) error {
+// Destroy is a no-op; the app's index is managed by elasticsearch rather than the logger
+func (a *elasticsearchAdapter) Destroy(ctx context.Context, app string) error {
 	return nil
 }
 
@@ -106,4 +321,5 @@ func (a *elasticsearchAdapter) Reopen() error {
 
 // Stop the storage adapter. Additional writes may not be performed after stopping.
 func (a *elasticsearchAdapter) Stop() {
+	close(a.stopCh)
 }
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 )
 
@@ -9,9 +11,16 @@ const (
 )
 
 type esconfig struct {
-	Host          string `envconfig:"DEIS_LOGGER_ELASTICSEARCH_SERVICE_HOST" default:"localhost"`
-	Port          int    `envconfig:"DEIS_LOGGER_ELASTICSEARCH_SERVICE_PORT" default:"9200"`
-	IndexTemplate string `envconfig:"DEIS_LOGGER_ELASTICSEARCH_INDEX_TEMPLATE" default:"deis-%s"`
+	Host           string `envconfig:"DEIS_LOGGER_ELASTICSEARCH_SERVICE_HOST" default:"localhost"`
+	Port           int    `envconfig:"DEIS_LOGGER_ELASTICSEARCH_SERVICE_PORT" default:"9200"`
+	IndexTemplate  string `envconfig:"DEIS_LOGGER_ELASTICSEARCH_INDEX_TEMPLATE" default:"deis-%s"`
+	TimeoutSeconds int    `envconfig:"DEIS_LOGGER_ELASTICSEARCH_TIMEOUT_SECONDS" default:"10"`
+	// RetentionMaxAgeSeconds is the default maximum age of the documents kept for an app
+	RetentionMaxAgeSeconds   int `envconfig:"DEIS_LOGGER_ELASTICSEARCH_RETENTION_MAX_AGE_SECONDS" default:"0"`
+	RetentionIntervalSeconds int `envconfig:"DEIS_LOGGER_ELASTICSEARCH_RETENTION_INTERVAL_SECONDS" default:"3600"`
+	Timeout                  time.Duration
+	RetentionMaxAge          time.Duration
+	RetentionInterval        time.Duration
 }
 
 func parseESConfig(appName string) (*esconfig, error) {
@@ -19,5 +28,8 @@ func parseESConfig(appName string) (*esconfig, error) {
 	if err := envconfig.Process(appName, ret); err != nil {
 		return nil, err
 	}
+	ret.Timeout = time.Duration(ret.TimeoutSeconds) * time.Second
+	ret.RetentionMaxAge = time.Duration(ret.RetentionMaxAgeSeconds) * time.Second
+	ret.RetentionInterval = time.Duration(ret.RetentionIntervalSeconds) * time.Second
 	return ret, nil
 }
@@ -68,7 +68,7 @@ func TestESReadFromNonExistingApp(t *testing.T) {
 	}
 
 	// No logs have been written; there should be no elasticsearch list for app
-	messages, err := a.Read(otherApp, 10, "")
+	messages, err := readLines(a.Read(context.Background(), otherApp, ReadOptions{Lines: 10}))
 	if messages != nil {
 		t.Error("Expected no messages, but got some")
 	}
@@ -134,7 +134,7 @@ func TestESLogs(t *testing.T) {
 	// there are 50 queued up OR a 1 second timeout has been reached.
 	time.Sleep(time.Second * 3)
 	// Read more logs than there are
-	messages, err := a.Read(app, 8, "")
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 8}))
 	if err != nil {
 		t.Error(err)
 	}
@@ -143,7 +143,7 @@ func TestESLogs(t *testing.T) {
 		t.Errorf("only expected 5 log messages, got %d", len(messages))
 	}
 	// Read fewer logs than there are
-	messages, err = a.Read(app, 3, "")
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 3}))
 	if err != nil {
 		t.Error(err)
 	}
@@ -216,7 +216,7 @@ func TestESLogsWithProcess(t *testing.T) {
 	// there are 50 queued up OR a 1 second timeout has been reached.
 	time.Sleep(time.Second * 3)
 	// Read more logs than there are
-	messages, err := a.Read(app, 8, "cmd")
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 8, Process: "cmd"}))
 	if err != nil {
 		t.Error(err)
 	}
@@ -225,7 +225,7 @@ func TestESLogsWithProcess(t *testing.T) {
 		t.Errorf("only expected 5 log messages, got %d", len(messages))
 	}
 	// Read fewer logs than there are
-	messages, err = a.Read(app, 3, "")
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 3}))
 	if err != nil {
 		t.Error(err)
 	}
@@ -240,7 +240,7 @@ func TestESLogsWithProcess(t *testing.T) {
 		}
 	}
 
-	messages, err = a.Read(app, 8, "web")
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 8, Process: "web"}))
 	if err != nil {
 		t.Error(err)
 	}
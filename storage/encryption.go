@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// keyringJSON is how a keyring is read from a keyfile or the environment. Apps and namespaces map
+// to their keys, newest first: the first key encrypts new lines and the others decrypt lines
+// encrypted with them, so keys can be rotated. An empty list of keys shreds the logs of an app or
+// namespace, whose lines are then dropped. Key IDs are unique across the keyring, e.g.
+// {"apps": {"payments": [{"id": "payments-2", "key": "<base64>"}, {"id": "payments-1", ...}]},
+// "namespaces": {"tenant-a": [{"id": "tenant-a-1", "key": "<base64>"}]}}
+type keyringJSON struct {
+	Apps       map[string][]keyJSON `json:"apps"`
+	Namespaces map[string][]keyJSON `json:"namespaces"`
+}
+
+type keyJSON struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// encryptionKey is an AES key along with the ID stored with every line it encrypts
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// keys holds the keys of a keyring by app, by namespace and by ID, along with the tombstones of the
+// apps, namespaces and keys that were shredded. Lines of shredded apps and namespaces are dropped
+// rather than stored unencrypted, and shredded keys are never used again.
+type keys struct {
+	apps               map[string]*encryptionKey
+	namespaces         map[string]*encryptionKey
+	byID               map[string]*encryptionKey
+	shreddedApps       map[string]bool
+	shreddedNamespaces map[string]bool
+	shreddedIDs        map[string]bool
+}
+
+func newKeys() *keys {
+	return &keys{
+		apps:               make(map[string]*encryptionKey),
+		namespaces:         make(map[string]*encryptionKey),
+		byID:               make(map[string]*encryptionKey),
+		shreddedApps:       make(map[string]bool),
+		shreddedNamespaces: make(map[string]bool),
+		shreddedIDs:        make(map[string]bool),
+	}
+}
+
+// add adds the keys of a keyring read from the given source, which names it in errors
+func (k *keys) add(source string, data []byte) error {
+	var kj keyringJSON
+	if err := json.Unmarshal(data, &kj); err != nil {
+		return fmt.Errorf("Error reading the keyring of %s: %s", source, err)
+	}
+	for _, scope := range []struct {
+		keys     map[string][]keyJSON
+		current  map[string]*encryptionKey
+		shredded map[string]bool
+	}{{kj.Apps, k.apps, k.shreddedApps}, {kj.Namespaces, k.namespaces, k.shreddedNamespaces}} {
+		for name, keys := range scope.keys {
+			if len(keys) == 0 {
+				scope.shredded[name] = true
+			}
+			for i, key := range keys {
+				parsed, err := parseEncryptionKey(key)
+				if err != nil {
+					return fmt.Errorf("Error reading the keyring of %s: %s", source, err)
+				}
+				if _, ok := k.byID[key.ID]; ok {
+					return fmt.Errorf("Error reading the keyring of %s: the key ID %q is used twice", source, key.ID)
+				}
+				k.byID[key.ID] = parsed
+				if i == 0 {
+					scope.current[name] = parsed
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// inherit keeps the tombstones of the previous keys, and shreds the apps, namespaces and keys that
+// were removed from the keyring since
+func (k *keys) inherit(previous *keys) {
+	for _, scope := range []struct {
+		current, previous          map[string]*encryptionKey
+		shredded, previousShredded map[string]bool
+	}{
+		{k.apps, previous.apps, k.shreddedApps, previous.shreddedApps},
+		{k.namespaces, previous.namespaces, k.shreddedNamespaces, previous.shreddedNamespaces},
+		{k.byID, previous.byID, k.shreddedIDs, previous.shreddedIDs},
+	} {
+		for name := range scope.previous {
+			if _, ok := scope.current[name]; !ok {
+				scope.shredded[name] = true
+			}
+		}
+		for name := range scope.previousShredded {
+			scope.shredded[name] = true
+		}
+	}
+	// a shredded key brought back, say from a backup, stays shredded
+	for id := range k.shreddedIDs {
+		delete(k.byID, id)
+	}
+	for _, scope := range []struct {
+		current  map[string]*encryptionKey
+		shredded map[string]bool
+	}{{k.apps, k.shreddedApps}, {k.namespaces, k.shreddedNamespaces}} {
+		for name, key := range scope.current {
+			if k.shreddedIDs[key.id] {
+				delete(scope.current, name)
+				scope.shredded[name] = true
+			}
+		}
+	}
+}
+
+func parseEncryptionKey(key keyJSON) (*encryptionKey, error) {
+	if key.ID == "" || len(key.ID) > 255 {
+		return nil, fmt.Errorf("invalid key ID %q", key.ID)
+	}
+	secret, err := base64.StdEncoding.DecodeString(key.Key)
+	if err != nil {
+		return nil, fmt.Errorf("the key %s isn't base64 encoded", key.ID)
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, fmt.Errorf("the key %s isn't an AES key: %s", key.ID, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionKey{id: key.ID, aead: aead}, nil
+}
+
+// keyring holds the keys encrypting the lines of apps, merged from a keyfile and the environment.
+// The keyfile is read again once it changes, so keys can be rotated and destroyed while the service
+// runs. A destroyed key makes the lines it encrypted unrecoverable, and an app or namespace whose
+// keys are all destroyed is shredded until the service restarts, unless the keyfile lists it
+// without keys.
+type keyring struct {
+	keyfile       string
+	env           string
+	checkInterval time.Duration
+	mutex         sync.RWMutex
+	keys          *keys
+	checked       time.Time
+	modTime       time.Time
+}
+
+// newKeyring returns the keyring configured by the environment, or nil if no keys are configured
+func newKeyring(cfg *encryptionConfig) (*keyring, error) {
+	if cfg.Keyfile == "" && cfg.Keyring == "" {
+		return nil, nil
+	}
+	k := &keyring{keyfile: cfg.Keyfile, env: cfg.Keyring, checkInterval: cfg.KeyfileCheckInterval}
+	if cfg.Keyfile != "" {
+		// lines aren't stored unencrypted because the keyfile wasn't mounted
+		if _, err := os.Stat(cfg.Keyfile); err != nil {
+			return nil, fmt.Errorf("Error reading the encryption keyfile: %s", err)
+		}
+	}
+	var err error
+	if k.keys, k.modTime, err = k.load(); err != nil {
+		return nil, err
+	}
+	k.checked = time.Now()
+	return k, nil
+}
+
+// load reads the keys of the keyfile and the environment
+func (k *keyring) load() (*keys, time.Time, error) {
+	keys := newKeys()
+	var modTime time.Time
+	if k.keyfile != "" {
+		fi, err := os.Stat(k.keyfile)
+		if err == nil {
+			modTime = fi.ModTime()
+			var data []byte
+			if data, err = ioutil.ReadFile(k.keyfile); err == nil {
+				err = keys.add(k.keyfile, data)
+			}
+		}
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	if k.env != "" {
+		if err := keys.add("DEIS_LOGGER_ENCRYPTION_KEYRING", []byte(k.env)); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return keys, modTime, nil
+}
+
+// current returns the keys, reading the keyfile again if it changed since it was last checked. The
+// previous keys are kept if it can't be read or is gone, as it is while a volume is remounted.
+func (k *keyring) current() *keys {
+	k.mutex.RLock()
+	keys, checked := k.keys, k.checked
+	k.mutex.RUnlock()
+	if k.keyfile == "" || time.Since(checked) < k.checkInterval {
+		return keys
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.checked != checked {
+		// another goroutine checked meanwhile
+		return k.keys
+	}
+	k.checked = time.Now()
+	fi, err := os.Stat(k.keyfile)
+	if err != nil {
+		log.Printf("Error reloading the encryption keys, keeping the previous ones: %s", err)
+		return k.keys
+	}
+	if fi.ModTime().Equal(k.modTime) {
+		return k.keys
+	}
+	loaded, modTime, err := k.load()
+	if err != nil {
+		log.Printf("Error reloading the encryption keys, keeping the previous ones: %s", err)
+		return k.keys
+	}
+	log.Printf("Reloaded the encryption keys of %s", k.keyfile)
+	loaded.inherit(k.keys)
+	k.keys, k.modTime = loaded, modTime
+	return k.keys
+}
+
+// key returns the key encrypting the lines of an app, or of the namespace it was logged in, or nil
+// if its lines aren't encrypted. It reports whether the app or namespace was shredded instead.
+func (k *keyring) key(app string, namespace string) (*encryptionKey, bool) {
+	keys := k.current()
+	if key, ok := keys.apps[app]; ok {
+		return key, false
+	}
+	if keys.shreddedApps[app] {
+		return nil, true
+	}
+	if namespace == "" {
+		return nil, false
+	}
+	if key, ok := keys.namespaces[namespace]; ok {
+		return key, false
+	}
+	return nil, keys.shreddedNamespaces[namespace]
+}
+
+// seal encrypts data with a key, binding it to the app it belongs to. It returns the length of the
+// key's ID, the ID itself, a random nonce and the ciphertext.
+func (k *keyring) seal(key *encryptionKey, app string, data []byte) ([]byte, error) {
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append([]byte{byte(len(key.id))}, key.id...)
+	sealed = append(sealed, nonce...)
+	return key.aead.Seal(sealed, nonce, data, []byte(app)), nil
+}
+
+// open decrypts data sealed for an app, failing if its key is no longer in the keyring
+func (k *keyring) open(app string, sealed []byte) ([]byte, error) {
+	if len(sealed) == 0 || len(sealed) < 1+int(sealed[0]) {
+		return nil, fmt.Errorf("truncated encrypted line")
+	}
+	id := string(sealed[1 : 1+sealed[0]])
+	sealed = sealed[1+len(id):]
+	key, ok := k.current().byID[id]
+	if !ok {
+		return nil, fmt.Errorf("the key %s is not in the keyring", id)
+	}
+	if len(sealed) < key.aead.NonceSize() {
+		return nil, fmt.Errorf("truncated encrypted line")
+	}
+	nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+	return key.aead.Open(nil, nonce, ciphertext, []byte(app))
+}
@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type encryptionConfig struct {
+	Keyfile                     string `envconfig:"DEIS_LOGGER_ENCRYPTION_KEYFILE" default:""`
+	Keyring                     string `envconfig:"DEIS_LOGGER_ENCRYPTION_KEYRING" default:""`
+	KeyfileCheckIntervalSeconds int    `envconfig:"DEIS_LOGGER_ENCRYPTION_KEYFILE_CHECK_INTERVAL_SECONDS" default:"10"`
+	KeyfileCheckInterval        time.Duration
+}
+
+func parseEncryptionConfig(appName string) (*encryptionConfig, error) {
+	ret := new(encryptionConfig)
+	if err := envconfig.Process(appName, ret); err != nil {
+		return nil, err
+	}
+	ret.KeyfileCheckInterval = time.Duration(ret.KeyfileCheckIntervalSeconds) * time.Second
+	return ret, nil
+}
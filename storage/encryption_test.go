@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestKey(t *testing.T, id string) keyJSON {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	return keyJSON{ID: id, Key: base64.StdEncoding.EncodeToString(secret)}
+}
+
+func keyringString(t *testing.T, kj keyringJSON) string {
+	data, err := json.Marshal(kj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// writeKeyfile replaces a keyfile, making sure that its modification time changes
+func writeKeyfile(t *testing.T, keyfile string, kj keyringJSON) {
+	modTime := time.Now()
+	if fi, err := os.Stat(keyfile); err == nil {
+		modTime = fi.ModTime().Add(time.Second)
+	}
+	if err := ioutil.WriteFile(keyfile, []byte(keyringString(t, kj)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(keyfile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestEncryptingCodec(t *testing.T, text bool, algorithm string, cfg *encryptionConfig) *lineCodec {
+	c, err := newLineCodec(&compressionConfig{Algorithm: algorithm, Level: "default"}, cfg, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	cfg := &encryptionConfig{Keyring: keyringString(t, keyringJSON{Apps: map[string][]keyJSON{app: {newTestKey(t, "key-1")}}})}
+	for _, text := range []bool{false, true} {
+		for _, algorithm := range []string{"none", "zstd"} {
+			c := newTestEncryptingCodec(t, text, algorithm, cfg)
+			stored, err := c.encode(app, "", compressibleLine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(stored, "healthz") || (text && strings.Contains(stored, "\n")) {
+				t.Errorf("Expected %q to be encrypted, got %q", compressibleLine, stored)
+			}
+			if line, ok := c.decode(app, stored); !ok || line != compressibleLine {
+				t.Errorf("Expected %q, got %q", compressibleLine, line)
+			}
+			// lines are bound to their app
+			if _, ok := c.decode("other-app", stored); ok {
+				t.Error("Expected a line of another app not to be decrypted")
+			}
+			// apps without a key aren't encrypted
+			if stored, _ := c.encode("other-app", "", "short"); stored != "short" {
+				t.Errorf("Expected a line of an app without a key to be stored as it is, got %q", stored)
+			}
+		}
+	}
+}
+
+func TestEncryptionNamespaceKeys(t *testing.T) {
+	cfg := &encryptionConfig{Keyring: keyringString(t, keyringJSON{Namespaces: map[string][]keyJSON{"tenant": {newTestKey(t, "tenant-1")}}})}
+	c := newTestEncryptingCodec(t, false, "none", cfg)
+	stored, err := c.encode(app, "tenant", "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == "message" {
+		t.Error("Expected a line logged in a namespace with a key to be encrypted")
+	}
+	if line, ok := c.decode(app, stored); !ok || line != "message" {
+		t.Errorf("Expected %q, got %q", "message", line)
+	}
+	if stored, _ := c.encode(app, "", "message"); stored != "message" {
+		t.Errorf("Expected a line without a namespace to be stored as it is, got %q", stored)
+	}
+}
+
+func TestEncryptionKeyRotationAndDestruction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyfile := path.Join(dir, "keys.json")
+	first, second := newTestKey(t, "key-1"), newTestKey(t, "key-2")
+	writeKeyfile(t, keyfile, keyringJSON{Apps: map[string][]keyJSON{app: {first}}})
+	c := newTestEncryptingCodec(t, true, "none", &encryptionConfig{Keyfile: keyfile})
+	before, err := c.encode(app, "", "before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keyfile is read again once it changes, and the new key encrypts new lines
+	writeKeyfile(t, keyfile, keyringJSON{Apps: map[string][]keyJSON{app: {second, first}}})
+	after, err := c.encode(app, "", "after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stored, expected := range map[string]string{before: "before", after: "after"} {
+		if line, ok := c.decode(app, stored); !ok || line != expected {
+			t.Errorf("Expected %q, got %q", expected, line)
+		}
+	}
+	// destroying a key makes the lines it encrypted unrecoverable
+	writeKeyfile(t, keyfile, keyringJSON{Apps: map[string][]keyJSON{app: {second}}})
+	if _, ok := c.decode(app, before); ok {
+		t.Error("Expected a line encrypted with a destroyed key not to be decrypted")
+	}
+	if line, ok := c.decode(app, after); !ok || line != "after" {
+		t.Errorf("Expected %q, got %q", "after", line)
+	}
+}
+
+func TestEncryptionFailsClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyfile := path.Join(dir, "keys.json")
+	// a keyfile that wasn't mounted doesn't leave lines unencrypted
+	if _, err := newKeyring(&encryptionConfig{Keyfile: keyfile}); err == nil {
+		t.Error("Expected a missing keyfile to be an error")
+	}
+	key := newTestKey(t, "key-1")
+	writeKeyfile(t, keyfile, keyringJSON{Apps: map[string][]keyJSON{app: {key}, "other-app": {newTestKey(t, "key-2")}}})
+	c := newTestEncryptingCodec(t, false, "none", &encryptionConfig{Keyfile: keyfile})
+	// the keys are kept while the keyfile is gone
+	if err := os.Remove(keyfile); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := c.encode(app, "", "line")
+	if err != nil || !strings.HasPrefix(stored, string([]byte{lineMarker, encryptedFormat})) {
+		t.Errorf("Expected the line to be encrypted while the keyfile is gone, got %q (%v)", stored, err)
+	}
+	// the lines of apps whose keys were destroyed are dropped, even once their keys are back
+	writeKeyfile(t, keyfile, keyringJSON{Apps: map[string][]keyJSON{"other-app": {newTestKey(t, "key-3")}}})
+	if _, err := c.encode(app, "", "line"); err != errShredded {
+		t.Errorf("Expected the line of a shredded app to be dropped, got %v", err)
+	}
+	writeKeyfile(t, keyfile, keyringJSON{Apps: map[string][]keyJSON{app: {key}, "other-app": {newTestKey(t, "key-3")}}})
+	if _, err := c.encode(app, "", "line"); err != errShredded {
+		t.Errorf("Expected the line of an app whose key was shredded to be dropped, got %v", err)
+	}
+	if _, ok := c.decode(app, stored); ok {
+		t.Error("Expected a line encrypted with a shredded key not to be decrypted")
+	}
+	// a new key makes the app's lines be stored again
+	writeKeyfile(t, keyfile, keyringJSON{Apps: map[string][]keyJSON{app: {newTestKey(t, "key-4")}, "other-app": {newTestKey(t, "key-3")}}})
+	if stored, err := c.encode(app, "", "line"); err != nil {
+		t.Error(err)
+	} else if line, ok := c.decode(app, stored); !ok || line != "line" {
+		t.Errorf("Expected %q, got %q", "line", line)
+	}
+	// apps and namespaces listed without keys are shredded from the start
+	shredded := newTestEncryptingCodec(t, false, "none", &encryptionConfig{Keyring: keyringString(t, keyringJSON{
+		Apps:       map[string][]keyJSON{app: {}},
+		Namespaces: map[string][]keyJSON{"tenant-a": {}},
+	})})
+	for _, namespace := range []string{"", "tenant-a"} {
+		if _, err := shredded.encode(app, namespace, "line"); err != errShredded {
+			t.Errorf("Expected the line of a shredded app to be dropped, got %v", err)
+		}
+	}
+	if _, err := shredded.encode("other-app", "tenant-a", "line"); err != errShredded {
+		t.Errorf("Expected the line of a shredded namespace to be dropped, got %v", err)
+	}
+	if stored, err := shredded.encode("other-app", "", "line"); err != nil || stored != "line" {
+		t.Errorf("Expected the line of an app without keys to be stored as it is, got %q (%v)", stored, err)
+	}
+}
+
+func TestKeyringConfig(t *testing.T) {
+	key := newTestKey(t, "key")
+	for _, keyring := range []string{
+		"not json",
+		keyringString(t, keyringJSON{Apps: map[string][]keyJSON{app: {key}, "other-app": {key}}}),
+		keyringString(t, keyringJSON{Apps: map[string][]keyJSON{app: {{ID: "key", Key: "not base64"}}}}),
+		keyringString(t, keyringJSON{Apps: map[string][]keyJSON{app: {{ID: "key", Key: base64.StdEncoding.EncodeToString([]byte("too short"))}}}}),
+		keyringString(t, keyringJSON{Apps: map[string][]keyJSON{app: {{Key: key.Key}}}}),
+	} {
+		if _, err := newKeyring(&encryptionConfig{Keyring: keyring}); err == nil {
+			t.Errorf("Expected %s to be invalid", keyring)
+		}
+	}
+}
+
+func TestBoltEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyfile := path.Join(dir, "keys.json")
+	writeKeyfile(t, keyfile, keyringJSON{Apps: map[string][]keyJSON{app: {newTestKey(t, "key-1")}}})
+	os.Setenv("DEIS_LOGGER_ENCRYPTION_KEYFILE", keyfile)
+	os.Setenv("DEIS_LOGGER_ENCRYPTION_KEYFILE_CHECK_INTERVAL_SECONDS", "0")
+	a, cleanup := newTestBoltAdapter(t, 10)
+	os.Unsetenv("DEIS_LOGGER_ENCRYPTION_KEYFILE")
+	os.Unsetenv("DEIS_LOGGER_ENCRYPTION_KEYFILE_CHECK_INTERVAL_SECONDS")
+	defer cleanup()
+	writeWAL(t, a, "2017-01-01T00:00:00Z test-app[web.1]: first", "2017-01-01T00:00:00Z test-app[worker.1]: second")
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10, Process: "web"}))
+	if err != nil || len(messages) != 1 || messages[0] != "2017-01-01T00:00:00Z test-app[web.1]: first" {
+		t.Errorf("Expected the line of the web process, got %v (%v)", messages, err)
+	}
+	// once the app's key is destroyed, none of its lines can be read, and new ones are dropped
+	// rather than stored unencrypted
+	writeKeyfile(t, keyfile, keyringJSON{})
+	writeWAL(t, a, "2017-01-01T00:00:00Z test-app[web.1]: third")
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10}); err == nil {
+		t.Error("Expected the lines of an app whose key was destroyed not to be read")
+	}
+}
+
+func TestBoltEncryptedRetention(t *testing.T) {
+	os.Setenv("DEIS_LOGGER_ENCRYPTION_KEYRING", keyringString(t, keyringJSON{Apps: map[string][]keyJSON{app: {newTestKey(t, "key-1")}}}))
+	a, cleanup := newTestBoltAdapter(t, 3)
+	os.Unsetenv("DEIS_LOGGER_ENCRYPTION_KEYRING")
+	defer cleanup()
+	for i := 0; i < 5; i++ {
+		writeWAL(t, a, fmt.Sprintf("2017-01-01T00:00:00Z test-app[web.1]: message %d", i))
+	}
+	if err := a.enforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	// expired lines are decrypted to find the process index they are removed from
+	var indexed int
+	if err := a.db.View(func(tx *bolt.Tx) error {
+		_, index := boltBuckets(tx, app, "web")
+		indexed = index.Stats().KeyN
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 3 {
+		t.Errorf("Expected the process index to hold the 3 retained lines, got %d", indexed)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10, Process: "web"}))
+	if err != nil || len(messages) != 3 || messages[0] != "2017-01-01T00:00:00Z test-app[web.1]: message 2" {
+		t.Errorf("Expected the 3 newest lines of the web process, got %v (%v)", messages, err)
+	}
+}
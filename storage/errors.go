@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrNotFound is the error returned if there are no logs for an app, or none that match the read
+// options
+type ErrNotFound struct {
+	App string
+}
+
+func newErrNotFound(app string) ErrNotFound {
+	return ErrNotFound{App: app}
+}
+
+func (e ErrNotFound) Error() string {
+	return fmt.Sprintf("Could not find logs for '%s'", e.App)
+}
+
+// ErrUnavailable is the error returned if the backend of a storage adapter can't be reached or
+// fails to serve a request
+type ErrUnavailable struct {
+	Adapter string
+	Err     error
+}
+
+func newErrUnavailable(adapterName string, err error) ErrUnavailable {
+	return ErrUnavailable{Adapter: adapterName, Err: err}
+}
+
+func (e ErrUnavailable) Error() string {
+	return fmt.Sprintf("The %s storage backend is unavailable: %s", e.Adapter, e.Err)
+}
+
+// unavailable returns the error of a failed request to a storage backend: the error of the
+// caller's context if it is done, as the request was abandoned, and an ErrUnavailable otherwise
+func unavailable(ctx context.Context, adapterName string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return newErrUnavailable(adapterName, err)
+}
+
+// ErrInvalidArgument is the error returned if the options of a request, such as a cursor, a query
+// or a retention, are invalid or not supported by a storage adapter
+type ErrInvalidArgument struct {
+	Message string
+}
+
+func newErrInvalidArgument(format string, args ...interface{}) ErrInvalidArgument {
+	return ErrInvalidArgument{Message: fmt.Sprintf(format, args...)}
+}
+
+func (e ErrInvalidArgument) Error() string {
+	return e.Message
+}
+
+// ErrQuotaExceeded is the error returned if the backend of a storage adapter refuses a request
+// because it is out of space or rate limiting its clients
+type ErrQuotaExceeded struct {
+	Adapter string
+	Err     error
+}
+
+func newErrQuotaExceeded(adapterName string, err error) ErrQuotaExceeded {
+	return ErrQuotaExceeded{Adapter: adapterName, Err: err}
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("The %s storage backend refused the request: %s", e.Adapter, e.Err)
+}
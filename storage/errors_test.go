@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gopkg.in/olivere/elastic.v5"
+)
+
+func isErrUnavailable(err error) bool {
+	_, ok := err.(ErrUnavailable)
+	return ok
+}
+
+func isErrQuotaExceeded(err error) bool {
+	_, ok := err.(ErrQuotaExceeded)
+	return ok
+}
+
+func isErrInvalidArgument(err error) bool {
+	_, ok := err.(ErrInvalidArgument)
+	return ok
+}
+
+func TestErrorMessages(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{newErrNotFound("foo"), "Could not find logs for 'foo'"},
+		{newErrUnavailable("redis", errors.New("dial tcp: connection refused")), "The redis storage backend is unavailable: dial tcp: connection refused"},
+		{newErrInvalidArgument("Invalid cursor: %s", "x"), "Invalid cursor: x"},
+		{newErrQuotaExceeded("loki", errors.New("rate limited")), "The loki storage backend refused the request: rate limited"},
+	}
+	for _, test := range tests {
+		if test.err.Error() != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, test.err.Error())
+		}
+	}
+}
+
+func TestRedisError(t *testing.T) {
+	if err := redisError("redis", nil); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if err := redisError("redis", errors.New("OOM command not allowed when used memory > 'maxmemory'.")); !isErrQuotaExceeded(err) {
+		t.Errorf("expected an ErrQuotaExceeded, got %#v", err)
+	}
+	if err := redisError("redis", errors.New("dial tcp: connection refused")); !isErrUnavailable(err) {
+		t.Errorf("expected an ErrUnavailable, got %#v", err)
+	}
+}
+
+func TestESError(t *testing.T) {
+	if err := esError(app, &elastic.Error{Status: 429}); !isErrQuotaExceeded(err) {
+		t.Errorf("expected an ErrQuotaExceeded, got %#v", err)
+	}
+	if err := esError(app, &elastic.Error{Status: 400}); !isErrInvalidArgument(err) {
+		t.Errorf("expected an ErrInvalidArgument, got %#v", err)
+	}
+	if err := esError(app, errors.New("no available connection")); !isErrUnavailable(err) {
+		t.Errorf("expected an ErrUnavailable, got %#v", err)
+	}
+}
+
+func TestInvalidArguments(t *testing.T) {
+	a, err := NewRingBufferAdapter(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []ReadOptions{
+		{Lines: 10, Before: "one"},
+		{Lines: 10, Query: "(", Regexp: true},
+		{Lines: 10, Context: -1},
+	} {
+		if _, err := a.Read(context.Background(), app, opts); !isErrInvalidArgument(err) {
+			t.Errorf("%+v: expected an ErrInvalidArgument, got %#v", opts, err)
+		}
+	}
+	if err := SetRetention(a, app, Retention{Lines: -1}); !isErrInvalidArgument(err) {
+		t.Errorf("expected an ErrInvalidArgument, got %#v", err)
+	}
+}
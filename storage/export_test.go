@@ -0,0 +1,24 @@
+package storage
+
+import "context"
+
+// Exported for tests of the storage_test package, which can import storagetest without an import
+// cycle
+
+// SetLogRoot sets the directory the file adapter writes to
+func SetLogRoot(dir string) {
+	logRoot = dir
+}
+
+// The sources of the redis adapter's scripts
+const (
+	RedisPushScript = redisPushScript
+	RedisReadScript = redisReadScript
+	RedisInfoScript = redisInfoScript
+)
+
+// EnforceElasticsearchRetention deletes the documents of an elasticsearch adapter that are older
+// than the maximum age of their app
+func EnforceElasticsearchRetention(a Adapter) error {
+	return a.(*elasticsearchAdapter).enforceRetention(context.Background())
+}
@@ -2,6 +2,8 @@ package storage
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 )
 
 type errUnrecognizedStorageAdapterType struct {
@@ -12,36 +14,99 @@ func (e errUnrecognizedStorageAdapterType) Error() string {
 	return fmt.Sprintf("Unrecognized storage adapter type: %s", e.adapterType)
 }
 
+// Config is the configuration every storage adapter is created with. Settings specific to an
+// adapter are read from the environment by its factory.
+type Config struct {
+	// Lines is the number of lines kept per app by adapters that bound them
+	Lines int
+}
+
+// Factory returns a new storage adapter for the given configuration
+type Factory func(Config) (Adapter, error)
+
+var (
+	factoriesMutex sync.RWMutex
+	factories      = make(map[string]Factory)
+)
+
+func init() {
+	Register("file", func(cfg Config) (Adapter, error) {
+		return NewFileAdapter()
+	})
+	Register("memory", func(cfg Config) (Adapter, error) {
+		return NewRingBufferAdapter(cfg.Lines)
+	})
+	Register("bolt", func(cfg Config) (Adapter, error) {
+		return NewBoltAdapter(cfg.Lines)
+	})
+	Register("redis", func(cfg Config) (Adapter, error) {
+		return NewRedisStorageAdapter(cfg.Lines)
+	})
+	Register("redis-streams", func(cfg Config) (Adapter, error) {
+		return NewRedisStreamsAdapter(cfg.Lines)
+	})
+	Register("tiered", func(cfg Config) (Adapter, error) {
+		return newTieredAdapterFromConfig(cfg.Lines)
+	})
+	Register("multi", func(cfg Config) (Adapter, error) {
+		return newMultiAdapterFromConfig(cfg.Lines)
+	})
+	Register("s3", func(cfg Config) (Adapter, error) {
+		return NewS3Adapter()
+	})
+	Register("loki", func(cfg Config) (Adapter, error) {
+		return NewLokiAdapter()
+	})
+	Register("elasticsearch", func(cfg Config) (Adapter, error) {
+		return NewESStorageAdapter()
+	})
+	Register("wal", func(cfg Config) (Adapter, error) {
+		return newWALAdapterFromConfig(cfg.Lines)
+	})
+	Register("breaker", func(cfg Config) (Adapter, error) {
+		return newBreakerAdapterFromConfig(cfg.Lines)
+	})
+}
+
+// Register makes a storage adapter available to NewAdapter under the given name. Adapters built
+// outside of this package register themselves from an init function of a package compiled into
+// the binary. Registering a nil factory or the same name twice panics.
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	if factory == nil {
+		panic("storage: Register factory is nil")
+	}
+	if _, ok := factories[name]; ok {
+		panic("storage: Register called twice for adapter " + name)
+	}
+	factories[name] = factory
+}
+
+// Adapters returns the sorted names of the registered storage adapters
+func Adapters() []string {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // NewAdapter returns a pointer to an appropriate implementation of the Adapter interface, as
 // determined by the adapterType string it is passed.
 func NewAdapter(adapterType string, numLines int) (Adapter, error) {
-	if adapterType == "file" {
-		adapter, err := NewFileAdapter()
-		if err != nil {
-			return nil, err
-		}
-		return adapter, nil
-	}
-	if adapterType == "memory" {
-		adapter, err := NewRingBufferAdapter(numLines)
-		if err != nil {
-			return nil, err
-		}
-		return adapter, nil
-	}
-	if adapterType == "redis" {
-		adapter, err := NewRedisStorageAdapter(numLines)
-		if err != nil {
-			return nil, err
-		}
-		return adapter, nil
+	factoriesMutex.RLock()
+	factory, ok := factories[adapterType]
+	factoriesMutex.RUnlock()
+	if !ok {
+		return nil, errUnrecognizedStorageAdapterType{adapterType: adapterType}
 	}
-	if adapterType == "elasticsearch" {
-		adapter, err := NewESStorageAdapter()
-		if err != nil {
-			return nil, err
-		}
-		return adapter, nil
+	adapter, err := factory(Config{Lines: numLines})
+	if err != nil {
+		return nil, err
 	}
-	return nil, errUnrecognizedStorageAdapterType{adapterType: adapterType}
+	return adapter, nil
 }
@@ -1,7 +1,11 @@
 package storage
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -24,6 +28,37 @@ func TestFactoryGetUsingInvalidValues(t *testing.T) {
 	}
 }
 
+func TestFactoryRegister(t *testing.T) {
+	Register("test-registered", func(cfg Config) (Adapter, error) {
+		return NewRingBufferAdapter(cfg.Lines * 2)
+	})
+	defer func() {
+		factoriesMutex.Lock()
+		delete(factories, "test-registered")
+		factoriesMutex.Unlock()
+	}()
+	a, err := NewAdapter("test-registered", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retType, ok := a.(*ringBufferAdapter); !ok || retType.retention.defaults.Lines != 2 {
+		t.Errorf("Expected a *ringBufferAdapter created with the given config, got %#v", a)
+	}
+	names := Adapters()
+	if i := sort.SearchStrings(names, "test-registered"); i == len(names) || names[i] != "test-registered" {
+		t.Errorf("Expected the registered adapter to be listed, got %v", names)
+	}
+	if i := sort.SearchStrings(names, "file"); i == len(names) || names[i] != "file" {
+		t.Errorf("Expected the built-in adapters to be listed, got %v", names)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a name twice to panic")
+		}
+	}()
+	Register("file", func(cfg Config) (Adapter, error) { return nil, nil })
+}
+
 func TestFactoryGetFileBasedAdapter(t *testing.T) {
 	a, err := NewAdapter("file", 1)
 	if err != nil {
@@ -46,6 +81,77 @@ func TestFactoryGetMemoryBasedAdapter(t *testing.T) {
 	}
 }
 
+func TestFactoryGetBoltBasedAdapter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("DEIS_LOGGER_BOLT_PATH", path.Join(dir, "logger.db"))
+	defer os.Unsetenv("DEIS_LOGGER_BOLT_PATH")
+	a, err := NewAdapter("bolt", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+	retType, ok := a.(*boltAdapter)
+	if !ok {
+		t.Fatalf("Expected a *boltAdapter, got %s", reflect.TypeOf(retType).String())
+	}
+}
+
+func TestFactoryGetTieredAdapter(t *testing.T) {
+	a, err := NewAdapter("tiered", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retType, ok := a.(*tieredAdapter)
+	if !ok {
+		t.Fatalf("Expected a *tieredAdapter, got %s", reflect.TypeOf(retType).String())
+	}
+	if _, ok := retType.cold.(*fileAdapter); !ok {
+		t.Errorf("Expected a *fileAdapter cold tier, got %s", reflect.TypeOf(retType.cold).String())
+	}
+}
+
+func TestFactoryGetMultiAdapter(t *testing.T) {
+	os.Setenv("DEIS_LOGGER_MULTI_ADAPTERS", "memory,file")
+	defer os.Unsetenv("DEIS_LOGGER_MULTI_ADAPTERS")
+	a, err := NewAdapter("multi", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retType, ok := a.(*multiAdapter)
+	if !ok {
+		t.Fatalf("Expected a *multiAdapter, got %s", reflect.TypeOf(retType).String())
+	}
+	if len(retType.children) != 2 {
+		t.Errorf("Expected 2 child adapters, got %d", len(retType.children))
+	}
+}
+
+func TestFactoryGetS3Adapter(t *testing.T) {
+	a, err := NewAdapter("s3", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retType, ok := a.(*s3Adapter)
+	if !ok {
+		t.Fatalf("Expected a *s3Adapter, got %s", reflect.TypeOf(retType).String())
+	}
+}
+
+func TestFactoryGetLokiAdapter(t *testing.T) {
+	a, err := NewAdapter("loki", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retType, ok := a.(*lokiAdapter)
+	if !ok {
+		t.Fatalf("Expected a *lokiAdapter, got %s", reflect.TypeOf(retType).String())
+	}
+}
+
 func TestGetRedisBasedAdapter(t *testing.T) {
 	a, err := NewAdapter("redis", 1)
 	if err != nil {
@@ -57,6 +163,17 @@ func TestGetRedisBasedAdapter(t *testing.T) {
 	}
 }
 
+func TestGetRedisStreamsBasedAdapter(t *testing.T) {
+	a, err := NewAdapter("redis-streams", 1)
+	if err != nil {
+		t.Error(err)
+	}
+	retType, ok := a.(*redisStreamsAdapter)
+	if !ok {
+		t.Errorf("Expected a redisStreamsAdapter, but got a %s", reflect.TypeOf(retType).String())
+	}
+}
+
 func TestGetESBasedAdapter(t *testing.T) {
 	a, err := NewAdapter("elasticsearch", 1)
 	if err != nil {
@@ -67,3 +184,14 @@ func TestGetESBasedAdapter(t *testing.T) {
 		t.Errorf("Expected a elasticsearchAdapter, but got a %s", reflect.TypeOf(retType).String())
 	}
 }
+
+func TestFactoryWALRejectsNonDurableAdapters(t *testing.T) {
+	defer os.Unsetenv("DEIS_LOGGER_WAL_ADAPTER")
+	for _, adapterType := range []string{"elasticsearch", "loki", "s3", "memory", "wal"} {
+		os.Setenv("DEIS_LOGGER_WAL_ADAPTER", adapterType)
+		if a, err := NewAdapter("wal", 1); err == nil {
+			a.Stop()
+			t.Errorf("Expected the write-ahead log to reject the %s adapter", adapterType)
+		}
+	}
+}
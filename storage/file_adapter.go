@@ -1,50 +1,105 @@
 package storage
 
 import (
-	"fmt"
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var logRoot = "/data/logs"
 
+const (
+	// rotatedSuffix is appended to the path of an app-specific log file when it is rotated
+	rotatedSuffix = ".1"
+	// generationSuffix is appended to the path of an app-specific log file to name the file holding
+	// its generation number, which counts the times it was rotated. Without that file, the log file
+	// is the first generation.
+	generationSuffix = ".gen"
+)
+
 type fileAdapter struct {
 	files map[string]*os.File
-	mutex sync.Mutex
+	// generations describes the current log file of every app with a retention, since it was
+	// rotated
+	generations map[string]*fileGeneration
+	retention   *retentions
+	codec       *lineCodec
+	recorder    recorder
+	mutex       sync.Mutex
+}
+
+// fileGeneration describes the lines written to an app-specific log file since it was last rotated
+type fileGeneration struct {
+	lines   int64
+	bytes   int64
+	started time.Time
 }
 
 // NewFileAdapter returns an Adapter that uses a file.
 func NewFileAdapter() (Adapter, error) {
-	return &fileAdapter{files: make(map[string]*os.File)}, nil
+	codec, err := newLineCodecFromConfig(true)
+	if err != nil {
+		return nil, err
+	}
+	recorder, err := newRecorderFromConfig("file")
+	if err != nil {
+		return nil, err
+	}
+	return &fileAdapter{
+		files:       make(map[string]*os.File),
+		generations: make(map[string]*fileGeneration),
+		retention:   newRetentions(Retention{}),
+		codec:       codec,
+		recorder:    recorder,
+	}, nil
 }
 
 // Start the storage adapter-- in the case of this implementation, a no-op
 func (a *fileAdapter) Start() {
 }
 
-// Write adds a log message to to an app-specific log file
-func (a *fileAdapter) Write(app string, message string) error {
-	// Check first if we might actually have to add to the map of file pointers so we can avoid
-	// waiting for / obtaining a lock unnecessarily
+// Write adds a log message to to an app-specific log file, compressing and encrypting it first if
+// that is configured
+func (a *fileAdapter) Write(ctx context.Context, app string, message string) error {
+	return a.write(app, "", message)
+}
+
+// WriteWithMetadata adds a log message to an app-specific log file, along with its metadata if that
+// is configured, encrypting it with the key of the namespace it was logged in if its app has none
+func (a *fileAdapter) WriteWithMetadata(ctx context.Context, app string, message string, metadata Metadata) error {
+	return a.write(app, metadata.Namespace, a.recorder.record(message, metadata))
+}
+
+func (a *fileAdapter) write(app string, namespace string, message string) error {
+	message, err := a.codec.encode(app, namespace, message)
+	if err == errShredded {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if retention := a.retention.get(app); !retention.IsZero() {
+		return a.writeRotating(app, message, retention)
+	}
+	// the file may be added to the map, reopened or destroyed meanwhile
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	f, ok := a.files[app]
 	if !ok {
-		// Ensure only one goroutine at a time can be adding a file pointer to the map of file
-		// pointers
-		a.mutex.Lock()
-		defer a.mutex.Unlock()
-		f, ok = a.files[app]
-		if !ok {
-			var err error
-			f, err = a.getFile(app)
-			if err != nil {
-				return err
-			}
-			a.files[app] = f
+		var err error
+		f, err = a.getFile(app)
+		if err != nil {
+			return err
 		}
+		a.files[app] = f
 	}
 	if _, err := f.WriteString(message + "\n"); err != nil {
 		return err
@@ -52,48 +107,377 @@ func (a *fileAdapter) Write(app string, message string) error {
 	return nil
 }
 
-// Read retrieves a specified number of log lines from an app-specific log file
-func (a *fileAdapter) Read(app string, lines int, process string) ([]string, error) {
-	if lines <= 0 {
-		return []string{}, nil
+// writeRotating adds a log message to an app-specific log file, first rotating the file if it
+// holds half of the lines or bytes the app's retention allows or was started more than the
+// maximum age ago. Only the previous generation of the file is kept, so an app keeps between half
+// and all of the lines and bytes it is allowed, and lines up to twice the maximum age old.
+func (a *fileAdapter) writeRotating(app string, message string, retention Retention) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	f, ok := a.files[app]
+	if !ok {
+		var err error
+		if f, err = a.getFile(app); err != nil {
+			return err
+		}
+		a.files[app] = f
+	}
+	gen, ok := a.generations[app]
+	if !ok {
+		var err error
+		if gen, err = newFileGeneration(f); err != nil {
+			return err
+		}
+		a.generations[app] = gen
+	}
+	now := time.Now()
+	size := int64(len(message) + 1)
+	if gen.lines > 0 && gen.full(retention, size, now) {
+		var err error
+		if f, err = a.rotate(app, f); err != nil {
+			return err
+		}
+		gen = &fileGeneration{started: now}
+		a.generations[app] = gen
+	}
+	if _, err := f.WriteString(message + "\n"); err != nil {
+		return err
+	}
+	gen.lines++
+	gen.bytes += size
+	return nil
+}
+
+// newFileGeneration describes an app-specific log file that was written to before the adapter
+// tracked it, counting its age from now
+func newFileGeneration(f *os.File) (*fileGeneration, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	lines, err := countLines(f.Name())
+	if err != nil {
+		return nil, err
 	}
+	return &fileGeneration{lines: lines, bytes: fi.Size(), started: time.Now()}, nil
+}
+
+// full reports whether adding size bytes would take the generation beyond half of the
+// retention's limits, or whether it was started more than the maximum age ago
+func (g *fileGeneration) full(retention Retention, size int64, now time.Time) bool {
+	return (retention.Lines > 0 && g.lines >= half(int64(retention.Lines))) ||
+		(retention.Bytes > 0 && g.bytes+size > half(retention.Bytes)) ||
+		(retention.MaxAge > 0 && now.Sub(g.started) >= retention.MaxAge)
+}
+
+// half returns half of a limit, but at least 1
+func half(limit int64) int64 {
+	if limit < 2 {
+		return 1
+	}
+	return limit / 2
+}
+
+// rotate replaces the previous generation of an app-specific log file with the current one and
+// returns a new, empty current file. The caller must hold the lock.
+func (a *fileAdapter) rotate(app string, f *os.File) (*os.File, error) {
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	delete(a.files, app)
 	filePath := a.getFilePath(app)
-	exists, err := fileExists(filePath)
+	generation, err := readGeneration(filePath)
 	if err != nil {
 		return nil, err
 	}
-	if !exists {
-		return nil, fmt.Errorf("Could not find logs for '%s'", app)
+	if err := os.Rename(filePath, filePath+rotatedSuffix); err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(filePath+generationSuffix, []byte(strconv.FormatInt(generation+1, 10)), 0644)
+	if err != nil {
+		return nil, err
 	}
-	logBytes, err := exec.Command("tail", "-n", strconv.Itoa(lines), filePath).Output()
+	f, err = a.getFile(app)
 	if err != nil {
 		return nil, err
 	}
-	logStrs := strings.Split(string(logBytes), "\n")
-	return logStrs[:len(logStrs)-1], nil
+	a.files[app] = f
+	return f, nil
 }
 
-// Destroy deletes stored logs for the specified application
-func (a *fileAdapter) Destroy(app string) error {
-	// Check first if the map of file pointers even contains the file pointer we want so we can avoid
-	// waiting for / obtaining a lock unnecessarily
-	f, ok := a.files[app]
-	if ok {
-		// Ensure no other goroutine is trying to modify the file pointer map while we're trying to
-		// clean up
-		a.mutex.Lock()
-		defer a.mutex.Unlock()
-		exists, err := fileExists(f.Name())
+// Read retrieves a specified number of log lines from an app-specific log file and the previous
+// generation of it, scanning them for lines matching the query. Lines are limited to a time range
+// using the timestamps they start with. Cursors are the generation numbers of the files lines are
+// in along with the offsets they start at, so they still point at the same lines once the file is
+// rotated. Compressed and encrypted lines are decoded, and skipped if they can't be.
+func (a *fileAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	if opts.Lines <= 0 {
+		return &Page{}, nil
+	}
+	f, err := a.openGenerations(app)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if len(f.files) == 0 {
+		return nil, newErrNotFound(app)
+	}
+	g, err := newGrepper(opts)
+	if err != nil {
+		return nil, err
+	}
+	collect := func(offset int64, stored string) bool {
+		if line, ok := a.codec.decode(app, stored); ok && opts.lineInTimeRange(line) {
+			g.add(line, f.cursor(offset))
+		}
+		// stop scanning once the read is abandoned
+		return !g.done() && ctx.Err() == nil
+	}
+	if opts.After != "" {
+		after, kept, err := f.offset(opts.After)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		// the line the cursor points at is skipped, unless it was rotated away
+		if err := scanLinesForward(f, f.size, after, kept, collect); err != nil {
+			return nil, err
+		}
+		return g.page, ctx.Err()
+	}
+	end := f.size
+	if opts.Before != "" {
+		if end, _, err = f.offset(opts.Before); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanLinesBackward(f, end, collect); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	g.page.reverse()
+	return g.page, nil
+}
+
+// openGenerations opens the previous generation of an app-specific log file, if there is one, and
+// the current file as one, read-only file. The lock is held so that the file isn't rotated in
+// between.
+func (a *fileAdapter) openGenerations(app string) (*concatFile, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	filePath := a.getFilePath(app)
+	generation, err := readGeneration(filePath)
+	if err != nil {
+		return nil, err
+	}
+	c := &concatFile{}
+	for i, p := range []string{filePath + rotatedSuffix, filePath} {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			err = c.add(f, generation-1+int64(i))
 		}
-		if exists {
-			if err := os.Remove(f.Name()); err != nil {
-				return err
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// readGeneration returns the generation number of an app-specific log file
+func readGeneration(filePath string) (int64, error) {
+	data, err := ioutil.ReadFile(filePath + generationSuffix)
+	if os.IsNotExist(err) {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// concatFile reads a sequence of files as if they were one
+type concatFile struct {
+	files []*os.File
+	sizes []int64
+	// generations are the generation numbers of the files, in increasing order
+	generations []int64
+	// size is the total size of the files when they were added
+	size int64
+}
+
+func (c *concatFile) add(f *os.File, generation int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.files = append(c.files, f)
+	c.sizes = append(c.sizes, fi.Size())
+	c.generations = append(c.generations, generation)
+	c.size += fi.Size()
+	return nil
+}
+
+// cursor returns the cursor of the line starting at an offset of the files: the generation number
+// of the file it is in and the offset it starts at within that file
+func (c *concatFile) cursor(offset int64) string {
+	i := 0
+	for ; i < len(c.files)-1 && offset >= c.sizes[i]; i++ {
+		offset -= c.sizes[i]
+	}
+	return strconv.FormatInt(c.generations[i], 10) + "." + strconv.FormatInt(offset, 10)
+}
+
+// offset returns the offset within the files of the line a cursor points at. If that line was
+// rotated away, kept is false and the offset is that of the oldest line kept. Cursors of
+// generations newer than the files point at their end.
+func (c *concatFile) offset(cursor string) (offset int64, kept bool, err error) {
+	parts := strings.SplitN(cursor, ".", 2)
+	if len(parts) != 2 {
+		return 0, false, newErrInvalidArgument("Invalid cursor: %s", cursor)
+	}
+	generation, err1 := strconv.ParseInt(parts[0], 10, 64)
+	offset, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil || offset < 0 {
+		return 0, false, newErrInvalidArgument("Invalid cursor: %s", cursor)
+	}
+	var base int64
+	for i, g := range c.generations {
+		if generation < g {
+			return base, false, nil
+		}
+		if generation == g {
+			if offset > c.sizes[i] {
+				offset = c.sizes[i]
+			}
+			return base + offset, true, nil
+		}
+		base += c.sizes[i]
+	}
+	return c.size, true, nil
+}
+
+// ReadAt implements io.ReaderAt. Lines written to the last file since it was added are not read.
+func (c *concatFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for i, f := range c.files {
+		if len(p) == 0 {
+			break
+		}
+		if off >= c.sizes[i] {
+			off -= c.sizes[i]
+			continue
+		}
+		want := p
+		if int64(len(want)) > c.sizes[i]-off {
+			want = want[:c.sizes[i]-off]
+		}
+		read, err := f.ReadAt(want, off)
+		n += read
+		if err != nil {
+			return n, err
+		}
+		p = p[read:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close closes every file
+func (c *concatFile) Close() error {
+	var err error
+	for _, f := range c.files {
+		if closeErr := f.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Apps describes the app-specific log files under the log root along with their previous
+// generations, counting the lines of each
+func (a *fileAdapter) Apps(ctx context.Context) ([]AppInfo, error) {
+	infos, err := ioutil.ReadDir(logRoot)
+	if os.IsNotExist(err) {
+		return []AppInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	apps := []AppInfo{}
+	for _, fi := range infos {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(fi.Name(), ".log") {
+			continue
+		}
+		lines, err := countLines(path.Join(logRoot, fi.Name()))
+		if os.IsNotExist(err) {
+			// destroyed since the directory was read
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		info := AppInfo{
+			Name:      strings.TrimSuffix(fi.Name(), ".log"),
+			Lines:     lines,
+			Bytes:     fi.Size(),
+			LastWrite: fi.ModTime(),
+		}
+		rotatedPath := path.Join(logRoot, fi.Name()+rotatedSuffix)
+		if rotated, err := os.Stat(rotatedPath); err == nil {
+			// the previous generation may be rotated away while its lines are counted
+			if lines, err := countLines(rotatedPath); err == nil {
+				info.Lines += lines
+				info.Bytes += rotated.Size()
 			}
 		}
-		delete(a.files, app)
+		apps = append(apps, info)
+	}
+	return apps, nil
+}
+
+// SetRetention overrides the limits of the lines kept for an app. They are enforced by rotating
+// the app's log file as lines are written to it.
+func (a *fileAdapter) SetRetention(app string, retention Retention) error {
+	if err := retention.limits("file", true, true, true); err != nil {
+		return err
+	}
+	a.retention.set(app, retention)
+	return nil
+}
+
+// Retention returns the limits of the lines kept for an app
+func (a *fileAdapter) Retention(app string) Retention {
+	return a.retention.get(app)
+}
+
+// Destroy deletes stored logs for the specified application
+func (a *fileAdapter) Destroy(ctx context.Context, app string) error {
+	// Ensure no other goroutine is trying to modify the file pointer map while we're trying to
+	// clean up
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	// Files are removed by their path, so apps written before the adapter was started are destroyed
+	// as well
+	filePath := a.getFilePath(app)
+	for _, p := range []string{filePath, filePath + rotatedSuffix, filePath + generationSuffix} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
+	delete(a.files, app)
+	delete(a.generations, app)
 	return nil
 }
 
@@ -104,6 +488,7 @@ func (a *fileAdapter) Reopen() error {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 	a.files = make(map[string]*os.File)
+	a.generations = make(map[string]*fileGeneration)
 	return nil
 }
 
@@ -131,6 +516,96 @@ func (a *fileAdapter) getFilePath(app string) string {
 	return path.Join(logRoot, app+".log")
 }
 
+// countLines counts the complete lines of a file
+func countLines(filePath string) (int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var lines int64
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		lines += int64(bytes.Count(buf[:n], []byte{'\n'}))
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// scanLinesForward calls fn with every complete line of the first size bytes following the one
+// that starts at offset after, or starting with it unless skip is set, along with the offset it
+// starts at, until fn returns false
+func scanLinesForward(f io.ReaderAt, size int64, after int64, skip bool, fn func(int64, string) bool) error {
+	if after > size {
+		return nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, after, size-after))
+	offset := after
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			// a line without a trailing newline is still being written
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start := offset
+		offset += int64(len(line))
+		if skip {
+			skip = false
+			continue
+		}
+		if !fn(start, strings.TrimSuffix(line, "\n")) {
+			return nil
+		}
+	}
+}
+
+// scanLinesBackward calls fn with every line that ends before offset end, newest first, along
+// with the offset it starts at, until fn returns false
+func scanLinesBackward(f io.ReaderAt, end int64, fn func(int64, string) bool) error {
+	const chunkSize = 64 * 1024
+	// buf holds the part of the file from pos up to the end of the next line to be returned
+	var buf []byte
+	pos := end
+	for {
+		for len(buf) > 0 {
+			i := bytes.LastIndexByte(buf[:len(buf)-1], '\n')
+			if i < 0 && pos > 0 {
+				// the start of the line has not been read yet
+				break
+			}
+			if !fn(pos+int64(i+1), string(buf[i+1:len(buf)-1])) {
+				return nil
+			}
+			buf = buf[:i+1]
+		}
+		if pos == 0 {
+			return nil
+		}
+		n := int64(chunkSize)
+		if pos < n {
+			n = pos
+		}
+		pos -= n
+		chunk := make([]byte, n, n+int64(len(buf)))
+		if _, err := f.ReadAt(chunk, pos); err != nil {
+			return err
+		}
+		if pos+n == end && chunk[n-1] != '\n' {
+			// the last line may not have its trailing newline yet
+			chunk = append(chunk, '\n')
+		}
+		buf = append(chunk, buf...)
+	}
+}
+
 func fileExists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if err == nil {
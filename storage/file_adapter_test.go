@@ -1,11 +1,15 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestReadFromNonExistingApp(t *testing.T) {
@@ -21,7 +25,7 @@ func TestReadFromNonExistingApp(t *testing.T) {
 		t.Error(err)
 	}
 	// No logs have been writter; there should be no ringBuffer for app
-	messages, err := a.Read(app, 10, "")
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
 	if messages != nil {
 		t.Error("Expected no messages, but got some")
 	}
@@ -43,12 +47,12 @@ func TestLogs(t *testing.T) {
 	}
 	// And write a few logs
 	for i := 0; i < 5; i++ {
-		if err := a.Write(app, fmt.Sprintf("message %d", i)); err != nil {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
 			t.Error(err)
 		}
 	}
 	// Read more logs than there are
-	messages, err := a.Read(app, 8, "")
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 8}))
 	if err != nil {
 		t.Error(err)
 	}
@@ -57,7 +61,7 @@ func TestLogs(t *testing.T) {
 		t.Error("only expected 5 log messages")
 	}
 	// Read fewer logs than there are
-	messages, err = a.Read(app, 3, "")
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 3}))
 	if err != nil {
 		t.Error(err)
 	}
@@ -73,6 +77,156 @@ func TestLogs(t *testing.T) {
 	}
 }
 
+func TestLogsTimeRange(t *testing.T) {
+	var err error
+	logRoot, err = ioutil.TempDir("", "log-tests")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(logRoot)
+	a, err := NewFileAdapter()
+	if err != nil {
+		t.Error(err)
+	}
+	start := time.Date(2017, 3, 1, 14, 0, 0, 0, time.UTC)
+	lines := make([]string, 10)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%s %s[web.v1]: message %d", start.Add(time.Duration(i)*time.Minute).Format(time.RFC3339), app, i)
+		if err := a.Write(context.Background(), app, lines[i]); err != nil {
+			t.Error(err)
+		}
+	}
+	// Lines without a timestamp are never within a time range
+	if err := a.Write(context.Background(), app, "message without a timestamp"); err != nil {
+		t.Error(err)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 3, Since: start.Add(2 * time.Minute), Until: start.Add(8 * time.Minute)}))
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(messages, lines[5:8]) {
+		t.Errorf("expected %v, got %v", lines[5:8], messages)
+	}
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 100, Since: start.Add(8 * time.Minute)}))
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(messages, lines[8:]) {
+		t.Errorf("expected %v, got %v", lines[8:], messages)
+	}
+}
+
+func TestLogsQuery(t *testing.T) {
+	var err error
+	logRoot, err = ioutil.TempDir("", "log-tests")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(logRoot)
+	a, err := NewFileAdapter()
+	if err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 20; i++ {
+		message := fmt.Sprintf("GET /healthz %d", 200)
+		if i%5 == 2 {
+			message = fmt.Sprintf("GET /v2/apps %d", 500+i)
+		}
+		if err := a.Write(context.Background(), app, message); err != nil {
+			t.Error(err)
+		}
+	}
+	// The limit applies to matches, however many lines are scanned for them
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 3, Query: "/APPS", IgnoreCase: true}))
+	if err != nil {
+		t.Error(err)
+	}
+	expected := []string{"GET /v2/apps 507", "GET /v2/apps 512", "GET /v2/apps 517"}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected %v, got %v", expected, messages)
+	}
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 1, Query: ` 50\d$`, Regexp: true, Context: 1}))
+	if err != nil {
+		t.Error(err)
+	}
+	expected = []string{"GET /healthz 200", "GET /v2/apps 507", "GET /healthz 200"}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected %v, got %v", expected, messages)
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 1, Query: "[", Regexp: true}); err == nil {
+		t.Error("expected an error for an invalid regular expression")
+	}
+}
+
+func TestLogsCursors(t *testing.T) {
+	var err error
+	logRoot, err = ioutil.TempDir("", "log-tests")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(logRoot)
+	a, err := NewFileAdapter()
+	if err != nil {
+		t.Error(err)
+	}
+	// Lines long enough for a page to span several chunks of the file
+	lines := make([]string, 10)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("message %d %s", i, strings.Repeat("x", 20*1024))
+		if err := a.Write(context.Background(), app, lines[i]); err != nil {
+			t.Error(err)
+		}
+	}
+	page, err := a.Read(context.Background(), app, ReadOptions{Lines: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, lines[6:]) {
+		t.Errorf("expected the last 4 lines, got %d lines", len(page.Lines))
+	}
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 10, Before: page.Before()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, lines[:6]) {
+		t.Errorf("expected the first 6 lines, got %d lines", len(page.Lines))
+	}
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 3, After: page.Before()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, lines[1:4]) {
+		t.Errorf("expected lines 1 through 3, got %d lines", len(page.Lines))
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 3, After: "end"}); err == nil {
+		t.Error("expected an error for an invalid cursor")
+	}
+}
+
+func TestReadCancelled(t *testing.T) {
+	var err error
+	logRoot, err = ioutil.TempDir("", "log-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logRoot)
+	a, err := NewFileAdapter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := a.Read(ctx, app, ReadOptions{Lines: 10}); err != context.Canceled {
+		t.Errorf("expected the context's error, got %v", err)
+	}
+	if _, err := a.Read(ctx, app, ReadOptions{Lines: 10, After: "1.0"}); err != context.Canceled {
+		t.Errorf("expected the context's error, got %v", err)
+	}
+}
+
 func TestDestroy(t *testing.T) {
 	var err error
 	logRoot, err = ioutil.TempDir("", "log-tests")
@@ -91,7 +245,7 @@ func TestDestroy(t *testing.T) {
 	}
 
 	// Write a log to create the file
-	if err := a.Write(app, "Hello, log!"); err != nil {
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
 		t.Error(err)
 	}
 	filename := path.Join(logRoot, fmt.Sprintf("%s.log", app))
@@ -100,7 +254,7 @@ func TestDestroy(t *testing.T) {
 		t.Error("Log file was expected to exist, but doesn't.")
 	}
 	// Now destroy it
-	if err := a.Destroy(app); err != nil {
+	if err := a.Destroy(context.Background(), app); err != nil {
 		t.Error(err)
 	}
 	// Now check that the file no longer exists
@@ -113,6 +267,38 @@ func TestDestroy(t *testing.T) {
 	}
 }
 
+func TestDestroyFromFreshAdapter(t *testing.T) {
+	var err error
+	logRoot, err = ioutil.TempDir("", "log-tests")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(logRoot)
+	// Logs written and rotated by a previous adapter, as after a restart
+	filename := path.Join(logRoot, fmt.Sprintf("%s.log", app))
+	for _, p := range []string{filename, filename + rotatedSuffix, filename + generationSuffix} {
+		if err := ioutil.WriteFile(p, []byte("1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := NewFileAdapter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Destroy(context.Background(), app); err != nil {
+		t.Error(err)
+	}
+	for _, p := range []string{filename, filename + rotatedSuffix, filename + generationSuffix} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", p, err)
+		}
+	}
+	// Destroying an app without logs isn't an error
+	if err := a.Destroy(context.Background(), app); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestReopen(t *testing.T) {
 	var err error
 	logRoot, err = ioutil.TempDir("", "log-tests")
@@ -129,7 +315,7 @@ func TestReopen(t *testing.T) {
 		t.Fatalf("returned adapter was not a ringBuffer")
 	}
 	// Write a log to create the file
-	if err := a.Write(app, "Hello, log!"); err != nil {
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
 		t.Error(err)
 	}
 	// At least one file reference should exist
@@ -145,3 +331,205 @@ func TestReopen(t *testing.T) {
 		t.Error("At least one log file reference still exists, but was expected not to.")
 	}
 }
+
+func TestApps(t *testing.T) {
+	var err error
+	logRoot, err = ioutil.TempDir("", "log-tests")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(logRoot)
+	a, err := NewFileAdapter()
+	if err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	// Files other than app-specific log files are ignored
+	if err := ioutil.WriteFile(path.Join(logRoot, "notes.txt"), []byte("not logs\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	apps, err := a.Apps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 || apps[0].Name != app || apps[0].Lines != 3 || apps[0].Bytes != 30 || apps[0].LastWrite.IsZero() {
+		t.Errorf("unexpected apps: %+v", apps)
+	}
+	logRoot = path.Join(logRoot, "missing")
+	if apps, err := a.Apps(context.Background()); err != nil || len(apps) != 0 {
+		t.Errorf("expected no apps without a log root, got %v, %v", apps, err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	var err error
+	logRoot, err = ioutil.TempDir("", "log-tests")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(logRoot)
+	sa, err := NewFileAdapter()
+	if err != nil {
+		t.Error(err)
+	}
+	a := sa.(*fileAdapter)
+	if err := a.SetRetention(app, Retention{Lines: 4}); err != nil {
+		t.Fatal(err)
+	}
+	// The file is rotated every 2 lines, keeping the previous 2
+	for i := 0; i < 7; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	page, err := a.Read(context.Background(), app, ReadOptions{Lines: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(page.Lines, ",") != "message 4,message 5,message 6" {
+		t.Errorf("expected lines from the current and previous generation, got %v", page.Lines)
+	}
+	// Cursors span both generations
+	after, err := a.Read(context.Background(), app, ReadOptions{Lines: 10, After: page.Cursors[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(after.Lines, ",") != "message 5,message 6" {
+		t.Errorf("expected the lines after the first, got %v", after.Lines)
+	}
+	before, err := a.Read(context.Background(), app, ReadOptions{Lines: 10, Before: page.Cursors[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(before.Lines, ",") != "message 4,message 5" {
+		t.Errorf("expected the lines before the last, got %v", before.Lines)
+	}
+	apps, err := a.Apps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 || apps[0].Lines != 3 || apps[0].Bytes != 30 {
+		t.Errorf("expected both generations to be described, got %+v", apps)
+	}
+	if err := a.SetRetention(app, Retention{MaxAge: -time.Second}); err == nil {
+		t.Error("expected an error for a negative limit")
+	}
+	if err := a.Destroy(context.Background(), app); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(logRoot, app+".log.1")); !os.IsNotExist(err) {
+		t.Errorf("expected the previous generation to be destroyed, got %v", err)
+	}
+}
+
+func TestCursorsAcrossRotation(t *testing.T) {
+	var err error
+	logRoot, err = ioutil.TempDir("", "log-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logRoot)
+	sa, err := NewFileAdapter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := sa.(*fileAdapter)
+	// The file is rotated every 2 lines, keeping the previous 2
+	if err := a.SetRetention(app, Retention{Lines: 4}); err != nil {
+		t.Fatal(err)
+	}
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	read := func(opts ReadOptions) string {
+		opts.Lines = 10
+		page, err := a.Read(context.Background(), app, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(page.Lines, ",")
+	}
+	write(0, 2)
+	page, err := a.Read(context.Background(), app, ReadOptions{Lines: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := page.Cursors
+	write(2, 4)
+	// the first generation is now the previous one
+	if lines := read(ReadOptions{After: first[0]}); lines != "message 1,message 2,message 3" {
+		t.Errorf("expected the lines after the first, got %v", lines)
+	}
+	if lines := read(ReadOptions{Before: first[1]}); lines != "message 0" {
+		t.Errorf("expected the lines before the second, got %v", lines)
+	}
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := page.Cursors
+	write(4, 5)
+	// the first generation was rotated away
+	if lines := read(ReadOptions{After: first[1]}); lines != "message 2,message 3,message 4" {
+		t.Errorf("expected every line kept after a line rotated away, got %v", lines)
+	}
+	if lines := read(ReadOptions{Before: first[1]}); lines != "" {
+		t.Errorf("expected no lines before a line rotated away, got %v", lines)
+	}
+	if lines := read(ReadOptions{After: second[3]}); lines != "message 4" {
+		t.Errorf("expected the lines after the fourth, got %v", lines)
+	}
+	if lines := read(ReadOptions{After: "9.0"}); lines != "" {
+		t.Errorf("expected no lines after a newer generation, got %v", lines)
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10, After: "1"}); err == nil {
+		t.Error("expected an error for a cursor without a generation")
+	}
+}
+
+func TestFileAdapterCompression(t *testing.T) {
+	var err error
+	logRoot, err = ioutil.TempDir("", "log-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logRoot)
+	a, err := NewFileAdapter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lines written before compression was turned on are read along with compressed lines
+	if err := a.Write(context.Background(), app, compressibleLine); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("DEIS_LOGGER_COMPRESSION", "zstd")
+	defer os.Unsetenv("DEIS_LOGGER_COMPRESSION")
+	if a, err = NewFileAdapter(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Write(context.Background(), app, compressibleLine); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(logRoot, app+".log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); len(lines) != 2 || lines[1][0] != lineMarker {
+		t.Errorf("Expected an uncompressed and a compressed line, got %q", lines)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10, Query: "healthz"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0] != compressibleLine || messages[1] != compressibleLine {
+		t.Errorf("Expected %q twice, got %q", compressibleLine, messages)
+	}
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"regexp"
+	"strings"
+)
+
+// matcher returns a function reporting whether a line matches the options' query. Without a query,
+// every line matches.
+func (o ReadOptions) matcher() (func(string) bool, error) {
+	switch {
+	case o.Query == "":
+		return func(string) bool { return true }, nil
+	case o.Regexp:
+		expr := o.Query
+		if o.IgnoreCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, newErrInvalidArgument("Invalid query: %s", err)
+		}
+		return re.MatchString, nil
+	case o.IgnoreCase:
+		return regexp.MustCompile("(?i)" + regexp.QuoteMeta(o.Query)).MatchString, nil
+	default:
+		query := o.Query
+		return func(line string) bool { return strings.Contains(line, query) }, nil
+	}
+}
+
+// filtered reports whether the options select lines by their content or time, so that more lines
+// than requested may have to be scanned to find them
+func (o ReadOptions) filtered() bool {
+	return o.Query != "" || o.timeBounded()
+}
+
+// grepper collects a page of the lines matching a query, and the context lines around every
+// match, from lines that are scanned one by one. As context is symmetric, lines may be scanned
+// either oldest or newest first. Every line is a match if there is no query.
+type grepper struct {
+	match   func(string) bool
+	limit   int
+	context int
+	page    *Page
+	matches int
+	// held are the most recently scanned lines that don't match, in case the next line does
+	held []heldLine
+	// trailing is the number of lines still to be collected as context of the last match
+	trailing int
+}
+
+type heldLine struct {
+	line     string
+	metadata *Metadata
+	id       string
+	cursor   string
+}
+
+func newGrepper(opts ReadOptions) (*grepper, error) {
+	match, err := opts.matcher()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Context < 0 {
+		return nil, newErrInvalidArgument("Invalid number of context lines: %d", opts.Context)
+	}
+	return &grepper{match: match, limit: opts.Lines, context: opts.Context, page: &Page{}}, nil
+}
+
+// add scans a stored line, collecting it if it matches or is context of a match. The query is
+// matched against the line, not the metadata stored along with it.
+func (g *grepper) add(stored string, cursor string) {
+	line, metadata, id := splitRecordID(stored)
+	if g.matches < g.limit && g.match(line) {
+		for _, held := range g.held {
+			g.page.addRecord(held.line, held.metadata, held.id, held.cursor)
+		}
+		g.held = g.held[:0]
+		g.page.addRecord(line, metadata, id, cursor)
+		g.matches++
+		g.trailing = g.context
+		return
+	}
+	if g.trailing > 0 {
+		g.page.addRecord(line, metadata, id, cursor)
+		g.trailing--
+		return
+	}
+	if g.context > 0 && g.matches < g.limit {
+		if len(g.held) == g.context {
+			g.held = g.held[1:]
+		}
+		g.held = append(g.held, heldLine{line: line, metadata: metadata, id: id, cursor: cursor})
+	}
+}
+
+// done reports whether every requested match, and the context following the last, was collected
+func (g *grepper) done() bool {
+	return g.matches >= g.limit && g.trailing == 0
+}
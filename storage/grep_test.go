@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		opts     ReadOptions
+		line     string
+		expected bool
+	}{
+		{ReadOptions{}, "anything", true},
+		{ReadOptions{Query: "rror"}, "an Error occurred", true},
+		{ReadOptions{Query: "ERROR"}, "an Error occurred", false},
+		{ReadOptions{Query: "ERROR", IgnoreCase: true}, "an Error occurred", true},
+		// Without Regexp, the query is matched literally
+		{ReadOptions{Query: "a.c", IgnoreCase: true}, "abc", false},
+		{ReadOptions{Query: "a.c", Regexp: true}, "abc", true},
+		{ReadOptions{Query: "^GET /[a-z]+ 5\\d\\d$", Regexp: true}, "GET /healthz 503", true},
+		{ReadOptions{Query: "get", Regexp: true}, "GET /healthz 503", false},
+		{ReadOptions{Query: "get", Regexp: true, IgnoreCase: true}, "GET /healthz 503", true},
+	}
+	for _, test := range tests {
+		match, err := test.opts.matcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match(test.line) != test.expected {
+			t.Errorf("%+v matching %q: expected %v", test.opts, test.line, test.expected)
+		}
+	}
+	if _, err := (ReadOptions{Query: "(", Regexp: true}).matcher(); err == nil {
+		t.Error("expected an error for an invalid regular expression")
+	}
+}
+
+func TestGrepContext(t *testing.T) {
+	lines := make([]seqLine, 12)
+	for i := range lines {
+		line := fmt.Sprintf("message %d", i+1)
+		if i == 1 || i == 5 || i == 6 || i == 10 {
+			line += " match"
+		}
+		lines[i] = seqLine{seq: int64(i + 1), line: line}
+	}
+	tests := []struct {
+		opts     ReadOptions
+		expected []string
+	}{
+		{ReadOptions{Lines: 10, Query: "match"}, []string{"2", "6", "7", "11"}},
+		// The limit applies to the matches, most recent first
+		{ReadOptions{Lines: 2, Query: "match"}, []string{"7", "11"}},
+		{ReadOptions{Lines: 2, Query: "match", After: "2"}, []string{"6", "7"}},
+		// Context of matches that are close together overlaps
+		{ReadOptions{Lines: 10, Query: "match", Context: 1}, []string{"1", "2", "3", "5", "6", "7", "8", "10", "11", "12"}},
+		{ReadOptions{Lines: 2, Query: "match", Context: 1}, []string{"6", "7", "8", "10", "11", "12"}},
+		{ReadOptions{Lines: 1, Query: "match", Context: 2, After: "2"}, []string{"4", "5", "6", "7", "8"}},
+		{ReadOptions{Lines: 1, Query: "match", Context: 2, Before: "11"}, []string{"5", "6", "7", "8", "9"}},
+	}
+	for _, test := range tests {
+		page, err := selectPage(lines, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(page.Cursors, test.expected) {
+			t.Errorf("selectPage(%+v): expected cursors %v, got %v", test.opts, test.expected, page.Cursors)
+		}
+	}
+	if _, err := selectPage(lines, ReadOptions{Lines: 1, Context: -1}); err == nil {
+		t.Error("expected an error for a negative number of context lines")
+	}
+}
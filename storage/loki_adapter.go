@@ -0,0 +1,737 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	lokiPushPath   = "/loki/api/v1/push"
+	lokiQueryPath  = "/loki/api/v1/query_range"
+	lokiDeletePath = "/loki/api/v1/delete"
+	lokiAppsPath   = "/loki/api/v1/label/app/values"
+)
+
+type lokiEntry struct {
+	ts   time.Time
+	line string
+}
+
+type lokiStream struct {
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+type lokiQueryResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		Result []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// lokiAdapter pushes log lines to Grafana Loki, batching them into streams labeled by app,
+// process type, version and namespace, and reads them back with LogQL.
+type lokiAdapter struct {
+	started   bool
+	config    *lokiConfig
+	client    *http.Client
+	retention *retentions
+	// streams holds the lines that have not been pushed yet, keyed by their label selector
+	streams map[string]*lokiStream
+	pending int
+	mutex   sync.Mutex
+	stopCh  chan struct{}
+}
+
+// NewLokiAdapter returns a storage adapter that stores logs in Grafana Loki.
+func NewLokiAdapter() (Adapter, error) {
+	cfg, err := parseLokiConfig(appName)
+	if err != nil {
+		return nil, err
+	}
+	return newLokiAdapter(cfg)
+}
+
+func newLokiAdapter(cfg *lokiConfig) (*lokiAdapter, error) {
+	if cfg.Encoding != "protobuf" && cfg.Encoding != "json" {
+		return nil, fmt.Errorf("Invalid loki encoding: %s", cfg.Encoding)
+	}
+	if cfg.BatchLines <= 0 {
+		return nil, fmt.Errorf("Invalid batch size: %d", cfg.BatchLines)
+	}
+	return &lokiAdapter{
+		config:    cfg,
+		client:    &http.Client{},
+		retention: newRetentions(Retention{MaxAge: cfg.RetentionMaxAge}),
+		streams:   make(map[string]*lokiStream),
+		stopCh:    make(chan struct{}),
+	}, nil
+}
+
+// Start the storage adapter. Batches are pushed and retention is enforced periodically in the
+// background. Invocations of this function are not concurrency safe and multiple serialized
+// invocations have no effect.
+func (a *lokiAdapter) Start() {
+	if !a.started {
+		a.started = true
+		if a.config.BatchWait <= 0 && a.config.RetentionInterval <= 0 {
+			return
+		}
+		go func() {
+			var flushCh, retentionCh <-chan time.Time
+			if a.config.BatchWait > 0 {
+				ticker := time.NewTicker(a.config.BatchWait)
+				defer ticker.Stop()
+				flushCh = ticker.C
+			}
+			if a.config.RetentionInterval > 0 {
+				ticker := time.NewTicker(a.config.RetentionInterval)
+				defer ticker.Stop()
+				retentionCh = ticker.C
+			}
+			for {
+				select {
+				case <-a.stopCh:
+					return
+				case <-flushCh:
+					if err := a.flush(context.Background()); err != nil {
+						log.Println(err)
+					}
+				case <-retentionCh:
+					if err := a.enforceRetention(context.Background()); err != nil {
+						log.Printf("Error enforcing retention: %s", err)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Write adds a log message, labeled only by app, to the next batch
+func (a *lokiAdapter) Write(ctx context.Context, app string, message string) error {
+	return a.WriteWithMetadata(ctx, app, message, Metadata{})
+}
+
+// WriteWithMetadata adds a log message to the next batch, labeled by app and the process type,
+// version and namespace from its metadata
+func (a *lokiAdapter) WriteWithMetadata(ctx context.Context, app string, message string, metadata Metadata) error {
+	labels := map[string]string{"app": app}
+	for name, value := range map[string]string{
+		"process":   metadata.Process,
+		"version":   metadata.Version,
+		"namespace": metadata.Namespace,
+	} {
+		if value != "" {
+			labels[name] = value
+		}
+	}
+	ts := metadata.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	selector := lokiSelector(labels)
+	a.mutex.Lock()
+	stream, ok := a.streams[selector]
+	if !ok {
+		stream = &lokiStream{labels: labels}
+		a.streams[selector] = stream
+	}
+	stream.entries = append(stream.entries, lokiEntry{ts: ts, line: message})
+	a.pending++
+	full := a.pending >= a.config.BatchLines
+	a.mutex.Unlock()
+	if full {
+		return a.flush(ctx)
+	}
+	return nil
+}
+
+// Read retrieves a specified number of log lines for an app, optionally limited to a single
+// process type and a time range, using LogQL range queries. The query is applied as a line filter
+// expression, but context lines can't be read. Lines sharing a timestamp are ordered by their
+// stream, and cursors point at a line by its timestamp and its position among the lines read at
+// that timestamp, so paging doesn't skip any of them.
+func (a *lokiAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	if opts.Lines <= 0 {
+		return &Page{}, nil
+	}
+	if opts.Context != 0 {
+		return nil, newErrInvalidArgument("Context lines are not supported by the loki storage adapter")
+	}
+	match, err := opts.matcher()
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{"app": app}
+	if opts.Process != "" {
+		labels["process"] = opts.Process
+	}
+	logQL := lokiSelector(labels) + lokiLineFilter(opts)
+	end := opts.Until
+	if end.IsZero() {
+		end = time.Now()
+	}
+	start := opts.Since
+	if start.IsZero() {
+		start = end.Add(-a.config.QueryLookback)
+	}
+	// The end of a range query is exclusive, its start is not
+	startNs, endNs := start.UnixNano(), end.UnixNano()
+	var lines []lokiLine
+	switch {
+	case opts.Before != "":
+		c, err := parseLokiCursor(opts.Before)
+		if err != nil {
+			return nil, err
+		}
+		if c.ts >= endNs {
+			lines, err = a.query(ctx, logQL, startNs, endNs, opts.Lines, false)
+		} else if c.newer >= 0 {
+			lines, err = a.query(ctx, logQL, startNs, c.ts+1, opts.Lines+c.newer+1, false)
+			// the cursor's line and the lines following it at its timestamp are skipped
+			lines = skipLokiLines(lines, func(line lokiLine) bool {
+				return line.cursor.ts == c.ts && line.cursor.newer <= c.newer
+			})
+		} else {
+			lines, err = a.queryAround(ctx, logQL, startNs, c.ts, c.ts, opts.Lines, c.older, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+	case opts.After != "":
+		c, err := parseLokiCursor(opts.After)
+		if err != nil {
+			return nil, err
+		}
+		if c.ts < startNs && !opts.Since.IsZero() {
+			lines, err = a.query(ctx, logQL, startNs, endNs, opts.Lines, true)
+		} else if c.older >= 0 {
+			lines, err = a.query(ctx, logQL, c.ts, endNs, opts.Lines+c.older+1, true)
+			// the cursor's line and the lines preceding it at its timestamp are skipped
+			lines = skipLokiLines(lines, func(line lokiLine) bool {
+				return line.cursor.ts == c.ts && line.cursor.older <= c.older
+			})
+		} else {
+			lines, err = a.queryAround(ctx, logQL, c.ts+1, endNs, c.ts, opts.Lines, c.newer, true)
+		}
+		if err != nil {
+			return nil, err
+		}
+	default:
+		if lines, err = a.query(ctx, logQL, startNs, endNs, opts.Lines, false); err != nil {
+			return nil, err
+		}
+	}
+	page := &Page{}
+	for _, line := range lines {
+		if opts.inTimeRange(line.ts) && match(line.line) {
+			page.add(line.line, line.cursor.String())
+		}
+	}
+	if len(page.Lines) == 0 {
+		return nil, newErrNotFound(app)
+	}
+	page.limit(opts.Lines, opts.After != "")
+	return page, nil
+}
+
+// queryAround reads the lines next to a cursor that only counts the lines at its timestamp on the
+// far side of it: up to n lines logged from start up to end, and the given number of lines at the
+// cursor's timestamp ts, which are the newest of them when reading forward and the oldest when
+// reading backward.
+func (a *lokiAdapter) queryAround(ctx context.Context, logQL string, start int64, end int64, ts int64, n int, count int, forward bool) ([]lokiLine, error) {
+	var atCursor []lokiLine
+	if count > 0 {
+		var err error
+		if atCursor, err = a.query(ctx, logQL, ts, ts+1, count, !forward); err != nil {
+			return nil, err
+		}
+	}
+	lines, err := a.query(ctx, logQL, start, end, n, forward)
+	if err != nil {
+		return nil, err
+	}
+	if forward {
+		return append(atCursor, lines...), nil
+	}
+	return append(lines, atCursor...), nil
+}
+
+// query reads up to limit lines logged from start up to end, in nanoseconds, with a LogQL range
+// query, and returns them oldest first along with their cursors. Loki stops reading at the limit,
+// so when it is reached, the lines read at the oldest timestamp may not be all of them when reading
+// backward, nor those at the newest timestamp when reading forward.
+func (a *lokiAdapter) query(ctx context.Context, logQL string, start int64, end int64, limit int, forward bool) ([]lokiLine, error) {
+	if limit <= 0 || start >= end {
+		return nil, nil
+	}
+	direction := "backward"
+	if forward {
+		direction = "forward"
+	}
+	query := url.Values{}
+	query.Set("query", logQL)
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("direction", direction)
+	query.Set("start", strconv.FormatInt(start, 10))
+	query.Set("end", strconv.FormatInt(end, 10))
+	body, err := a.do(ctx, "GET", lokiQueryPath+"?"+query.Encode(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(lokiQueryResponse)
+	if err := json.Unmarshal(body, resp); err != nil {
+		return nil, err
+	}
+	var lines []lokiLine
+	for _, stream := range resp.Data.Result {
+		selector := lokiSelector(stream.Stream)
+		first := len(lines)
+		for _, value := range stream.Values {
+			ns, err := strconv.ParseInt(value[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid loki timestamp: %s", value[0])
+			}
+			lines = append(lines, lokiLine{lokiEntry: lokiEntry{ts: time.Unix(0, ns), line: value[1]}, stream: selector})
+		}
+		if !forward {
+			// loki returns the newest lines first when reading backward
+			for i, j := first, len(lines)-1; i < j; i, j = i+1, j-1 {
+				lines[i], lines[j] = lines[j], lines[i]
+			}
+		}
+	}
+	// Lines from different streams are interleaved by time
+	sort.SliceStable(lines, func(i, j int) bool {
+		if !lines[i].ts.Equal(lines[j].ts) {
+			return lines[i].ts.Before(lines[j].ts)
+		}
+		return lines[i].stream < lines[j].stream
+	})
+	truncated := len(lines) >= limit
+	if len(lines) > limit {
+		if forward {
+			lines = lines[:limit]
+		} else {
+			lines = lines[len(lines)-limit:]
+		}
+	}
+	for i := 0; i < len(lines); {
+		ts := lines[i].ts.UnixNano()
+		j := i
+		for j < len(lines) && lines[j].ts.UnixNano() == ts {
+			j++
+		}
+		for k := i; k < j; k++ {
+			lines[k].cursor = lokiCursor{ts: ts, older: k - i, newer: j - 1 - k}
+			if truncated && !forward && i == 0 {
+				lines[k].cursor.older = -1
+			}
+			if truncated && forward && j == len(lines) {
+				lines[k].cursor.newer = -1
+			}
+		}
+		i = j
+	}
+	return lines, nil
+}
+
+// lokiLine is a line read from loki, along with the selector of its stream and its cursor
+type lokiLine struct {
+	lokiEntry
+	stream string
+	cursor lokiCursor
+}
+
+// skipLokiLines returns the lines that skip doesn't hold
+func skipLokiLines(lines []lokiLine, skip func(lokiLine) bool) []lokiLine {
+	kept := lines[:0]
+	for _, line := range lines {
+		if !skip(line) {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
+
+// lokiCursor points at a line by its timestamp in nanoseconds and the number of lines at that
+// timestamp that are older and newer than it. A count is -1 if the read returning the line didn't
+// return every line on that side of it, and at least one of them is known.
+type lokiCursor struct {
+	ts    int64
+	older int
+	newer int
+}
+
+func parseLokiCursor(cursor string) (lokiCursor, error) {
+	parts := strings.Split(cursor, ":")
+	if len(parts) != 3 {
+		return lokiCursor{}, newErrInvalidArgument("Invalid cursor: %s", cursor)
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return lokiCursor{}, newErrInvalidArgument("Invalid cursor: %s", cursor)
+	}
+	c := lokiCursor{ts: ts, older: -1, newer: -1}
+	for i, count := range []*int{&c.older, &c.newer} {
+		if parts[i+1] == "" {
+			continue
+		}
+		if *count, err = strconv.Atoi(parts[i+1]); err != nil || *count < 0 {
+			return lokiCursor{}, newErrInvalidArgument("Invalid cursor: %s", cursor)
+		}
+	}
+	if c.older < 0 && c.newer < 0 {
+		return lokiCursor{}, newErrInvalidArgument("Invalid cursor: %s", cursor)
+	}
+	return c, nil
+}
+
+func (c lokiCursor) String() string {
+	counts := make([]string, 2)
+	for i, count := range []int{c.older, c.newer} {
+		if count >= 0 {
+			counts[i] = strconv.Itoa(count)
+		}
+	}
+	return strconv.FormatInt(c.ts, 10) + ":" + counts[0] + ":" + counts[1]
+}
+
+// Apps lists the values of the app label of lines logged within the query lookback. Loki can't
+// tell the number or size of their lines without querying all of them.
+func (a *lokiAdapter) Apps(ctx context.Context) ([]AppInfo, error) {
+	end := time.Now()
+	query := url.Values{}
+	query.Set("start", strconv.FormatInt(end.Add(-a.config.QueryLookback).UnixNano(), 10))
+	query.Set("end", strconv.FormatInt(end.UnixNano(), 10))
+	body, err := a.do(ctx, "GET", lokiAppsPath+"?"+query.Encode(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := struct {
+		Data []string `json:"data"`
+	}{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	apps := make([]AppInfo, len(resp.Data))
+	for i, app := range resp.Data {
+		apps[i] = AppInfo{Name: app}
+	}
+	return apps, nil
+}
+
+// Destroy requests the deletion of every log line of the specified application. Loki only
+// deletes lines if its compactor has deletion enabled.
+func (a *lokiAdapter) Destroy(ctx context.Context, app string) error {
+	a.mutex.Lock()
+	for selector, stream := range a.streams {
+		if stream.labels["app"] == app {
+			a.pending -= len(stream.entries)
+			delete(a.streams, selector)
+		}
+	}
+	a.mutex.Unlock()
+	query := url.Values{}
+	query.Set("query", lokiSelector(map[string]string{"app": app}))
+	query.Set("start", "0")
+	_, err := a.do(ctx, "POST", lokiDeletePath+"?"+query.Encode(), "", nil)
+	return err
+}
+
+// SetRetention overrides the maximum age of the lines kept for an app. Loki can't limit the number
+// or size of an app's lines.
+func (a *lokiAdapter) SetRetention(app string, retention Retention) error {
+	if err := retention.limits("loki", false, false, true); err != nil {
+		return err
+	}
+	a.retention.set(app, retention)
+	return nil
+}
+
+// Retention returns the limits of the lines kept for an app
+func (a *lokiAdapter) Retention(app string) Retention {
+	return a.retention.get(app)
+}
+
+// enforceRetention requests, for every app with a maximum age, the deletion of its lines older
+// than that. Only the apps with lines within the query lookback are listed, and loki only deletes
+// lines if its compactor has deletion enabled.
+func (a *lokiAdapter) enforceRetention(ctx context.Context) error {
+	if !a.retention.expires() {
+		return nil
+	}
+	apps, err := a.Apps(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, app := range apps {
+		maxAge := a.retention.get(app.Name).MaxAge
+		if maxAge <= 0 {
+			continue
+		}
+		query := url.Values{}
+		query.Set("query", lokiSelector(map[string]string{"app": app.Name}))
+		query.Set("start", "0")
+		query.Set("end", strconv.FormatInt(now.Add(-maxAge).Unix(), 10))
+		if _, err := a.do(ctx, "POST", lokiDeletePath+"?"+query.Encode(), "", nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reopen the storage adapter-- in the case of this implementation, a no-op
+func (a *lokiAdapter) Reopen() error {
+	return nil
+}
+
+// Stop the storage adapter, pushing any batched lines. Additional writes may not be performed
+// after stopping.
+func (a *lokiAdapter) Stop() {
+	close(a.stopCh)
+	if err := a.flush(context.Background()); err != nil {
+		log.Println(err)
+	}
+}
+
+// flush pushes every batched line to loki
+func (a *lokiAdapter) flush(ctx context.Context) error {
+	a.mutex.Lock()
+	if a.pending == 0 {
+		a.mutex.Unlock()
+		return nil
+	}
+	streams := make([]*lokiStream, 0, len(a.streams))
+	for _, stream := range a.streams {
+		streams = append(streams, stream)
+	}
+	a.streams = make(map[string]*lokiStream)
+	a.pending = 0
+	a.mutex.Unlock()
+	return a.push(ctx, streams)
+}
+
+// push sends streams to loki. If that fails, the streams are put back in front of the lines
+// batched since, so they are retried with the next batch. Loki refuses a whole push if any of its
+// lines is invalid, for instance too old, so a refused push of several streams is retried stream
+// by stream. Loki ignores lines it already holds, so the lines of the streams it accepted aren't
+// duplicated. The streams loki refuses on their own are logged, dropped and counted as
+// loki.rejected_lines.
+func (a *lokiAdapter) push(ctx context.Context, streams []*lokiStream) error {
+	var body []byte
+	var contentType string
+	if a.config.Encoding == "json" {
+		var err error
+		if body, err = encodeLokiJSON(streams); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	} else {
+		body = snappy.Encode(nil, encodeLokiProtobuf(streams))
+		contentType = "application/x-protobuf"
+	}
+	_, err := a.do(ctx, "POST", lokiPushPath, contentType, bytes.NewReader(body))
+	if err == nil {
+		return nil
+	}
+	if _, invalid := err.(ErrInvalidArgument); !invalid {
+		a.requeue(streams)
+		return err
+	}
+	if len(streams) == 1 {
+		lines := len(streams[0].entries)
+		log.Printf("Dropping %d lines of loki stream %s: %s", lines, lokiSelector(streams[0].labels), err)
+		metrics.Add("loki.rejected_lines", int64(lines))
+		return nil
+	}
+	for i := range streams {
+		if err := a.push(ctx, streams[i:i+1]); err != nil {
+			a.requeue(streams[i+1:])
+			return err
+		}
+	}
+	return nil
+}
+
+// requeue puts streams that couldn't be pushed back in front of the lines batched since. Up to ten
+// batches are buffered while loki is unavailable, and the oldest lines beyond that are dropped.
+func (a *lokiAdapter) requeue(streams []*lokiStream) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, stream := range streams {
+		a.pending += len(stream.entries)
+		selector := lokiSelector(stream.labels)
+		if batched, ok := a.streams[selector]; ok {
+			stream.entries = append(stream.entries, batched.entries...)
+		}
+		a.streams[selector] = stream
+	}
+	var dropped int64
+	for max := 10 * a.config.BatchLines; a.pending > max; a.pending-- {
+		var oldest *lokiStream
+		for _, stream := range a.streams {
+			if len(stream.entries) > 0 && (oldest == nil || stream.entries[0].ts.Before(oldest.entries[0].ts)) {
+				oldest = stream
+			}
+		}
+		oldest.entries = oldest.entries[1:]
+		dropped++
+	}
+	for selector, stream := range a.streams {
+		if len(stream.entries) == 0 {
+			delete(a.streams, selector)
+		}
+	}
+	if dropped > 0 {
+		metrics.Add("loki.dropped_lines", dropped)
+	}
+}
+
+// do sends a request to loki, giving up after the request timeout. Loki answers 429 once a tenant
+// exceeds its ingestion or query limits, and 400 to queries it can't parse and to pushes holding
+// invalid lines.
+func (a *lokiAdapter) do(ctx context.Context, method string, path string, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(a.config.URL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	reqCtx, cancel := withTimeout(ctx, a.config.RequestTimeout)
+	defer cancel()
+	req = req.WithContext(reqCtx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if a.config.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", a.config.TenantID)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, unavailable(ctx, "loki", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, unavailable(ctx, "loki", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("%s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(respBody)))
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests:
+			return nil, newErrQuotaExceeded("loki", err)
+		case http.StatusBadRequest:
+			return nil, newErrInvalidArgument("%s", err)
+		default:
+			return nil, newErrUnavailable("loki", err)
+		}
+	}
+	return respBody, nil
+}
+
+// lokiSelector returns the LogQL stream selector matching exactly the given labels
+func lokiSelector(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%s", name, strconv.Quote(labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// lokiLineFilter returns the LogQL line filter expression matching the lines that match the
+// options' query
+func lokiLineFilter(opts ReadOptions) string {
+	switch {
+	case opts.Query == "":
+		return ""
+	case opts.Regexp && opts.IgnoreCase:
+		return " |~ " + strconv.Quote("(?i)"+opts.Query)
+	case opts.Regexp:
+		return " |~ " + strconv.Quote(opts.Query)
+	case opts.IgnoreCase:
+		return " |~ " + strconv.Quote("(?i)"+regexp.QuoteMeta(opts.Query))
+	default:
+		return " |= " + strconv.Quote(opts.Query)
+	}
+}
+
+func encodeLokiJSON(streams []*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	req := struct {
+		Streams []jsonStream `json:"streams"`
+	}{Streams: make([]jsonStream, len(streams))}
+	for i, stream := range streams {
+		values := make([][2]string, len(stream.entries))
+		for j, entry := range stream.entries {
+			values[j] = [2]string{strconv.FormatInt(entry.ts.UnixNano(), 10), entry.line}
+		}
+		req.Streams[i] = jsonStream{Stream: stream.labels, Values: values}
+	}
+	return json.Marshal(req)
+}
+
+// encodeLokiProtobuf encodes streams as a logproto.PushRequest:
+//
+//	message PushRequest { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	message EntryAdapter { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func encodeLokiProtobuf(streams []*lokiStream) []byte {
+	var req []byte
+	for _, stream := range streams {
+		msg := appendProtoBytes(nil, 1, []byte(lokiSelector(stream.labels)))
+		for _, entry := range stream.entries {
+			ts := appendProtoVarint(nil, 1, uint64(entry.ts.Unix()))
+			ts = appendProtoVarint(ts, 2, uint64(entry.ts.Nanosecond()))
+			e := appendProtoBytes(nil, 1, ts)
+			e = appendProtoBytes(e, 2, []byte(entry.line))
+			msg = appendProtoBytes(msg, 2, e)
+		}
+		req = appendProtoBytes(req, 1, msg)
+	}
+	return req
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = appendUvarint(b, uint64(field<<3))
+	return appendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = appendUvarint(b, uint64(field<<3|2))
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
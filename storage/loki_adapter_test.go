@@ -0,0 +1,733 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// lokiStandIn is a minimal stand-in for the loki HTTP API. It stores pushed lines by stream and
+// answers range queries with exact label matchers, returning the newest lines first when reading
+// backward. Delete requests remove the lines of the matching streams logged before their end, which
+// is now if unset.
+type lokiStandIn struct {
+	*httptest.Server
+	streams map[string][][2]string
+	deleted []string
+	pushes  int
+	// failures is the number of pushes to fail before accepting them again
+	failures int
+	// rejected holds the selectors of streams refused as invalid, along with the rest of their push
+	rejected map[string]bool
+	encoding string
+	mutex    sync.Mutex
+}
+
+var lokiMatcherRegex = regexp.MustCompile(`(\w+)="((?:[^"\\]|\\.)*)"`)
+
+var lokiLineFilterRegex = regexp.MustCompile(`\} (\|[=~]) ("(?:[^"\\]|\\.)*")$`)
+
+func newLokiStandIn(t *testing.T) *lokiStandIn {
+	s := &lokiStandIn{streams: make(map[string][][2]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(lokiPushPath, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.pushes++
+		if s.failures > 0 {
+			s.failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var pushed map[string][][2]string
+		if r.Header.Get("Content-Type") == "application/json" {
+			s.encoding = "json"
+			pushed = map[string][][2]string{}
+			req := struct {
+				Streams []struct {
+					Stream map[string]string `json:"stream"`
+					Values [][2]string       `json:"values"`
+				} `json:"streams"`
+			}{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				t.Errorf("invalid push request: %s", err)
+			}
+			for _, stream := range req.Streams {
+				pushed[lokiSelector(stream.Stream)] = stream.Values
+			}
+		} else {
+			s.encoding = "protobuf"
+			decoded, err := snappy.Decode(nil, body)
+			if err != nil {
+				t.Errorf("invalid snappy body: %s", err)
+			}
+			pushed = decodeLokiProtobuf(t, decoded)
+		}
+		for selector := range pushed {
+			if s.rejected[selector] {
+				http.Error(w, "entry too far behind", http.StatusBadRequest)
+				return
+			}
+		}
+		for selector, values := range pushed {
+			s.streams[selector] = append(s.streams[selector], values...)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc(lokiQueryPath, func(w http.ResponseWriter, r *http.Request) {
+		matchers := map[string]string{}
+		for _, m := range lokiMatcherRegex.FindAllStringSubmatch(r.URL.Query().Get("query"), -1) {
+			matchers[m[1]], _ = strconv.Unquote(`"` + m[2] + `"`)
+		}
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		// Timestamps of the same length compare like the numbers they represent
+		start, end := r.URL.Query().Get("start"), r.URL.Query().Get("end")
+		lineMatches := func(line string) bool { return true }
+		if m := lokiLineFilterRegex.FindStringSubmatch(r.URL.Query().Get("query")); m != nil {
+			filter, _ := strconv.Unquote(m[2])
+			if m[1] == "|=" {
+				lineMatches = func(line string) bool { return strings.Contains(line, filter) }
+			} else {
+				lineMatches = regexp.MustCompile(filter).MatchString
+			}
+		}
+		resp := new(lokiQueryResponse)
+		resp.Status = "success"
+		s.mutex.Lock()
+		for selector, values := range s.streams {
+			labels := map[string]string{}
+			for _, m := range lokiMatcherRegex.FindAllStringSubmatch(selector, -1) {
+				labels[m[1]], _ = strconv.Unquote(`"` + m[2] + `"`)
+			}
+			matched := true
+			for name, value := range matchers {
+				if labels[name] != value {
+					matched = false
+				}
+			}
+			if !matched {
+				continue
+			}
+			inRange := [][2]string{}
+			for _, value := range values {
+				if value[0] >= start && value[0] < end && lineMatches(value[1]) {
+					inRange = append(inRange, value)
+				}
+			}
+			values = inRange
+			// direction=backward returns the newest lines, newest first
+			if r.URL.Query().Get("direction") != "forward" {
+				for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+					values[i], values[j] = values[j], values[i]
+				}
+			}
+			if len(values) > limit {
+				values = values[:limit]
+			}
+			resp.Data.Result = append(resp.Data.Result, struct {
+				Stream map[string]string `json:"stream"`
+				Values [][2]string       `json:"values"`
+			}{Stream: labels, Values: values})
+		}
+		s.mutex.Unlock()
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc(lokiAppsPath, func(w http.ResponseWriter, r *http.Request) {
+		apps := map[string]bool{}
+		s.mutex.Lock()
+		for selector := range s.streams {
+			for _, m := range lokiMatcherRegex.FindAllStringSubmatch(selector, -1) {
+				if m[1] == "app" {
+					app, _ := strconv.Unquote(`"` + m[2] + `"`)
+					apps[app] = true
+				}
+			}
+		}
+		s.mutex.Unlock()
+		resp := struct {
+			Status string   `json:"status"`
+			Data   []string `json:"data"`
+		}{Status: "success", Data: []string{}}
+		for app := range apps {
+			resp.Data = append(resp.Data, app)
+		}
+		sort.Strings(resp.Data)
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc(lokiDeletePath, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		end := time.Now()
+		if seconds, err := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64); err == nil {
+			end = time.Unix(seconds, 0)
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.deleted = append(s.deleted, query)
+		for selector, values := range s.streams {
+			if !strings.HasPrefix(selector, strings.TrimSuffix(query, "}")) {
+				continue
+			}
+			kept := [][2]string{}
+			for _, value := range values {
+				if ns, _ := strconv.ParseInt(value[0], 10, 64); ns >= end.UnixNano() {
+					kept = append(kept, value)
+				}
+			}
+			s.streams[selector] = kept
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func decodeProtoFields(t *testing.T, b []byte) map[int][][]byte {
+	fields := map[int][][]byte{}
+	readUvarint := func() uint64 {
+		var v uint64
+		for shift := uint(0); ; shift += 7 {
+			c := b[0]
+			b = b[1:]
+			v |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				return v
+			}
+		}
+	}
+	for len(b) > 0 {
+		tag := readUvarint()
+		switch tag & 7 {
+		case 0:
+			fields[int(tag>>3)] = append(fields[int(tag>>3)], []byte(strconv.FormatUint(readUvarint(), 10)))
+		case 2:
+			n := readUvarint()
+			fields[int(tag>>3)] = append(fields[int(tag>>3)], b[:n])
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+func decodeLokiProtobuf(t *testing.T, b []byte) map[string][][2]string {
+	streams := map[string][][2]string{}
+	for _, stream := range decodeProtoFields(t, b)[1] {
+		fields := decodeProtoFields(t, stream)
+		selector := string(fields[1][0])
+		for _, entry := range fields[2] {
+			entryFields := decodeProtoFields(t, entry)
+			ts := decodeProtoFields(t, entryFields[1][0])
+			seconds, _ := strconv.ParseInt(string(ts[1][0]), 10, 64)
+			nanos, _ := strconv.ParseInt(string(ts[2][0]), 10, 64)
+			ns := strconv.FormatInt(time.Unix(seconds, nanos).UnixNano(), 10)
+			streams[selector] = append(streams[selector], [2]string{ns, string(entryFields[2][0])})
+		}
+	}
+	return streams
+}
+
+func newTestLokiAdapter(t *testing.T, url string, encoding string, batchLines int) *lokiAdapter {
+	a, err := newLokiAdapter(&lokiConfig{
+		URL:           url,
+		Encoding:      encoding,
+		BatchLines:    batchLines,
+		QueryLookback: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestLokiWithBadConfig(t *testing.T) {
+	if _, err := newLokiAdapter(&lokiConfig{Encoding: "xml", BatchLines: 1}); err == nil {
+		t.Error("Expected an error for an invalid encoding")
+	}
+	if _, err := newLokiAdapter(&lokiConfig{Encoding: "json", BatchLines: 0}); err == nil {
+		t.Error("Expected an error for an invalid batch size")
+	}
+}
+
+func TestLokiReadFromNonExistingApp(t *testing.T) {
+	s := newLokiStandIn(t)
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "json", 10)
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if messages != nil {
+		t.Error("Expected no messages, but got some")
+	}
+	if err == nil || err.Error() != fmt.Sprintf("Could not find logs for '%s'", app) {
+		t.Error("Did not receive expected error message")
+	}
+}
+
+func TestLokiLogs(t *testing.T) {
+	for _, encoding := range []string{"json", "protobuf"} {
+		s := newLokiStandIn(t)
+		a := newTestLokiAdapter(t, s.URL, encoding, 5)
+		// Queries end now, so lines are logged in the past
+		now := time.Now().Add(-time.Second)
+		for i := 0; i < 5; i++ {
+			process := "web"
+			if i%2 == 1 {
+				process = "worker"
+			}
+			metadata := Metadata{Time: now.Add(time.Duration(i) * time.Millisecond), Process: process, Version: "v2", Namespace: app}
+			if err := a.WriteWithMetadata(context.Background(), app, fmt.Sprintf("message %d", i), metadata); err != nil {
+				t.Error(err)
+			}
+		}
+		// A full batch is pushed as a single request
+		if s.pushes != 1 || s.encoding != encoding {
+			t.Errorf("expected 1 %s push, got %d %s pushes", encoding, s.pushes, s.encoding)
+		}
+		selector := lokiSelector(map[string]string{"app": app, "namespace": app, "process": "web", "version": "v2"})
+		if len(s.streams[selector]) != 3 {
+			t.Errorf("expected 3 lines in stream %s, got %d", selector, len(s.streams[selector]))
+		}
+		// Lines of every stream are merged in time order
+		messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 3}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(messages, []string{"message 2", "message 3", "message 4"}) {
+			t.Errorf("unexpected messages: %v", messages)
+		}
+		messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10, Process: "worker"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(messages, []string{"message 1", "message 3"}) {
+			t.Errorf("unexpected worker messages: %v", messages)
+		}
+		s.Close()
+	}
+}
+
+func TestLokiTimeRange(t *testing.T) {
+	s := newLokiStandIn(t)
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "json", 5)
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		metadata := Metadata{Time: start.Add(time.Duration(i) * time.Minute)}
+		if err := a.WriteWithMetadata(context.Background(), app, fmt.Sprintf("message %d", i), metadata); err != nil {
+			t.Error(err)
+		}
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10, Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(messages, []string{"message 1", "message 2"}) {
+		t.Errorf("unexpected messages: %v", messages)
+	}
+}
+
+func TestLokiQuery(t *testing.T) {
+	s := newLokiStandIn(t)
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "json", 6)
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 6; i++ {
+		metadata := Metadata{Time: start.Add(time.Duration(i) * time.Minute)}
+		if err := a.WriteWithMetadata(context.Background(), app, fmt.Sprintf("message %d: %s", i, []string{"Error", "ok"}[i%2]), metadata); err != nil {
+			t.Error(err)
+		}
+	}
+	tests := []struct {
+		opts     ReadOptions
+		expected []string
+	}{
+		{ReadOptions{Lines: 2, Query: "Error"}, []string{"message 2: Error", "message 4: Error"}},
+		{ReadOptions{Lines: 10, Query: "error"}, nil},
+		{ReadOptions{Lines: 1, Query: "error", IgnoreCase: true}, []string{"message 4: Error"}},
+		{ReadOptions{Lines: 10, Query: "^message [0-2]: o", Regexp: true}, []string{"message 1: ok"}},
+	}
+	for _, test := range tests {
+		messages, _ := readLines(a.Read(context.Background(), app, test.opts))
+		if !reflect.DeepEqual(messages, test.expected) {
+			t.Errorf("%+v: expected %v, got %v", test.opts, test.expected, messages)
+		}
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 1, Query: "Error", Context: 1}); err == nil {
+		t.Error("expected an error reading context lines")
+	}
+}
+
+func TestLokiLineFilter(t *testing.T) {
+	for expected, opts := range map[string]ReadOptions{
+		"":                     {},
+		` |= "a \"b\""`:        {Query: `a "b"`},
+		` |~ "(?i)a\\.b"`:      {Query: "a.b", IgnoreCase: true},
+		` |~ "^\\d+ (?:x|y)$"`: {Query: `^\d+ (?:x|y)$`, Regexp: true},
+		` |~ "(?i)^get"`:       {Query: "^get", Regexp: true, IgnoreCase: true},
+	} {
+		if filter := lokiLineFilter(opts); filter != expected {
+			t.Errorf("%+v: expected %s, got %s", opts, expected, filter)
+		}
+	}
+}
+
+func TestLokiCursors(t *testing.T) {
+	s := newLokiStandIn(t)
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "json", 5)
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		metadata := Metadata{Time: start.Add(time.Duration(i) * time.Minute)}
+		if err := a.WriteWithMetadata(context.Background(), app, fmt.Sprintf("message %d", i), metadata); err != nil {
+			t.Error(err)
+		}
+	}
+	page, err := a.Read(context.Background(), app, ReadOptions{Lines: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 2, Before: page.Before()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"message 1", "message 2"}) {
+		t.Errorf("unexpected messages before the last page: %v", page.Lines)
+	}
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 1, After: page.After()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"message 3"}) {
+		t.Errorf("unexpected messages after the page: %v", page.Lines)
+	}
+}
+
+func TestLokiCursorsSharingTimestamps(t *testing.T) {
+	s := newLokiStandIn(t)
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "json", 20)
+	ts := time.Now().Add(-time.Minute).Truncate(time.Second)
+	writes := []struct {
+		line    string
+		process string
+		offset  time.Duration
+	}{
+		{"before", "web", -time.Second},
+		{"web 0", "web", 0},
+		{"worker 0", "worker", 0},
+		{"web 1", "web", 0},
+		{"web 2", "web", 0},
+		{"worker 1", "worker", 0},
+		{"web 3", "web", 0},
+		{"web 4", "web", 0},
+		{"after", "web", time.Second},
+	}
+	for _, write := range writes {
+		metadata := Metadata{Time: ts.Add(write.offset), Process: write.process}
+		if err := a.WriteWithMetadata(context.Background(), app, write.line, metadata); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := a.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Lines sharing a timestamp are ordered by their stream
+	expected := []string{"before", "web 0", "web 1", "web 2", "web 3", "web 4", "worker 0", "worker 1", "after"}
+	for _, lines := range []int{1, 2, 3, 4} {
+		var backward []string
+		page, err := a.Read(context.Background(), app, ReadOptions{Lines: lines})
+		for err == nil {
+			backward = append(append([]string{}, page.Lines...), backward...)
+			// every line's cursor points at it
+			for i := range page.Lines {
+				if i > 0 {
+					before, err := a.Read(context.Background(), app, ReadOptions{Lines: 1, Before: page.Cursors[i]})
+					if err != nil || before.Lines[0] != page.Lines[i-1] {
+						t.Errorf("reading the line before %s: expected %s, got %v, %v", page.Lines[i], page.Lines[i-1], before, err)
+					}
+				}
+				if i < len(page.Lines)-1 {
+					after, err := a.Read(context.Background(), app, ReadOptions{Lines: 1, After: page.Cursors[i]})
+					if err != nil || after.Lines[0] != page.Lines[i+1] {
+						t.Errorf("reading the line after %s: expected %s, got %v, %v", page.Lines[i], page.Lines[i+1], after, err)
+					}
+				}
+			}
+			page, err = a.Read(context.Background(), app, ReadOptions{Lines: lines, Before: page.Before()})
+		}
+		if !reflect.DeepEqual(backward, expected) {
+			t.Errorf("paging back %d lines at a time: expected %v, got %v", lines, expected, backward)
+		}
+		forward := []string{"before"}
+		page, err = a.Read(context.Background(), app, ReadOptions{Lines: 1, Until: ts})
+		if err == nil {
+			page, err = a.Read(context.Background(), app, ReadOptions{Lines: lines, After: page.After()})
+		}
+		for err == nil {
+			forward = append(forward, page.Lines...)
+			// lines before forward pages are found as well
+			before, beforeErr := a.Read(context.Background(), app, ReadOptions{Lines: 1, Before: page.Before()})
+			if beforeErr != nil || before.Lines[0] != forward[len(forward)-len(page.Lines)-1] {
+				t.Errorf("reading the line before %s: got %v, %v", page.Lines[0], before, beforeErr)
+			}
+			page, err = a.Read(context.Background(), app, ReadOptions{Lines: lines, After: page.After()})
+		}
+		if !reflect.DeepEqual(forward, expected) {
+			t.Errorf("paging forward %d lines at a time: expected %v, got %v", lines, expected, forward)
+		}
+	}
+	for _, cursor := range []string{"1", "1:", "1::", "x:0:0", "1:-1:"} {
+		if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 1, Before: cursor}); !isErrInvalidArgument(err) {
+			t.Errorf("expected an ErrInvalidArgument for cursor %q, got %#v", cursor, err)
+		}
+	}
+}
+
+func TestLokiStopPushesBatchedLines(t *testing.T) {
+	s := newLokiStandIn(t)
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "protobuf", 10)
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
+		t.Error(err)
+	}
+	if s.pushes != 0 {
+		t.Errorf("expected no pushes before the batch is full, got %d", s.pushes)
+	}
+	a.Stop()
+	if s.pushes != 1 {
+		t.Errorf("expected 1 push after stopping, got %d", s.pushes)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(messages, []string{"Hello, log!"}) {
+		t.Errorf("unexpected messages: %v", messages)
+	}
+}
+
+func TestLokiRequeuesFailedPushes(t *testing.T) {
+	s := newLokiStandIn(t)
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "json", 2)
+	s.failures = 1
+	if err := a.Write(context.Background(), app, "1"); err != nil {
+		t.Error(err)
+	}
+	if err := a.Write(context.Background(), app, "2"); !isErrUnavailable(err) {
+		t.Errorf("expected an ErrUnavailable for a failed push, got %#v", err)
+	}
+	if err := a.Write(context.Background(), app, "3"); err != nil {
+		t.Error(err)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(messages, []string{"1", "2", "3"}) {
+		t.Errorf("expected the lines of the failed push to be pushed again, got %v", messages)
+	}
+}
+
+func TestLokiDropsOldestLinesWhileUnavailable(t *testing.T) {
+	s := newLokiStandIn(t)
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "json", 1)
+	s.failures = 100
+	dropped := storageMetric("loki.dropped_lines")
+	var expected []string
+	for i := 1; i <= 15; i++ {
+		a.Write(context.Background(), app, strconv.Itoa(i))
+		if i > 5 {
+			expected = append(expected, strconv.Itoa(i))
+		}
+	}
+	if a.pending != 10 {
+		t.Errorf("expected 10 buffered lines, got %d", a.pending)
+	}
+	if n := storageMetric("loki.dropped_lines") - dropped; n != 5 {
+		t.Errorf("expected 5 dropped lines, got %d", n)
+	}
+	s.mutex.Lock()
+	s.failures = 0
+	s.mutex.Unlock()
+	a.Stop()
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 20}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected the newest lines to be kept, got %v", messages)
+	}
+}
+
+func TestLokiDropsRejectedStreams(t *testing.T) {
+	s := newLokiStandIn(t)
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "json", 4)
+	s.rejected = map[string]bool{lokiSelector(map[string]string{"app": app, "process": "worker"}): true}
+	dropped, rejected := storageMetric("loki.dropped_lines"), storageMetric("loki.rejected_lines")
+	for i, process := range []string{"web", "worker", "web", "worker"} {
+		if err := a.WriteWithMetadata(context.Background(), app, fmt.Sprintf("message %d", i), Metadata{Process: process}); err != nil {
+			t.Errorf("expected refused streams not to fail the write, got %#v", err)
+		}
+	}
+	if a.pending != 0 {
+		t.Errorf("expected no buffered lines, got %d", a.pending)
+	}
+	if n := storageMetric("loki.rejected_lines") - rejected; n != 2 {
+		t.Errorf("expected 2 rejected lines, got %d", n)
+	}
+	if n := storageMetric("loki.dropped_lines") - dropped; n != 0 {
+		t.Errorf("expected no dropped lines, got %d", n)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(messages, []string{"message 0", "message 2"}) {
+		t.Errorf("expected the lines of the accepted stream to be pushed, got %v", messages)
+	}
+}
+
+func TestLokiDestroy(t *testing.T) {
+	s := newLokiStandIn(t)
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "json", 10)
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
+		t.Error(err)
+	}
+	if err := a.Destroy(context.Background(), app); err != nil {
+		t.Error(err)
+	}
+	if a.pending != 0 {
+		t.Errorf("expected batched lines to be dropped, got %d", a.pending)
+	}
+	expected := []string{lokiSelector(map[string]string{"app": app})}
+	if !reflect.DeepEqual(s.deleted, expected) {
+		t.Errorf("expected a delete request for %v, got %v", expected, s.deleted)
+	}
+}
+
+func TestLokiRetention(t *testing.T) {
+	s := newLokiStandIn(t)
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "json", 10)
+	now := time.Now()
+	for _, name := range []string{"foo", "bar"} {
+		for _, age := range []time.Duration{3 * time.Hour, 30 * time.Minute, time.Minute} {
+			metadata := Metadata{Time: now.Add(-age), Process: "web"}
+			if err := a.WriteWithMetadata(context.Background(), name, "Hello, log!", metadata); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if err := a.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetRetention("foo", Retention{Bytes: 1024}); err == nil {
+		t.Error("expected an error for a retention limiting bytes")
+	}
+	if err := a.SetRetention("foo", Retention{MaxAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.enforceRetention(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{lokiSelector(map[string]string{"app": "foo"})}
+	if !reflect.DeepEqual(s.deleted, expected) {
+		t.Errorf("expected a delete request for %v, got %v", expected, s.deleted)
+	}
+	for name, lines := range map[string]int{"foo": 2, "bar": 3} {
+		page, err := a.Read(context.Background(), name, ReadOptions{Lines: 10, Since: now.Add(-24 * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Lines) != lines {
+			t.Errorf("expected %d lines of %s to be kept, got %v", lines, name, page.Lines)
+		}
+	}
+}
+
+func TestLokiSelector(t *testing.T) {
+	selector := lokiSelector(map[string]string{"process": "web", "app": `my"app`})
+	if selector != `{app="my\"app",process="web"}` {
+		t.Errorf("unexpected selector: %s", selector)
+	}
+}
+
+func TestLokiApps(t *testing.T) {
+	s := newLokiStandIn(t)
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "json", 1)
+	for _, name := range []string{"foo", "bar", "foo"} {
+		if err := a.Write(context.Background(), name, "Hello, log!"); err != nil {
+			t.Error(err)
+		}
+	}
+	apps, err := a.Apps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(apps, []AppInfo{{Name: "bar"}, {Name: "foo"}}) {
+		t.Errorf("unexpected apps: %+v", apps)
+	}
+}
+
+func TestLokiErrors(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unhappy", status)
+	}))
+	defer s.Close()
+	a := newTestLokiAdapter(t, s.URL, "json", 10)
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10}); !isErrUnavailable(err) {
+		t.Errorf("expected an ErrUnavailable, got %#v", err)
+	}
+	status = http.StatusTooManyRequests
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10}); !isErrQuotaExceeded(err) {
+		t.Errorf("expected an ErrQuotaExceeded, got %#v", err)
+	}
+	status = http.StatusBadRequest
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10}); !isErrInvalidArgument(err) {
+		t.Errorf("expected an ErrInvalidArgument, got %#v", err)
+	}
+	s.Close()
+	if err := a.Destroy(context.Background(), app); !isErrUnavailable(err) {
+		t.Errorf("expected an ErrUnavailable for an unreachable loki, got %#v", err)
+	}
+}
+
+func TestLokiTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer s.Close()
+	defer close(release)
+	a := newTestLokiAdapter(t, s.URL, "json", 10)
+	a.config.RequestTimeout = 10 * time.Millisecond
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10}); !isErrUnavailable(err) {
+		t.Errorf("expected an ErrUnavailable for a request that timed out, got %#v", err)
+	}
+	// Requests abandoned by the caller fail with the caller's error
+	a.config.RequestTimeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := a.Read(ctx, app, ReadOptions{Lines: 10}); err != context.DeadlineExceeded {
+		t.Errorf("expected the context's error, got %#v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type lokiConfig struct {
+	URL                   string `envconfig:"DEIS_LOGGER_LOKI_URL" default:"http://localhost:3100"`
+	TenantID              string `envconfig:"DEIS_LOGGER_LOKI_TENANT_ID" default:""`
+	Encoding              string `envconfig:"DEIS_LOGGER_LOKI_ENCODING" default:"protobuf"`
+	BatchLines            int    `envconfig:"DEIS_LOGGER_LOKI_BATCH_LINES" default:"500"`
+	BatchWaitSeconds      int    `envconfig:"DEIS_LOGGER_LOKI_BATCH_WAIT_SECONDS" default:"1"`
+	QueryLookbackHours    int    `envconfig:"DEIS_LOGGER_LOKI_QUERY_LOOKBACK_HOURS" default:"720"`
+	RequestTimeoutSeconds int    `envconfig:"DEIS_LOGGER_LOKI_REQUEST_TIMEOUT_SECONDS" default:"10"`
+	// RetentionMaxAgeSeconds is the default maximum age of the lines kept for an app
+	RetentionMaxAgeSeconds   int `envconfig:"DEIS_LOGGER_LOKI_RETENTION_MAX_AGE_SECONDS" default:"0"`
+	RetentionIntervalSeconds int `envconfig:"DEIS_LOGGER_LOKI_RETENTION_INTERVAL_SECONDS" default:"3600"`
+	BatchWait                time.Duration
+	QueryLookback            time.Duration
+	RequestTimeout           time.Duration
+	RetentionMaxAge          time.Duration
+	RetentionInterval        time.Duration
+}
+
+func parseLokiConfig(appName string) (*lokiConfig, error) {
+	ret := new(lokiConfig)
+	if err := envconfig.Process(appName, ret); err != nil {
+		return nil, err
+	}
+	ret.BatchWait = time.Duration(ret.BatchWaitSeconds) * time.Second
+	ret.QueryLookback = time.Duration(ret.QueryLookbackHours) * time.Hour
+	ret.RequestTimeout = time.Duration(ret.RequestTimeoutSeconds) * time.Second
+	ret.RetentionMaxAge = time.Duration(ret.RetentionMaxAgeSeconds) * time.Second
+	ret.RetentionInterval = time.Duration(ret.RetentionIntervalSeconds) * time.Second
+	return ret, nil
+}
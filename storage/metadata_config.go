@@ -0,0 +1,17 @@
+package storage
+
+import (
+	"github.com/kelseyhightower/envconfig"
+)
+
+type metadataConfig struct {
+	Adapters []string `envconfig:"DEIS_LOGGER_METADATA_ADAPTERS" default:""`
+}
+
+func parseMetadataConfig(appName string) (*metadataConfig, error) {
+	ret := new(metadataConfig)
+	if err := envconfig.Process(appName, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
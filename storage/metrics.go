@@ -0,0 +1,9 @@
+package storage
+
+import (
+	"expvar"
+)
+
+// metrics holds counters reported by the storage adapters. They are published through expvar and
+// therefore served on /debug/vars by the profiling server.
+var metrics = expvar.NewMap("storage")
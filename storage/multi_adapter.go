@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+type multiChild struct {
+	name    string
+	adapter Adapter
+	// healthy is 1 while the child's last operation succeeded, and 0 otherwise
+	healthy int32
+}
+
+func (c *multiChild) isHealthy() bool {
+	return atomic.LoadInt32(&c.healthy) == 1
+}
+
+func (c *multiChild) setHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&c.healthy, 1)
+	} else {
+		atomic.StoreInt32(&c.healthy, 0)
+	}
+}
+
+func (c *multiChild) read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	page, err := c.adapter.Read(ctx, app, opts)
+	if err != nil {
+		c.count("read_errors")
+		return nil, err
+	}
+	c.count("reads")
+	page.tagCursors(c.name)
+	return page, nil
+}
+
+func (c *multiChild) count(metric string) {
+	metrics.Add(fmt.Sprintf("multi.%s.%s", c.name, metric), 1)
+}
+
+// multiAdapter fans writes out to an ordered list of child adapters and reads from the first
+// healthy one that can answer.
+type multiAdapter struct {
+	children []*multiChild
+}
+
+// NewMultiAdapter returns a storage adapter that writes to a child adapter of each of the given
+// types. Reads are served by the first child, in the given order, that is healthy and returns logs.
+func NewMultiAdapter(adapterTypes []string, numLines int) (Adapter, error) {
+	if len(adapterTypes) == 0 {
+		return nil, fmt.Errorf("No storage adapters given")
+	}
+	children := make([]*multiChild, len(adapterTypes))
+	for i, adapterType := range adapterTypes {
+		adapterType = strings.TrimSpace(adapterType)
+		if adapterType == "multi" {
+			return nil, fmt.Errorf("Invalid child storage adapter type: %s", adapterType)
+		}
+		adapter, err := NewAdapter(adapterType, numLines)
+		if err != nil {
+			return nil, err
+		}
+		children[i] = &multiChild{name: fmt.Sprintf("%d-%s", i, adapterType), adapter: adapter, healthy: 1}
+	}
+	return &multiAdapter{children: children}, nil
+}
+
+func newMultiAdapterFromConfig(numLines int) (Adapter, error) {
+	cfg, err := parseMultiConfig(appName)
+	if err != nil {
+		return nil, err
+	}
+	return NewMultiAdapter(cfg.Adapters, numLines)
+}
+
+// Start every child adapter
+func (a *multiAdapter) Start() {
+	for _, child := range a.children {
+		child.adapter.Start()
+	}
+}
+
+// Write adds a log message to every child adapter. A failing child does not prevent the others
+// from being written to; an error is only returned if every child failed or the context is done.
+func (a *multiAdapter) Write(ctx context.Context, app string, message string) error {
+	return a.write(ctx, app, func(child Adapter) error {
+		return child.Write(ctx, app, message)
+	})
+}
+
+// WriteWithMetadata adds a log message to every child adapter, passing its metadata along to the
+// children that make use of it
+func (a *multiAdapter) WriteWithMetadata(ctx context.Context, app string, message string, metadata Metadata) error {
+	return a.write(ctx, app, func(child Adapter) error {
+		return WriteWithMetadata(ctx, child, app, message, metadata)
+	})
+}
+
+func (a *multiAdapter) write(ctx context.Context, app string, write func(Adapter) error) error {
+	var errs []string
+	for _, child := range a.children {
+		if err := write(child.adapter); err != nil {
+			if ctx.Err() != nil {
+				// the child isn't to blame for a write that was abandoned
+				return ctx.Err()
+			}
+			child.count("write_errors")
+			child.setHealthy(false)
+			errs = append(errs, fmt.Sprintf("%s: %s", child.name, err))
+			continue
+		}
+		child.count("writes")
+		child.setHealthy(true)
+	}
+	if len(errs) == len(a.children) {
+		return fmt.Errorf("Error writing to every storage adapter: %s", strings.Join(errs, "; "))
+	}
+	for _, err := range errs {
+		log.Printf("Error writing logs for %s: %s", app, err)
+	}
+	return nil
+}
+
+// Read retrieves a specified number of log lines from the first healthy child that returns them.
+// Unhealthy children are only tried once every healthy child has failed. Cursors are tagged with
+// the child that returned them and reads with a cursor are served by that child.
+func (a *multiAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	if cursor := opts.Before + opts.After; cursor != "" {
+		name, cursor, err := untagCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Before != "" {
+			opts.Before = cursor
+		} else {
+			opts.After = cursor
+		}
+		for _, child := range a.children {
+			if child.name == name {
+				return child.read(ctx, app, opts)
+			}
+		}
+		return nil, newErrInvalidArgument("Invalid cursor: %s", opts.Before+opts.After)
+	}
+	var firstErr error
+	for _, healthy := range []bool{true, false} {
+		for _, child := range a.children {
+			if child.isHealthy() != healthy {
+				continue
+			}
+			page, err := child.read(ctx, app, opts)
+			if err == nil {
+				return page, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// Apps describes the apps of every healthy child adapter. An app held by several children is
+// described by the first of them.
+func (a *multiAdapter) Apps(ctx context.Context) ([]AppInfo, error) {
+	apps := []AppInfo{}
+	listed := false
+	var firstErr error
+	for _, child := range a.children {
+		if !child.isHealthy() {
+			continue
+		}
+		childApps, err := child.adapter.Apps(ctx)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Error listing apps in %s: %s", child.name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		apps = mergeApps(apps, childApps)
+		listed = true
+	}
+	if !listed && firstErr != nil {
+		return nil, firstErr
+	}
+	return apps, nil
+}
+
+// SetRetention overrides the limits of the lines kept for an app by every child adapter that can
+// keep a different amount of logs for every app
+func (a *multiAdapter) SetRetention(app string, retention Retention) error {
+	set := false
+	var firstErr error
+	for _, child := range a.children {
+		rs, ok := child.adapter.(RetentionSetter)
+		if !ok {
+			continue
+		}
+		set = true
+		if err := rs.SetRetention(app, retention); err != nil {
+			log.Printf("Error setting the retention for %s in %s: %s", app, child.name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if !set {
+		return newErrInvalidArgument("None of the storage adapters can keep a different amount of logs for every app")
+	}
+	return firstErr
+}
+
+// Retention returns the limits of the lines kept for an app by the first child adapter that can
+// keep a different amount of logs for every app
+func (a *multiAdapter) Retention(app string) Retention {
+	for _, child := range a.children {
+		if rs, ok := child.adapter.(RetentionSetter); ok {
+			return rs.Retention(app)
+		}
+	}
+	return Retention{}
+}
+
+// Destroy deletes stored logs for the specified application from every child adapter
+func (a *multiAdapter) Destroy(ctx context.Context, app string) error {
+	var firstErr error
+	for _, child := range a.children {
+		if err := child.adapter.Destroy(ctx, app); err != nil {
+			log.Printf("Error destroying logs for %s in %s: %s", app, child.name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Reopen every child adapter
+func (a *multiAdapter) Reopen() error {
+	var firstErr error
+	for _, child := range a.children {
+		if err := child.adapter.Reopen(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Stop every child adapter
+func (a *multiAdapter) Stop() {
+	for _, child := range a.children {
+		child.adapter.Stop()
+	}
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type failingAdapter struct {
+	Adapter
+}
+
+func (a failingAdapter) Write(ctx context.Context, app string, message string) error {
+	return errors.New("write failed")
+}
+
+func (a failingAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	return nil, errors.New("read failed")
+}
+
+func newTestMultiAdapter(t *testing.T, adapters ...Adapter) *multiAdapter {
+	a := &multiAdapter{}
+	for i, adapter := range adapters {
+		a.children = append(a.children, &multiChild{name: fmt.Sprintf("%d-test", i), adapter: adapter, healthy: 1})
+	}
+	return a
+}
+
+func newTestRingBufferAdapter(t *testing.T, size int) Adapter {
+	a, err := NewRingBufferAdapter(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestMultiWithNoAdapters(t *testing.T) {
+	a, err := NewMultiAdapter([]string{}, 10)
+	if a != nil {
+		t.Error("Expected no storage adapter, but got one")
+	}
+	if err == nil {
+		t.Error("Did not receive expected error")
+	}
+}
+
+func TestMultiWritesToEveryChild(t *testing.T) {
+	first := newTestRingBufferAdapter(t, 10)
+	second := newTestRingBufferAdapter(t, 10)
+	a := newTestMultiAdapter(t, first, second)
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
+		t.Fatal(err)
+	}
+	for _, child := range []Adapter{first, second} {
+		messages, err := readLines(child.Read(context.Background(), app, ReadOptions{Lines: 10}))
+		if err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(messages, []string{"Hello, log!"}) {
+			t.Errorf("unexpected messages: %v", messages)
+		}
+	}
+}
+
+func TestMultiIsolatesChildErrors(t *testing.T) {
+	healthy := newTestRingBufferAdapter(t, 10)
+	a := newTestMultiAdapter(t, failingAdapter{}, healthy)
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
+		t.Fatalf("Expected the write to succeed on the healthy child, got %s", err)
+	}
+	if a.children[0].isHealthy() {
+		t.Error("Expected the failing child to be marked unhealthy")
+	}
+	// The first child is unhealthy, so reads are served by the second
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(messages, []string{"Hello, log!"}) {
+		t.Errorf("unexpected messages: %v", messages)
+	}
+	// Every child failing is an error
+	a = newTestMultiAdapter(t, failingAdapter{}, failingAdapter{})
+	if err := a.Write(context.Background(), app, "Hello, log!"); err == nil {
+		t.Error("Expected an error when every child fails")
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10}); err == nil || err.Error() != "read failed" {
+		t.Errorf("Expected the first child's read error, got %v", err)
+	}
+}
+
+func TestMultiReadFallsThroughMissingLogs(t *testing.T) {
+	first := newTestRingBufferAdapter(t, 10)
+	second := newTestRingBufferAdapter(t, 10)
+	a := newTestMultiAdapter(t, first, second)
+	if err := second.Write(context.Background(), app, "only in second"); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(messages, []string{"only in second"}) {
+		t.Errorf("unexpected messages: %v", messages)
+	}
+}
+
+func TestMultiCursors(t *testing.T) {
+	first := newTestRingBufferAdapter(t, 10)
+	second := newTestRingBufferAdapter(t, 10)
+	a := newTestMultiAdapter(t, first, second)
+	if err := second.Write(context.Background(), app, "only in second"); err != nil {
+		t.Fatal(err)
+	}
+	page, err := a.Read(context.Background(), app, ReadOptions{Lines: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.After() != "1-test:1" {
+		t.Errorf("expected a cursor of the second child, got %s", page.After())
+	}
+	// Reads with a cursor are served by the child that returned it, even if another has logs
+	if err := a.Write(context.Background(), app, "in both"); err != nil {
+		t.Fatal(err)
+	}
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 10, After: page.After()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"in both"}) || page.After() != "1-test:2" {
+		t.Errorf("unexpected page: %+v", page)
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10, After: "2-test:1"}); err == nil {
+		t.Error("expected an error for a cursor of an unknown child")
+	}
+}
+
+func TestMultiDestroy(t *testing.T) {
+	first := newTestRingBufferAdapter(t, 10)
+	second := newTestRingBufferAdapter(t, 10)
+	a := newTestMultiAdapter(t, first, second)
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Destroy(context.Background(), app); err != nil {
+		t.Error(err)
+	}
+	for _, child := range []Adapter{first, second} {
+		if _, err := child.Read(context.Background(), app, ReadOptions{Lines: 10}); err == nil {
+			t.Error("child still has logs, but was expected not to")
+		}
+	}
+}
+
+func TestMultiApps(t *testing.T) {
+	first := newTestRingBufferAdapter(t, 10)
+	second := newTestRingBufferAdapter(t, 10)
+	a := newTestMultiAdapter(t, first, failingAdapter{}, second)
+	a.children[1].setHealthy(false)
+	if err := first.Write(context.Background(), "foo", "Hello, log!"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"foo", "foo", "bar"} {
+		if err := second.Write(context.Background(), name, "Hello, log!"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	apps, err := a.Apps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// foo is described by the first child
+	if len(apps) != 2 || apps[0].Name != "foo" || apps[0].Lines != 1 || apps[1].Name != "bar" {
+		t.Errorf("unexpected apps: %+v", apps)
+	}
+}
+
+func TestMultiSetRetention(t *testing.T) {
+	first := newTestRingBufferAdapter(t, 10)
+	second := newTestRingBufferAdapter(t, 10)
+	a := newTestMultiAdapter(t, failingAdapter{}, first, second)
+	if err := a.SetRetention(app, Retention{Lines: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, child := range []Adapter{first, second} {
+		if retention := child.(RetentionSetter).Retention(app); retention.Lines != 2 {
+			t.Errorf("expected every child that supports it to keep 2 lines, got %+v", retention)
+		}
+	}
+	if retention := a.Retention(app); retention.Lines != 2 {
+		t.Errorf("unexpected retention: %+v", retention)
+	}
+	if err := newTestMultiAdapter(t, failingAdapter{}).SetRetention(app, Retention{Lines: 2}); err == nil {
+		t.Error("expected an error when no child supports retention overrides")
+	}
+}
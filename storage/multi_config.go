@@ -0,0 +1,17 @@
+package storage
+
+import (
+	"github.com/kelseyhightower/envconfig"
+)
+
+type multiConfig struct {
+	Adapters []string `envconfig:"DEIS_LOGGER_MULTI_ADAPTERS" default:"redis,file"`
+}
+
+func parseMultiConfig(appName string) (*multiConfig, error) {
+	ret := new(multiConfig)
+	if err := envconfig.Process(appName, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
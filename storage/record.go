@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// recordFormat follows the line marker of lines stored along with the metadata of their
+	// message, or with the ID of their write. It is followed by the write ID, the time of the
+	// message in base 36 nanoseconds, its namespace, pod, container, process type, version and
+	// stream, and the line, separated by recordSeparator. Records are text, so backends storing
+	// lines of text store them as they are. Time ranges and process types are taken from a record's
+	// metadata rather than from its rendered line, which may be in any log format.
+	recordFormat = 'r'
+	// recordSeparator is the ASCII unit separator, which neither metadata nor log lines hold
+	recordSeparator = "\x1f"
+	// recordFields counts the fields of a record, the line being the last one
+	recordFields = 9
+)
+
+// metadataAdapters are the storage adapters that can store the metadata of messages along with
+// their lines
+var metadataAdapters = map[string]bool{
+	"memory":        true,
+	"file":          true,
+	"bolt":          true,
+	"redis":         true,
+	"redis-streams": true,
+	"s3":            true,
+}
+
+// recorder stores lines along with the metadata of their messages if it is set. Records take more
+// room than lines, so adapters only store them if they are listed in DEIS_LOGGER_METADATA_ADAPTERS.
+type recorder bool
+
+// newRecorderFromConfig returns the recorder of an adapter type as configured by the environment
+func newRecorderFromConfig(adapterType string) (recorder, error) {
+	cfg, err := parseMetadataConfig(appName)
+	if err != nil {
+		return false, err
+	}
+	var r recorder
+	for _, name := range cfg.Adapters {
+		if !metadataAdapters[name] {
+			return false, fmt.Errorf("Invalid storage adapter type storing metadata: %s", name)
+		}
+		if name == adapterType {
+			r = true
+		}
+	}
+	return r, nil
+}
+
+// record returns the line to store for a message, which is a record if metadata is stored. Lines
+// that are records of their write ID already keep it.
+func (r recorder) record(line string, metadata Metadata) string {
+	if !r {
+		return line
+	}
+	line, _, id := splitRecordID(line)
+	return newRecord(line, id, metadata)
+}
+
+// newRecord returns a line to be stored along with the ID of its write, if it has one, and the
+// metadata of its message. Lines written without either are stored as they are.
+func newRecord(line string, id string, metadata Metadata) string {
+	if id == "" && metadata == (Metadata{}) {
+		return line
+	}
+	var t string
+	if !metadata.Time.IsZero() {
+		t = strconv.FormatInt(metadata.Time.UnixNano(), 36)
+	}
+	return string([]byte{lineMarker, recordFormat}) + strings.Join([]string{
+		id,
+		t,
+		metadata.Namespace,
+		metadata.Pod,
+		metadata.Container,
+		metadata.Process,
+		metadata.Version,
+		metadata.Stream,
+		line,
+	}, recordSeparator)
+}
+
+// splitRecord returns the line held by a stored line and the metadata stored along with it, which
+// is nil for lines stored without
+func splitRecord(stored string) (string, *Metadata) {
+	line, metadata, _ := splitRecordID(stored)
+	return line, metadata
+}
+
+// splitRecordID returns the line held by a stored line, the metadata stored along with it and the
+// ID of its write, which are nil and empty for lines stored without
+func splitRecordID(stored string) (string, *Metadata, string) {
+	if len(stored) < 2 || stored[0] != lineMarker || stored[1] != recordFormat {
+		return stored, nil, ""
+	}
+	fields := strings.SplitN(stored[2:], recordSeparator, recordFields)
+	if len(fields) != recordFields {
+		return stored, nil, ""
+	}
+	metadata := Metadata{
+		Namespace: fields[2],
+		Pod:       fields[3],
+		Container: fields[4],
+		Process:   fields[5],
+		Version:   fields[6],
+		Stream:    fields[7],
+	}
+	if fields[1] != "" {
+		ns, err := strconv.ParseInt(fields[1], 36, 64)
+		if err != nil {
+			return stored, nil, ""
+		}
+		metadata.Time = time.Unix(0, ns).UTC()
+	}
+	if metadata == (Metadata{}) {
+		return fields[8], nil, fields[0]
+	}
+	return fields[8], &metadata, fields[0]
+}
+
+// storesRecords reports whether an adapter reads records back as the lines they hold
+func storesRecords(a Adapter) bool {
+	switch a.(type) {
+	case *ringBufferAdapter, *fileAdapter, *boltAdapter, *redisAdapter, *redisStreamsAdapter, *s3Adapter:
+		return true
+	}
+	return false
+}
+
+// recordLine returns the line held by a stored line, without its metadata
+func recordLine(stored string) string {
+	line, _ := splitRecord(stored)
+	return line
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRecords(t *testing.T) {
+	metadata := Metadata{
+		Time:      time.Date(2017, 3, 1, 14, 2, 0, 123, time.UTC),
+		Namespace: "foo",
+		Pod:       "foo-web-845861952-nzf60",
+		Container: "foo-web",
+		Process:   "web",
+		Version:   "v2",
+		Stream:    "stderr",
+	}
+	for _, line := range []string{"hello", "", "fields\x1fin\x1fthe line"} {
+		stored := newRecord(line, "id", metadata)
+		read, readMetadata, id := splitRecordID(stored)
+		if read != line || readMetadata == nil || *readMetadata != metadata || id != "id" {
+			t.Errorf("expected %q, %+v and an ID, got %q, %+v and %q", line, metadata, read, readMetadata, id)
+		}
+	}
+	// records of a write ID alone have no metadata
+	if read, readMetadata, id := splitRecordID(newRecord("hello", "id", Metadata{})); read != "hello" || readMetadata != nil || id != "id" {
+		t.Errorf("expected a line with an ID only, got %q, %+v and %q", read, readMetadata, id)
+	}
+	// recording the metadata of a record of a write ID keeps the ID
+	if read, readMetadata, id := splitRecordID(recorder(true).record(newRecord("hello", "id", Metadata{}), metadata)); read != "hello" || readMetadata == nil || id != "id" {
+		t.Errorf("expected a line with its ID and metadata, got %q, %+v and %q", read, readMetadata, id)
+	}
+	// records only take the room of their fields and separators beyond the line and metadata
+	if overhead := len(newRecord("", "", metadata)) - len("foofoo-web-845861952-nzf60foo-webwebv2stderr"); overhead > 24 {
+		t.Errorf("expected records to take at most 24 bytes more than their fields, got %d", overhead)
+	}
+	for _, stored := range []string{"hello", "\x00rbogus", "\x00r\x1f!\x1f\x1f\x1f\x1f\x1f\x1f\x1fhello"} {
+		if read, readMetadata := splitRecord(stored); read != stored || readMetadata != nil {
+			t.Errorf("expected %q to be read as it is, got %q and %+v", stored, read, readMetadata)
+		}
+	}
+	if stored := newRecord("hello", "", Metadata{}); stored != "hello" {
+		t.Errorf("expected lines without metadata to be stored as they are, got %q", stored)
+	}
+}
+
+func TestRecorderFromConfig(t *testing.T) {
+	defer os.Unsetenv("DEIS_LOGGER_METADATA_ADAPTERS")
+	// metadata isn't stored unless it is configured
+	if r, err := newRecorderFromConfig("file"); err != nil || r {
+		t.Errorf("expected no records by default, got %v, %v", r, err)
+	}
+	if r := recorder(false); r.record("hello", Metadata{Process: "web"}) != "hello" {
+		t.Error("expected a disabled recorder to store lines as they are")
+	}
+	os.Setenv("DEIS_LOGGER_METADATA_ADAPTERS", "memory,file")
+	for adapterType, expected := range map[string]bool{"memory": true, "file": true, "bolt": false} {
+		if r, err := newRecorderFromConfig(adapterType); err != nil || bool(r) != expected {
+			t.Errorf("%s: expected %v, got %v, %v", adapterType, expected, r, err)
+		}
+	}
+	os.Setenv("DEIS_LOGGER_METADATA_ADAPTERS", "file,loki")
+	if _, err := newRecorderFromConfig("file"); err == nil {
+		t.Error("expected adapters that can't store metadata to be rejected")
+	}
+}
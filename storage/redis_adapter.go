@@ -1,17 +1,137 @@
 package storage
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"log"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	r "gopkg.in/redis.v3"
 )
 
+const (
+	// redisPushScript appends a line to an app's list and counts it, so every line keeps its
+	// position in the app's sequence of lines even as the list is trimmed. The count is moved from
+	// the key it used to be kept at, unless that key is the list of another app, and lists written
+	// before lines were counted start counting from their length.
+	redisPushScript = `
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	local seq = redis.call('LLEN', KEYS[1])
+	if redis.call('TYPE', KEYS[3]).ok == 'string' then
+		seq = redis.call('GET', KEYS[3])
+		redis.call('DEL', KEYS[3])
+	end
+	redis.call('SET', KEYS[2], seq)
+end
+redis.call('RPUSH', KEYS[1], ARGV[1])
+return redis.call('INCR', KEYS[2])`
+	// redisReadScript returns up to ARGV[3] lines of an app's list along with the position of the
+	// first of them in the app's sequence of lines. They are the lines following the position
+	// ARGV[2] if ARGV[1] is 'after', and the lines preceding it, or the last lines if it is empty,
+	// otherwise.
+	redisReadScript = `
+local len = redis.call('LLEN', KEYS[1])
+local seq = redis.call('GET', KEYS[2])
+if not seq and redis.call('TYPE', KEYS[3]).ok == 'string' then
+	seq = redis.call('GET', KEYS[3])
+end
+local first = tonumber(seq or len) - len + 1
+local n = tonumber(ARGV[3])
+local from, to
+if ARGV[1] == 'after' then
+	from = math.max(tonumber(ARGV[2]) + 1 - first, 0)
+	to = from + n - 1
+else
+	to = len - 1
+	if ARGV[2] ~= '' then
+		to = math.min(tonumber(ARGV[2]) - 1 - first, to)
+	end
+	from = math.max(to - n + 1, 0)
+end
+if to < from then
+	return {first + from, {}}
+end
+return {first + from, redis.call('LRANGE', KEYS[1], from, to)}`
+	// redisInfoScript returns the number of lines in an app's list, the memory it uses and its last
+	// line, or nothing if the key doesn't hold a list. The memory used is zero on servers without
+	// MEMORY USAGE.
+	redisInfoScript = `
+if redis.call('TYPE', KEYS[1]).ok ~= 'list' then
+	return {}
+end
+local bytes = redis.pcall('MEMORY', 'USAGE', KEYS[1])
+if type(bytes) ~= 'number' then
+	bytes = 0
+end
+return {redis.call('LLEN', KEYS[1]), bytes, redis.call('LINDEX', KEYS[1], -1) or ''}`
+	redisScanCount = 1000
+	// redisReadChunk is the most lines a read gets from redis at once. Reads that have to scan
+	// more lines than they return, because they are filtered, get one chunk after the other.
+	redisReadChunk = 1000
+	// redisSeqKeyPrefix starts the keys counting the lines written to the lists of apps. App names
+	// can't hold a slash, so these keys never collide with the list of an app.
+	redisSeqKeyPrefix = "logger/seq/"
+	// redisOldSeqKeySuffix ends the keys that used to count the lines of apps. Pushes move their
+	// count to the app's current key, and reads fall back to them until then, so cursors of lines
+	// written before still point at the same lines. Keys holding a list rather than a count are the
+	// lists of apps named like them, and are left alone.
+	redisOldSeqKeySuffix = ":seq"
+)
+
+var (
+	redisPush = newRedisScript(redisPushScript)
+	redisRead = newRedisScript(redisReadScript)
+	redisInfo = newRedisScript(redisInfoScript)
+)
+
+// redisSeqKeys returns the key counting the lines written to an app's list, along with the key that
+// used to count them
+func redisSeqKeys(app string) []string {
+	return []string{redisSeqKeyPrefix + app, app + redisOldSeqKeySuffix}
+}
+
+// redisScript is a Lua script that is run with EVALSHA, so that its source isn't sent along with
+// every line
+type redisScript struct {
+	src string
+	sha string
+}
+
+func newRedisScript(src string) *redisScript {
+	sum := sha1.Sum([]byte(src))
+	return &redisScript{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+// run runs the script, sending its source if redis doesn't have it cached, as after a restart
+func (s *redisScript) run(client *r.Client, keys []string, args []string) *r.Cmd {
+	cmd := client.EvalSha(s.sha, keys, args)
+	if err := cmd.Err(); err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		return client.Eval(s.src, keys, args)
+	}
+	return cmd
+}
+
+// load makes sure that redis has the script cached, so that pipelines can run it with EVALSHA
+func (s *redisScript) load(client *r.Client) error {
+	exists, err := client.ScriptExists(s.sha).Result()
+	if err != nil {
+		return err
+	}
+	if len(exists) == 1 && exists[0] {
+		return nil
+	}
+	return client.ScriptLoad(s.src).Err()
+}
+
 type message struct {
 	app         string
 	messageBody string
+	// done, if set, receives the result of sending the message to redis
+	done chan error
 }
 
 func newMessage(app string, messageBody string) *message {
@@ -21,58 +141,109 @@ func newMessage(app string, messageBody string) *message {
 	}
 }
 
+// newSyncMessage returns a message whose result is sent to its done channel, which makes the
+// pipeline it is added to be sent right away
+func newSyncMessage(app string, messageBody string) *message {
+	m := newMessage(app, messageBody)
+	m.done = make(chan error, 1)
+	return m
+}
+
+// send queues a message to be pipelined, waiting for its result if it is synchronous
+func send(ctx context.Context, messages chan<- *message, m *message) error {
+	select {
+	case messages <- m:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if m.done == nil {
+		return nil
+	}
+	select {
+	case err := <-m.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// messagePipeliner collects pushes in a pipeline. It is only used by the goroutine that sends the
+// pipeline, so the pushes of one pipeline are in redis before those of the next.
 type messagePipeliner struct {
-	bufferSize    int
+	retention     *retentions
 	messageCount  int
+	client        *r.Client
 	pipeline      *r.Pipeline
 	timeoutTicker *time.Ticker
 	queuedApps    map[string]bool
-	errCh         chan error
-	rwLock        *sync.RWMutex
+	// waiting holds the done channels of the synchronous messages in the pipeline
+	waiting []chan error
 }
 
-func newMessagePipeliner(bufferSize int, redisClient *r.Client, timeout time.Duration, errCh chan error) *messagePipeliner {
+func newMessagePipeliner(retention *retentions, redisClient *r.Client, timeout time.Duration) *messagePipeliner {
 	return &messagePipeliner{
-		bufferSize:    bufferSize,
+		retention:     retention,
+		client:        redisClient,
 		pipeline:      redisClient.Pipeline(),
 		timeoutTicker: time.NewTicker(timeout),
 		queuedApps:    map[string]bool{},
-		errCh:         errCh,
-		rwLock:        &sync.RWMutex{},
 	}
 }
 
 func (mp *messagePipeliner) addMessage(message *message) {
-	if err := mp.pipeline.RPush(message.app, message.messageBody).Err(); err == nil {
-		mp.rwLock.Lock()
-		mp.queuedApps[message.app] = true
-		mp.rwLock.Unlock()
-		mp.messageCount++
-	} else {
-		mp.errCh <- fmt.Errorf("Error adding rpush to %s to the pipeline: %s", message.app, err)
+	keys := append([]string{message.app}, redisSeqKeys(message.app)...)
+	if err := mp.pipeline.EvalSha(redisPush.sha, keys, []string{message.messageBody}).Err(); err != nil {
+		err = fmt.Errorf("Error adding push to %s to the pipeline: %s", message.app, err)
+		if message.done != nil {
+			message.done <- redisError("redis", err)
+			return
+		}
+		log.Println(err)
+		return
+	}
+	mp.queuedApps[message.app] = true
+	mp.messageCount++
+	if message.done != nil {
+		mp.waiting = append(mp.waiting, message.done)
 	}
 }
 
-func (mp messagePipeliner) execPipeline() {
-	defer mp.rwLock.RUnlock()
-	mp.rwLock.RLock()
+func (mp *messagePipeliner) execPipeline() {
+	if mp.messageCount == 0 {
+		return
+	}
 	for app := range mp.queuedApps {
-		if err := mp.pipeline.LTrim(app, int64(-1*mp.bufferSize), -1).Err(); err != nil {
-			mp.errCh <- fmt.Errorf("Error adding ltrim of %s to the pipeline: %s", app, err)
+		lines := mp.retention.get(app).Lines
+		if err := mp.pipeline.LTrim(app, int64(-1*lines), -1).Err(); err != nil {
+			log.Printf("Error adding ltrim of %s to the pipeline: %s", app, err)
 		}
 	}
-	if _, err := mp.pipeline.Exec(); err != nil {
-		mp.errCh <- fmt.Errorf("Error executing pipeline: %s", err)
+	// the pushes run the script by its digest, which fails if redis lost it
+	err := redisPush.load(mp.client)
+	if err != nil {
+		log.Printf("Error loading the push script: %s", err)
+	}
+	if _, execErr := mp.pipeline.Exec(); execErr != nil {
+		err = execErr
+		log.Printf("Error executing pipeline: %s", err)
 	}
+	for _, done := range mp.waiting {
+		done <- redisError("redis", err)
+	}
+	mp.messageCount = 0
+	mp.queuedApps = map[string]bool{}
+	mp.waiting = nil
 }
 
 type redisAdapter struct {
 	started        bool
-	bufferSize     int
+	retention      *retentions
 	redisClient    *r.Client
 	messageChannel chan *message
 	stopCh         chan struct{}
 	config         *redisConfig
+	codec          *lineCodec
+	recorder       recorder
 }
 
 // NewRedisStorageAdapter returns a pointer to a new instance of a redis-based storage.Adapter.
@@ -87,75 +258,301 @@ func NewRedisStorageAdapter(bufferSize int) (Adapter, error) {
 	if err != nil {
 		return nil, err
 	}
+	codec, err := newLineCodecFromConfig(false)
+	if err != nil {
+		return nil, err
+	}
+	recorder, err := newRecorderFromConfig("redis")
+	if err != nil {
+		return nil, err
+	}
 	rsa := &redisAdapter{
-		bufferSize: bufferSize,
-		redisClient: r.NewClient(&r.Options{
-			Addr:     fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
-			Password: cfg.Password, // "" == no password
-			DB:       int64(cfg.DB),
-		}),
+		retention:      newRetentions(Retention{Lines: bufferSize}),
+		redisClient:    newRedisClient(cfg),
 		messageChannel: make(chan *message),
 		stopCh:         make(chan struct{}),
 		config:         cfg,
+		codec:          codec,
+		recorder:       recorder,
 	}
 	return rsa, nil
 }
 
+// newRedisClient returns a client of the configured redis. The client doesn't take contexts, so
+// commands are bounded by its read and write timeouts instead.
+func newRedisClient(cfg *redisConfig) *r.Client {
+	return r.NewClient(&r.Options{
+		Addr:         fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
+		Password:     cfg.Password, // "" == no password
+		DB:           int64(cfg.DB),
+		ReadTimeout:  cfg.Timeout,
+		WriteTimeout: cfg.Timeout,
+	})
+}
+
 // Start the storage adapter. Invocations of this function are not concurrency safe and multiple
 // serialized invocations have no effect.
 func (a *redisAdapter) Start() {
 	if !a.started {
 		a.started = true
-		errCh := make(chan error)
-		mp := newMessagePipeliner(a.bufferSize, a.redisClient, a.config.PipelineTimeout, errCh)
+		mp := newMessagePipeliner(a.retention, a.redisClient, a.config.PipelineTimeout)
 		go func() {
 			defer mp.pipeline.Close()
+			defer mp.timeoutTicker.Stop()
 			for {
 				select {
-				case err := <-errCh:
-					log.Println(err)
 				case <-a.stopCh:
+					mp.execPipeline()
 					return
 				case message := <-a.messageChannel:
 					mp.addMessage(message)
-					if mp.messageCount == a.config.PipelineLength {
-						go mp.execPipeline()
+					if mp.messageCount >= a.config.PipelineLength || message.done != nil {
+						mp.execPipeline()
 					}
 				case <-mp.timeoutTicker.C:
-					go mp.execPipeline()
+					mp.execPipeline()
 				}
 			}
 		}()
 	}
 }
 
-// Write adds a log message to to an app-specific list in redis using ring-buffer-like semantics
-func (a *redisAdapter) Write(app string, messageBody string) error {
-	a.messageChannel <- newMessage(app, messageBody)
-	return nil
+// Write adds a log message to to an app-specific list in redis using ring-buffer-like semantics.
+// The message is compressed and encrypted first if that is configured.
+func (a *redisAdapter) Write(ctx context.Context, app string, messageBody string) error {
+	return a.write(ctx, app, "", messageBody)
 }
 
-// Read retrieves a specified number of log lines from an app-specific list in redis
-func (a *redisAdapter) Read(app string, lines int, process string) ([]string, error) {
-	stringSliceCmd := a.redisClient.LRange(app, int64(-1*lines), -1)
-	result, err := stringSliceCmd.Result()
+// WriteWithMetadata adds a log message to an app-specific list in redis, along with its metadata if
+// that is configured, encrypting it with the key of the namespace it was logged in if its app has
+// none
+func (a *redisAdapter) WriteWithMetadata(ctx context.Context, app string, messageBody string, metadata Metadata) error {
+	return a.write(ctx, app, metadata.Namespace, a.recorder.record(messageBody, metadata))
+}
+
+// WriteSync adds a log message to an app-specific list in redis like WriteWithMetadata, but sends
+// it to redis right away and returns once redis stored it
+func (a *redisAdapter) WriteSync(ctx context.Context, app string, messageBody string, metadata Metadata) error {
+	messageBody, err := a.codec.encode(app, metadata.Namespace, a.recorder.record(messageBody, metadata))
+	if err == errShredded {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return send(ctx, a.messageChannel, newSyncMessage(app, messageBody))
+}
+
+func (a *redisAdapter) write(ctx context.Context, app string, namespace string, messageBody string) error {
+	messageBody, err := a.codec.encode(app, namespace, messageBody)
+	if err == errShredded {
+		return nil
+	}
 	if err != nil {
+		return err
+	}
+	return send(ctx, a.messageChannel, newMessage(app, messageBody))
+}
+
+// Read retrieves a specified number of log lines from an app-specific list in redis. Lines are
+// limited to a time range using the timestamps they start with and searched for the query, getting
+// chunks of the list from the end, or from the cursor, until enough lines are found. Cursors are the
+// lines' positions in the app's sequence of lines. Compressed and encrypted lines are decoded, and
+// skipped if they can't be.
+func (a *redisAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	if len(result) > 0 {
-		return result, nil
+	cursor := opts.Before + opts.After
+	if cursor != "" {
+		if _, err := strconv.ParseInt(cursor, 10, 64); err != nil {
+			return nil, newErrInvalidArgument("Invalid cursor: %s", cursor)
+		}
 	}
-	return nil, fmt.Errorf("Could not find logs for '%s'", app)
+	g, err := newGrepper(opts)
+	if err != nil {
+		return nil, err
+	}
+	direction := "before"
+	if opts.After != "" {
+		direction = "after"
+	}
+	chunk := redisReadChunk
+	if !opts.filtered() && opts.Lines < chunk {
+		chunk = opts.Lines
+	}
+	keys := append([]string{app}, redisSeqKeys(app)...)
+	for chunk > 0 && !g.done() {
+		reply, err := redisRead.run(a.redisClient, keys, []string{direction, cursor, strconv.Itoa(chunk)}).Result()
+		if err != nil {
+			return nil, redisError("redis", err)
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 2 {
+			return nil, fmt.Errorf("Unexpected reply reading logs for '%s': %v", app, reply)
+		}
+		first, _ := values[0].(int64)
+		result, _ := values[1].([]interface{})
+		if len(result) == 0 {
+			break
+		}
+		scan := func(i int) {
+			stored, _ := result[i].(string)
+			if line, ok := a.codec.decode(app, stored); ok && opts.lineInTimeRange(line) {
+				g.add(line, strconv.FormatInt(first+int64(i), 10))
+			}
+		}
+		if direction == "after" {
+			for i := 0; i < len(result) && !g.done(); i++ {
+				scan(i)
+			}
+			cursor = strconv.FormatInt(first+int64(len(result)-1), 10)
+		} else {
+			for i := len(result) - 1; i >= 0 && !g.done(); i-- {
+				scan(i)
+			}
+			cursor = strconv.FormatInt(first, 10)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if direction == "before" {
+		g.page.reverse()
+	}
+	if len(g.page.Lines) > 0 {
+		return g.page, nil
+	}
+	return nil, newErrNotFound(app)
 }
 
-// Destroy deletes an app-specific list from redis
-func (a *redisAdapter) Destroy(app string) error {
-	if err := a.redisClient.Del(app).Err(); err != nil {
+// Apps scans redis for app-specific lists and describes them, a batch of scanned keys per
+// pipeline. The size of an app's lines is approximated by the memory its list uses. Lines are
+// written some time after they were logged, so the time of an app's last write is approximated by
+// its last line's.
+func (a *redisAdapter) Apps(ctx context.Context) ([]AppInfo, error) {
+	// the descriptions run the script by its digest, which fails if redis lost it
+	if err := redisInfo.load(a.redisClient); err != nil {
+		return nil, redisError("redis", err)
+	}
+	apps := []AppInfo{}
+	err := scanKeys(ctx, a.redisClient, "*", func(keys []string) error {
+		pipeline := a.redisClient.Pipeline()
+		defer pipeline.Close()
+		cmds := make([]*r.Cmd, len(keys))
+		for i, key := range keys {
+			cmds[i] = pipeline.EvalSha(redisInfo.sha, []string{key}, nil)
+		}
+		if _, err := pipeline.Exec(); err != nil {
+			return err
+		}
+		for i, key := range keys {
+			values, ok := cmds[i].Val().([]interface{})
+			if !ok || len(values) == 0 {
+				continue
+			}
+			if len(values) != 3 {
+				return fmt.Errorf("Unexpected reply describing '%s': %v", key, values)
+			}
+			info := AppInfo{Name: key}
+			info.Lines, _ = values[0].(int64)
+			info.Bytes, _ = values[1].(int64)
+			if stored, ok := values[2].(string); ok {
+				if line, ok := a.codec.decode(key, stored); ok {
+					info.LastWrite, _ = timeFromLine(line)
+				}
+			}
+			apps = append(apps, info)
+		}
+		return nil
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, redisError("redis", err)
+	}
+	return apps, nil
+}
+
+// scanKeys calls fn with every batch of keys matching a pattern, in no particular order. The
+// commands of the client can't be cancelled, so the scan is abandoned between batches once the
+// context is done.
+func scanKeys(ctx context.Context, client *r.Client, match string, fn func([]string) error) error {
+	var cursor int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		next, keys, err := client.Scan(cursor, match, redisScanCount).Result()
+		if err != nil {
+			return err
+		}
+		if err := fn(keys); err != nil {
+			return err
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// SetRetention overrides the length an app-specific list in redis is trimmed to
+func (a *redisAdapter) SetRetention(app string, retention Retention) error {
+	if err := retention.limits("redis", true, false, false); err != nil {
 		return err
 	}
+	a.retention.set(app, retention)
+	lines := a.retention.get(app).Lines
+	return redisError("redis", a.redisClient.LTrim(app, int64(-1*lines), -1).Err())
+}
+
+// Retention returns the limits of the lines kept in an app-specific list in redis
+func (a *redisAdapter) Retention(app string) Retention {
+	return a.retention.get(app)
+}
+
+// Destroy deletes an app-specific list from redis, along with the keys counting its lines
+func (a *redisAdapter) Destroy(ctx context.Context, app string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	keys := append([]string{app}, redisSeqKeys(app)...)
+	typ, err := a.redisClient.Type(keys[2]).Result()
+	if err != nil {
+		return redisError("redis", err)
+	}
+	if typ != "string" {
+		keys = keys[:2]
+	}
+	if err := a.redisClient.Del(keys...).Err(); err != nil {
+		return redisError("redis", err)
+	}
 	return nil
 }
 
+// redisError classifies an error returned by redis. Redis refuses writes with an OOM error once it
+// uses as much memory as it is allowed to.
+func redisError(adapterName string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if strings.HasPrefix(err.Error(), "OOM ") {
+		return newErrQuotaExceeded(adapterName, err)
+	}
+	return newErrUnavailable(adapterName, err)
+}
+
+// Healthy pings redis, since writes are pipelined in the background and don't fail when it can't
+// be reached
+func (a *redisAdapter) Healthy(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return redisError("redis", a.redisClient.Ping().Err())
+}
+
 // Reopen the storage adapter-- in the case of this implementation, a no-op
 func (a *redisAdapter) Reopen() error {
 	return nil
@@ -3,7 +3,9 @@
 package storage
 
 import (
+	"context"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -15,7 +17,7 @@ func TestRedisReadFromNonExistingApp(t *testing.T) {
 		t.Error(err)
 	}
 	// No logs have been written; there should be no redis list for app
-	messages, err := a.Read(app, 10, "")
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
 	if messages != nil {
 		t.Error("Expected no messages, but got some")
 	}
@@ -47,7 +49,7 @@ func TestRedisLogs(t *testing.T) {
 	defer a.Stop()
 	// And write a few logs to it, but do NOT fill it up
 	for i := 0; i < 5; i++ {
-		if err := a.Write(app, fmt.Sprintf("message %d", i)); err != nil {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
 			t.Error(err)
 		}
 	}
@@ -55,7 +57,7 @@ func TestRedisLogs(t *testing.T) {
 	// there are 50 queued up OR a 1 second timeout has been reached.
 	time.Sleep(time.Second * 2)
 	// Read more logs than there are
-	messages, err := a.Read(app, 8, "")
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 8}))
 	if err != nil {
 		t.Error(err)
 	}
@@ -64,7 +66,7 @@ func TestRedisLogs(t *testing.T) {
 		t.Errorf("only expected 5 log messages, got %d", len(messages))
 	}
 	// Read fewer logs than there are
-	messages, err = a.Read(app, 3, "")
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 3}))
 	if err != nil {
 		t.Error(err)
 	}
@@ -80,7 +82,7 @@ func TestRedisLogs(t *testing.T) {
 	}
 	// Overfill the buffer
 	for i := 5; i < 11; i++ {
-		if err := a.Write(app, fmt.Sprintf("message %d", i)); err != nil {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
 			t.Error(err)
 		}
 	}
@@ -88,7 +90,7 @@ func TestRedisLogs(t *testing.T) {
 	// there are 50 queued up OR a 1 second timeout has been reached.
 	time.Sleep(time.Second * 2)
 	// Read more logs than the buffer can hold
-	messages, err = a.Read(app, 20, "")
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 20}))
 	if err != nil {
 		t.Error(err)
 	}
@@ -113,7 +115,7 @@ func TestRedisDestroy(t *testing.T) {
 	a.Start()
 	defer a.Stop()
 	// Write a log to create the file
-	if err := a.Write(app, "Hello, log!"); err != nil {
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
 		t.Error(err)
 	}
 	// Sleep for a bit because the adapter queues logs internally and writes them to Redis only when
@@ -128,7 +130,7 @@ func TestRedisDestroy(t *testing.T) {
 		t.Error("Log redis list was expected to exist, but doesn't.")
 	}
 	// Now destroy it
-	if err := a.Destroy(app); err != nil {
+	if err := a.Destroy(context.Background(), app); err != nil {
 		t.Error(err)
 	}
 	// Now check that the redis list no longer exists
@@ -140,3 +142,154 @@ func TestRedisDestroy(t *testing.T) {
 		t.Error("Log redis list still exist, but was expected not to.")
 	}
 }
+
+func TestRedisApps(t *testing.T) {
+	a, err := NewRedisStorageAdapter(10)
+	if err != nil {
+		t.Error(err)
+	}
+	a.Start()
+	defer a.Stop()
+	for i := 0; i < 3; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	// Sleep for a bit because the adapter queues logs internally and writes them to Redis only when
+	// there are 50 queued up OR a 1 second timeout has been reached.
+	time.Sleep(time.Second * 2)
+	defer a.Destroy(context.Background(), app)
+	apps, err := a.Apps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, info := range apps {
+		// keys that don't hold a list, like the line counter, are not apps
+		if info.Name == redisSeqKeys(app)[0] {
+			t.Errorf("unexpected app %s", info.Name)
+		}
+		if info.Name == app {
+			found = true
+			if info.Lines != 3 || info.Bytes < 27 {
+				t.Errorf("unexpected description of %s: %+v", app, info)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected %s among the apps, got %v", app, apps)
+	}
+}
+
+func TestRedisSetRetention(t *testing.T) {
+	a, err := NewRedisStorageAdapter(10)
+	if err != nil {
+		t.Error(err)
+	}
+	a.Start()
+	defer a.Stop()
+	rs := a.(RetentionSetter)
+	if err := rs.SetRetention(app, Retention{Bytes: 1024}); err == nil {
+		t.Error("expected an error for an unsupported limit")
+	}
+	for i := 0; i < 5; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	// Sleep for a bit because the adapter queues logs internally and writes them to Redis only when
+	// there are 50 queued up OR a 1 second timeout has been reached.
+	time.Sleep(time.Second * 2)
+	defer a.Destroy(context.Background(), app)
+	// Lines beyond the new limit are trimmed right away
+	if err := rs.SetRetention(app, Retention{Lines: 2}); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[1] != "message 4" {
+		t.Errorf("expected the 2 newest lines, got %v", messages)
+	}
+}
+
+func TestRedisMovesOldLineCounts(t *testing.T) {
+	sa, err := NewRedisStorageAdapter(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := sa.(*redisAdapter)
+	a.Start()
+	defer a.Stop()
+	defer a.Destroy(context.Background(), app)
+	// lines written before the count was moved, 100 lines into the app's sequence
+	keys := redisSeqKeys(app)
+	if err := a.redisClient.RPush(app, "message 1", "message 2").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.redisClient.Set(keys[1], "100", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	page, err := a.Read(context.Background(), app, ReadOptions{Lines: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Cursors, []string{"99", "100"}) {
+		t.Errorf("expected the cursors of the old count, got %v", page.Cursors)
+	}
+	if err := a.Write(context.Background(), app, "message 3"); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Second * 2)
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 10, After: "99"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"message 2", "message 3"}) || page.After() != "101" {
+		t.Errorf("expected lines to be counted on from the old count, got %+v", page)
+	}
+	if exists, err := a.redisClient.Exists(keys[1]).Result(); err != nil || exists {
+		t.Errorf("expected the old count to be removed, got %v, %v", exists, err)
+	}
+}
+
+func TestRedisReadsInChunks(t *testing.T) {
+	n := 2*redisReadChunk + 10
+	sa, err := NewRedisStorageAdapter(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := sa.(*redisAdapter)
+	defer a.Destroy(context.Background(), app)
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("message %d", i+1)
+	}
+	lines[4] = "needle"
+	if err := a.redisClient.RPush(app, lines...).Err(); err != nil {
+		t.Fatal(err)
+	}
+	// filtered reads scan chunk after chunk for the lines they return
+	page, err := a.Read(context.Background(), app, ReadOptions{Lines: 1, Query: "needle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"needle"}) || page.Before() != "5" {
+		t.Errorf("expected the needle, got %+v", page)
+	}
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: n, After: "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, lines[5:]) {
+		t.Errorf("expected %d lines after the needle, got %d", n-5, len(page.Lines))
+	}
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: n, Before: "6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, lines[:5]) {
+		t.Errorf("expected the lines up to the needle, got %v", page.Lines)
+	}
+}
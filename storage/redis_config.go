@@ -13,7 +13,10 @@ type redisConfig struct {
 	DB                     int    `envconfig:"DEIS_LOGGER_REDIS_DB" default:"0"`
 	PipelineLength         int    `envconfig:"DEIS_LOGGER_REDIS_PIPELINE_LENGTH" default:"50"`
 	PipelineTimeoutSeconds int    `envconfig:"DEIS_LOGGER_REDIS_PIPELINE_TIMEOUT_SECONDS" default:"1"`
+	StreamKeyPrefix        string `envconfig:"DEIS_LOGGER_REDIS_STREAM_KEY_PREFIX" default:"stream:"`
+	TimeoutSeconds         int    `envconfig:"DEIS_LOGGER_REDIS_TIMEOUT_SECONDS" default:"5"`
 	PipelineTimeout        time.Duration
+	Timeout                time.Duration
 }
 
 func parseConfig(appName string) (*redisConfig, error) {
@@ -22,5 +25,6 @@ func parseConfig(appName string) (*redisConfig, error) {
 		return nil, err
 	}
 	ret.PipelineTimeout = time.Duration(ret.PipelineTimeoutSeconds) * time.Second
+	ret.Timeout = time.Duration(ret.TimeoutSeconds) * time.Second
 	return ret, nil
 }
@@ -10,10 +10,20 @@ import (
 
 func TestParseConfig(t *testing.T) {
 	host := os.Getenv("DEIS_LOGGER_REDIS_SERVICE_HOST")
-	password := os.Getenv("DEIS_LOGGER_REDIS_PASSWORD")
-	db := os.Getenv("DEIS_LOGGER_REDIS_DB")
-	pipelineLength := os.Getenv("DEIS_LOGGER_REDIS_PIPELINE_LENGTH")
-	pipelineTimeoutSeconds := os.Getenv("DEIS_LOGGER_REDIS_PIPELINE_TIMEOUT_SECONDS")
+	// restore the configuration afterwards, for the tests of the redis adapters using it
+	for _, key := range []string{
+		"DEIS_LOGGER_REDIS_SERVICE_PORT",
+		"DEIS_LOGGER_REDIS_PASSWORD",
+		"DEIS_LOGGER_REDIS_DB",
+		"DEIS_LOGGER_REDIS_PIPELINE_LENGTH",
+		"DEIS_LOGGER_REDIS_PIPELINE_TIMEOUT_SECONDS",
+	} {
+		if value, ok := os.LookupEnv(key); ok {
+			defer os.Setenv(key, value)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
 
 	os.Setenv("DEIS_LOGGER_REDIS_PASSWORD", "password")
 	os.Setenv("DEIS_LOGGER_REDIS_DB", "2")
@@ -31,9 +41,4 @@ func TestParseConfig(t *testing.T) {
 	assert.Equal(t, c.Password, "password")
 	assert.Equal(t, c.PipelineLength, 1)
 	assert.Equal(t, c.PipelineTimeoutSeconds, 2)
-
-	os.Setenv("DEIS_LOGGER_REDIS_PASSWORD", password)
-	os.Setenv("DEIS_LOGGER_REDIS_DB", db)
-	os.Setenv("DEIS_LOGGER_REDIS_PIPELINE_LENGTH", pipelineLength)
-	os.Setenv("DEIS_LOGGER_REDIS_PIPELINE_TIMEOUT_SECONDS", pipelineTimeoutSeconds)
 }
@@ -0,0 +1,459 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	r "gopkg.in/redis.v3"
+)
+
+const streamLineField = "line"
+
+// StreamEntry is a single stored log line together with the ID it was assigned by the stream and
+// the metadata stored along with it, if any.
+type StreamEntry struct {
+	ID       string
+	Line     string
+	Metadata *Metadata
+}
+
+// StreamReader is implemented by storage adapters that assign an ID to every stored line and can
+// therefore read relative to those IDs or to the time encoded in them.
+type StreamReader interface {
+	// ReadAfter retrieves up to count lines stored after the line with the given ID. An empty ID
+	// reads from the beginning of the stream.
+	ReadAfter(ctx context.Context, app string, id string, count int) ([]StreamEntry, error)
+	// ReadRange retrieves up to count of the most recent lines stored between start and end,
+	// inclusive.
+	ReadRange(ctx context.Context, app string, start time.Time, end time.Time, count int) ([]StreamEntry, error)
+}
+
+// streamPipeliner collects additions to streams in a pipeline. It is only used by the goroutine
+// that sends the pipeline.
+type streamPipeliner struct {
+	retention    *retentions
+	keyPrefix    string
+	messageCount int
+	pipeline     *r.Pipeline
+	// waiting holds the done channels of the synchronous messages in the pipeline
+	waiting []chan error
+}
+
+func newStreamPipeliner(retention *retentions, keyPrefix string, redisClient *r.Client) *streamPipeliner {
+	return &streamPipeliner{
+		retention: retention,
+		keyPrefix: keyPrefix,
+		pipeline:  redisClient.Pipeline(),
+	}
+}
+
+func (sp *streamPipeliner) addMessage(message *message) {
+	cmd := r.NewStringCmd("XADD", sp.keyPrefix+message.app, "MAXLEN", "~", sp.retention.get(message.app).Lines, "*", streamLineField, message.messageBody)
+	sp.pipeline.Process(cmd)
+	if err := cmd.Err(); err != nil {
+		err = fmt.Errorf("Error adding xadd to %s to the pipeline: %s", message.app, err)
+		if message.done != nil {
+			message.done <- redisError("redis-streams", err)
+			return
+		}
+		log.Println(err)
+		return
+	}
+	sp.messageCount++
+	if message.done != nil {
+		sp.waiting = append(sp.waiting, message.done)
+	}
+}
+
+func (sp *streamPipeliner) execPipeline() {
+	if sp.messageCount == 0 {
+		return
+	}
+	sp.messageCount = 0
+	_, err := sp.pipeline.Exec()
+	if err != nil {
+		log.Printf("Error executing pipeline: %s", err)
+	}
+	for _, done := range sp.waiting {
+		done <- redisError("redis-streams", err)
+	}
+	sp.waiting = nil
+}
+
+type redisStreamsAdapter struct {
+	started        bool
+	retention      *retentions
+	redisClient    *r.Client
+	messageChannel chan *message
+	stopCh         chan struct{}
+	config         *redisConfig
+	recorder       recorder
+}
+
+// NewRedisStreamsAdapter returns a pointer to a new instance of a storage.Adapter backed by redis
+// streams. Each app's stream is trimmed to approximately bufferSize entries.
+func NewRedisStreamsAdapter(bufferSize int) (Adapter, error) {
+	if bufferSize <= 0 {
+		return nil, fmt.Errorf("Invalid buffer size: %d", bufferSize)
+	}
+	cfg, err := parseConfig(appName)
+	if err != nil {
+		return nil, err
+	}
+	recorder, err := newRecorderFromConfig("redis-streams")
+	if err != nil {
+		return nil, err
+	}
+	return &redisStreamsAdapter{
+		retention:      newRetentions(Retention{Lines: bufferSize}),
+		redisClient:    newRedisClient(cfg),
+		messageChannel: make(chan *message),
+		stopCh:         make(chan struct{}),
+		config:         cfg,
+		recorder:       recorder,
+	}, nil
+}
+
+// Start the storage adapter. Invocations of this function are not concurrency safe and multiple
+// serialized invocations have no effect.
+func (a *redisStreamsAdapter) Start() {
+	if !a.started {
+		a.started = true
+		sp := newStreamPipeliner(a.retention, a.config.StreamKeyPrefix, a.redisClient)
+		ticker := time.NewTicker(a.config.PipelineTimeout)
+		go func() {
+			defer sp.pipeline.Close()
+			defer ticker.Stop()
+			for {
+				select {
+				case <-a.stopCh:
+					sp.execPipeline()
+					return
+				case message := <-a.messageChannel:
+					sp.addMessage(message)
+					if sp.messageCount >= a.config.PipelineLength || message.done != nil {
+						sp.execPipeline()
+					}
+				case <-ticker.C:
+					sp.execPipeline()
+				}
+			}
+		}()
+	}
+}
+
+// Write adds a log message to an app-specific stream in redis, trimming it to the buffer size
+func (a *redisStreamsAdapter) Write(ctx context.Context, app string, messageBody string) error {
+	return send(ctx, a.messageChannel, newMessage(app, messageBody))
+}
+
+// WriteWithMetadata adds a log message to an app-specific stream in redis like Write, storing its
+// metadata along with it if that is configured
+func (a *redisStreamsAdapter) WriteWithMetadata(ctx context.Context, app string, messageBody string, metadata Metadata) error {
+	return send(ctx, a.messageChannel, newMessage(app, a.recorder.record(messageBody, metadata)))
+}
+
+// WriteSync adds a log message to an app-specific stream in redis like WriteWithMetadata, but sends
+// it to redis right away and returns once redis stored it
+func (a *redisStreamsAdapter) WriteSync(ctx context.Context, app string, messageBody string, metadata Metadata) error {
+	return send(ctx, a.messageChannel, newSyncMessage(app, a.recorder.record(messageBody, metadata)))
+}
+
+// Read retrieves a specified number of log lines from an app-specific stream in redis. Lines are
+// limited to a time range using the timestamps they start with and searched for the query.
+// Cursors are stream IDs.
+func (a *redisStreamsAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	if opts.Lines <= 0 {
+		return &Page{}, nil
+	}
+	count := opts.Lines
+	if opts.filtered() {
+		count = a.retention.get(app).Lines
+	}
+	var entries []StreamEntry
+	var err error
+	if opts.After != "" {
+		var start string
+		if start, err = nextStreamID(opts.After); err != nil {
+			return nil, err
+		}
+		entries, err = a.xrange(ctx, app, start, "+", count)
+	} else {
+		start, end := "-", "+"
+		// Lines are stored after they were logged, so entries older than since can be skipped
+		if !opts.Since.IsZero() {
+			start = streamTimeID(opts.Since)
+		}
+		if opts.Before != "" {
+			if end, err = prevStreamID(opts.Before); err != nil {
+				return nil, err
+			}
+			// No line can be stored before the first possible stream ID
+			if end == "" {
+				return nil, newErrNotFound(app)
+			}
+		}
+		entries, err = a.xrevrange(ctx, app, end, start, count)
+	}
+	if err != nil {
+		return nil, err
+	}
+	g, err := newGrepper(opts)
+	if err != nil {
+		return nil, err
+	}
+	scan := func(entry StreamEntry) {
+		if opts.lineInTimeRange(entry.Line) {
+			g.add(entry.Line, entry.ID)
+		}
+	}
+	if opts.After != "" {
+		for i := 0; i < len(entries) && !g.done(); i++ {
+			scan(entries[i])
+		}
+	} else {
+		for i := len(entries) - 1; i >= 0 && !g.done(); i-- {
+			scan(entries[i])
+		}
+		g.page.reverse()
+	}
+	if len(g.page.Lines) == 0 {
+		return nil, newErrNotFound(app)
+	}
+	return g.page, nil
+}
+
+// ReadAfter retrieves up to count log lines stored after the given stream ID
+func (a *redisStreamsAdapter) ReadAfter(ctx context.Context, app string, id string, count int) ([]StreamEntry, error) {
+	if count <= 0 {
+		return []StreamEntry{}, nil
+	}
+	start := "-"
+	if id != "" {
+		next, err := nextStreamID(id)
+		if err != nil {
+			return nil, err
+		}
+		start = next
+	}
+	entries, err := a.xrange(ctx, app, start, "+", count)
+	return splitRecords(entries), err
+}
+
+// ReadRange retrieves up to count of the most recent log lines stored between start and end
+func (a *redisStreamsAdapter) ReadRange(ctx context.Context, app string, start time.Time, end time.Time, count int) ([]StreamEntry, error) {
+	if count <= 0 {
+		return []StreamEntry{}, nil
+	}
+	entries, err := a.xrevrange(ctx, app, streamTimeID(end), streamTimeID(start), count)
+	return splitRecords(entries), err
+}
+
+// splitRecords splits the lines of stream entries that are records into the line and its metadata
+func splitRecords(entries []StreamEntry) []StreamEntry {
+	for i := range entries {
+		entries[i].Line, entries[i].Metadata = splitRecord(entries[i].Line)
+	}
+	return entries
+}
+
+// Apps scans redis for app-specific streams and describes them. The time of an app's last write is
+// taken from the ID of its last entry. The size of its lines is not counted.
+func (a *redisStreamsAdapter) Apps(ctx context.Context) ([]AppInfo, error) {
+	apps := []AppInfo{}
+	err := scanKeys(ctx, a.redisClient, a.config.StreamKeyPrefix+"*", func(keys []string) error {
+		for _, key := range keys {
+			app := strings.TrimPrefix(key, a.config.StreamKeyPrefix)
+			xlen := r.NewIntCmd("XLEN", key)
+			a.redisClient.Process(xlen)
+			lines, err := xlen.Result()
+			if err != nil {
+				return err
+			}
+			info := AppInfo{Name: app, Lines: lines}
+			last, err := a.xrevrange(ctx, app, "+", "-", 1)
+			if err != nil {
+				return err
+			}
+			if len(last) > 0 {
+				info.LastWrite, _ = streamIDTime(last[0].ID)
+			}
+			apps = append(apps, info)
+		}
+		return nil
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, redisError("redis-streams", err)
+	}
+	return apps, nil
+}
+
+// SetRetention overrides the length an app-specific stream is trimmed to, approximately
+func (a *redisStreamsAdapter) SetRetention(app string, retention Retention) error {
+	if err := retention.limits("redis-streams", true, false, false); err != nil {
+		return err
+	}
+	a.retention.set(app, retention)
+	cmd := r.NewIntCmd("XTRIM", a.config.StreamKeyPrefix+app, "MAXLEN", "~", a.retention.get(app).Lines)
+	a.redisClient.Process(cmd)
+	return redisError("redis-streams", cmd.Err())
+}
+
+// Retention returns the limits of the lines kept in an app-specific stream
+func (a *redisStreamsAdapter) Retention(app string) Retention {
+	return a.retention.get(app)
+}
+
+// Destroy deletes an app-specific stream from redis
+func (a *redisStreamsAdapter) Destroy(ctx context.Context, app string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := a.redisClient.Del(a.config.StreamKeyPrefix + app).Err(); err != nil {
+		return redisError("redis-streams", err)
+	}
+	return nil
+}
+
+// Reopen the storage adapter-- in the case of this implementation, a no-op
+func (a *redisStreamsAdapter) Reopen() error {
+	return nil
+}
+
+// Stop the storage adapter. Additional writes may not be performed after stopping.
+func (a *redisStreamsAdapter) Stop() {
+	close(a.stopCh)
+}
+
+// Healthy pings redis, since writes are pipelined in the background and don't fail when it can't
+// be reached
+func (a *redisStreamsAdapter) Healthy(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return redisError("redis-streams", a.redisClient.Ping().Err())
+}
+
+// xrange reads up to count entries between start and end, oldest first
+func (a *redisStreamsAdapter) xrange(ctx context.Context, app string, start string, end string, count int) ([]StreamEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cmd := r.NewSliceCmd("XRANGE", a.config.StreamKeyPrefix+app, start, end, "COUNT", count)
+	a.redisClient.Process(cmd)
+	result, err := cmd.Result()
+	if err != nil {
+		return nil, redisError("redis-streams", err)
+	}
+	return parseStreamEntries(result)
+}
+
+// xrevrange reads up to count entries between end and start, newest first, and returns them in
+// the order they were written.
+func (a *redisStreamsAdapter) xrevrange(ctx context.Context, app string, end string, start string, count int) ([]StreamEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cmd := r.NewSliceCmd("XREVRANGE", a.config.StreamKeyPrefix+app, end, start, "COUNT", count)
+	a.redisClient.Process(cmd)
+	result, err := cmd.Result()
+	if err != nil {
+		return nil, redisError("redis-streams", err)
+	}
+	entries, err := parseStreamEntries(result)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries)/2 - 1; i >= 0; i-- {
+		opp := len(entries) - 1 - i
+		entries[i], entries[opp] = entries[opp], entries[i]
+	}
+	return entries, nil
+}
+
+// parseStreamEntries converts an XRANGE / XREVRANGE reply into stream entries
+func parseStreamEntries(reply []interface{}) ([]StreamEntry, error) {
+	entries := make([]StreamEntry, 0, len(reply))
+	for _, item := range reply {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("Unexpected stream entry: %v", item)
+		}
+		id, ok := pair[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected stream entry ID: %v", pair[0])
+		}
+		fields, ok := pair[1].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Unexpected stream entry fields: %v", pair[1])
+		}
+		entry := StreamEntry{ID: id}
+		for i := 0; i+1 < len(fields); i += 2 {
+			if name, _ := fields[i].(string); name == streamLineField {
+				entry.Line, _ = fields[i+1].(string)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// nextStreamID returns the smallest stream ID that is greater than the given one
+func nextStreamID(id string) (string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return "", newErrInvalidArgument("Invalid stream ID: %s", id)
+	}
+	if len(parts) == 1 {
+		return fmt.Sprintf("%d-%d", ms+1, 0), nil
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", newErrInvalidArgument("Invalid stream ID: %s", id)
+	}
+	return fmt.Sprintf("%d-%d", ms, seq+1), nil
+}
+
+// prevStreamID returns the greatest stream ID that is less than the given one, or an empty string
+// for 0-0, which is the smallest stream ID
+func prevStreamID(id string) (string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		return "", newErrInvalidArgument("Invalid stream ID: %s", id)
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", newErrInvalidArgument("Invalid stream ID: %s", id)
+	}
+	if seq > 0 {
+		return fmt.Sprintf("%d-%d", ms, seq-1), nil
+	}
+	if ms == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("%d-%d", ms-1, uint64(math.MaxUint64)), nil
+}
+
+// streamIDTime returns the time a stream ID was generated at
+func streamIDTime(id string) (time.Time, bool) {
+	ms, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
+
+// streamTimeID returns the millisecond part of the stream IDs generated at time t
+func streamTimeID(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
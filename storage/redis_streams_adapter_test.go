@@ -0,0 +1,214 @@
+// +build testredis
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRedisStreamsReadFromNonExistingApp(t *testing.T) {
+	a, err := NewRedisStreamsAdapter(10)
+	if err != nil {
+		t.Error(err)
+	}
+	// No logs have been written; there should be no redis stream for app
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if messages != nil {
+		t.Error("Expected no messages, but got some")
+	}
+	if err == nil || err.Error() != fmt.Sprintf("Could not find logs for '%s'", app) {
+		t.Error("Did not receive expected error message")
+	}
+}
+
+func TestRedisStreamsWithBadBufferSizes(t *testing.T) {
+	for _, size := range []int{-1, 0} {
+		a, err := NewRedisStreamsAdapter(size)
+		if a != nil {
+			t.Error("Expected no storage adapter, but got one")
+		}
+		if err == nil || err.Error() != fmt.Sprintf("Invalid buffer size: %d", size) {
+			t.Error("Did not receive expected error message")
+		}
+	}
+}
+
+func TestRedisStreamsLogs(t *testing.T) {
+	a, err := NewRedisStreamsAdapter(10)
+	if err != nil {
+		t.Error(err)
+	}
+	a.Start()
+	defer a.Stop()
+	defer a.Destroy(context.Background(), app)
+	for i := 0; i < 5; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	// Sleep for a bit because the adapter queues logs internally and writes them to Redis only when
+	// there are 50 queued up OR a 1 second timeout has been reached.
+	time.Sleep(time.Second * 2)
+	// Read more logs than there are
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 8}))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(messages) != 5 {
+		t.Errorf("only expected 5 log messages, got %d", len(messages))
+	}
+	// Read fewer logs than there are; should get the 3 MOST RECENT logs
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 3}))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(messages) != 3 {
+		t.Errorf("only expected 3 log messages, got %d", len(messages))
+	}
+	for i := 0; i < 3; i++ {
+		expectedMessage := fmt.Sprintf("message %d", i+2)
+		if messages[i] != expectedMessage {
+			t.Errorf("expected: \"%s\", got \"%s\"", expectedMessage, messages[i])
+		}
+	}
+}
+
+func TestRedisStreamsReadBeforeFirstID(t *testing.T) {
+	a, err := NewRedisStreamsAdapter(10)
+	if err != nil {
+		t.Error(err)
+	}
+	a.Start()
+	defer a.Stop()
+	defer a.Destroy(context.Background(), app)
+	if err := a.Write(context.Background(), app, "message 0"); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Second * 2)
+	// No line can be stored before the smallest stream ID
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10, Before: "0-0"}))
+	if messages != nil {
+		t.Errorf("expected no messages, got %v", messages)
+	}
+	if err == nil || err.Error() != fmt.Sprintf("Could not find logs for '%s'", app) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestRedisStreamsReadAfter(t *testing.T) {
+	sa, err := NewRedisStreamsAdapter(10)
+	if err != nil {
+		t.Error(err)
+	}
+	a := sa.(*redisStreamsAdapter)
+	a.Start()
+	defer a.Stop()
+	defer a.Destroy(context.Background(), app)
+	for i := 0; i < 5; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	time.Sleep(time.Second * 2)
+	entries, err := a.ReadAfter(context.Background(), app, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Line != "message 1" {
+		t.Fatalf("expected the 2 oldest entries, got %v", entries)
+	}
+	// Resuming from the last seen ID should return only the remaining entries
+	entries, err = a.ReadAfter(context.Background(), app, entries[1].ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		expectedMessage := fmt.Sprintf("message %d", i+2)
+		if entry.Line != expectedMessage {
+			t.Errorf("expected: \"%s\", got \"%s\"", expectedMessage, entry.Line)
+		}
+	}
+}
+
+func TestRedisStreamsReadRange(t *testing.T) {
+	sa, err := NewRedisStreamsAdapter(10)
+	if err != nil {
+		t.Error(err)
+	}
+	a := sa.(*redisStreamsAdapter)
+	a.Start()
+	defer a.Stop()
+	defer a.Destroy(context.Background(), app)
+	if err := a.Write(context.Background(), app, "before"); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Second * 2)
+	start := time.Now()
+	if err := a.Write(context.Background(), app, "during"); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Second * 2)
+	entries, err := a.ReadRange(context.Background(), app, start, time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Line != "during" {
+		t.Errorf("expected only the entry written during the range, got %v", entries)
+	}
+}
+
+func TestRedisStreamsApps(t *testing.T) {
+	a, err := NewRedisStreamsAdapter(10)
+	if err != nil {
+		t.Error(err)
+	}
+	a.Start()
+	defer a.Stop()
+	before := time.Now().Add(-time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	time.Sleep(time.Second * 2)
+	defer a.Destroy(context.Background(), app)
+	apps, err := a.Apps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range apps {
+		if info.Name == app {
+			if info.Lines != 3 || info.LastWrite.Before(before) {
+				t.Errorf("unexpected description of %s: %+v", app, info)
+			}
+			return
+		}
+	}
+	t.Errorf("expected %s among the apps, got %v", app, apps)
+}
+
+func TestRedisStreamsSetRetention(t *testing.T) {
+	a, err := NewRedisStreamsAdapter(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := a.(RetentionSetter)
+	if err := rs.SetRetention(app, Retention{MaxAge: time.Hour}); err == nil {
+		t.Error("expected an error for an unsupported limit")
+	}
+	if err := rs.SetRetention(app, Retention{Lines: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if retention := rs.Retention(app); retention != (Retention{Lines: 2}) {
+		t.Errorf("unexpected retention: %+v", retention)
+	}
+	if retention := rs.Retention("other"); retention != (Retention{Lines: 10}) {
+		t.Errorf("expected the default retention, got %+v", retention)
+	}
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retention limits the logs kept for an app to a number of lines, a total size in bytes and a
+// maximum age. A zero limit is unset.
+type Retention struct {
+	Lines  int
+	Bytes  int64
+	MaxAge time.Duration
+}
+
+// retentionJSON is how a Retention is read from and written as JSON, with the maximum age as a
+// duration string such as "24h"
+type retentionJSON struct {
+	Lines  int    `json:"lines,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	MaxAge string `json:"max_age,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (r Retention) MarshalJSON() ([]byte, error) {
+	rj := retentionJSON{Lines: r.Lines, Bytes: r.Bytes}
+	if r.MaxAge > 0 {
+		rj.MaxAge = r.MaxAge.String()
+	}
+	return json.Marshal(rj)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (r *Retention) UnmarshalJSON(data []byte) error {
+	var rj retentionJSON
+	if err := json.Unmarshal(data, &rj); err != nil {
+		return err
+	}
+	*r = Retention{Lines: rj.Lines, Bytes: rj.Bytes}
+	if rj.MaxAge != "" {
+		maxAge, err := time.ParseDuration(rj.MaxAge)
+		if err != nil {
+			return newErrInvalidArgument("Invalid max_age: %s", err)
+		}
+		r.MaxAge = maxAge
+	}
+	return nil
+}
+
+// Validate checks that none of the limits is negative
+func (r Retention) Validate() error {
+	if r.Lines < 0 || r.Bytes < 0 || r.MaxAge < 0 {
+		return newErrInvalidArgument("Invalid retention %+v: limits may not be negative", r)
+	}
+	return nil
+}
+
+// IsZero reports whether no limit is set
+func (r Retention) IsZero() bool {
+	return r == Retention{}
+}
+
+// merge returns the retention with every limit that is unset taken from defaults
+func (r Retention) merge(defaults Retention) Retention {
+	if r.Lines == 0 {
+		r.Lines = defaults.Lines
+	}
+	if r.Bytes == 0 {
+		r.Bytes = defaults.Bytes
+	}
+	if r.MaxAge == 0 {
+		r.MaxAge = defaults.MaxAge
+	}
+	return r
+}
+
+// limits checks that a storage adapter supports every limit set by the retention, returning an
+// error naming those it doesn't
+func (r Retention) limits(adapterName string, lines bool, bytes bool, maxAge bool) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	var unsupported []string
+	if r.Lines != 0 && !lines {
+		unsupported = append(unsupported, "lines")
+	}
+	if r.Bytes != 0 && !bytes {
+		unsupported = append(unsupported, "bytes")
+	}
+	if r.MaxAge != 0 && !maxAge {
+		unsupported = append(unsupported, "max_age")
+	}
+	if len(unsupported) > 0 {
+		return newErrInvalidArgument("The %s storage adapter can't limit logs by %s", adapterName, strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// RetentionSetter is implemented by storage adapters that can keep a different amount of logs
+// for every app.
+type RetentionSetter interface {
+	// SetRetention overrides the limits of the logs kept for an app. Unset limits keep the
+	// adapter's default, so the zero Retention removes an app's override.
+	SetRetention(app string, retention Retention) error
+	// Retention returns the limits of the logs kept for an app
+	Retention(app string) Retention
+}
+
+// SetRetention overrides the limits of the logs the given storage adapter keeps for an app,
+// failing if the adapter isn't a RetentionSetter.
+func SetRetention(a Adapter, app string, retention Retention) error {
+	rs, ok := a.(RetentionSetter)
+	if !ok {
+		return newErrInvalidArgument("The storage adapter can't keep a different amount of logs for every app")
+	}
+	return rs.SetRetention(app, retention)
+}
+
+// ReadRetentionFile reads per-app retention overrides from a JSON file mapping app names to their
+// limits, e.g. {"gateway": {"lines": 50000}, "cron": {"lines": 200, "max_age": "24h"}}
+func ReadRetentionFile(filePath string) (map[string]Retention, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	retentions := map[string]Retention{}
+	if err := json.Unmarshal(data, &retentions); err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", filePath, err)
+	}
+	for app, retention := range retentions {
+		if err := retention.Validate(); err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s: %s", filePath, app, err)
+		}
+	}
+	return retentions, nil
+}
+
+// retentions holds the retention overrides of an adapter's apps along with its defaults
+type retentions struct {
+	defaults  Retention
+	overrides map[string]Retention
+	mutex     sync.RWMutex
+}
+
+func newRetentions(defaults Retention) *retentions {
+	return &retentions{defaults: defaults, overrides: make(map[string]Retention)}
+}
+
+// get returns an app's retention, with the defaults for the limits it doesn't override
+func (r *retentions) get(app string) Retention {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.overrides[app].merge(r.defaults)
+}
+
+// expires reports whether the lines of any app are limited to a maximum age
+func (r *retentions) expires() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.defaults.MaxAge > 0 {
+		return true
+	}
+	for _, retention := range r.overrides {
+		if retention.MaxAge > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *retentions) set(app string, retention Retention) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if retention.IsZero() {
+		delete(r.overrides, app)
+	} else {
+		r.overrides[app] = retention
+	}
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetentionJSON(t *testing.T) {
+	r := Retention{Lines: 200, MaxAge: 36 * time.Hour}
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"lines":200,"max_age":"36h0m0s"}` {
+		t.Errorf("unexpected JSON: %s", data)
+	}
+	var decoded Retention
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != r {
+		t.Errorf("expected %+v, got %+v", r, decoded)
+	}
+	if err := json.Unmarshal([]byte(`{"max_age":"a day"}`), &decoded); err == nil {
+		t.Error("expected an error for an invalid duration")
+	}
+}
+
+func TestReadRetentionFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "retention.json")
+	data := `{"gateway": {"lines": 50000}, "cron": {"lines": 200, "max_age": "24h"}}`
+	if err := ioutil.WriteFile(filePath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	retentions, err := ReadRetentionFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Retention{
+		"gateway": {Lines: 50000},
+		"cron":    {Lines: 200, MaxAge: 24 * time.Hour},
+	}
+	if !reflect.DeepEqual(retentions, expected) {
+		t.Errorf("expected %+v, got %+v", expected, retentions)
+	}
+	if err := ioutil.WriteFile(filePath, []byte(`{"cron": {"bytes": -1}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadRetentionFile(filePath); err == nil {
+		t.Error("expected an error for a negative limit")
+	}
+}
+
+func TestRetentions(t *testing.T) {
+	r := newRetentions(Retention{Lines: 1000, MaxAge: time.Hour})
+	r.set("cron", Retention{Lines: 10, Bytes: 1024})
+	if retention := r.get("cron"); retention != (Retention{Lines: 10, Bytes: 1024, MaxAge: time.Hour}) {
+		t.Errorf("expected the override to be merged with the defaults, got %+v", retention)
+	}
+	if retention := r.get("gateway"); retention != (Retention{Lines: 1000, MaxAge: time.Hour}) {
+		t.Errorf("expected the defaults, got %+v", retention)
+	}
+	r.set("cron", Retention{})
+	if retention := r.get("cron"); retention != (Retention{Lines: 1000, MaxAge: time.Hour}) {
+		t.Errorf("expected the override to be removed, got %+v", retention)
+	}
+	if err := (Retention{Bytes: 1024}).limits("redis", true, false, false); err == nil {
+		t.Error("expected an error for an unsupported limit")
+	}
+	if err := SetRetention(failingAdapter{}, "cron", Retention{Lines: 10}); err == nil {
+		t.Error("expected an error for an adapter without retention overrides")
+	}
+}
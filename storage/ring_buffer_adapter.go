@@ -2,31 +2,105 @@ package storage
 
 import (
 	"container/ring"
+	"context"
 	"fmt"
 	"log"
+	"sort"
 	"sync"
+	"time"
 )
 
 type ringBuffer struct {
-	ring  *ring.Ring
+	ring *ring.Ring
+	// seq is the sequence number of the most recently written line
+	seq       int64
+	lastWrite time.Time
+	// bytes is the total size of the lines held
+	bytes int64
 	mutex sync.RWMutex
 }
 
+// ringLine is a line held by a ringBuffer along with the time it was written at
+type ringLine struct {
+	seqLine
+	written time.Time
+}
+
 func newRingBuffer(size int) *ringBuffer {
 	return &ringBuffer{ring: ring.New(size)}
 }
 
-func (rb *ringBuffer) write(message string) {
+func (rb *ringBuffer) write(message string, retention Retention) {
 	// Get a write lock since writing adjusts the value of the internal ring pointer
 	rb.mutex.Lock()
 	defer rb.mutex.Unlock()
+	rb.seq++
+	rb.lastWrite = time.Now()
 	rb.ring = rb.ring.Next()
-	rb.ring.Value = message
+	if overwritten, ok := rb.ring.Value.(ringLine); ok {
+		rb.bytes -= int64(len(overwritten.line))
+	}
+	rb.ring.Value = ringLine{seqLine: seqLine{seq: rb.seq, line: message}, written: rb.lastWrite}
+	rb.bytes += int64(len(message))
+	rb.trim(retention)
+}
+
+// trim drops the oldest lines beyond the retention's size and age limits. The caller must hold
+// the write lock. Since lines are only ever dropped oldest first, the slots that don't hold a line
+// always precede those that do.
+func (rb *ringBuffer) trim(retention Retention) {
+	var cutoff time.Time
+	if retention.MaxAge > 0 {
+		cutoff = time.Now().Add(-retention.MaxAge)
+	}
+	for r, i := rb.ring.Next(), 0; i < rb.ring.Len(); r, i = r.Next(), i+1 {
+		line, ok := r.Value.(ringLine)
+		if !ok {
+			continue
+		}
+		if (retention.Bytes == 0 || rb.bytes <= retention.Bytes) && !line.written.Before(cutoff) {
+			return
+		}
+		rb.bytes -= int64(len(line.line))
+		r.Value = nil
+	}
+}
+
+// expire drops the lines beyond the retention's size and age limits
+func (rb *ringBuffer) expire(retention Retention) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	rb.trim(retention)
+}
+
+// resize changes the number of lines the ringBuffer holds, keeping the most recent ones
+func (rb *ringBuffer) resize(size int) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	if size == rb.ring.Len() {
+		return
+	}
+	resized := ring.New(size)
+	// Copy the newest lines into the new ring, newest first
+	r := resized
+	for old, i := rb.ring, 0; i < rb.ring.Len(); old, i = old.Prev(), i+1 {
+		line, ok := old.Value.(ringLine)
+		if !ok {
+			continue
+		}
+		if i >= size {
+			rb.bytes -= int64(len(line.line))
+			continue
+		}
+		r.Value = line
+		r = r.Prev()
+	}
+	rb.ring = resized
 }
 
-func (rb *ringBuffer) read(lines int) []string {
+func (rb *ringBuffer) read(lines int) []seqLine {
 	if lines <= 0 {
-		return []string{}
+		return []seqLine{}
 	}
 	// Only need a read lock because nothing we're about to do affects the internal state of the
 	// ringBuffer.  Mutliple reads can happen in parallel.  Only writing requires an exclusive lock.
@@ -38,20 +112,34 @@ func (rb *ringBuffer) read(lines int) []string {
 	} else {
 		start = rb.ring.Next()
 	}
-	data := make([]string, 0, lines)
+	data := make([]seqLine, 0, lines)
 	start.Do(func(line interface{}) {
 		if line == nil || lines <= 0 {
 			return
 		}
 		lines--
-		data = append(data, line.(string))
+		data = append(data, line.(ringLine).seqLine)
 	})
 	return data
 }
 
+// info describes the lines held by the ringBuffer
+func (rb *ringBuffer) info(app string) AppInfo {
+	rb.mutex.RLock()
+	defer rb.mutex.RUnlock()
+	info := AppInfo{Name: app, LastWrite: rb.lastWrite, Bytes: rb.bytes}
+	rb.ring.Do(func(line interface{}) {
+		if line != nil {
+			info.Lines++
+		}
+	})
+	return info
+}
+
 type ringBufferAdapter struct {
-	bufferSize  int
+	retention   *retentions
 	ringBuffers map[string]*ringBuffer
+	recorder    recorder
 	mutex       sync.Mutex
 }
 
@@ -60,7 +148,15 @@ func NewRingBufferAdapter(bufferSize int) (Adapter, error) {
 	if bufferSize <= 0 {
 		return nil, fmt.Errorf("Invalid ringBuffer size: %d", bufferSize)
 	}
-	return &ringBufferAdapter{bufferSize: bufferSize, ringBuffers: make(map[string]*ringBuffer)}, nil
+	recorder, err := newRecorderFromConfig("memory")
+	if err != nil {
+		return nil, err
+	}
+	return &ringBufferAdapter{
+		retention:   newRetentions(Retention{Lines: bufferSize}),
+		ringBuffers: make(map[string]*ringBuffer),
+		recorder:    recorder,
+	}, nil
 }
 
 // Start the storage adapter-- in the case of this implementation, a no-op
@@ -68,11 +164,12 @@ func (a *ringBufferAdapter) Start() {
 }
 
 // Write adds a log message to to an app-specific ringBuffer
-func (a *ringBufferAdapter) Write(app string, message string) error {
+func (a *ringBufferAdapter) Write(ctx context.Context, app string, message string) error {
 	// Check first if we might actually have to add to the map of ringBuffer pointers so we can avoid
 	// waiting for / obtaining a lock unnecessarily
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
+	retention := a.retention.get(app)
 	rb, ok := a.ringBuffers[app]
 	if !ok {
 		// Ensure only one goroutine at a time can be adding a ringBuffer to the map of ringBuffers
@@ -80,37 +177,94 @@ func (a *ringBufferAdapter) Write(app string, message string) error {
 		rb, ok = a.ringBuffers[app]
 		if !ok {
 			log.Printf("Creating buffer for app:%v", app)
-			rb = newRingBuffer(a.bufferSize)
+			rb = newRingBuffer(retention.Lines)
 			a.ringBuffers[app] = rb
 		}
 	}
-	rb.write(message)
+	rb.write(message, retention)
 	return nil
 }
 
-// Read retrieves a specified number of log lines from an app-specific ringBuffer
-func (a *ringBufferAdapter) Read(app string, lines int, process string) ([]string, error) {
+// WriteWithMetadata adds a log message to an app-specific ringBuffer, along with its metadata if
+// that is configured
+func (a *ringBufferAdapter) WriteWithMetadata(ctx context.Context, app string, message string, metadata Metadata) error {
+	return a.Write(ctx, app, a.recorder.record(message, metadata))
+}
+
+// Read retrieves a specified number of log lines from an app-specific ringBuffer. Lines are
+// limited to a time range using the timestamps they start with and searched for the query.
+// Cursors are the lines' sequence numbers within the app.
+func (a *ringBufferAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	a.mutex.Lock()
 	rb, ok := a.ringBuffers[app]
+	a.mutex.Unlock()
 	if ok {
-		data := rb.read(lines)
-		if len(data) == 0 {
-			return nil, fmt.Errorf("Could not find logs for '%s'. Ringbuffer existed for '%s', but returned no logs.", app, app)
+		retention := a.retention.get(app)
+		if retention.MaxAge > 0 {
+			// Lines expire even if no new lines are written
+			rb.expire(retention)
+		}
+		var data []seqLine
+		if opts.filtered() || opts.Before != "" || opts.After != "" {
+			data = rb.read(retention.Lines)
+		} else {
+			data = rb.read(opts.Lines)
 		}
-		return data, nil
+		page, err := selectPage(data, opts)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Lines) == 0 {
+			return nil, newErrNotFound(app)
+		}
+		return page, nil
 	}
-	return nil, fmt.Errorf("Could not find logs for '%s'. No ringbuffer existed for '%s'.", app, app)
+	return nil, newErrNotFound(app)
 }
 
-// Destroy deletes stored logs for the specified application
-func (a *ringBufferAdapter) Destroy(app string) error {
-	// Check first if the map of ringBuffer pointers even contains the ringBuffer we intend to
-	// delete so we can avoid waiting for / obtaining a lock unnecessarily
-	_, ok := a.ringBuffers[app]
-	if ok {
-		a.mutex.Lock()
-		defer a.mutex.Unlock()
-		delete(a.ringBuffers, app)
+// Apps describes the logs held by every app-specific ringBuffer
+func (a *ringBufferAdapter) Apps(ctx context.Context) ([]AppInfo, error) {
+	a.mutex.Lock()
+	ringBuffers := make(map[string]*ringBuffer, len(a.ringBuffers))
+	for app, rb := range a.ringBuffers {
+		ringBuffers[app] = rb
+	}
+	a.mutex.Unlock()
+	apps := make([]AppInfo, 0, len(ringBuffers))
+	for app, rb := range ringBuffers {
+		apps = append(apps, rb.info(app))
 	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+	return apps, nil
+}
+
+// SetRetention overrides the number of lines held by an app's ringBuffer, along with the total
+// size and the age of the lines it holds
+func (a *ringBufferAdapter) SetRetention(app string, retention Retention) error {
+	if err := retention.limits("memory", true, true, true); err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.retention.set(app, retention)
+	if rb, ok := a.ringBuffers[app]; ok {
+		retention = a.retention.get(app)
+		rb.resize(retention.Lines)
+		rb.expire(retention)
+	}
+	return nil
+}
+
+// Retention returns the limits of the lines held by an app's ringBuffer
+func (a *ringBufferAdapter) Retention(app string) Retention {
+	return a.retention.get(app)
+}
+
+// Destroy deletes stored logs for the specified application
+func (a *ringBufferAdapter) Destroy(ctx context.Context, app string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.ringBuffers, app)
 	return nil
 }
 
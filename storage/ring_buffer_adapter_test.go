@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRingBufferReadFromNonExistingApp(t *testing.T) {
@@ -16,11 +19,11 @@ func TestRingBufferReadFromNonExistingApp(t *testing.T) {
 		t.Fatalf("returned adapter was not a ringBuffer")
 	}
 	// No logs have been writter; there should be no ringBuffer for app
-	messages, err := a.Read(app, 10, "")
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
 	if messages != nil {
 		t.Error("Expected no messages, but got some")
 	}
-	if err == nil || err.Error() != fmt.Sprintf("Could not find logs for '%s'. No ringbuffer existed for '%s'.", app, app) {
+	if err != newErrNotFound(app) {
 		t.Error("Did not receive expected error message")
 	}
 }
@@ -46,12 +49,12 @@ func TestRingBufferLogs(t *testing.T) {
 	}
 	// And write a few logs to it, but do NOT fill it up
 	for i := 0; i < 5; i++ {
-		if err := a.Write(app, fmt.Sprintf("message %d", i)); err != nil {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
 			t.Error(err)
 		}
 	}
 	// Read more logs than there are
-	messages, err := a.Read(app, 8, "")
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 8}))
 	if err != nil {
 		t.Error(err)
 	}
@@ -60,7 +63,7 @@ func TestRingBufferLogs(t *testing.T) {
 		t.Errorf("only expected 5 log messages, got %d", len(messages))
 	}
 	// Read fewer logs than there are
-	messages, err = a.Read(app, 3, "")
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 3}))
 	if err != nil {
 		t.Error(err)
 	}
@@ -76,12 +79,12 @@ func TestRingBufferLogs(t *testing.T) {
 	}
 	// Overfill the buffer
 	for i := 5; i < 11; i++ {
-		if err := a.Write(app, fmt.Sprintf("message %d", i)); err != nil {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
 			t.Error(err)
 		}
 	}
 	// Read more logs than the buffer can hold
-	messages, err = a.Read(app, 20, "")
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 20}))
 	if err != nil {
 		t.Error(err)
 	}
@@ -109,7 +112,7 @@ func TestRingBufferDestroy(t *testing.T) {
 		t.Fatalf("returned adapter was not a ringBuffer")
 	}
 	// Write a log to create the file
-	if err := a.Write(app, "Hello, log!"); err != nil {
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
 		t.Error(err)
 	}
 	// A ringBuffer should exist for the app
@@ -117,7 +120,7 @@ func TestRingBufferDestroy(t *testing.T) {
 		t.Error("Log ringbuffer was expected to exist, but doesn't.")
 	}
 	// Now destroy it
-	if err := a.Destroy(app); err != nil {
+	if err := a.Destroy(context.Background(), app); err != nil {
 		t.Error(err)
 	}
 	// Now check that the ringBuffer no longer exists
@@ -125,3 +128,133 @@ func TestRingBufferDestroy(t *testing.T) {
 		t.Error("Log ringbuffer still exist, but was expected not to.")
 	}
 }
+
+func TestRingBufferTimeRange(t *testing.T) {
+	a, err := NewRingBufferAdapter(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2017, 3, 1, 14, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		line := fmt.Sprintf("%s %s[web.v1]: message %d", start.Add(time.Duration(i)*time.Minute).Format(time.RFC3339), app, i)
+		if err := a.Write(context.Background(), app, line); err != nil {
+			t.Error(err)
+		}
+	}
+	opts := ReadOptions{Lines: 10, Since: start.Add(2 * time.Minute), Until: start.Add(8 * time.Minute)}
+	messages, err := readLines(a.Read(context.Background(), app, opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 6 || !strings.HasSuffix(messages[0], "message 2") || !strings.HasSuffix(messages[5], "message 7") {
+		t.Errorf("expected messages 2 through 7, got %v", messages)
+	}
+	// Only the most recent lines within the range are returned
+	opts.Lines = 2
+	messages, err = readLines(a.Read(context.Background(), app, opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || !strings.HasSuffix(messages[0], "message 6") {
+		t.Errorf("expected messages 6 and 7, got %v", messages)
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10, Since: start.Add(time.Hour)}); err == nil {
+		t.Error("expected an error reading a time range without logs")
+	}
+}
+
+func TestRingBufferApps(t *testing.T) {
+	a, err := NewRingBufferAdapter(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apps, err := a.Apps(context.Background())
+	if err != nil || len(apps) != 0 {
+		t.Errorf("expected no apps, got %v, %v", apps, err)
+	}
+	before := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := a.Write(context.Background(), "foo", fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := a.Write(context.Background(), "bar", "Hello, log!"); err != nil {
+		t.Error(err)
+	}
+	apps, err = a.Apps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 2 || apps[0].Name != "bar" || apps[1].Name != "foo" {
+		t.Fatalf("expected apps bar and foo, got %v", apps)
+	}
+	// Only the lines the ring buffer still holds are counted
+	if apps[1].Lines != 3 || apps[1].Bytes != 27 || apps[1].LastWrite.Before(before) {
+		t.Errorf("unexpected description of foo: %+v", apps[1])
+	}
+}
+
+func TestRingBufferSetRetention(t *testing.T) {
+	a, err := NewRingBufferAdapter(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := a.(RetentionSetter)
+	if err := rs.SetRetention("foo", Retention{Lines: 3}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		for _, app := range []string{"foo", "bar"} {
+			if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if messages, _ := readLines(a.Read(context.Background(), "foo", ReadOptions{Lines: 10})); len(messages) != 3 {
+		t.Errorf("expected 3 retained lines for foo, got %v", messages)
+	}
+	if messages, _ := readLines(a.Read(context.Background(), "bar", ReadOptions{Lines: 10})); len(messages) != 5 {
+		t.Errorf("expected 5 retained lines for bar, got %v", messages)
+	}
+	// Shrinking an existing buffer keeps the newest lines
+	if err := rs.SetRetention("bar", Retention{Lines: 2}); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := readLines(a.Read(context.Background(), "bar", ReadOptions{Lines: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(messages, ",") != "message 3,message 4" {
+		t.Errorf("expected the 2 newest lines for bar, got %v", messages)
+	}
+	// Only as many of the newest lines as fit are kept
+	if err := rs.SetRetention("foo", Retention{Lines: 3, Bytes: 20}); err != nil {
+		t.Fatal(err)
+	}
+	messages, err = readLines(a.Read(context.Background(), "foo", ReadOptions{Lines: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(messages, ",") != "message 3,message 4" {
+		t.Errorf("expected the 2 newest lines for foo to fit in 20 bytes, got %v", messages)
+	}
+	if err := a.Write(context.Background(), "foo", "message 5"); err != nil {
+		t.Error(err)
+	}
+	if apps, _ := a.Apps(context.Background()); apps[1].Name != "foo" || apps[1].Lines != 2 || apps[1].Bytes != 18 {
+		t.Errorf("unexpected description of foo: %+v", apps)
+	}
+	if err := rs.SetRetention("foo", Retention{MaxAge: time.Nanosecond}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Read(context.Background(), "foo", ReadOptions{Lines: 10}); err == nil {
+		t.Error("expected all of foo's lines to have expired")
+	}
+	// Removing an override restores the defaults
+	if err := rs.SetRetention("foo", Retention{}); err != nil {
+		t.Fatal(err)
+	}
+	if retention := rs.Retention("foo"); retention != (Retention{Lines: 5}) {
+		t.Errorf("expected the default retention, got %+v", retention)
+	}
+}
@@ -0,0 +1,526 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+)
+
+// objectStore is the subset of an S3-compatible API used by the s3 adapter
+type objectStore interface {
+	PutObject(ctx context.Context, key string, body []byte) error
+	GetObject(ctx context.Context, key string) ([]byte, error)
+	// ListObjects returns the keys of every object whose key starts with prefix
+	ListObjects(ctx context.Context, prefix string) ([]string, error)
+	RemoveObject(ctx context.Context, key string) error
+}
+
+type minioObjectStore struct {
+	client *minio.Client
+	bucket string
+	region string
+}
+
+func (s *minioObjectStore) ensureBucket() error {
+	exists, err := s.client.BucketExists(s.bucket)
+	if err != nil || exists {
+		return err
+	}
+	return s.client.MakeBucket(s.bucket, s.region)
+}
+
+func (s *minioObjectStore) PutObject(ctx context.Context, key string, body []byte) error {
+	_, err := s.client.PutObjectWithContext(ctx, s.bucket, key, bytes.NewReader(body), int64(len(body)), minio.PutObjectOptions{
+		ContentType: "application/gzip",
+	})
+	return err
+}
+
+func (s *minioObjectStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	obj, err := s.client.GetObjectWithContext(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return ioutil.ReadAll(obj)
+}
+
+// ListObjects doesn't take a context, so listing stops at the page after the context is done
+func (s *minioObjectStore) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	keys := []string{}
+	for obj := range s.client.ListObjectsV2(s.bucket, prefix, true, doneCh) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		keys = append(keys, obj.Key)
+	}
+	return keys, nil
+}
+
+func (s *minioObjectStore) RemoveObject(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.client.RemoveObject(s.bucket, key)
+}
+
+// s3Batch holds lines that have not been written out yet, along with the key of the object they
+// will be written to
+type s3Batch struct {
+	key   string
+	lines []string
+}
+
+// s3Adapter archives log lines as gzipped, time-partitioned objects in an S3-compatible object
+// store. Lines are buffered per app and written out in batches.
+type s3Adapter struct {
+	started           bool
+	store             objectStore
+	batchLines        int
+	flushInterval     time.Duration
+	timeout           time.Duration
+	retention         *retentions
+	retentionInterval time.Duration
+	buffers           map[string]*s3Batch
+	recorder          recorder
+	mutex             sync.Mutex
+	stopCh            chan struct{}
+}
+
+// NewS3Adapter returns a storage adapter that archives logs to an S3-compatible object store.
+func NewS3Adapter() (Adapter, error) {
+	cfg, err := parseS3Config(appName)
+	if err != nil {
+		return nil, err
+	}
+	client, err := minio.NewWithRegion(cfg.Endpoint, cfg.AccessKey, cfg.SecretKey, cfg.UseSSL, cfg.Region)
+	if err != nil {
+		return nil, err
+	}
+	store := &minioObjectStore{client: client, bucket: cfg.Bucket, region: cfg.Region}
+	a, err := newS3Adapter(store, cfg.BatchLines, cfg.FlushInterval)
+	if err != nil {
+		return nil, err
+	}
+	a.timeout = cfg.Timeout
+	a.retention = newRetentions(Retention{MaxAge: cfg.RetentionMaxAge})
+	a.retentionInterval = cfg.RetentionInterval
+	if a.recorder, err = newRecorderFromConfig("s3"); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func newS3Adapter(store objectStore, batchLines int, flushInterval time.Duration) (*s3Adapter, error) {
+	if batchLines <= 0 {
+		return nil, fmt.Errorf("Invalid batch size: %d", batchLines)
+	}
+	return &s3Adapter{
+		store:         store,
+		batchLines:    batchLines,
+		flushInterval: flushInterval,
+		retention:     newRetentions(Retention{}),
+		buffers:       make(map[string]*s3Batch),
+		stopCh:        make(chan struct{}),
+	}, nil
+}
+
+// Start the storage adapter. Buffered lines are flushed and retention is enforced periodically in
+// the background. Invocations of this function are not concurrency safe and multiple serialized
+// invocations have no effect.
+func (a *s3Adapter) Start() {
+	if !a.started {
+		a.started = true
+		if s, ok := a.store.(*minioObjectStore); ok {
+			if err := s.ensureBucket(); err != nil {
+				log.Printf("Error creating bucket %s: %s", s.bucket, err)
+			}
+		}
+		if a.flushInterval <= 0 && a.retentionInterval <= 0 {
+			return
+		}
+		go func() {
+			var flushCh, retentionCh <-chan time.Time
+			if a.flushInterval > 0 {
+				ticker := time.NewTicker(a.flushInterval)
+				defer ticker.Stop()
+				flushCh = ticker.C
+			}
+			if a.retentionInterval > 0 {
+				ticker := time.NewTicker(a.retentionInterval)
+				defer ticker.Stop()
+				retentionCh = ticker.C
+			}
+			for {
+				select {
+				case <-a.stopCh:
+					return
+				case <-flushCh:
+					a.flushAll(context.Background())
+				case <-retentionCh:
+					if err := a.enforceRetention(context.Background()); err != nil {
+						log.Printf("Error enforcing retention: %s", err)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Write buffers a log message, writing the app's buffered lines out as a new object once a full
+// batch has been collected
+func (a *s3Adapter) Write(ctx context.Context, app string, message string) error {
+	a.mutex.Lock()
+	batch, ok := a.buffers[app]
+	if !ok {
+		batch = &s3Batch{key: s3ObjectKey(app, time.Now())}
+		a.buffers[app] = batch
+	}
+	batch.lines = append(batch.lines, message)
+	if len(batch.lines) < a.batchLines {
+		a.mutex.Unlock()
+		return nil
+	}
+	delete(a.buffers, app)
+	a.mutex.Unlock()
+	return a.flush(ctx, app, batch)
+}
+
+// WriteWithMetadata buffers a log message like Write, storing its metadata along with it if that is
+// configured
+func (a *s3Adapter) WriteWithMetadata(ctx context.Context, app string, message string, metadata Metadata) error {
+	return a.Write(ctx, app, a.recorder.record(message, metadata))
+}
+
+// Read retrieves a specified number of log lines, starting with lines that have not been flushed
+// yet and continuing with the app's newest objects. Lines are limited to a time range using the
+// timestamps they start with and searched for the query. Cursors are the key of the object holding
+// a line and its index within that object.
+func (a *s3Adapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	if opts.Lines <= 0 {
+		return &Page{}, nil
+	}
+	cursorKey, cursorIndex := "", -1
+	if cursor := opts.Before + opts.After; cursor != "" {
+		var err error
+		if cursorKey, cursorIndex, err = parseS3Cursor(app, cursor); err != nil {
+			return nil, err
+		}
+	}
+	keys, err := a.listObjects(ctx, app+"/")
+	if err != nil {
+		return nil, err
+	}
+	// keys sort chronologically, see s3ObjectKey
+	sort.Strings(keys)
+	a.mutex.Lock()
+	var pending *s3Batch
+	if batch, ok := a.buffers[app]; ok {
+		pending = &s3Batch{key: batch.key, lines: append([]string{}, batch.lines...)}
+		keys = append(keys, pending.key)
+	}
+	a.mutex.Unlock()
+	readLines := func(key string) ([]string, error) {
+		if pending != nil && key == pending.key {
+			return pending.lines, nil
+		}
+		storeCtx, cancel := withTimeout(ctx, a.timeout)
+		defer cancel()
+		body, err := a.store.GetObject(storeCtx, key)
+		if err != nil {
+			return nil, unavailable(ctx, "s3", err)
+		}
+		lines, err := gunzipLines(body)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", key, err)
+		}
+		return lines, nil
+	}
+	g, err := newGrepper(opts)
+	if err != nil {
+		return nil, err
+	}
+	collect := func(key string, i int, line string) {
+		if (opts.Process == "" || processFromLine(line) == opts.Process) && opts.lineInTimeRange(line) {
+			g.add(line, fmt.Sprintf("%s#%d", key, i))
+		}
+	}
+	if opts.After != "" {
+		for k := sort.SearchStrings(keys, cursorKey); k < len(keys) && !g.done(); k++ {
+			lines, err := readLines(keys[k])
+			if err != nil {
+				return nil, err
+			}
+			for i := 0; i < len(lines) && !g.done(); i++ {
+				if keys[k] != cursorKey || i > cursorIndex {
+					collect(keys[k], i, lines[i])
+				}
+			}
+		}
+	} else {
+		k := len(keys) - 1
+		if opts.Before != "" {
+			k = sort.Search(len(keys), func(i int) bool { return keys[i] > cursorKey }) - 1
+		}
+		for ; k >= 0 && !g.done(); k-- {
+			// Lines were buffered before the next object's first line was
+			if k+1 < len(keys) {
+				if next, ok := s3ObjectTime(keys[k+1]); ok && next.Before(opts.Since) {
+					break
+				}
+			}
+			lines, err := readLines(keys[k])
+			if err != nil {
+				return nil, err
+			}
+			for i := len(lines) - 1; i >= 0 && !g.done(); i-- {
+				if keys[k] != cursorKey || i < cursorIndex {
+					collect(keys[k], i, lines[i])
+				}
+			}
+		}
+		g.page.reverse()
+	}
+	if len(g.page.Lines) == 0 {
+		return nil, newErrNotFound(app)
+	}
+	return g.page, nil
+}
+
+// Apps lists the apps that have archived objects or buffered lines. Objects aren't downloaded to
+// count their lines, and the time of an app's last write is approximated by the time the first
+// line of its newest object was buffered at.
+func (a *s3Adapter) Apps(ctx context.Context) ([]AppInfo, error) {
+	keys, err := a.listObjects(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	a.mutex.Lock()
+	for _, batch := range a.buffers {
+		keys = append(keys, batch.key)
+	}
+	a.mutex.Unlock()
+	lastWrites := map[string]time.Time{}
+	for _, key := range keys {
+		i := strings.IndexByte(key, '/')
+		if i < 0 {
+			continue
+		}
+		app := key[:i]
+		t, _ := s3ObjectTime(key)
+		if last, ok := lastWrites[app]; !ok || t.After(last) {
+			lastWrites[app] = t
+		}
+	}
+	apps := make([]AppInfo, 0, len(lastWrites))
+	for app, t := range lastWrites {
+		apps = append(apps, AppInfo{Name: app, LastWrite: t})
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+	return apps, nil
+}
+
+// Destroy deletes buffered lines and every archived object for the specified application
+func (a *s3Adapter) Destroy(ctx context.Context, app string) error {
+	a.mutex.Lock()
+	delete(a.buffers, app)
+	a.mutex.Unlock()
+	keys, err := a.listObjects(ctx, app+"/")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		storeCtx, cancel := withTimeout(ctx, a.timeout)
+		err := a.store.RemoveObject(storeCtx, key)
+		cancel()
+		if err != nil {
+			return unavailable(ctx, "s3", err)
+		}
+	}
+	return nil
+}
+
+// SetRetention overrides the maximum age of the lines kept for an app. Objects aren't downloaded to
+// count their lines, so the number or size of an app's lines can't be limited.
+func (a *s3Adapter) SetRetention(app string, retention Retention) error {
+	if err := retention.limits("s3", false, false, true); err != nil {
+		return err
+	}
+	a.retention.set(app, retention)
+	return nil
+}
+
+// Retention returns the limits of the lines kept for an app
+func (a *s3Adapter) Retention(app string) Retention {
+	return a.retention.get(app)
+}
+
+// enforceRetention deletes, for every app with a maximum age, the objects holding only lines older
+// than that. The lines of an object were buffered before those of the app's next object, so an
+// object is deleted once the next one is older than the maximum age. The newest object of an app
+// is kept.
+func (a *s3Adapter) enforceRetention(ctx context.Context) error {
+	if !a.retention.expires() {
+		return nil
+	}
+	keys, err := a.listObjects(ctx, "")
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	for _, batch := range a.buffers {
+		keys = append(keys, batch.key)
+	}
+	a.mutex.Unlock()
+	// keys sort chronologically within an app, see s3ObjectKey
+	sort.Strings(keys)
+	now := time.Now()
+	for i := 0; i+1 < len(keys); i++ {
+		j := strings.IndexByte(keys[i], '/')
+		if j < 0 || !strings.HasPrefix(keys[i+1], keys[i][:j+1]) {
+			continue
+		}
+		maxAge := a.retention.get(keys[i][:j]).MaxAge
+		next, ok := s3ObjectTime(keys[i+1])
+		if maxAge <= 0 || !ok || now.Sub(next) < maxAge {
+			continue
+		}
+		storeCtx, cancel := withTimeout(ctx, a.timeout)
+		err := a.store.RemoveObject(storeCtx, keys[i])
+		cancel()
+		if err != nil {
+			return unavailable(ctx, "s3", err)
+		}
+	}
+	return nil
+}
+
+// listObjects returns the keys of every object whose key starts with prefix
+func (a *s3Adapter) listObjects(ctx context.Context, prefix string) ([]string, error) {
+	storeCtx, cancel := withTimeout(ctx, a.timeout)
+	defer cancel()
+	keys, err := a.store.ListObjects(storeCtx, prefix)
+	if err != nil {
+		return nil, unavailable(ctx, "s3", err)
+	}
+	return keys, nil
+}
+
+// Reopen the storage adapter-- in the case of this implementation, a no-op
+func (a *s3Adapter) Reopen() error {
+	return nil
+}
+
+// Stop the storage adapter, flushing any buffered lines. Additional writes may not be performed
+// after stopping.
+func (a *s3Adapter) Stop() {
+	close(a.stopCh)
+	a.flushAll(context.Background())
+}
+
+func (a *s3Adapter) flushAll(ctx context.Context) {
+	a.mutex.Lock()
+	buffers := a.buffers
+	a.buffers = make(map[string]*s3Batch)
+	a.mutex.Unlock()
+	for app, batch := range buffers {
+		if err := a.flush(ctx, app, batch); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// flush writes a batch of lines out as a single gzipped object. If that fails, the lines are put
+// back at the front of the app's buffer so they are retried with the next batch.
+func (a *s3Adapter) flush(ctx context.Context, app string, batch *s3Batch) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for _, line := range batch.lines {
+		fmt.Fprintln(zw, line)
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	storeCtx, cancel := withTimeout(ctx, a.timeout)
+	defer cancel()
+	if err := a.store.PutObject(storeCtx, batch.key, buf.Bytes()); err != nil {
+		a.mutex.Lock()
+		if buffered, ok := a.buffers[app]; ok {
+			batch.lines = append(batch.lines, buffered.lines...)
+		}
+		// Don't buffer without bound while the object store is unavailable
+		if max := 10 * a.batchLines; len(batch.lines) > max {
+			batch.lines = batch.lines[len(batch.lines)-max:]
+		}
+		a.buffers[app] = batch
+		a.mutex.Unlock()
+		return newErrUnavailable("s3", fmt.Errorf("Error writing %s: %s", batch.key, err))
+	}
+	return nil
+}
+
+// parseS3Cursor splits a cursor into the key of an app's object and the index of a line within it
+func parseS3Cursor(app string, cursor string) (string, int, error) {
+	i := strings.LastIndexByte(cursor, '#')
+	if i < 0 || !strings.HasPrefix(cursor, app+"/") {
+		return "", 0, newErrInvalidArgument("Invalid cursor: %s", cursor)
+	}
+	index, err := strconv.Atoi(cursor[i+1:])
+	if err != nil {
+		return "", 0, newErrInvalidArgument("Invalid cursor: %s", cursor)
+	}
+	return cursor[:i], index, nil
+}
+
+// s3ObjectKey returns the key of an object whose first line was buffered at time t. Keys are
+// partitioned by app and hour and, within an app, sort chronologically.
+func s3ObjectKey(app string, t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("%s/%s-%019d.log.gz", app, t.Format("2006/01/02/15"), t.UnixNano())
+}
+
+// s3ObjectTime returns the time an object's first line was buffered at from its key
+func s3ObjectTime(key string) (time.Time, bool) {
+	name := path.Base(key)
+	i := strings.IndexByte(name, '-')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(strings.TrimSuffix(name[i+1:], ".log.gz"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+func gunzipLines(body []byte) ([]string, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	lines := []string{}
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
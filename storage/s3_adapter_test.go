@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryObjectStore struct {
+	objects map[string][]byte
+	fail    bool
+	mutex   sync.Mutex
+}
+
+func newMemoryObjectStore() *memoryObjectStore {
+	return &memoryObjectStore{objects: make(map[string][]byte)}
+}
+
+func (s *memoryObjectStore) PutObject(_ context.Context, key string, body []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.fail {
+		return errors.New("object store unavailable")
+	}
+	s.objects[key] = body
+	return nil
+}
+
+func (s *memoryObjectStore) GetObject(_ context.Context, key string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	body, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", key)
+	}
+	return body, nil
+}
+
+func (s *memoryObjectStore) ListObjects(_ context.Context, prefix string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := []string{}
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memoryObjectStore) RemoveObject(_ context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func TestS3ReadFromNonExistingApp(t *testing.T) {
+	a, err := newS3Adapter(newMemoryObjectStore(), 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if messages != nil {
+		t.Error("Expected no messages, but got some")
+	}
+	if err == nil || err.Error() != fmt.Sprintf("Could not find logs for '%s'", app) {
+		t.Error("Did not receive expected error message")
+	}
+}
+
+func TestS3WithBadBatchSizes(t *testing.T) {
+	for _, size := range []int{-1, 0} {
+		a, err := newS3Adapter(newMemoryObjectStore(), size, 0)
+		if a != nil {
+			t.Error("Expected no storage adapter, but got one")
+		}
+		if err == nil || err.Error() != fmt.Sprintf("Invalid batch size: %d", size) {
+			t.Error("Did not receive expected error message")
+		}
+	}
+}
+
+func TestS3Logs(t *testing.T) {
+	store := newMemoryObjectStore()
+	a, err := newS3Adapter(store, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two full batches are written out as objects, the last line stays buffered
+	for i := 0; i < 7; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	keys, _ := store.ListObjects(context.Background(), app+"/")
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 objects, got %d", len(keys))
+	}
+	// Read more logs than there are
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 7 {
+		t.Errorf("only expected 7 log messages, got %d", len(messages))
+	}
+	// Read across the buffer and the newest object; should get the 5 MOST RECENT logs
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 5}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 5 {
+		t.Fatalf("only expected 5 log messages, got %d", len(messages))
+	}
+	for i := 0; i < 5; i++ {
+		expectedMessage := fmt.Sprintf("message %d", i+2)
+		if messages[i] != expectedMessage {
+			t.Errorf("expected: \"%s\", got \"%s\"", expectedMessage, messages[i])
+		}
+	}
+}
+
+func TestS3TimeRange(t *testing.T) {
+	store := newMemoryObjectStore()
+	a, err := newS3Adapter(store, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2017, 3, 1, 14, 0, 0, 0, time.UTC)
+	// An object written before the time range is never read
+	store.PutObject(context.Background(), s3ObjectKey(app, start.Add(5*time.Minute)), []byte("not gzipped"))
+	var lines []string
+	for i := 5; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf("%s %s[web.v1]: message %d", start.Add(time.Duration(i)*time.Minute).Format(time.RFC3339), app, i))
+	}
+	// The next object's first line was buffered before the time range, too
+	if err := a.flush(context.Background(), app, &s3Batch{key: s3ObjectKey(app, start.Add(5*time.Minute+30*time.Second)), lines: lines}); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10, Since: start.Add(6 * time.Minute), Until: start.Add(9 * time.Minute)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(messages, lines[1:4]) {
+		t.Errorf("expected %v, got %v", lines[1:4], messages)
+	}
+}
+
+func TestS3Metadata(t *testing.T) {
+	a, err := newS3Adapter(newMemoryObjectStore(), 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.recorder = true
+	start := time.Now().UTC().Add(-time.Hour)
+	var lines []string
+	// lines in a custom log format, archived along with their metadata
+	for i, process := range []string{"web", "worker", "web", "worker", "web"} {
+		line := fmt.Sprintf("%s said: message %d", process, i)
+		lines = append(lines, line)
+		metadata := Metadata{Time: start.Add(time.Duration(i) * time.Minute), Process: process, Container: app + "-" + process}
+		if err := a.WriteWithMetadata(context.Background(), app, line, metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page, err := a.Read(context.Background(), app, ReadOptions{Lines: 10, Process: "web", Since: start.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{lines[2], lines[4]}; !reflect.DeepEqual(page.Lines, expected) {
+		t.Errorf("expected %v, got %v", expected, page.Lines)
+	}
+	if m := page.LineMetadata(0); m == nil || m.Container != app+"-web" {
+		t.Errorf("expected the metadata of %q, got %+v", page.Lines[0], m)
+	}
+}
+
+func TestS3Cursors(t *testing.T) {
+	store := newMemoryObjectStore()
+	a, err := newS3Adapter(store, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two objects and a buffered line
+	for i := 0; i < 7; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	page, err := a.Read(context.Background(), app, ReadOptions{Lines: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"message 5", "message 6"}) {
+		t.Errorf("unexpected messages: %v", page.Lines)
+	}
+	// Paging back crosses objects
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 4, Before: page.Before()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"message 1", "message 2", "message 3", "message 4"}) {
+		t.Errorf("unexpected messages before the first page: %v", page.Lines)
+	}
+	// Lines written since are found after the last page, even once they have been archived
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 10, After: page.After()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := page.After()
+	for i := 7; i < 9; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 10, After: after})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"message 7", "message 8"}) {
+		t.Errorf("unexpected messages after the last page: %v", page.Lines)
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 10, After: "otherapp/key#1"}); err == nil {
+		t.Error("expected an error for another app's cursor")
+	}
+}
+
+func TestS3ObjectTime(t *testing.T) {
+	written := time.Date(2017, 3, 1, 14, 0, 0, 123, time.UTC)
+	if got, ok := s3ObjectTime(s3ObjectKey(app, written)); !ok || !got.Equal(written) {
+		t.Errorf("expected %s, got %s", written, got)
+	}
+	if _, ok := s3ObjectTime(app + "/unexpected.log.gz"); ok {
+		t.Error("expected no time for an unexpected key")
+	}
+}
+
+func TestS3StopFlushesBufferedLines(t *testing.T) {
+	store := newMemoryObjectStore()
+	a, err := newS3Adapter(store, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
+		t.Error(err)
+	}
+	a.Stop()
+	keys, _ := store.ListObjects(context.Background(), app+"/")
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 object, got %d", len(keys))
+	}
+	body, _ := store.GetObject(context.Background(), keys[0])
+	lines, err := gunzipLines(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, []string{"Hello, log!"}) {
+		t.Errorf("unexpected object contents: %v", lines)
+	}
+}
+
+func TestS3RetriesFailedBatches(t *testing.T) {
+	store := newMemoryObjectStore()
+	store.fail = true
+	a, err := newS3Adapter(store, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Write(context.Background(), app, "message 0")
+	if err := a.Write(context.Background(), app, "message 1"); err == nil {
+		t.Error("expected an error writing to an unavailable object store")
+	}
+	store.fail = false
+	a.Write(context.Background(), app, "message 2")
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(messages, []string{"message 0", "message 1", "message 2"}) {
+		t.Errorf("unexpected messages: %v", messages)
+	}
+}
+
+func TestS3Destroy(t *testing.T) {
+	store := newMemoryObjectStore()
+	a, err := newS3Adapter(store, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := app + "-other"
+	a.Write(context.Background(), app, "Hello, log!")
+	a.Write(context.Background(), other, "Hello, log!")
+	if err := a.Destroy(context.Background(), app); err != nil {
+		t.Error(err)
+	}
+	if keys, _ := store.ListObjects(context.Background(), app+"/"); len(keys) != 0 {
+		t.Errorf("expected the app's objects to be deleted, got %v", keys)
+	}
+	if keys, _ := store.ListObjects(context.Background(), other+"/"); len(keys) != 1 {
+		t.Errorf("expected other apps' objects to be kept, got %v", keys)
+	}
+}
+
+func TestS3ObjectKey(t *testing.T) {
+	ts := time.Date(2026, 10, 17, 14, 2, 0, 0, time.UTC)
+	key := s3ObjectKey(app, ts)
+	expected := fmt.Sprintf("%s/2026/10/17/14-%019d.log.gz", app, ts.UnixNano())
+	if key != expected {
+		t.Errorf("expected %s, got %s", expected, key)
+	}
+}
+
+func TestS3Apps(t *testing.T) {
+	store := newMemoryObjectStore()
+	a, err := newS3Adapter(store, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := a.Write(context.Background(), "foo", fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	// Apps with buffered lines only are listed as well
+	if err := a.Write(context.Background(), "bar", "Hello, log!"); err != nil {
+		t.Error(err)
+	}
+	apps, err := a.Apps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 2 || apps[0].Name != "bar" || apps[1].Name != "foo" {
+		t.Fatalf("expected apps bar and foo, got %v", apps)
+	}
+	if pending := a.buffers["foo"].key; !strings.HasSuffix(pending, fmt.Sprintf("-%019d.log.gz", apps[1].LastWrite.UnixNano())) {
+		t.Errorf("expected the last write of foo to be that of its buffered lines, got %s", apps[1].LastWrite)
+	}
+}
+
+func TestS3Retention(t *testing.T) {
+	store := newMemoryObjectStore()
+	a, err := newS3Adapter(store, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, object := range []struct {
+		app string
+		age time.Duration
+	}{
+		{"foo", 3 * time.Hour}, {"foo", 2 * time.Hour}, {"foo", 30 * time.Minute}, {"foo", time.Minute},
+		{"bar", 3 * time.Hour}, {"bar", 2 * time.Hour},
+		{"baz", 5 * time.Hour},
+	} {
+		store.PutObject(context.Background(), s3ObjectKey(object.app, now.Add(-object.age)), nil)
+	}
+	if err := a.SetRetention("foo", Retention{Lines: 10}); err == nil {
+		t.Error("expected an error for a retention limiting lines")
+	}
+	for _, app := range []string{"foo", "baz"} {
+		if err := a.SetRetention(app, Retention{MaxAge: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.enforceRetention(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// an object is deleted once the next one is older than the maximum age, and an app's newest
+	// object is kept
+	for app, expected := range map[string]int{"foo": 3, "bar": 2, "baz": 1} {
+		if keys, _ := store.ListObjects(context.Background(), app+"/"); len(keys) != expected {
+			t.Errorf("expected %d objects of %s to be kept, got %v", expected, app, keys)
+		}
+	}
+	if keys, _ := store.ListObjects(context.Background(), s3ObjectKey("foo", now.Add(-3*time.Hour))); len(keys) != 0 {
+		t.Errorf("expected the oldest object of foo to be deleted, got %v", keys)
+	}
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type s3Config struct {
+	Endpoint             string `envconfig:"DEIS_LOGGER_S3_ENDPOINT" default:"localhost:9000"`
+	AccessKey            string `envconfig:"DEIS_LOGGER_S3_ACCESS_KEY" default:""`
+	SecretKey            string `envconfig:"DEIS_LOGGER_S3_SECRET_KEY" default:""`
+	Region               string `envconfig:"DEIS_LOGGER_S3_REGION" default:"us-east-1"`
+	Bucket               string `envconfig:"DEIS_LOGGER_S3_BUCKET" default:"logs"`
+	UseSSL               bool   `envconfig:"DEIS_LOGGER_S3_USE_SSL" default:"false"`
+	BatchLines           int    `envconfig:"DEIS_LOGGER_S3_BATCH_LINES" default:"1000"`
+	FlushIntervalSeconds int    `envconfig:"DEIS_LOGGER_S3_FLUSH_INTERVAL_SECONDS" default:"60"`
+	TimeoutSeconds       int    `envconfig:"DEIS_LOGGER_S3_TIMEOUT_SECONDS" default:"30"`
+	// RetentionMaxAgeSeconds is the default maximum age of the lines kept for an app
+	RetentionMaxAgeSeconds   int `envconfig:"DEIS_LOGGER_S3_RETENTION_MAX_AGE_SECONDS" default:"0"`
+	RetentionIntervalSeconds int `envconfig:"DEIS_LOGGER_S3_RETENTION_INTERVAL_SECONDS" default:"3600"`
+	FlushInterval            time.Duration
+	Timeout                  time.Duration
+	RetentionMaxAge          time.Duration
+	RetentionInterval        time.Duration
+}
+
+func parseS3Config(appName string) (*s3Config, error) {
+	ret := new(s3Config)
+	if err := envconfig.Process(appName, ret); err != nil {
+		return nil, err
+	}
+	ret.FlushInterval = time.Duration(ret.FlushIntervalSeconds) * time.Second
+	ret.Timeout = time.Duration(ret.TimeoutSeconds) * time.Second
+	ret.RetentionMaxAge = time.Duration(ret.RetentionMaxAgeSeconds) * time.Second
+	ret.RetentionInterval = time.Duration(ret.RetentionIntervalSeconds) * time.Second
+	return ret, nil
+}
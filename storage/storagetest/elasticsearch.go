@@ -0,0 +1,628 @@
+package storagetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const esDocType = "doc"
+
+// Elasticsearch is an in-process stand-in for an elasticsearch 5 server. It serves the searches
+// of the elasticsearch storage adapter: bool queries of term, range and query_string queries,
+// sorting, search_after and terms aggregations with max sub-aggregations, along with
+// delete-by-query requests using the same queries. Documents are added with Index and are
+// searchable right away. Query strings are matched as case-insensitive substrings or,
+// between slashes, regular expressions rather than analyzed.
+type Elasticsearch struct {
+	// URL is the base URL of the server, with no trailing slash
+	URL     string
+	server  *httptest.Server
+	mutex   sync.Mutex
+	indices map[string][]esDoc
+	seq     int
+}
+
+type esDoc struct {
+	index  string
+	id     string
+	source map[string]interface{}
+}
+
+// NewElasticsearch starts an elasticsearch stand-in. The caller should call Close when finished to
+// shut it down.
+func NewElasticsearch() *Elasticsearch {
+	s := &Elasticsearch{indices: make(map[string][]esDoc)}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+	return s
+}
+
+// Host returns the host the server listens at
+func (s *Elasticsearch) Host() string {
+	return strings.SplitN(s.server.Listener.Addr().String(), ":", 2)[0]
+}
+
+// Port returns the port the server listens at
+func (s *Elasticsearch) Port() int {
+	addr := s.server.Listener.Addr().String()
+	port, _ := strconv.Atoi(addr[strings.LastIndex(addr, ":")+1:])
+	return port
+}
+
+// Index adds a document to an index, creating the index if it doesn't exist. Documents are given
+// increasing IDs, so documents with the same sort values are sorted in the order they were indexed.
+func (s *Elasticsearch) Index(index string, source map[string]interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seq++
+	s.indices[index] = append(s.indices[index], esDoc{index: index, id: fmt.Sprintf("%020d", s.seq), source: source})
+}
+
+// DeleteIndex deletes an index and its documents
+func (s *Elasticsearch) DeleteIndex(index string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.indices, index)
+}
+
+// Close shuts the server down
+func (s *Elasticsearch) Close() {
+	s.server.Close()
+}
+
+func (s *Elasticsearch) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/":
+		writeESJSON(w, http.StatusOK, map[string]interface{}{
+			"name":    "storagetest",
+			"version": map[string]interface{}{"number": "5.6.16"},
+			"tagline": "You Know, for Search",
+		})
+	case r.URL.Path == "/_nodes/http":
+		// the client sniffs the cluster for the nodes it sends requests to
+		writeESJSON(w, http.StatusOK, map[string]interface{}{
+			"cluster_name": "storagetest",
+			"nodes": map[string]interface{}{
+				"storagetest": map[string]interface{}{
+					"name": "storagetest",
+					"http": map[string]interface{}{"publish_address": s.server.Listener.Addr().String()},
+				},
+			},
+		})
+	case strings.HasSuffix(r.URL.Path, "/_search") && (r.Method == "GET" || r.Method == "POST"):
+		s.search(w, r, strings.Trim(strings.TrimSuffix(r.URL.Path, "/_search"), "/"))
+	case strings.HasSuffix(r.URL.Path, "/_delete_by_query") && r.Method == "POST":
+		s.deleteByQuery(w, r, strings.Trim(strings.TrimSuffix(r.URL.Path, "/_delete_by_query"), "/"))
+	default:
+		writeESError(w, http.StatusBadRequest, "illegal_argument_exception", "unsupported request "+r.Method+" "+r.URL.Path)
+	}
+}
+
+type esSearch struct {
+	Query        map[string]interface{}            `json:"query"`
+	Size         *int                              `json:"size"`
+	Sort         []interface{}                     `json:"sort"`
+	SearchAfter  []interface{}                     `json:"search_after"`
+	Aggregations map[string]map[string]interface{} `json:"aggregations"`
+	Aggs         map[string]map[string]interface{} `json:"aggs"`
+}
+
+type esSortField struct {
+	field      string
+	descending bool
+}
+
+func (s *Elasticsearch) search(w http.ResponseWriter, r *http.Request, indexPattern string) {
+	var req esSearch
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&req); err != nil && err != io.EOF {
+		writeESError(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+	docs, missing := s.docs(indexPattern)
+	if missing != "" {
+		writeESError(w, http.StatusNotFound, "index_not_found_exception", "no such index: "+missing)
+		return
+	}
+	var matches []esDoc
+	for _, doc := range docs {
+		ok, err := esMatch(doc, req.Query)
+		if err != nil {
+			writeESError(w, http.StatusBadRequest, "query_shard_exception", err.Error())
+			return
+		}
+		if ok {
+			matches = append(matches, doc)
+		}
+	}
+	sortFields, err := parseESSort(req.Sort)
+	if err != nil {
+		writeESError(w, http.StatusBadRequest, "parsing_exception", err.Error())
+		return
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return compareESSortValues(esSortValues(matches[i], sortFields), esSortValues(matches[j], sortFields), sortFields) < 0
+	})
+	if req.SearchAfter != nil {
+		if len(req.SearchAfter) != len(sortFields) {
+			writeESError(w, http.StatusBadRequest, "illegal_argument_exception", "search_after has a different number of values than sort")
+			return
+		}
+		i := 0
+		for i < len(matches) && compareESSortValues(esSortValues(matches[i], sortFields), req.SearchAfter, sortFields) <= 0 {
+			i++
+		}
+		matches = matches[i:]
+	}
+	size := 10
+	if req.Size != nil {
+		size = *req.Size
+	}
+	hits := []interface{}{}
+	for i := 0; i < len(matches) && i < size; i++ {
+		hit := map[string]interface{}{
+			"_index":  matches[i].index,
+			"_type":   esDocType,
+			"_id":     matches[i].id,
+			"_score":  nil,
+			"_source": matches[i].source,
+		}
+		if len(sortFields) > 0 {
+			hit["sort"] = esSortValues(matches[i], sortFields)
+		}
+		hits = append(hits, hit)
+	}
+	resp := map[string]interface{}{
+		"took":      1,
+		"timed_out": false,
+		"_shards":   map[string]interface{}{"total": 1, "successful": 1, "failed": 0},
+		"hits":      map[string]interface{}{"total": len(matches), "max_score": nil, "hits": hits},
+	}
+	aggs := req.Aggregations
+	if aggs == nil {
+		aggs = req.Aggs
+	}
+	if aggs != nil {
+		result, err := esAggregate(matches, aggs)
+		if err != nil {
+			writeESError(w, http.StatusBadRequest, "parsing_exception", err.Error())
+			return
+		}
+		resp["aggregations"] = result
+	}
+	writeESJSON(w, http.StatusOK, resp)
+}
+
+func (s *Elasticsearch) deleteByQuery(w http.ResponseWriter, r *http.Request, indexPattern string) {
+	var req struct {
+		Query map[string]interface{} `json:"query"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&req); err != nil {
+		writeESError(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+	if _, missing := s.docs(indexPattern); missing != "" {
+		writeESError(w, http.StatusNotFound, "index_not_found_exception", "no such index: "+missing)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	kept := map[string][]esDoc{}
+	deleted := 0
+	for name, docs := range s.indices {
+		if !esIndexMatches(indexPattern, name) {
+			continue
+		}
+		kept[name] = []esDoc{}
+		for _, doc := range docs {
+			ok, err := esMatch(doc, req.Query)
+			if err != nil {
+				writeESError(w, http.StatusBadRequest, "query_shard_exception", err.Error())
+				return
+			}
+			if ok {
+				deleted++
+			} else {
+				kept[name] = append(kept[name], doc)
+			}
+		}
+	}
+	for name, docs := range kept {
+		s.indices[name] = docs
+	}
+	writeESJSON(w, http.StatusOK, map[string]interface{}{
+		"took":      1,
+		"timed_out": false,
+		"total":     deleted,
+		"deleted":   deleted,
+		"failures":  []interface{}{},
+	})
+}
+
+// esIndexMatches reports whether an index name matches a comma separated list of index names and
+// wildcard patterns
+func esIndexMatches(indexPattern string, name string) bool {
+	for _, pattern := range strings.Split(indexPattern, ",") {
+		if pattern == "" || pattern == "_all" {
+			pattern = "*"
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// docs returns the documents of every index matching a comma separated list of index names and
+// wildcard patterns, along with the first name that doesn't match an index
+func (s *Elasticsearch) docs(indexPattern string) ([]esDoc, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	names := make([]string, 0, len(s.indices))
+	for name := range s.indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var docs []esDoc
+	for _, pattern := range strings.Split(indexPattern, ",") {
+		if pattern == "" || pattern == "_all" {
+			pattern = "*"
+		}
+		if !strings.Contains(pattern, "*") {
+			if _, ok := s.indices[pattern]; !ok {
+				return nil, pattern
+			}
+		}
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok {
+				docs = append(docs, s.indices[name]...)
+			}
+		}
+	}
+	return docs, ""
+}
+
+// esField returns the value of a field of a document, given by its dotted path
+func esField(doc esDoc, field string) (interface{}, bool) {
+	if field == "_uid" {
+		return esDocType + "#" + doc.id, true
+	}
+	if field == "_id" {
+		return doc.id, true
+	}
+	var value interface{} = doc.source
+	for _, name := range strings.Split(field, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// esClauses returns the queries of a bool query clause, which is either a single query or a list
+func esClauses(clause interface{}) []interface{} {
+	if clauses, ok := clause.([]interface{}); ok {
+		return clauses
+	}
+	return []interface{}{clause}
+}
+
+func esMatch(doc esDoc, query map[string]interface{}) (bool, error) {
+	if len(query) == 0 {
+		return true, nil
+	}
+	for kind, body := range query {
+		params, _ := body.(map[string]interface{})
+		switch kind {
+		case "match_all":
+			return true, nil
+		case "bool":
+			return esMatchBool(doc, params)
+		case "term":
+			for field, value := range params {
+				if m, ok := value.(map[string]interface{}); ok {
+					value = m["value"]
+				}
+				actual, ok := esField(doc, field)
+				return ok && fmt.Sprint(actual) == fmt.Sprint(value), nil
+			}
+		case "range":
+			for field, bounds := range params {
+				m, _ := bounds.(map[string]interface{})
+				actual, ok := esField(doc, field)
+				return ok && esInRange(actual, m), nil
+			}
+		case "query_string":
+			return esMatchQueryString(doc, params)
+		}
+		return false, fmt.Errorf("unsupported query %s", kind)
+	}
+	return true, nil
+}
+
+func esMatchBool(doc esDoc, params map[string]interface{}) (bool, error) {
+	for _, occur := range []string{"filter", "must"} {
+		for _, clause := range esClauses(params[occur]) {
+			if clause == nil {
+				continue
+			}
+			q, _ := clause.(map[string]interface{})
+			if ok, err := esMatch(doc, q); !ok || err != nil {
+				return false, err
+			}
+		}
+	}
+	for _, clause := range esClauses(params["must_not"]) {
+		if clause == nil {
+			continue
+		}
+		q, _ := clause.(map[string]interface{})
+		if ok, err := esMatch(doc, q); ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// esInRange reports whether a value is within the from/to or gt/gte/lt/lte bounds of a range query
+func esInRange(value interface{}, bounds map[string]interface{}) bool {
+	check := func(bound interface{}, ok func(int) bool) bool {
+		return bound == nil || ok(compareESValues(value, bound))
+	}
+	includeLower, _ := bounds["include_lower"].(bool)
+	includeUpper, _ := bounds["include_upper"].(bool)
+	if _, ok := bounds["include_lower"]; !ok {
+		includeLower = true
+	}
+	if _, ok := bounds["include_upper"]; !ok {
+		includeUpper = true
+	}
+	return check(bounds["from"], func(c int) bool { return c > 0 || (includeLower && c == 0) }) &&
+		check(bounds["to"], func(c int) bool { return c < 0 || (includeUpper && c == 0) }) &&
+		check(bounds["gt"], func(c int) bool { return c > 0 }) &&
+		check(bounds["gte"], func(c int) bool { return c >= 0 }) &&
+		check(bounds["lt"], func(c int) bool { return c < 0 }) &&
+		check(bounds["lte"], func(c int) bool { return c <= 0 })
+}
+
+func esMatchQueryString(doc esDoc, params map[string]interface{}) (bool, error) {
+	query, _ := params["query"].(string)
+	field, _ := params["default_field"].(string)
+	if field == "" {
+		field = "_all"
+	}
+	value, ok := esField(doc, field)
+	if !ok {
+		return false, nil
+	}
+	text := fmt.Sprint(value)
+	if len(query) > 1 && strings.HasPrefix(query, "/") && strings.HasSuffix(query, "/") {
+		re, err := regexp.Compile("(?i)" + strings.Replace(query[1:len(query)-1], `\/`, "/", -1))
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(text), nil
+	}
+	if len(query) > 1 && strings.HasPrefix(query, `"`) && strings.HasSuffix(query, `"`) {
+		query = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(query[1 : len(query)-1])
+		return strings.Contains(strings.ToLower(text), strings.ToLower(query)), nil
+	}
+	for _, term := range strings.Fields(query) {
+		if !strings.Contains(strings.ToLower(text), strings.ToLower(term)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func parseESSort(sorts []interface{}) ([]esSortField, error) {
+	fields := make([]esSortField, 0, len(sorts))
+	for _, s := range sorts {
+		switch v := s.(type) {
+		case string:
+			fields = append(fields, esSortField{field: v})
+		case map[string]interface{}:
+			for field, order := range v {
+				if m, ok := order.(map[string]interface{}); ok {
+					order = m["order"]
+				}
+				fields = append(fields, esSortField{field: field, descending: order == "desc"})
+			}
+		default:
+			return nil, fmt.Errorf("invalid sort %v", s)
+		}
+	}
+	return fields, nil
+}
+
+// esSortValues returns the values a document is sorted by. Dates are sorted by their milliseconds
+// since the epoch.
+func esSortValues(doc esDoc, fields []esSortField) []interface{} {
+	values := make([]interface{}, len(fields))
+	for i, f := range fields {
+		value, _ := esField(doc, f.field)
+		if t, ok := esTime(value); ok {
+			value = t.UnixNano() / int64(time.Millisecond)
+		}
+		values[i] = value
+	}
+	return values
+}
+
+func compareESSortValues(a []interface{}, b []interface{}, fields []esSortField) int {
+	for i, f := range fields {
+		c := compareESValues(a[i], b[i])
+		if f.descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareESValues compares two values as times, numbers or strings, in that order of preference
+func compareESValues(a interface{}, b interface{}) int {
+	if ta, ok := esTime(a); ok {
+		if tb, ok := esTime(b); ok {
+			return compareESNumbers(float64(ta.UnixNano()), float64(tb.UnixNano()))
+		}
+		a = float64(ta.UnixNano() / int64(time.Millisecond))
+	}
+	if fa, ok := esNumber(a); ok {
+		if fb, ok := esNumber(b); ok {
+			return compareESNumbers(fa, fb)
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func compareESNumbers(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func esTime(value interface{}) (time.Time, bool) {
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t, err == nil
+}
+
+func esNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// esAggregate runs terms aggregations, with max sub-aggregations, over the matching documents
+func esAggregate(docs []esDoc, aggs map[string]map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	for name, agg := range aggs {
+		if max, ok := agg["max"].(map[string]interface{}); ok {
+			field, _ := max["field"].(string)
+			var value interface{}
+			for _, doc := range docs {
+				v, ok := esField(doc, field)
+				if !ok {
+					continue
+				}
+				if t, ok := esTime(v); ok {
+					v = float64(t.UnixNano() / int64(time.Millisecond))
+				}
+				if f, ok := esNumber(v); ok && (value == nil || f > value.(float64)) {
+					value = f
+				}
+			}
+			result[name] = map[string]interface{}{"value": value}
+			continue
+		}
+		terms, ok := agg["terms"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unsupported aggregation %s", name)
+		}
+		field, _ := terms["field"].(string)
+		size := 10
+		if n, ok := esNumber(terms["size"]); ok {
+			size = int(n)
+		}
+		groups := make(map[string][]esDoc)
+		var keys []string
+		for _, doc := range docs {
+			v, ok := esField(doc, field)
+			if !ok {
+				continue
+			}
+			key := fmt.Sprint(v)
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], doc)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(groups[keys[i]]) != len(groups[keys[j]]) {
+				return len(groups[keys[i]]) > len(groups[keys[j]])
+			}
+			return keys[i] < keys[j]
+		})
+		if len(keys) > size {
+			keys = keys[:size]
+		}
+		subAggs := make(map[string]map[string]interface{})
+		for _, sub := range []string{"aggregations", "aggs"} {
+			if m, ok := agg[sub].(map[string]interface{}); ok {
+				for subName, subAgg := range m {
+					subAggs[subName], _ = subAgg.(map[string]interface{})
+				}
+			}
+		}
+		buckets := make([]interface{}, len(keys))
+		for i, key := range keys {
+			bucket, err := esAggregate(groups[key], subAggs)
+			if err != nil {
+				return nil, err
+			}
+			bucket["key"] = key
+			bucket["doc_count"] = len(groups[key])
+			buckets[i] = bucket
+		}
+		result[name] = map[string]interface{}{
+			"doc_count_error_upper_bound": 0,
+			"sum_other_doc_count":         0,
+			"buckets":                     buckets,
+		}
+	}
+	return result, nil
+}
+
+func writeESJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeESError(w http.ResponseWriter, code int, errorType string, reason string) {
+	cause := map[string]interface{}{"type": errorType, "reason": reason}
+	writeESJSON(w, code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"root_cause": []interface{}{cause},
+			"type":       errorType,
+			"reason":     reason,
+		},
+		"status": code,
+	})
+}
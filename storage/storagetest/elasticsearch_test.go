@@ -0,0 +1,99 @@
+package storagetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func search(t *testing.T, s *Elasticsearch, path string, body string) (int, map[string]interface{}) {
+	resp, err := http.Post(s.URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	result := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, result
+}
+
+func hitLogs(result map[string]interface{}) []string {
+	logs := []string{}
+	for _, hit := range result["hits"].(map[string]interface{})["hits"].([]interface{}) {
+		logs = append(logs, hit.(map[string]interface{})["_source"].(map[string]interface{})["log"].(string))
+	}
+	return logs
+}
+
+func TestElasticsearchSearch(t *testing.T) {
+	s := NewElasticsearch()
+	defer s.Close()
+	for i, log := range []string{"first", "Second", "third"} {
+		process := "web"
+		if i == 1 {
+			process = "worker"
+		}
+		s.Index("deis-app", map[string]interface{}{
+			"@timestamp": "2017-01-01T00:00:0" + string('0'+byte(i)) + "Z",
+			"log":        log,
+			"kubernetes": map[string]interface{}{"container": map[string]interface{}{"name": "app-" + process}},
+		})
+	}
+	tests := []struct {
+		body     string
+		expected []string
+	}{
+		{`{"query":{"match_all":{}},"sort":[{"@timestamp":{"order":"desc"}}],"size":2}`, []string{"third", "Second"}},
+		{`{"query":{"bool":{"filter":{"term":{"kubernetes.container.name":"app-web"}}}},"sort":[{"@timestamp":{"order":"asc"}}]}`, []string{"first", "third"}},
+		{`{"query":{"range":{"@timestamp":{"from":"2017-01-01T00:00:01Z","include_lower":false}}}}`, []string{"third"}},
+		{`{"query":{"query_string":{"query":"second","default_field":"log"}}}`, []string{"Second"}},
+		{`{"query":{"match_all":{}},"sort":[{"@timestamp":{"order":"asc"}}],"search_after":[1483228800000]}`, []string{"Second", "third"}},
+	}
+	for _, test := range tests {
+		code, result := search(t, s, "/deis-app/_search", test.body)
+		if code != http.StatusOK {
+			t.Errorf("searching with %s: expected a 200, got a %d: %v", test.body, code, result)
+			continue
+		}
+		if logs := hitLogs(result); !reflect.DeepEqual(test.expected, logs) {
+			t.Errorf("searching with %s: expected %q, got %q", test.body, test.expected, logs)
+		}
+	}
+}
+
+func TestElasticsearchMissingIndex(t *testing.T) {
+	s := NewElasticsearch()
+	defer s.Close()
+	if code, _ := search(t, s, "/deis-missing/_search", `{}`); code != http.StatusNotFound {
+		t.Errorf("expected a 404 searching a missing index, got a %d", code)
+	}
+	if code, result := search(t, s, "/deis-*/_search", `{}`); code != http.StatusOK {
+		t.Errorf("expected a 200 searching a pattern matching no index, got a %d: %v", code, result)
+	}
+}
+
+func TestElasticsearchDeleteByQuery(t *testing.T) {
+	s := NewElasticsearch()
+	defer s.Close()
+	for i, log := range []string{"first", "second", "third"} {
+		s.Index("deis-app", map[string]interface{}{
+			"@timestamp": "2017-01-01T00:00:0" + string('0'+byte(i)) + "Z",
+			"log":        log,
+		})
+	}
+	code, result := search(t, s, "/deis-app/_delete_by_query", `{"query":{"range":{"@timestamp":{"to":"2017-01-01T00:00:02Z","include_upper":false}}}}`)
+	if code != http.StatusOK || result["deleted"] != float64(2) {
+		t.Errorf("expected 2 documents to be deleted, got a %d: %v", code, result)
+	}
+	_, result = search(t, s, "/deis-app/_search", `{"query":{"match_all":{}}}`)
+	if logs := hitLogs(result); !reflect.DeepEqual(logs, []string{"third"}) {
+		t.Errorf("expected the newest document to be kept, got %v", logs)
+	}
+	if code, _ := search(t, s, "/deis-other/_delete_by_query", `{"query":{"match_all":{}}}`); code != http.StatusNotFound {
+		t.Errorf("expected a 404 for a missing index, got a %d", code)
+	}
+}
@@ -0,0 +1,695 @@
+package storagetest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// Status is a simple string reply, such as the OK of a SET or the type of a key, as opposed to a
+// bulk string reply
+type Status string
+
+// Script is a Go stand-in for a Lua script run with EVAL. It is passed a function that runs a
+// command, like redis.call, along with the script's keys and arguments. Replies and return values
+// are nil, string, Status, int64 or []interface{}.
+type Script func(call func(args ...string) (interface{}, error), keys []string, args []string) (interface{}, error)
+
+// Redis is an in-process stand-in for a redis server. It speaks enough of the redis protocol for
+// the redis and redis-streams storage adapters: strings, lists, streams, key scans and pipelined
+// commands, all in a single database. It has no Lua interpreter, so EVAL and EVALSHA run the Go
+// stand-in registered for a script's source instead. Streams are always trimmed exactly.
+type Redis struct {
+	// Addr is the host:port the server listens at
+	Addr     string
+	listener net.Listener
+	mutex    sync.Mutex
+	// values are strings, lists ([]string) and streams (*redisStream)
+	values  map[string]interface{}
+	scripts map[string]Script
+	// loaded maps the SHA1 digests of the scripts that were loaded or run to their source
+	loaded map[string]string
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+type redisStream struct {
+	entries []redisStreamEntry
+	lastID  redisStreamID
+}
+
+type redisStreamEntry struct {
+	id     redisStreamID
+	fields []string
+}
+
+type redisStreamID struct {
+	ms, seq uint64
+}
+
+func (id redisStreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id redisStreamID) less(other redisStreamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// NewRedis starts a redis stand-in listening on a random local port. The caller should call Close
+// when finished to shut it down.
+func NewRedis() (*Redis, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Redis{
+		Addr:     l.Addr().String(),
+		listener: l,
+		values:   make(map[string]interface{}),
+		scripts:  make(map[string]Script),
+		loaded:   make(map[string]string),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Host returns the host the server listens at
+func (s *Redis) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr)
+	return host
+}
+
+// Port returns the port the server listens at
+func (s *Redis) Port() int {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// HandleScript registers the Go stand-in run by EVAL for the given script source
+func (s *Redis) HandleScript(script string, fn Script) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.scripts[script] = fn
+}
+
+// Do runs a command as if a client had sent it
+func (s *Redis) Do(args ...string) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.do(args)
+}
+
+// Close stops the server, closing every client connection
+func (s *Redis) Close() error {
+	err := s.listener.Close()
+	s.mutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Redis) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns[conn] = struct{}{}
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+// handle serves a client connection, answering every command in the order it was sent so
+// pipelined commands are answered in order too
+func (s *Redis) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readRedisCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				writeRedisReply(w, fmt.Errorf("ERR Protocol error: %s", err))
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		reply, err := s.Do(args...)
+		if err != nil {
+			writeRedisReply(w, err)
+		} else {
+			writeRedisReply(w, reply)
+		}
+		// replies to pipelined commands are written together
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if strings.ToUpper(args[0]) == "QUIT" {
+			w.Flush()
+			return
+		}
+	}
+}
+
+// readRedisCommand reads a command sent either as an array of bulk strings or inline
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid multibulk length %q", line[1:])
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readRedisLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected '$', got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk length %q", line[1:])
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readRedisLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeRedisReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case Status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, s := range v {
+			writeRedisReply(w, s)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeRedisReply(w, item)
+		}
+	default:
+		fmt.Fprintf(w, "-ERR unexpected reply %T\r\n", v)
+	}
+}
+
+// do runs a command. The caller must hold the mutex.
+func (s *Redis) do(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("ERR empty command")
+	}
+	cmd, args := strings.ToUpper(args[0]), args[1:]
+	arity := map[string]int{
+		"GET": 1, "SET": 2, "INCR": 1, "TYPE": 1, "LLEN": 1, "LINDEX": 2, "LRANGE": 3, "LTRIM": 3,
+		"XLEN": 1, "MEMORY": 2,
+	}
+	if n, ok := arity[cmd]; ok && len(args) < n {
+		return nil, fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd))
+	}
+	switch cmd {
+	case "PING":
+		return Status("PONG"), nil
+	case "AUTH", "SELECT", "QUIT":
+		return Status("OK"), nil
+	case "GET":
+		switch v := s.values[args[0]].(type) {
+		case nil:
+			return nil, nil
+		case string:
+			return v, nil
+		}
+		return nil, errWrongType
+	case "SET":
+		s.values[args[0]] = args[1]
+		return Status("OK"), nil
+	case "INCR":
+		var n int64
+		switch v := s.values[args[0]].(type) {
+		case nil:
+		case string:
+			var err error
+			if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+		default:
+			return nil, errWrongType
+		}
+		n++
+		s.values[args[0]] = strconv.FormatInt(n, 10)
+		return n, nil
+	case "EXISTS", "DEL":
+		var n int64
+		for _, key := range args {
+			if _, ok := s.values[key]; ok {
+				n++
+				if cmd == "DEL" {
+					delete(s.values, key)
+				}
+			}
+		}
+		return n, nil
+	case "TYPE":
+		switch s.values[args[0]].(type) {
+		case nil:
+			return Status("none"), nil
+		case string:
+			return Status("string"), nil
+		case []string:
+			return Status("list"), nil
+		}
+		return Status("stream"), nil
+	case "SCAN":
+		return s.scan(args)
+	case "LLEN", "LINDEX", "LRANGE", "LTRIM", "RPUSH":
+		return s.list(cmd, args)
+	case "MEMORY":
+		return s.memory(args)
+	case "XADD", "XLEN", "XRANGE", "XREVRANGE", "XTRIM":
+		return s.stream(cmd, args)
+	case "EVAL":
+		return s.eval(args)
+	case "EVALSHA":
+		if len(args) > 0 {
+			script, ok := s.loaded[strings.ToLower(args[0])]
+			if !ok {
+				return nil, errors.New("NOSCRIPT No matching script. Please use EVAL.")
+			}
+			args = append([]string{script}, args[1:]...)
+		}
+		return s.eval(args)
+	case "SCRIPT":
+		return s.script(args)
+	}
+	return nil, fmt.Errorf("ERR unknown command '%s'", strings.ToLower(cmd))
+}
+
+// scan returns every key matching the pattern in a single iteration
+func (s *Redis) scan(args []string) (interface{}, error) {
+	if len(args) < 1 {
+		return nil, errors.New("ERR wrong number of arguments for 'scan' command")
+	}
+	match := "*"
+	for i := 1; i+1 < len(args); i += 2 {
+		if strings.ToUpper(args[i]) == "MATCH" {
+			match = args[i+1]
+		}
+	}
+	keys := []string{}
+	for key := range s.values {
+		if ok, _ := path.Match(match, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return []interface{}{"0", keys}, nil
+}
+
+func (s *Redis) list(cmd string, args []string) (interface{}, error) {
+	if cmd == "RPUSH" && len(args) < 2 {
+		return nil, errors.New("ERR wrong number of arguments for 'rpush' command")
+	}
+	var list []string
+	switch v := s.values[args[0]].(type) {
+	case nil:
+	case []string:
+		list = v
+	default:
+		return nil, errWrongType
+	}
+	switch cmd {
+	case "RPUSH":
+		list = append(list, args[1:]...)
+		s.values[args[0]] = list
+		return int64(len(list)), nil
+	case "LLEN":
+		return int64(len(list)), nil
+	case "LINDEX":
+		i, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+		if i < 0 {
+			i += len(list)
+		}
+		if i < 0 || i >= len(list) {
+			return nil, nil
+		}
+		return list[i], nil
+	}
+	start, err1 := strconv.Atoi(args[1])
+	stop, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	start, stop = listRange(len(list), start, stop)
+	if cmd == "LRANGE" {
+		lines := []string{}
+		if start <= stop {
+			lines = append(lines, list[start:stop+1]...)
+		}
+		return lines, nil
+	}
+	if start > stop {
+		delete(s.values, args[0])
+	} else {
+		s.values[args[0]] = append([]string{}, list[start:stop+1]...)
+	}
+	return Status("OK"), nil
+}
+
+// memory answers MEMORY USAGE with the size of a string or of the elements of a list, which is
+// less than redis would report
+func (s *Redis) memory(args []string) (interface{}, error) {
+	if strings.ToUpper(args[0]) != "USAGE" {
+		return nil, fmt.Errorf("ERR unknown subcommand '%s'", args[0])
+	}
+	switch v := s.values[args[1]].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return int64(len(v)), nil
+	case []string:
+		var n int64
+		for _, element := range v {
+			n += int64(len(element))
+		}
+		return n, nil
+	}
+	return int64(0), nil
+}
+
+// listRange resolves the possibly negative start and stop indexes of a list of the given length
+// to indexes within it. The range is empty if start ends up greater than stop.
+func listRange(length int, start int, stop int) (int, int) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return start, stop
+}
+
+func (s *Redis) stream(cmd string, args []string) (interface{}, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd))
+	}
+	key := args[0]
+	stream, ok := s.values[key].(*redisStream)
+	if !ok && s.values[key] != nil {
+		return nil, errWrongType
+	}
+	if stream == nil {
+		if cmd != "XADD" {
+			return s.emptyStream(cmd)
+		}
+		stream = &redisStream{}
+	}
+	switch cmd {
+	case "XADD":
+		return s.xadd(key, stream, args[1:])
+	case "XLEN":
+		return int64(len(stream.entries)), nil
+	case "XTRIM":
+		if len(args) < 3 || strings.ToUpper(args[1]) != "MAXLEN" {
+			return nil, errors.New("ERR syntax error")
+		}
+		maxLen, err := parseMaxLen(args[2:])
+		if err != nil {
+			return nil, err
+		}
+		return int64(stream.trim(maxLen)), nil
+	}
+	if len(args) < 3 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd))
+	}
+	first, last := args[1], args[2]
+	if cmd == "XREVRANGE" {
+		first, last = last, first
+	}
+	start, err := parseRedisStreamID(first, false)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseRedisStreamID(last, true)
+	if err != nil {
+		return nil, err
+	}
+	count := -1
+	if len(args) == 5 && strings.ToUpper(args[3]) == "COUNT" {
+		if count, err = strconv.Atoi(args[4]); err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+	}
+	reply := []interface{}{}
+	for i := range stream.entries {
+		if cmd == "XREVRANGE" {
+			i = len(stream.entries) - 1 - i
+		}
+		entry := stream.entries[i]
+		if entry.id.less(start) || end.less(entry.id) {
+			continue
+		}
+		if count >= 0 && len(reply) == count {
+			break
+		}
+		fields := make([]interface{}, len(entry.fields))
+		for j, field := range entry.fields {
+			fields[j] = field
+		}
+		reply = append(reply, []interface{}{entry.id.String(), fields})
+	}
+	return reply, nil
+}
+
+func (s *Redis) emptyStream(cmd string) (interface{}, error) {
+	if cmd == "XLEN" || cmd == "XTRIM" {
+		return int64(0), nil
+	}
+	return []interface{}{}, nil
+}
+
+// xadd appends an entry to a stream, generating its ID if it is "*", and trims the stream if the
+// arguments start with a MAXLEN
+func (s *Redis) xadd(key string, stream *redisStream, args []string) (interface{}, error) {
+	maxLen := -1
+	if len(args) > 0 && strings.ToUpper(args[0]) == "MAXLEN" {
+		n := 2
+		if len(args) > 1 && (args[1] == "~" || args[1] == "=") {
+			n = 3
+		}
+		if len(args) < n {
+			return nil, errors.New("ERR syntax error")
+		}
+		var err error
+		if maxLen, err = parseMaxLen(args[1:n]); err != nil {
+			return nil, err
+		}
+		args = args[n:]
+	}
+	if len(args) < 3 || len(args)%2 != 1 {
+		return nil, errors.New("ERR wrong number of arguments for 'xadd' command")
+	}
+	var id redisStreamID
+	if args[0] == "*" {
+		id = redisStreamID{ms: uint64(time.Now().UnixNano() / int64(time.Millisecond))}
+		if !stream.lastID.less(id) {
+			id = redisStreamID{ms: stream.lastID.ms, seq: stream.lastID.seq + 1}
+		}
+	} else {
+		var err error
+		if id, err = parseRedisStreamID(args[0], false); err != nil {
+			return nil, err
+		}
+		if !stream.lastID.less(id) {
+			return nil, errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+		}
+	}
+	stream.entries = append(stream.entries, redisStreamEntry{id: id, fields: append([]string{}, args[1:]...)})
+	stream.lastID = id
+	if maxLen >= 0 {
+		stream.trim(maxLen)
+	}
+	s.values[key] = stream
+	return id.String(), nil
+}
+
+// trim drops the oldest entries beyond maxLen, returning how many were dropped
+func (st *redisStream) trim(maxLen int) int {
+	if len(st.entries) <= maxLen {
+		return 0
+	}
+	n := len(st.entries) - maxLen
+	st.entries = append([]redisStreamEntry{}, st.entries[n:]...)
+	return n
+}
+
+// parseMaxLen parses the length of a MAXLEN, which may be preceded by "~" or "="
+func parseMaxLen(args []string) (int, error) {
+	if args[0] == "~" || args[0] == "=" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return 0, errors.New("ERR syntax error")
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		return 0, errors.New("ERR value is not an integer or out of range")
+	}
+	return n, nil
+}
+
+// parseRedisStreamID parses the bound of a range of stream IDs. A bound without a sequence number
+// includes every ID of its millisecond.
+func parseRedisStreamID(id string, end bool) (redisStreamID, error) {
+	switch id {
+	case "-":
+		return redisStreamID{}, nil
+	case "+":
+		return redisStreamID{ms: math.MaxUint64, seq: math.MaxUint64}, nil
+	}
+	parts := strings.SplitN(id, "-", 2)
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return redisStreamID{}, errors.New("ERR Invalid stream ID specified as stream command argument")
+	}
+	if len(parts) == 1 {
+		if end {
+			return redisStreamID{ms: ms, seq: math.MaxUint64}, nil
+		}
+		return redisStreamID{ms: ms}, nil
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return redisStreamID{}, errors.New("ERR Invalid stream ID specified as stream command argument")
+	}
+	return redisStreamID{ms: ms, seq: seq}, nil
+}
+
+// script loads scripts, tells whether they are loaded and flushes them, like redis does when it
+// restarts
+func (s *Redis) script(args []string) (interface{}, error) {
+	if len(args) < 1 {
+		return nil, errors.New("ERR wrong number of arguments for 'script' command")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "LOAD":
+		if len(args) != 2 {
+			return nil, errors.New("ERR wrong number of arguments for 'script|load' command")
+		}
+		return s.load(args[1]), nil
+	case "EXISTS":
+		exists := make([]interface{}, len(args)-1)
+		for i, sha := range args[1:] {
+			_, ok := s.loaded[strings.ToLower(sha)]
+			exists[i] = int64(0)
+			if ok {
+				exists[i] = int64(1)
+			}
+		}
+		return exists, nil
+	case "FLUSH":
+		s.loaded = make(map[string]string)
+		return Status("OK"), nil
+	}
+	return nil, fmt.Errorf("ERR unknown subcommand '%s'", args[0])
+}
+
+// load caches a script for EVALSHA, returning its SHA1 digest
+func (s *Redis) load(script string) string {
+	sum := sha1.Sum([]byte(script))
+	sha := hex.EncodeToString(sum[:])
+	s.loaded[sha] = script
+	return sha
+}
+
+// eval runs the Go stand-in of a script. Errors returned by commands it calls are passed on, like
+// redis.call raises them.
+func (s *Redis) eval(args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errors.New("ERR wrong number of arguments for 'eval' command")
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys < 0 || numKeys > len(args)-2 {
+		return nil, errors.New("ERR Number of keys can't be greater than number of args")
+	}
+	s.load(args[0])
+	fn, ok := s.scripts[args[0]]
+	if !ok {
+		return nil, errors.New("ERR Error running script: no Go stand-in is registered for the script")
+	}
+	call := func(args ...string) (interface{}, error) {
+		return s.do(args)
+	}
+	return fn(call, args[2:2+numKeys], args[2+numKeys:])
+}
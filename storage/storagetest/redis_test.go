@@ -0,0 +1,139 @@
+package storagetest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// redisConversation sends pipelined commands to the server, returning the raw replies
+func redisConversation(t *testing.T, s *Redis, commands ...[]string) []string {
+	conn, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w := bufio.NewWriter(conn)
+	for _, args := range commands {
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	replies := make([]string, len(commands))
+	for i := range replies {
+		reply, err := readRawReply(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies[i] = reply
+	}
+	return replies
+}
+
+// readRawReply reads a reply, leaving it encoded
+func readRawReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	var n int
+	switch line[0] {
+	case '$':
+		if fmt.Sscanf(line, "$%d", &n); n >= 0 {
+			rest, err := r.ReadString('\n')
+			return line + rest, err
+		}
+	case '*':
+		fmt.Sscanf(line, "*%d", &n)
+		for i := 0; i < n; i++ {
+			item, err := readRawReply(r)
+			if err != nil {
+				return "", err
+			}
+			line += item
+		}
+	}
+	return line, nil
+}
+
+func TestRedisLists(t *testing.T) {
+	s, err := NewRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	replies := redisConversation(t, s,
+		[]string{"RPUSH", "app", "a", "b", "c"},
+		[]string{"LTRIM", "app", "-2", "-1"},
+		[]string{"LRANGE", "app", "0", "-1"},
+		[]string{"TYPE", "app"},
+		[]string{"INCR", "app"},
+		[]string{"SCAN", "0", "MATCH", "a*", "COUNT", "10"},
+		[]string{"DEL", "app", "missing"},
+		[]string{"GET", "app"},
+	)
+	expected := []string{
+		":3\r\n",
+		"+OK\r\n",
+		"*2\r\n$1\r\nb\r\n$1\r\nc\r\n",
+		"+list\r\n",
+		"-" + errWrongType.Error() + "\r\n",
+		"*2\r\n$1\r\n0\r\n*1\r\n$3\r\napp\r\n",
+		":1\r\n",
+		"$-1\r\n",
+	}
+	if !reflect.DeepEqual(expected, replies) {
+		t.Errorf("expected %q, got %q", expected, replies)
+	}
+}
+
+func TestRedisStreams(t *testing.T) {
+	s, err := NewRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, line := range []string{"a", "b", "c"} {
+		if _, err := s.Do("XADD", "stream", "MAXLEN", "~", "2", "*", "line", line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := s.Do("XLEN", "stream"); err != nil || n != int64(2) {
+		t.Errorf("expected 2 entries, got %v (%v)", n, err)
+	}
+	reply, err := s.Do("XREVRANGE", "stream", "+", "-", "COUNT", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, ok := reply.([]interface{})
+	if !ok || len(entries) != 1 || !strings.HasSuffix(fmt.Sprint(entries[0]), "[line c]]") {
+		t.Errorf("expected the newest entry, got %v", reply)
+	}
+}
+
+func TestRedisEval(t *testing.T) {
+	s, err := NewRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.HandleScript("return redis.call('INCR', KEYS[1])", func(call func(...string) (interface{}, error), keys []string, args []string) (interface{}, error) {
+		return call("INCR", keys[0])
+	})
+	replies := redisConversation(t, s,
+		[]string{"EVAL", "return redis.call('INCR', KEYS[1])", "1", "counter"},
+		[]string{"EVAL", "return redis.call('INCR', KEYS[1])", "1", "counter"},
+		[]string{"EVAL", "return 1", "0"},
+	)
+	if replies[0] != ":1\r\n" || replies[1] != ":2\r\n" || !strings.HasPrefix(replies[2], "-ERR") {
+		t.Errorf("unexpected replies %q", replies)
+	}
+}
@@ -0,0 +1,303 @@
+// Package storagetest runs a standard battery of tests against any storage.Adapter, and provides
+// in-process stand-ins for the servers of the redis and elasticsearch storage adapters.
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deis/logger/storage"
+)
+
+const (
+	concurrentWriters = 4
+	concurrentLines   = 10
+)
+
+// Suite describes how to test a storage adapter
+type Suite struct {
+	// New returns a started storage adapter that keeps the given number of lines per app. Every
+	// test creates an adapter of its own and uses apps of its own, and tests run in parallel.
+	New func(t *testing.T, lines int) storage.Adapter
+	// Write adds a log line for an app. It defaults to the adapter's Write, and must be set for
+	// read-only adapters, whose lines are written by some other means.
+	Write func(a storage.Adapter, app string, line string) error
+	// Flush, if set, is called after lines are written and before they are read, for adapters
+	// that write asynchronously. It waits until they can be read, failing the test if they can't.
+	Flush func(t *testing.T, a storage.Adapter)
+	// Unbounded is set for adapters that may keep more lines than they are created with, such as
+	// adapters without a limit or those trimming lines periodically or approximately
+	Unbounded bool
+	// Processes is set for adapters that can read the lines of a single process type
+	Processes bool
+	// ReadOnly is set for adapters that can't destroy logs
+	ReadOnly bool
+	// Metadata is set for adapters that are configured to store the metadata of lines written
+	// with storage.WriteWithMetadata along with them
+	Metadata bool
+}
+
+// Run runs the battery of tests against the adapters the suite creates, as parallel subtests. It
+// returns once they have all finished, so whatever they share can be cleaned up after it does.
+func Run(t *testing.T, s Suite) {
+	tests := []struct {
+		name  string
+		lines int
+		run   func(t *testing.T, s Suite, a storage.Adapter)
+	}{
+		{"NotFound", 10, testNotFound},
+		{"Order", 10, testOrder},
+		{"Limits", 5, testLimits},
+		{"Processes", 10, testProcesses},
+		{"Destroy", 10, testDestroy},
+		{"Concurrency", concurrentWriters * concurrentLines, testConcurrency},
+		{"Metadata", 10, testMetadata},
+	}
+	// parallel subtests finish after the test running them returns, so they are grouped
+	t.Run("Adapter", func(t *testing.T) {
+		for _, test := range tests {
+			test := test
+			t.Run(test.name, func(t *testing.T) {
+				if test.name == "Processes" && !s.Processes {
+					t.Skip("the adapter can't read the lines of a single process type")
+				}
+				if test.name == "Destroy" && s.ReadOnly {
+					t.Skip("the adapter can't destroy logs")
+				}
+				if test.name == "Metadata" && !s.Metadata {
+					t.Skip("the adapter doesn't store the metadata of lines")
+				}
+				a := s.New(t, test.lines)
+				t.Parallel()
+				defer a.Stop()
+				test.run(t, s, a)
+			})
+		}
+	})
+}
+
+// Line returns a log line of an app's process, formatted the way the log aggregator formats them
+func Line(app string, process string, message string) string {
+	return fmt.Sprintf("%s %s[%s.1]: %s", time.Now().UTC().Format(time.RFC3339Nano), app, process, message)
+}
+
+func (s Suite) write(t *testing.T, a storage.Adapter, app string, lines ...string) {
+	for _, line := range lines {
+		var err error
+		if s.Write != nil {
+			err = s.Write(a, app, line)
+		} else {
+			err = a.Write(context.Background(), app, line)
+		}
+		if err != nil {
+			// writes may be made by goroutines other than the test's, which can't stop it
+			t.Errorf("writing to %s: %s", app, err)
+			return
+		}
+	}
+}
+
+func (s Suite) flush(t *testing.T, a storage.Adapter) {
+	if s.Flush != nil {
+		s.Flush(t, a)
+	}
+}
+
+func read(t *testing.T, a storage.Adapter, app string, opts storage.ReadOptions) []string {
+	page, err := a.Read(context.Background(), app, opts)
+	if err != nil {
+		t.Fatalf("reading %s: %s", app, err)
+	}
+	return page.Lines
+}
+
+func expectNotFound(t *testing.T, a storage.Adapter, app string) {
+	page, err := a.Read(context.Background(), app, storage.ReadOptions{Lines: 10})
+	if _, ok := err.(storage.ErrNotFound); !ok {
+		var lines []string
+		if page != nil {
+			lines = page.Lines
+		}
+		t.Errorf("reading %s: expected a storage.ErrNotFound, got %v and lines %q", app, err, lines)
+	}
+}
+
+func messages(app string, process string, n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = Line(app, process, fmt.Sprintf("message %d", i))
+	}
+	return lines
+}
+
+func expectLines(t *testing.T, what string, expected []string, actual []string) {
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("%s: expected %q, got %q", what, expected, actual)
+	}
+}
+
+// testNotFound checks that reading an app without logs fails with a storage.ErrNotFound
+func testNotFound(t *testing.T, s Suite, a storage.Adapter) {
+	expectNotFound(t, a, "storagetest-not-found")
+}
+
+// testOrder checks that lines are read oldest first, and that reads return the newest lines
+func testOrder(t *testing.T, s Suite, a storage.Adapter) {
+	const app = "storagetest-order"
+	lines := messages(app, "web", 5)
+	s.write(t, a, app, lines...)
+	s.flush(t, a)
+	expectLines(t, "reading more lines than were written", lines, read(t, a, app, storage.ReadOptions{Lines: 10}))
+	expectLines(t, "reading fewer lines than were written", lines[2:], read(t, a, app, storage.ReadOptions{Lines: 3}))
+}
+
+// testLimits checks that reading more lines than an adapter keeps returns the lines it kept
+func testLimits(t *testing.T, s Suite, a storage.Adapter) {
+	const app = "storagetest-limits"
+	lines := messages(app, "web", 8)
+	s.write(t, a, app, lines...)
+	s.flush(t, a)
+	actual := read(t, a, app, storage.ReadOptions{Lines: 10})
+	if s.Unbounded && len(actual) > 5 && len(actual) <= len(lines) {
+		// any number of the newest lines may have been kept
+		lines = lines[len(lines)-len(actual):]
+	} else {
+		lines = lines[3:]
+	}
+	expectLines(t, "reading more lines than are kept", lines, actual)
+}
+
+// testProcesses checks that the lines of a single process type can be read
+func testProcesses(t *testing.T, s Suite, a storage.Adapter) {
+	const app = "storagetest-processes"
+	var web []string
+	for i := 0; i < 6; i++ {
+		process := "worker"
+		if i%2 == 0 {
+			process = "web"
+		}
+		line := Line(app, process, fmt.Sprintf("message %d", i))
+		if process == "web" {
+			web = append(web, line)
+		}
+		s.write(t, a, app, line)
+	}
+	s.flush(t, a)
+	expectLines(t, "reading the lines of a process type", web, read(t, a, app, storage.ReadOptions{Lines: 10, Process: "web"}))
+}
+
+// testDestroy checks that destroying an app's logs leaves other apps' logs alone
+func testDestroy(t *testing.T, s Suite, a storage.Adapter) {
+	const app, other = "storagetest-destroy", "storagetest-destroy-other"
+	lines := messages(other, "web", 3)
+	s.write(t, a, app, messages(app, "web", 3)...)
+	s.write(t, a, other, lines...)
+	s.flush(t, a)
+	if err := a.Destroy(context.Background(), app); err != nil {
+		t.Fatal(err)
+	}
+	expectNotFound(t, a, app)
+	expectLines(t, "reading another app", lines, read(t, a, other, storage.ReadOptions{Lines: 10}))
+}
+
+// testMetadata checks that the metadata of lines written along with it is read back with them, and
+// that time ranges and process types are taken from it rather than from lines, which may be in any
+// log format
+func testMetadata(t *testing.T, s Suite, a storage.Adapter) {
+	const app = "storagetest-metadata"
+	start := time.Now().UTC().Add(-time.Hour)
+	var lines, web []string
+	var metadata []storage.Metadata
+	for i := 0; i < 4; i++ {
+		process := "worker"
+		if i%2 == 0 {
+			process = "web"
+		}
+		// a custom log format, without a timestamp
+		line := fmt.Sprintf("%s said: message %d", process, i)
+		lines = append(lines, line)
+		if process == "web" {
+			web = append(web, line)
+		}
+		metadata = append(metadata, storage.Metadata{
+			Time:      start.Add(time.Duration(i) * time.Minute),
+			Namespace: app,
+			Pod:       fmt.Sprintf("%s-%s-845861952-nzf6%d", app, process, i),
+			Container: app + "-" + process,
+			Process:   process,
+			Version:   "v2",
+			Stream:    "stderr",
+		})
+		if err := storage.WriteWithMetadata(context.Background(), a, app, line, metadata[i]); err != nil {
+			t.Fatalf("writing to %s: %s", app, err)
+		}
+	}
+	s.flush(t, a)
+	page, err := a.Read(context.Background(), app, storage.ReadOptions{Lines: 10})
+	if err != nil {
+		t.Fatalf("reading %s: %s", app, err)
+	}
+	expectLines(t, "reading lines written with metadata", lines, page.Lines)
+	for i := range page.Lines {
+		actual := page.LineMetadata(i)
+		if actual == nil || !actual.Time.Equal(metadata[i].Time) {
+			t.Errorf("reading the metadata of line %d: expected %+v, got %+v", i, metadata[i], actual)
+			continue
+		}
+		expected, read := metadata[i], *actual
+		expected.Time, read.Time = time.Time{}, time.Time{}
+		if expected != read {
+			t.Errorf("reading the metadata of line %d: expected %+v, got %+v", i, metadata[i], actual)
+		}
+	}
+	expectLines(t, "reading a time range of lines written with metadata", lines[1:3], read(t, a, app, storage.ReadOptions{
+		Lines: 10,
+		Since: metadata[1].Time,
+		Until: metadata[3].Time,
+	}))
+	expectLines(t, "searching lines written with metadata", lines[2:3], read(t, a, app, storage.ReadOptions{Lines: 10, Query: "message 2"}))
+	if s.Processes {
+		expectLines(t, "reading the lines of a process type written with metadata", web, read(t, a, app, storage.ReadOptions{Lines: 10, Process: "web"}))
+	}
+}
+
+// testConcurrency checks that concurrent writes, to an app each and to an app they share, are
+// neither lost nor reordered
+func testConcurrency(t *testing.T, s Suite, a storage.Adapter) {
+	const shared = "storagetest-concurrency"
+	expected := make([][]string, concurrentWriters)
+	var all []string
+	var wg sync.WaitGroup
+	for i := range expected {
+		app := fmt.Sprintf("%s-%d", shared, i)
+		expected[i] = messages(app, "web", concurrentLines)
+		sharedLines := messages(shared, "web", concurrentLines)
+		for j := range sharedLines {
+			sharedLines[j] += fmt.Sprintf(" of writer %d", i)
+		}
+		all = append(all, sharedLines...)
+		wg.Add(1)
+		go func(app string, lines []string, sharedLines []string) {
+			defer wg.Done()
+			for j := range lines {
+				s.write(t, a, app, lines[j])
+				s.write(t, a, shared, sharedLines[j])
+			}
+		}(app, expected[i], sharedLines)
+	}
+	wg.Wait()
+	s.flush(t, a)
+	for i, lines := range expected {
+		app := fmt.Sprintf("%s-%d", shared, i)
+		expectLines(t, "reading lines written concurrently with other apps'", lines, read(t, a, app, storage.ReadOptions{Lines: concurrentLines}))
+	}
+	actual := read(t, a, shared, storage.ReadOptions{Lines: len(all)})
+	sort.Strings(all)
+	sort.Strings(actual)
+	expectLines(t, "reading lines written concurrently to the same app", all, actual)
+}
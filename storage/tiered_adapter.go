@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// tieredAdapter serves recent lines from an in-memory ring buffer and mirrors every write to a
+// durable adapter that holds the longer history. Every write is stored along with an ID in both
+// tiers, so that lines read from both are only returned once.
+type tieredAdapter struct {
+	hot      Adapter
+	hotLines int
+	cold     Adapter
+	// ids is set if the cold tier stores the IDs of writes
+	ids bool
+	// seq is the ID of the last write. It starts at the time the adapter was created, so IDs aren't
+	// reused across restarts.
+	seq uint64
+}
+
+// NewTieredAdapter returns a storage adapter that keeps the most recent hotLines lines per app in
+// memory and mirrors all writes to the given cold adapter.
+func NewTieredAdapter(hotLines int, cold Adapter) (Adapter, error) {
+	hot, err := NewRingBufferAdapter(hotLines)
+	if err != nil {
+		return nil, err
+	}
+	return &tieredAdapter{
+		hot:      hot,
+		hotLines: hotLines,
+		cold:     cold,
+		ids:      storesRecords(cold),
+		seq:      uint64(time.Now().UnixNano()),
+	}, nil
+}
+
+func newTieredAdapterFromConfig(numLines int) (Adapter, error) {
+	cfg, err := parseTieredConfig(appName)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ColdAdapter == "tiered" {
+		return nil, fmt.Errorf("Invalid cold storage adapter type: %s", cfg.ColdAdapter)
+	}
+	cold, err := NewAdapter(cfg.ColdAdapter, numLines)
+	if err != nil {
+		return nil, err
+	}
+	return NewTieredAdapter(cfg.HotLines, cold)
+}
+
+// Start both tiers
+func (a *tieredAdapter) Start() {
+	a.hot.Start()
+	a.cold.Start()
+}
+
+// Write adds a log message to both tiers
+func (a *tieredAdapter) Write(ctx context.Context, app string, message string) error {
+	hotMessage, coldMessage := a.record(message)
+	if err := a.hot.Write(ctx, app, hotMessage); err != nil {
+		return err
+	}
+	return a.cold.Write(ctx, app, coldMessage)
+}
+
+// WriteWithMetadata adds a log message to both tiers, passing its metadata along to both
+func (a *tieredAdapter) WriteWithMetadata(ctx context.Context, app string, message string, metadata Metadata) error {
+	hotMessage, coldMessage := a.record(message)
+	if err := WriteWithMetadata(ctx, a.hot, app, hotMessage, metadata); err != nil {
+		return err
+	}
+	return WriteWithMetadata(ctx, a.cold, app, coldMessage, metadata)
+}
+
+// record returns the lines to store in the hot and the cold tier for a message, which are records
+// of the ID of its write if the tier stores them
+func (a *tieredAdapter) record(message string) (string, string) {
+	hot := newRecord(message, strconv.FormatUint(atomic.AddUint64(&a.seq, 1), 36), Metadata{})
+	if !a.ids {
+		return hot, message
+	}
+	return hot, hot
+}
+
+// Read retrieves a specified number of log lines from the hot tier, falling back to the cold tier
+// when more lines are requested than the hot tier holds. Cursors are tagged with the tier that
+// returned them and reads with a cursor are served by that tier.
+func (a *tieredAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	if cursor := opts.Before + opts.After; cursor != "" {
+		tier, cursor, err := untagCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Before != "" {
+			opts.Before = cursor
+		} else {
+			opts.After = cursor
+		}
+		switch tier {
+		case "hot":
+			return a.readHot(ctx, app, opts)
+		case "cold":
+			return readTier(ctx, a.cold, "cold", app, opts)
+		}
+		return nil, newErrInvalidArgument("Invalid cursor: %s", opts.Before+opts.After)
+	}
+	hot, hotErr := readTier(ctx, a.hot, "hot", app, opts)
+	if hotErr == nil && len(hot.Lines) >= opts.Lines {
+		return hot, nil
+	}
+	cold, coldErr := readTier(ctx, a.cold, "cold", app, opts)
+	if coldErr != nil {
+		if hotErr == nil {
+			return hot, nil
+		}
+		return nil, coldErr
+	}
+	if hotErr != nil || !a.ids {
+		// without IDs the lines both tiers hold can't be told apart from repeated lines, so lines
+		// the cold tier hasn't stored yet are only read once it has
+		return cold, nil
+	}
+	return mergeTiers(cold, hot, opts.Lines), nil
+}
+
+// readHot reads the lines around a cursor of the hot tier. When paging back past the oldest line
+// the hot tier holds, the cold tier is read instead, skipping the lines that the hot tier holds
+// from the cursor on. Polling with a cursor the hot tier no longer holds skips the lines it
+// dropped since.
+func (a *tieredAdapter) readHot(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	hot, hotErr := readTier(ctx, a.hot, "hot", app, opts)
+	if opts.Before == "" || (hotErr == nil && len(hot.Lines) >= opts.Lines) {
+		return hot, hotErr
+	}
+	all, err := a.hot.Read(ctx, app, ReadOptions{Lines: a.hotLines, Process: opts.Process, Since: opts.Since, Until: opts.Until})
+	if err != nil {
+		return hot, hotErr
+	}
+	skip := -1
+	for i, cursor := range all.Cursors {
+		if cursor == opts.Before {
+			skip = len(all.Cursors) - i
+		}
+	}
+	if skip < 0 {
+		// the hot tier dropped the cursor's line, so it can't be found in the cold tier either
+		return hot, hotErr
+	}
+	coldOpts := opts
+	coldOpts.Before = ""
+	coldOpts.Lines += skip
+	cold, err := readTier(ctx, a.cold, "cold", app, coldOpts)
+	if err != nil {
+		return hot, hotErr
+	}
+	if len(cold.Lines) <= skip {
+		return nil, newErrNotFound(app)
+	}
+	cold.slice(0, len(cold.Lines)-skip)
+	return cold, nil
+}
+
+func readTier(ctx context.Context, tier Adapter, name string, app string, opts ReadOptions) (*Page, error) {
+	page, err := tier.Read(ctx, app, opts)
+	if err != nil {
+		return nil, err
+	}
+	page.tagCursors(name)
+	return page, nil
+}
+
+// Apps describes the apps of the cold tier, which holds the longer history, along with any app
+// that only the hot tier has lines for yet
+func (a *tieredAdapter) Apps(ctx context.Context) ([]AppInfo, error) {
+	apps, err := a.cold.Apps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hotApps, err := a.hot.Apps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return mergeApps(apps, hotApps), nil
+}
+
+// SetRetention overrides the limits of the lines kept for an app by the cold tier, which must
+// support them. The hot tier keeps to the same limits, but never more than hotLines lines.
+func (a *tieredAdapter) SetRetention(app string, retention Retention) error {
+	if err := SetRetention(a.cold, app, retention); err != nil {
+		return err
+	}
+	if retention.Lines > a.hotLines {
+		retention.Lines = a.hotLines
+	}
+	return SetRetention(a.hot, app, retention)
+}
+
+// Retention returns the limits of the lines kept for an app by the cold tier
+func (a *tieredAdapter) Retention(app string) Retention {
+	if rs, ok := a.cold.(RetentionSetter); ok {
+		return rs.Retention(app)
+	}
+	return a.hot.(RetentionSetter).Retention(app)
+}
+
+// Destroy deletes stored logs for the specified application from both tiers
+func (a *tieredAdapter) Destroy(ctx context.Context, app string) error {
+	if err := a.hot.Destroy(ctx, app); err != nil {
+		return err
+	}
+	return a.cold.Destroy(ctx, app)
+}
+
+// Reopen both tiers
+func (a *tieredAdapter) Reopen() error {
+	if err := a.hot.Reopen(); err != nil {
+		return err
+	}
+	return a.cold.Reopen()
+}
+
+// Stop both tiers
+func (a *tieredAdapter) Stop() {
+	a.hot.Stop()
+	a.cold.Stop()
+}
+
+// mergeTiers returns the last n lines of the cold page followed by the hot page. Since every
+// write is mirrored, the cold lines usually end with some or all of the hot lines; those are only
+// included once, from the hot page. They are told apart by the IDs of their writes, so repeated
+// lines are kept, and lines the cold tier hasn't stored yet are read from the hot one.
+func mergeTiers(cold *Page, hot *Page, n int) *Page {
+	hotIDs := make(map[string]bool, len(hot.Lines))
+	for i := range hot.Lines {
+		if id := hot.lineID(i); id != "" {
+			hotIDs[id] = true
+		}
+	}
+	merged := &Page{}
+	for i := range cold.Lines {
+		if !hotIDs[cold.lineID(i)] {
+			merged.addRecord(cold.Lines[i], cold.LineMetadata(i), cold.lineID(i), cold.Cursors[i])
+		}
+	}
+	for i := range hot.Lines {
+		merged.addRecord(hot.Lines[i], hot.LineMetadata(i), hot.lineID(i), hot.Cursors[i])
+	}
+	merged.limit(n, false)
+	return merged
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestTieredAdapter(t *testing.T, hotLines int, coldLines int) *tieredAdapter {
+	cold, err := NewRingBufferAdapter(coldLines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, err := NewTieredAdapter(hotLines, cold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sa.(*tieredAdapter)
+}
+
+func TestTieredReadFromNonExistingApp(t *testing.T) {
+	a := newTestTieredAdapter(t, 5, 10)
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if messages != nil {
+		t.Error("Expected no messages, but got some")
+	}
+	if err == nil {
+		t.Error("Did not receive expected error")
+	}
+}
+
+func TestTieredLogs(t *testing.T) {
+	a := newTestTieredAdapter(t, 3, 10)
+	for i := 0; i < 8; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	// Served entirely from the hot tier
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 2}))
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(messages, []string{"message 6", "message 7"}) {
+		t.Errorf("unexpected messages from the hot tier: %v", messages)
+	}
+	// More lines than the hot tier holds
+	messages, err = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 6}))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(messages) != 6 {
+		t.Fatalf("expected 6 log messages, got %d", len(messages))
+	}
+	for i := 0; i < 6; i++ {
+		expectedMessage := fmt.Sprintf("message %d", i+2)
+		if messages[i] != expectedMessage {
+			t.Errorf("expected: \"%s\", got \"%s\"", expectedMessage, messages[i])
+		}
+	}
+}
+
+func TestTieredDestroy(t *testing.T) {
+	a := newTestTieredAdapter(t, 3, 10)
+	if err := a.Write(context.Background(), app, "Hello, log!"); err != nil {
+		t.Error(err)
+	}
+	if err := a.Destroy(context.Background(), app); err != nil {
+		t.Error(err)
+	}
+	if _, err := a.hot.Read(context.Background(), app, ReadOptions{Lines: 1}); err == nil {
+		t.Error("hot tier still has logs, but was expected not to")
+	}
+	if _, err := a.cold.Read(context.Background(), app, ReadOptions{Lines: 1}); err == nil {
+		t.Error("cold tier still has logs, but was expected not to")
+	}
+}
+
+func TestMergeTiers(t *testing.T) {
+	// lines are written as <line>/<write ID>
+	tests := []struct {
+		cold     []string
+		hot      []string
+		n        int
+		expected []string
+	}{
+		// cold tier is up to date with the hot tier
+		{[]string{"a/1", "b/2", "c/3", "d/4"}, []string{"c/3", "d/4"}, 10, []string{"a", "b", "c", "d"}},
+		// cold tier lags behind the hot tier
+		{[]string{"a/1", "b/2", "c/3"}, []string{"c/3", "d/4"}, 10, []string{"a", "b", "c", "d"}},
+		// cold tier has nothing the hot tier has
+		{[]string{"a/1", "b/2"}, []string{"c/3", "d/4"}, 10, []string{"a", "b", "c", "d"}},
+		// hot tier was emptied, e.g. after a restart
+		{[]string{"a/1", "b/2"}, []string{}, 10, []string{"a", "b"}},
+		// only the last n lines are returned
+		{[]string{"a/1", "b/2", "c/3", "d/4"}, []string{"c/3", "d/4"}, 3, []string{"b", "c", "d"}},
+		// repeated lines are told apart by their writes
+		{[]string{"a/1", "a/2", "a/3", "a/4"}, []string{"a/3", "a/4"}, 10, []string{"a", "a", "a", "a"}},
+		{[]string{"a/1", "a/2", "a/3"}, []string{"a/3", "a/4"}, 10, []string{"a", "a", "a", "a"}},
+		{[]string{"a/1", "a/2"}, []string{"a/3", "a/4"}, 10, []string{"a", "a", "a", "a"}},
+		// lines stored without an ID, e.g. before the adapter was tiered, are kept
+		{[]string{"a/", "a/", "a/1"}, []string{"a/1"}, 10, []string{"a", "a", "a"}},
+	}
+	for _, test := range tests {
+		cold, hot := &Page{}, &Page{}
+		for _, line := range test.cold {
+			parts := strings.SplitN(line, "/", 2)
+			cold.add(newRecord(parts[0], parts[1], Metadata{}), "cold:"+line)
+		}
+		for _, line := range test.hot {
+			parts := strings.SplitN(line, "/", 2)
+			hot.add(newRecord(parts[0], parts[1], Metadata{}), "hot:"+line)
+		}
+		merged := mergeTiers(cold, hot, test.n)
+		if !reflect.DeepEqual(merged.Lines, test.expected) {
+			t.Errorf("mergeTiers(%v, %v, %d): expected %v, got %v", test.cold, test.hot, test.n, test.expected, merged.Lines)
+		}
+		// Lines held by both tiers keep the hot tier's cursor
+		if len(test.hot) > 0 && merged.After() != "hot:"+test.hot[len(test.hot)-1] {
+			t.Errorf("mergeTiers(%v, %v, %d): unexpected cursor %s", test.cold, test.hot, test.n, merged.After())
+		}
+	}
+}
+
+func TestTieredRepeatedLines(t *testing.T) {
+	a := newTestTieredAdapter(t, 3, 10)
+	for i := 0; i < 4; i++ {
+		if err := a.Write(context.Background(), app, "2017-03-01T14:02:00Z foo[web.v2.nzf60]: same"); err != nil {
+			t.Error(err)
+		}
+	}
+	// a line the cold tier hasn't stored yet
+	hotMessage, _ := a.record("2017-03-01T14:02:00Z foo[web.v2.nzf60]: same")
+	if err := a.hot.Write(context.Background(), app, hotMessage); err != nil {
+		t.Error(err)
+	}
+	messages, err := readLines(a.Read(context.Background(), app, ReadOptions{Lines: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 5 {
+		t.Errorf("expected every repeated line once, got %v", messages)
+	}
+}
+
+func TestTieredCursors(t *testing.T) {
+	a := newTestTieredAdapter(t, 3, 10)
+	for i := 0; i < 8; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	page, err := a.Read(context.Background(), app, ReadOptions{Lines: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Paging back past the hot tier continues in the cold tier
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 3, Before: page.Before()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"message 3", "message 4", "message 5"}) {
+		t.Errorf("unexpected messages before the hot page: %v", page.Lines)
+	}
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 10, Before: page.Before()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"message 0", "message 1", "message 2"}) {
+		t.Errorf("unexpected messages before the cold page: %v", page.Lines)
+	}
+	// Reading after a cold cursor is served by the cold tier
+	after := page.After()
+	page, err = a.Read(context.Background(), app, ReadOptions{Lines: 2, After: after})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(page.Lines, []string{"message 3", "message 4"}) {
+		t.Errorf("unexpected messages after the cold page: %v", page.Lines)
+	}
+	if _, err := a.Read(context.Background(), app, ReadOptions{Lines: 2, After: "warm:1"}); err == nil {
+		t.Error("expected an error for a cursor of an unknown tier")
+	}
+}
+
+func TestTieredApps(t *testing.T) {
+	a := newTestTieredAdapter(t, 3, 10)
+	for i := 0; i < 5; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	// An app the cold tier doesn't hold yet
+	if err := a.hot.Write(context.Background(), "hot-only", "Hello, log!"); err != nil {
+		t.Error(err)
+	}
+	apps, err := a.Apps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 2 || apps[0].Name != app || apps[0].Lines != 5 || apps[1].Name != "hot-only" {
+		t.Errorf("unexpected apps: %+v", apps)
+	}
+}
+
+func TestTieredSetRetention(t *testing.T) {
+	a := newTestTieredAdapter(t, 3, 10)
+	if err := a.SetRetention(app, Retention{Lines: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if retention := a.Retention(app); retention.Lines != 5 {
+		t.Errorf("expected the cold tier's retention, got %+v", retention)
+	}
+	// The hot tier never keeps more than hotLines lines
+	if retention := a.hot.(RetentionSetter).Retention(app); retention.Lines != 3 {
+		t.Errorf("expected the hot tier to keep 3 lines, got %+v", retention)
+	}
+	for i := 0; i < 8; i++ {
+		if err := a.Write(context.Background(), app, fmt.Sprintf("message %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+	if messages, _ := readLines(a.cold.Read(context.Background(), app, ReadOptions{Lines: 10})); len(messages) != 5 {
+		t.Errorf("expected the cold tier to keep 5 lines, got %v", messages)
+	}
+	if err := a.SetRetention(app, Retention{Lines: -1}); err == nil {
+		t.Error("expected an error for a negative limit")
+	}
+}
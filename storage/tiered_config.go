@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"github.com/kelseyhightower/envconfig"
+)
+
+type tieredConfig struct {
+	HotLines    int    `envconfig:"DEIS_LOGGER_TIERED_HOT_LINES" default:"1000"`
+	ColdAdapter string `envconfig:"DEIS_LOGGER_TIERED_COLD_ADAPTER" default:"file"`
+}
+
+func parseTieredConfig(appName string) (*tieredConfig, error) {
+	ret := new(tieredConfig)
+	if err := envconfig.Process(appName, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,544 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walSegmentSuffix = ".wal"
+	walPositionFile  = "position"
+	// walReplayBatch is the most records replayed between checks of the backend's health
+	walReplayBatch = 100
+	// walWriteTimeout bounds every write replayed to the backend
+	walWriteTimeout = 10 * time.Second
+)
+
+// walRecord is a write held in the write-ahead log. Records are stored as lines of JSON.
+type walRecord struct {
+	App      string    `json:"app"`
+	Message  string    `json:"message"`
+	Metadata *Metadata `json:"metadata,omitempty"`
+}
+
+// walSegment describes a file of the write-ahead log
+type walSegment struct {
+	seq   uint64
+	bytes int64
+	lines int64
+}
+
+// walPosition is a position in the write-ahead log: an offset into a segment and the number of
+// lines before it
+type walPosition struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Lines   int64  `json:"lines"`
+}
+
+func (p walPosition) before(other walPosition) bool {
+	return p.Segment < other.Segment || (p.Segment == other.Segment && p.Offset < other.Offset)
+}
+
+// walAdapter appends every write to segment files on disk and replays them, in order, to a backend
+// adapter while it is healthy. When the segments exceed their disk budget the oldest are dropped.
+// Reads are served by the backend, so lines are readable once they have been replayed.
+type walAdapter struct {
+	backend       Adapter
+	dir           string
+	segmentBytes  int64
+	maxBytes      int64
+	retryInterval time.Duration
+	mutex         sync.Mutex
+	// segments are ordered oldest first, and writes are appended to the last one
+	segments []*walSegment
+	file     *os.File
+	// replayed is the position up to which the oldest segment has been replayed
+	replayed walPosition
+	// destroyed holds the end of the log at the time an app's logs were destroyed, as the records
+	// of the app written before then must not be replayed
+	destroyed    map[string]walPosition
+	wake         chan struct{}
+	stopCh       chan struct{}
+	wg           sync.WaitGroup
+	started      bool
+	backlogLines *expvar.Int
+	backlogBytes *expvar.Int
+	segmentCount *expvar.Int
+}
+
+func newWALAdapter(backend Adapter, cfg *walConfig) (*walAdapter, error) {
+	if cfg.SegmentBytes <= 0 || cfg.MaxBytes < cfg.SegmentBytes {
+		return nil, fmt.Errorf("Invalid write-ahead log sizes: %d byte segments, %d bytes at most", cfg.SegmentBytes, cfg.MaxBytes)
+	}
+	if err := os.MkdirAll(cfg.Path, 0755); err != nil {
+		return nil, err
+	}
+	a := &walAdapter{
+		backend:       backend,
+		dir:           cfg.Path,
+		segmentBytes:  cfg.SegmentBytes,
+		maxBytes:      cfg.MaxBytes,
+		retryInterval: cfg.RetryInterval,
+		destroyed:     make(map[string]walPosition),
+		wake:          make(chan struct{}, 1),
+		stopCh:        make(chan struct{}),
+		backlogLines:  new(expvar.Int),
+		backlogBytes:  new(expvar.Int),
+		segmentCount:  new(expvar.Int),
+	}
+	metrics.Set("wal.backlog_lines", a.backlogLines)
+	metrics.Set("wal.backlog_bytes", a.backlogBytes)
+	metrics.Set("wal.segments", a.segmentCount)
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// walBackends are the adapters that have stored a line durably once their write returns, so that a
+// replayed line is never lost. The elasticsearch adapter doesn't store writes, and the loki and s3
+// adapters buffer them in memory.
+var walBackends = map[string]bool{"redis": true, "redis-streams": true, "bolt": true, "file": true}
+
+func newWALAdapterFromConfig(numLines int) (Adapter, error) {
+	cfg, err := parseWALConfig(appName)
+	if err != nil {
+		return nil, err
+	}
+	if !walBackends[cfg.Adapter] {
+		return nil, fmt.Errorf("Invalid storage adapter type behind the write-ahead log: %s", cfg.Adapter)
+	}
+	backend, err := NewAdapter(cfg.Adapter, numLines)
+	if err != nil {
+		return nil, err
+	}
+	a, err := newWALAdapter(backend, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// open loads the segments left by a previous run, skipping those it replayed, and opens the newest
+// segment for writing. A line left incomplete by a crash is cut off.
+func (a *walAdapter) open() error {
+	infos, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		return err
+	}
+	var position walPosition
+	if data, err := ioutil.ReadFile(filepath.Join(a.dir, walPositionFile)); err == nil {
+		if err := json.Unmarshal(data, &position); err != nil {
+			log.Printf("Ignoring the invalid position of the write-ahead log: %s", err)
+			position = walPosition{}
+		}
+	}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), walSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(info.Name(), walSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq < position.Segment {
+			if err := os.Remove(a.segmentPath(seq)); err != nil {
+				return err
+			}
+			continue
+		}
+		segment, err := loadWALSegment(a.segmentPath(seq), seq)
+		if err != nil {
+			return err
+		}
+		a.segments = append(a.segments, segment)
+	}
+	sort.Slice(a.segments, func(i, j int) bool { return a.segments[i].seq < a.segments[j].seq })
+	if len(a.segments) == 0 {
+		a.segments = []*walSegment{{seq: position.Segment + 1}}
+	}
+	oldest, newest := a.segments[0], a.segments[len(a.segments)-1]
+	a.replayed = walPosition{Segment: oldest.seq}
+	if position.Segment == oldest.seq && position.Offset <= oldest.bytes {
+		a.replayed = position
+	}
+	a.file, err = os.OpenFile(a.segmentPath(newest.seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	a.updateMetrics()
+	return nil
+}
+
+// loadWALSegment counts the lines of a segment, truncating it after the last complete line
+func loadWALSegment(path string, seq uint64) (*walSegment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	segment := &walSegment{seq: seq}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Cutting off an incomplete record of %s", path)
+				return segment, os.Truncate(path, segment.bytes)
+			}
+			return segment, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		segment.bytes += int64(len(line))
+		segment.lines++
+	}
+}
+
+func (a *walAdapter) segmentPath(seq uint64) string {
+	return filepath.Join(a.dir, fmt.Sprintf("%020d%s", seq, walSegmentSuffix))
+}
+
+// Start the backend and the replaying of the write-ahead log to it
+func (a *walAdapter) Start() {
+	a.backend.Start()
+	if !a.started {
+		a.started = true
+		a.wg.Add(1)
+		go a.replay()
+	}
+}
+
+// Write appends a log message to the write-ahead log, to be written to the backend later
+func (a *walAdapter) Write(ctx context.Context, app string, message string) error {
+	return a.append(ctx, walRecord{App: app, Message: message})
+}
+
+// WriteWithMetadata appends a log message and its metadata to the write-ahead log, to be written
+// to the backend later
+func (a *walAdapter) WriteWithMetadata(ctx context.Context, app string, message string, metadata Metadata) error {
+	return a.append(ctx, walRecord{App: app, Message: message, Metadata: &metadata})
+}
+
+func (a *walAdapter) append(ctx context.Context, record walRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	size := int64(len(data))
+	if size > a.segmentBytes {
+		return newErrQuotaExceeded("wal", fmt.Errorf("A message of %d bytes doesn't fit in a segment of the write-ahead log", size))
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if current := a.segments[len(a.segments)-1]; current.bytes > 0 && current.bytes+size > a.segmentBytes {
+		if err := a.rotate(); err != nil {
+			return newErrUnavailable("wal", err)
+		}
+	}
+	a.enforceBudget(size)
+	if _, err := a.file.Write(data); err != nil {
+		return newErrUnavailable("wal", err)
+	}
+	current := a.segments[len(a.segments)-1]
+	current.bytes += size
+	current.lines++
+	a.updateMetrics()
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate closes the segment being written to and starts a new one. The caller must hold the mutex.
+func (a *walAdapter) rotate() error {
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	seq := a.segments[len(a.segments)-1].seq + 1
+	f, err := os.OpenFile(a.segmentPath(seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	a.file = f
+	a.segments = append(a.segments, &walSegment{seq: seq})
+	return nil
+}
+
+// enforceBudget drops the oldest segments until the given number of bytes can be written without
+// exceeding the disk budget. The segment being written to is never dropped. The caller must hold
+// the mutex.
+func (a *walAdapter) enforceBudget(size int64) {
+	var total int64
+	for _, segment := range a.segments {
+		total += segment.bytes
+	}
+	for total+size > a.maxBytes && len(a.segments) > 1 {
+		oldest := a.segments[0]
+		dropped := oldest.lines - a.replayed.Lines
+		a.removeOldest()
+		total -= oldest.bytes
+		metrics.Add("wal.dropped_lines", dropped)
+		log.Printf("The write-ahead log exceeded %d bytes, dropped %d lines that weren't replayed", a.maxBytes, dropped)
+	}
+}
+
+// removeOldest deletes the oldest segment. The caller must hold the mutex.
+func (a *walAdapter) removeOldest() {
+	if err := os.Remove(a.segmentPath(a.segments[0].seq)); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	a.segments = a.segments[1:]
+	a.replayed = walPosition{Segment: a.segments[0].seq}
+	for app, position := range a.destroyed {
+		if position.before(a.replayed) {
+			delete(a.destroyed, app)
+		}
+	}
+	a.savePosition()
+}
+
+// savePosition records how far the log has been replayed, so a restart doesn't replay it all
+// again. Lines replayed since the position was last saved are replayed again after a crash. The
+// caller must hold the mutex.
+func (a *walAdapter) savePosition() {
+	data, err := json.Marshal(a.replayed)
+	if err == nil {
+		tmp := filepath.Join(a.dir, walPositionFile+".tmp")
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, filepath.Join(a.dir, walPositionFile))
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving the position of the write-ahead log: %s", err)
+	}
+}
+
+// updateMetrics reports the lines and bytes waiting to be replayed. The caller must hold the mutex.
+func (a *walAdapter) updateMetrics() {
+	var lines, bytes int64
+	for _, segment := range a.segments {
+		lines += segment.lines
+		bytes += segment.bytes
+	}
+	a.backlogLines.Set(lines - a.replayed.Lines)
+	a.backlogBytes.Set(bytes - a.replayed.Offset)
+	a.segmentCount.Set(int64(len(a.segments)))
+}
+
+// replay writes the records of the log to the backend in order, waiting for new records once
+// they have all been replayed and retrying after an interval while the backend fails
+func (a *walAdapter) replay() {
+	defer a.wg.Done()
+	failing := false
+	for {
+		select {
+		case <-a.stopCh:
+			return
+		default:
+		}
+		seq, offset, end := a.next()
+		if offset >= end {
+			select {
+			case <-a.wake:
+				continue
+			case <-a.stopCh:
+				return
+			}
+		}
+		err := a.replayBatch(seq, offset, end)
+		if err == nil {
+			if failing {
+				log.Println("Replaying the write-ahead log again")
+				failing = false
+			}
+			continue
+		}
+		metrics.Add("wal.replay_errors", 1)
+		if !failing {
+			log.Printf("Error replaying the write-ahead log, retrying every %s: %s", a.retryInterval, err)
+			failing = true
+		}
+		select {
+		case <-time.After(a.retryInterval):
+		case <-a.stopCh:
+			return
+		}
+	}
+}
+
+// next deletes the oldest segments once they have been replayed, returning the range of the
+// oldest segment that is still to be replayed
+func (a *walAdapter) next() (uint64, int64, int64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for len(a.segments) > 1 && a.replayed.Offset >= a.segments[0].bytes {
+		a.removeOldest()
+	}
+	a.updateMetrics()
+	return a.replayed.Segment, a.replayed.Offset, a.segments[0].bytes
+}
+
+// replayBatch replays records from a range of a segment once the backend is healthy
+func (a *walAdapter) replayBatch(seq uint64, offset int64, end int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), walWriteTimeout)
+	err := Healthy(ctx, a.backend)
+	cancel()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(a.segmentPath(seq))
+	if os.IsNotExist(err) {
+		// the segment was dropped
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(io.NewSectionReader(f, offset, end-offset))
+	for i := 0; i < walReplayBatch; i++ {
+		select {
+		case <-a.stopCh:
+			return nil
+		default:
+		}
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			log.Printf("Skipping an invalid record of the write-ahead log: %s", err)
+		} else if !a.wasDestroyed(record.App, walPosition{Segment: seq, Offset: offset}) {
+			if err := a.forward(record); err != nil {
+				return err
+			}
+			metrics.Add("wal.replayed_lines", 1)
+		}
+		offset += int64(len(line))
+		if !a.advance(seq, int64(len(line))) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// forward writes a record to the backend, returning once the backend stored it, so that the
+// replayed position only moves past stored records
+func (a *walAdapter) forward(record walRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), walWriteTimeout)
+	defer cancel()
+	if _, ok := a.backend.(SyncWriter); ok {
+		var metadata Metadata
+		if record.Metadata != nil {
+			metadata = *record.Metadata
+		}
+		return WriteSync(ctx, a.backend, record.App, record.Message, metadata)
+	}
+	if record.Metadata != nil {
+		return WriteWithMetadata(ctx, a.backend, record.App, record.Message, *record.Metadata)
+	}
+	return a.backend.Write(ctx, record.App, record.Message)
+}
+
+func (a *walAdapter) wasDestroyed(app string, position walPosition) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	destroyed, ok := a.destroyed[app]
+	return ok && position.before(destroyed)
+}
+
+// advance moves the replayed position past a record of the given size, unless its segment was
+// dropped meanwhile
+func (a *walAdapter) advance(seq uint64, size int64) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.replayed.Segment != seq {
+		return false
+	}
+	a.replayed.Offset += size
+	a.replayed.Lines++
+	a.updateMetrics()
+	return true
+}
+
+// Read retrieves a specified number of log lines from the backend. Lines that haven't been
+// replayed yet aren't read.
+func (a *walAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	return a.backend.Read(ctx, app, opts)
+}
+
+// Apps describes the apps of the backend
+func (a *walAdapter) Apps(ctx context.Context) ([]AppInfo, error) {
+	return a.backend.Apps(ctx)
+}
+
+// SetRetention overrides the limits of the lines kept for an app by the backend
+func (a *walAdapter) SetRetention(app string, retention Retention) error {
+	return SetRetention(a.backend, app, retention)
+}
+
+// Retention returns the limits of the lines kept for an app by the backend
+func (a *walAdapter) Retention(app string) Retention {
+	if rs, ok := a.backend.(RetentionSetter); ok {
+		return rs.Retention(app)
+	}
+	return Retention{}
+}
+
+// Destroy deletes stored logs for the specified application from the backend, and skips those of
+// its records in the write-ahead log that haven't been replayed yet
+func (a *walAdapter) Destroy(ctx context.Context, app string) error {
+	a.mutex.Lock()
+	current := a.segments[len(a.segments)-1]
+	a.destroyed[app] = walPosition{Segment: current.seq, Offset: current.bytes}
+	a.mutex.Unlock()
+	return a.backend.Destroy(ctx, app)
+}
+
+// Reopen the backend
+func (a *walAdapter) Reopen() error {
+	return a.backend.Reopen()
+}
+
+// Stop replaying, saving how far the write-ahead log was replayed, and stop the backend. Records
+// that weren't replayed are replayed once the log is opened again.
+func (a *walAdapter) Stop() {
+	close(a.stopCh)
+	a.wg.Wait()
+	a.mutex.Lock()
+	a.savePosition()
+	if err := a.file.Sync(); err != nil {
+		log.Println(err)
+	}
+	a.file.Close()
+	a.mutex.Unlock()
+	a.backend.Stop()
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyAdapter fails writes and reads, or reports being unhealthy, while told to
+type flakyAdapter struct {
+	Adapter
+	failing   int32
+	unhealthy int32
+}
+
+func (a *flakyAdapter) Write(ctx context.Context, app string, message string) error {
+	if atomic.LoadInt32(&a.failing) == 1 {
+		return errors.New("write failed")
+	}
+	return a.Adapter.Write(ctx, app, message)
+}
+
+func (a *flakyAdapter) Read(ctx context.Context, app string, opts ReadOptions) (*Page, error) {
+	if atomic.LoadInt32(&a.failing) == 1 {
+		return nil, newErrUnavailable("flaky", errors.New("read failed"))
+	}
+	return a.Adapter.Read(ctx, app, opts)
+}
+
+func (a *flakyAdapter) Healthy(ctx context.Context) error {
+	if atomic.LoadInt32(&a.unhealthy) == 1 {
+		return errors.New("unhealthy")
+	}
+	return nil
+}
+
+func newTestWALAdapter(t *testing.T, backend Adapter, dir string, segmentBytes int64, maxBytes int64) *walAdapter {
+	a, err := newWALAdapter(backend, &walConfig{
+		Path:          dir,
+		SegmentBytes:  segmentBytes,
+		MaxBytes:      maxBytes,
+		RetryInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start()
+	return a
+}
+
+func newTestWALDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "wal-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// waitForLines waits for an adapter to hold the expected lines of an app
+func waitForLines(t *testing.T, a Adapter, expected []string) {
+	var messages []string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		messages, _ = readLines(a.Read(context.Background(), app, ReadOptions{Lines: 100}))
+		if reflect.DeepEqual(messages, expected) {
+			return
+		}
+	}
+	t.Fatalf("Expected %v, got %v", expected, messages)
+}
+
+func storageMetric(name string) int64 {
+	if v, ok := metrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func writeWAL(t *testing.T, a Adapter, messages ...string) {
+	for _, message := range messages {
+		if err := a.Write(context.Background(), app, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWALReplaysInOrder(t *testing.T) {
+	dir := newTestWALDir(t)
+	defer os.RemoveAll(dir)
+	backend := newTestRingBufferAdapter(t, 10)
+	a := newTestWALAdapter(t, backend, dir, 1024, 4096)
+	defer a.Stop()
+	writeWAL(t, a, "first", "second", "third")
+	waitForLines(t, a, []string{"first", "second", "third"})
+	if backlog := storageMetric("wal.backlog_lines"); backlog != 0 {
+		t.Errorf("Expected no backlog, got %d lines", backlog)
+	}
+}
+
+func TestWALHoldsWritesDuringOutage(t *testing.T) {
+	dir := newTestWALDir(t)
+	defer os.RemoveAll(dir)
+	backend := &flakyAdapter{Adapter: newTestRingBufferAdapter(t, 10), failing: 1}
+	a := newTestWALAdapter(t, backend, dir, 1024, 4096)
+	defer a.Stop()
+	writeWAL(t, a, "first", "second", "third")
+	time.Sleep(50 * time.Millisecond)
+	if messages, err := readLines(backend.Read(context.Background(), app, ReadOptions{Lines: 10})); err == nil {
+		t.Fatalf("Expected no lines to be replayed during the outage, got %v", messages)
+	}
+	if backlog := storageMetric("wal.backlog_lines"); backlog != 3 {
+		t.Errorf("Expected a backlog of 3 lines, got %d", backlog)
+	}
+	if errors := storageMetric("wal.replay_errors"); errors == 0 {
+		t.Error("Expected replay errors to be counted")
+	}
+	atomic.StoreInt32(&backend.failing, 0)
+	waitForLines(t, a, []string{"first", "second", "third"})
+}
+
+func TestWALWaitsForHealthyBackend(t *testing.T) {
+	dir := newTestWALDir(t)
+	defer os.RemoveAll(dir)
+	backend := &flakyAdapter{Adapter: newTestRingBufferAdapter(t, 10), unhealthy: 1}
+	a := newTestWALAdapter(t, backend, dir, 1024, 4096)
+	defer a.Stop()
+	writeWAL(t, a, "first")
+	time.Sleep(50 * time.Millisecond)
+	if messages, err := readLines(backend.Read(context.Background(), app, ReadOptions{Lines: 10})); err == nil {
+		t.Fatalf("Expected no lines to be replayed to an unhealthy backend, got %v", messages)
+	}
+	atomic.StoreInt32(&backend.unhealthy, 0)
+	waitForLines(t, a, []string{"first"})
+}
+
+func TestWALDropsOldestSegments(t *testing.T) {
+	dir := newTestWALDir(t)
+	defer os.RemoveAll(dir)
+	backend := &flakyAdapter{Adapter: newTestRingBufferAdapter(t, 100), failing: 1}
+	// every record takes 42 bytes, so a segment holds 5 records and the log 2 segments
+	a := newTestWALAdapter(t, backend, dir, 210, 420)
+	defer a.Stop()
+	dropped := storageMetric("wal.dropped_lines")
+	var messages []string
+	for i := 0; i < 20; i++ {
+		messages = append(messages, fmt.Sprintf("message %02d", i))
+	}
+	writeWAL(t, a, messages...)
+	if segments := storageMetric("wal.segments"); segments != 2 {
+		t.Errorf("Expected 2 segments, got %d", segments)
+	}
+	if n := storageMetric("wal.dropped_lines") - dropped; n != 10 {
+		t.Errorf("Expected 10 dropped lines, got %d", n)
+	}
+	atomic.StoreInt32(&backend.failing, 0)
+	waitForLines(t, a, messages[10:])
+}
+
+func TestWALReplaysAfterRestart(t *testing.T) {
+	dir := newTestWALDir(t)
+	defer os.RemoveAll(dir)
+	backend := &flakyAdapter{Adapter: newTestRingBufferAdapter(t, 10), failing: 1}
+	a := newTestWALAdapter(t, backend, dir, 1024, 4096)
+	writeWAL(t, a, "first", "second")
+	a.Stop()
+	// a crash left an incomplete record behind
+	f, err := os.OpenFile(a.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"app":"`)
+	f.Close()
+	a = newTestWALAdapter(t, newTestRingBufferAdapter(t, 10), dir, 1024, 4096)
+	writeWAL(t, a, "third")
+	waitForLines(t, a, []string{"first", "second", "third"})
+	a.Stop()
+	// the log was replayed, so it isn't replayed again
+	a = newTestWALAdapter(t, newTestRingBufferAdapter(t, 10), dir, 1024, 4096)
+	defer a.Stop()
+	writeWAL(t, a, "fourth")
+	waitForLines(t, a, []string{"fourth"})
+}
+
+func TestWALDestroy(t *testing.T) {
+	dir := newTestWALDir(t)
+	defer os.RemoveAll(dir)
+	backend := &flakyAdapter{Adapter: newTestRingBufferAdapter(t, 10), failing: 1}
+	a := newTestWALAdapter(t, backend, dir, 1024, 4096)
+	defer a.Stop()
+	writeWAL(t, a, "first", "second")
+	if err := a.Destroy(context.Background(), app); err != nil {
+		t.Fatal(err)
+	}
+	writeWAL(t, a, "third")
+	atomic.StoreInt32(&backend.failing, 0)
+	waitForLines(t, a, []string{"third"})
+}
+
+func TestWALRejectsOversizedMessages(t *testing.T) {
+	dir := newTestWALDir(t)
+	defer os.RemoveAll(dir)
+	a := newTestWALAdapter(t, newTestRingBufferAdapter(t, 10), dir, 100, 400)
+	defer a.Stop()
+	err := a.Write(context.Background(), app, string(make([]byte, 100)))
+	if _, ok := err.(ErrQuotaExceeded); !ok {
+		t.Errorf("Expected an ErrQuotaExceeded, got %v", err)
+	}
+}
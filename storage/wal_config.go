@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type walConfig struct {
+	Adapter              string `envconfig:"DEIS_LOGGER_WAL_ADAPTER" default:"redis"`
+	Path                 string `envconfig:"DEIS_LOGGER_WAL_PATH" default:"/data/logs/wal"`
+	SegmentBytes         int64  `envconfig:"DEIS_LOGGER_WAL_SEGMENT_BYTES" default:"4194304"`
+	MaxBytes             int64  `envconfig:"DEIS_LOGGER_WAL_MAX_BYTES" default:"268435456"`
+	RetryIntervalSeconds int    `envconfig:"DEIS_LOGGER_WAL_RETRY_INTERVAL_SECONDS" default:"5"`
+	RetryInterval        time.Duration
+}
+
+func parseWALConfig(appName string) (*walConfig, error) {
+	ret := new(walConfig)
+	if err := envconfig.Process(appName, ret); err != nil {
+		return nil, err
+	}
+	ret.RetryInterval = time.Duration(ret.RetryIntervalSeconds) * time.Second
+	return ret, nil
+}
@@ -0,0 +1,139 @@
+package weblog
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	logger "github.com/deis/logger/log"
+	"github.com/deis/logger/storage"
+)
+
+// Representations of the lines returned by GET /logs/{app}
+const (
+	textOutput   = "text"
+	jsonOutput   = "json"
+	ndjsonOutput = "ndjson"
+)
+
+// outputTypes maps the media types of the Accept header to representations
+var outputTypes = map[string]string{
+	"text/plain":           textOutput,
+	"application/json":     jsonOutput,
+	"application/x-ndjson": ndjsonOutput,
+	"application/ndjson":   ndjsonOutput,
+}
+
+// logEntry is how a log line is represented in JSON. The fields are taken from the metadata stored
+// along with a line, and the message and level are parsed back from lines stored in the default
+// formats. Lines stored without metadata only have the fields their line holds, which is just an
+// app and a message for lines in other formats. Pod is the name of the pod, or the random suffix of
+// its name if only that is known.
+type logEntry struct {
+	Time      string `json:"time,omitempty"`
+	App       string `json:"app"`
+	Process   string `json:"process,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+	Stream    string `json:"stream,omitempty"`
+	// Level is only set for the messages of the controller
+	Level   string `json:"level,omitempty"`
+	Message string `json:"message"`
+}
+
+// newLogEntry returns the entry of a line of an app, and of the metadata stored along with it if
+// it isn't nil
+func newLogEntry(app string, line string, metadata *storage.Metadata) logEntry {
+	line = strings.TrimSuffix(line, "\n")
+	entry := logEntry{App: app, Message: line}
+	if l, ok := logger.ParseLine(line); ok {
+		entry = newLineEntry(app, l)
+	}
+	if metadata == nil {
+		return entry
+	}
+	if !metadata.Time.IsZero() {
+		entry.Time = metadata.Time.UTC().Format(time.RFC3339Nano)
+	}
+	// lines don't hold the full name of their pod, nor their container and stream
+	set := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	set(&entry.Process, metadata.Process)
+	set(&entry.Version, metadata.Version)
+	set(&entry.Pod, metadata.Pod)
+	set(&entry.Container, metadata.Container)
+	set(&entry.Stream, metadata.Stream)
+	return entry
+}
+
+// newLineEntry returns the entry of the fields of a line of an app
+func newLineEntry(app string, l *logger.Line) logEntry {
+	entry := logEntry{
+		Time:      l.Time.UTC().Format(time.RFC3339Nano),
+		App:       app,
+		Process:   l.Process,
+		Version:   l.Version,
+		Pod:       l.Kubernetes.PodName,
+		Container: l.Kubernetes.ContainerName,
+		Stream:    l.Stream,
+		Level:     l.Level,
+		Message:   l.Text,
+	}
+	if entry.Pod == "" {
+		entry.Pod = l.PodSuffix
+	}
+	return entry
+}
+
+// negotiateOutput returns the representation asked for by the output query parameter or, failing
+// that, the first media type of the Accept header that is known. Text is the default.
+func negotiateOutput(r *http.Request) (string, error) {
+	if output := r.URL.Query().Get("output"); output != "" {
+		switch output {
+		case textOutput, jsonOutput, ndjsonOutput:
+			return output, nil
+		}
+		return "", fmt.Errorf("Invalid output: %s", output)
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		if output, ok := outputTypes[mediaType]; ok {
+			return output, nil
+		}
+	}
+	return textOutput, nil
+}
+
+// writeEntries writes the lines of a page of an app as a JSON array or as newline delimited JSON
+func writeEntries(w http.ResponseWriter, output string, app string, page *storage.Page) {
+	encoder := json.NewEncoder(w)
+	if output == ndjsonOutput {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for i, line := range page.Lines {
+			if err := encoder.Encode(newLogEntry(app, line, page.LineMetadata(i))); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		return
+	}
+	entries := make([]logEntry, len(page.Lines))
+	for i, line := range page.Lines {
+		entries[i] = newLogEntry(app, line, page.LineMetadata(i))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := encoder.Encode(entries); err != nil {
+		log.Println(err)
+	}
+}
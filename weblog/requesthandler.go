@@ -1,39 +1,103 @@
 package weblog
 
 import (
-	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	logger "github.com/deis/logger/log"
 	"github.com/deis/logger/storage"
 	"github.com/gorilla/mux"
-	"github.com/topfreegames/stern/stern"
-	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
-	appName = "logger"
+	// beforeCursorHeader and afterCursorHeader hold the cursors for reading the lines preceding and
+	// following the returned lines, to be passed back in the before and after query parameters
+	beforeCursorHeader = "X-Log-Cursor-Before"
+	afterCursorHeader  = "X-Log-Cursor-After"
 )
 
+// appInfo is how a storage.AppInfo is listed by GET /logs
+type appInfo struct {
+	Name  string `json:"name"`
+	Lines int64  `json:"lines"`
+	Bytes int64  `json:"bytes"`
+	// LastWrite is omitted if the storage adapter can't tell it
+	LastWrite string `json:"last_write,omitempty"`
+}
+
+// registeredNames is how GET /adapters lists the implementations compiled into the service
+type registeredNames struct {
+	StorageAdapters []string `json:"storage_adapters"`
+	Aggregators     []string `json:"aggregators"`
+}
+
+// healthz is the JSON body of GET /healthz, for storage adapters that report their state
+type healthz struct {
+	Storage map[string]interface{} `json:"storage"`
+}
+
 type requestHandler struct {
 	storageAdapter storage.Adapter
+	// broker passes on the messages of the apps being tailed, if tailing is available
+	broker *logger.Broker
 }
 
-func newRequestHandler(storageAdapter storage.Adapter) *requestHandler {
+func newRequestHandler(storageAdapter storage.Adapter, broker *logger.Broker) *requestHandler {
 	return &requestHandler{
 		storageAdapter: storageAdapter,
+		broker:         broker,
 	}
 }
 
+// getHealthz responds with 200 OK, along with the state of the storage adapter if it reports one.
+// An open circuit breaker doesn't make the service unhealthy, as its fallback serves requests.
 func (h requestHandler) getHealthz(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+	status := storage.Status(h.storageAdapter)
+	if status == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(healthz{Storage: status}); err != nil {
+		log.Println(err)
+	}
+}
+
+func (h requestHandler) getAdapters(w http.ResponseWriter, r *http.Request) {
+	names := registeredNames{StorageAdapters: storage.Adapters(), Aggregators: logger.Aggregators()}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(names); err != nil {
+		log.Println(err)
+	}
+}
+
+func (h requestHandler) getApps(w http.ResponseWriter, r *http.Request) {
+	apps, err := h.storageAdapter.Apps(r.Context())
+	if err != nil {
+		log.Println(err)
+		writeError(w, err)
+		return
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+	infos := make([]appInfo, len(apps))
+	for i, app := range apps {
+		infos[i] = appInfo{Name: app.Name, Lines: app.Lines, Bytes: app.Bytes}
+		if !app.LastWrite.IsZero() {
+			infos[i].LastWrite = app.LastWrite.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		log.Println(err)
+	}
 }
 
 func (h requestHandler) getLogs(w http.ResponseWriter, r *http.Request) {
@@ -51,81 +115,252 @@ func (h requestHandler) getLogs(w http.ResponseWriter, r *http.Request) {
 			logLines = 100
 		}
 	}
-	process := r.URL.Query().Get("process")
-	logs, err := h.storageAdapter.Read(app, logLines, process)
+	opts := storage.ReadOptions{Lines: logLines, Process: r.URL.Query().Get("process")}
+	now := time.Now()
+	var err error
+	if opts.Since, err = parseTimeParam(r.URL.Query().Get("since"), now); err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid since: %s", err))
+		return
+	}
+	if opts.Until, err = parseTimeParam(r.URL.Query().Get("until"), now); err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid until: %s", err))
+		return
+	}
+	if !opts.Since.IsZero() && !opts.Until.IsZero() && !opts.Until.After(opts.Since) {
+		writeErrorMessage(w, http.StatusBadRequest, "Invalid time range: until must be after since")
+		return
+	}
+	if opts.Before, err = decodeCursor(r.URL.Query().Get("before")); err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, "Invalid before cursor")
+		return
+	}
+	if opts.After, err = decodeCursor(r.URL.Query().Get("after")); err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, "Invalid after cursor")
+		return
+	}
+	if opts.Before != "" && opts.After != "" {
+		writeErrorMessage(w, http.StatusBadRequest, "Only one of before and after may be given")
+		return
+	}
+	if err := parseQueryParams(r, &opts); err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	output, err := negotiateOutput(r)
 	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var format *logger.LineFormat
+	if value := r.URL.Query().Get("format"); value != "" {
+		if output != textOutput {
+			writeErrorMessage(w, http.StatusBadRequest, "Only text output can be given a format")
+			return
+		}
+		if format, err = logger.NewLineFormat(value, ""); err != nil {
+			writeErrorMessage(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	page, err := h.storageAdapter.Read(r.Context(), app, opts)
+	if err == nil && len(page.Lines) == 0 {
+		err = storage.ErrNotFound{App: app}
+	}
+	if _, ok := err.(storage.ErrNotFound); ok {
 		log.Println(err)
-		if strings.HasPrefix(err.Error(), "Could not find logs for") {
-			w.WriteHeader(http.StatusNoContent)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+		// Reads without logs have no content rather than not being found, and polling continues
+		// from the same cursor
+		if after := r.URL.Query().Get("after"); after != "" {
+			w.Header().Set(afterCursorHeader, after)
 		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, err)
 		return
 	}
+	w.Header().Set(beforeCursorHeader, encodeCursor(page.Before()))
+	w.Header().Set(afterCursorHeader, encodeCursor(page.After()))
 	log.Printf("Returning the last %v lines for %s", logLines, app)
-	for _, line := range logs {
+	if output != textOutput {
+		writeEntries(w, output, app, page)
+		return
+	}
+	for i, line := range page.Lines {
 		// strip any trailing newline characters from the logs
-		fmt.Fprintf(w, "%s\n", strings.TrimSuffix(line, "\n"))
+		fmt.Fprintf(w, "%s\n", strings.TrimSuffix(reformat(format, app, line, page.LineMetadata(i)), "\n"))
 	}
 }
 
+// reformat renders a stored line of an app with the format of a request, if it gave one. Lines are
+// stored rendered, so only the fields of the metadata stored along with a line and those of lines
+// stored in the default formats can be rendered again. Lines without either are returned as they
+// are.
+func reformat(format *logger.LineFormat, app string, line string, metadata *storage.Metadata) string {
+	if format == nil {
+		return line
+	}
+	l, ok := logger.StoredLine(app, line, metadata)
+	if !ok {
+		return line
+	}
+	return format.Render(l)
+}
+
+// parseTimeParam parses a time given either as an RFC3339 timestamp or as a duration, such as
+// "15m", relative to now. An empty value yields the zero time.
+func parseTimeParam(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC3339 time nor a positive duration", value)
+	}
+	return now.Add(-d), nil
+}
+
+// parseQueryParams sets the options for searching logs from the q, regex, ignore_case and context
+// query parameters
+func parseQueryParams(r *http.Request, opts *storage.ReadOptions) error {
+	params := r.URL.Query()
+	opts.Query = params.Get("q")
+	var err error
+	if value := params.Get("regex"); value != "" {
+		if opts.Regexp, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("Invalid regex: %q is not a boolean", value)
+		}
+	}
+	if value := params.Get("ignore_case"); value != "" {
+		if opts.IgnoreCase, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("Invalid ignore_case: %q is not a boolean", value)
+		}
+	}
+	if opts.Regexp {
+		if _, err := regexp.Compile(opts.Query); err != nil {
+			return fmt.Errorf("Invalid q: %s", err)
+		}
+	}
+	if value := params.Get("context"); value != "" {
+		if opts.Context, err = strconv.Atoi(value); err != nil || opts.Context < 0 {
+			return fmt.Errorf("Invalid context: %q is not a non-negative number", value)
+		}
+	}
+	return nil
+}
+
+// encodeCursor turns a storage adapter's cursor into an opaque, URL safe one
+func encodeCursor(cursor string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	return string(decoded), err
+}
+
 func (h requestHandler) deleteLogs(w http.ResponseWriter, r *http.Request) {
 	app := mux.Vars(r)["app"]
-	if err := h.storageAdapter.Destroy(app); err != nil {
+	if err := h.storageAdapter.Destroy(r.Context(), app); err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	// tails can't resume after lines that were destroyed
+	if h.broker != nil {
+		h.broker.Forget(app)
 	}
 }
 
-var sternCfg *stern.Config
+// getRetention returns the limits of the logs kept for an app as JSON
+func (h requestHandler) getRetention(w http.ResponseWriter, r *http.Request) {
+	rs, ok := h.storageAdapter.(storage.RetentionSetter)
+	if !ok {
+		writeErrorMessage(w, http.StatusBadRequest, "The storage adapter can't keep a different amount of logs for every app")
+		return
+	}
+	writeRetention(w, rs.Retention(mux.Vars(r)["app"]))
+}
 
-func initStern() {
-	cfg, err := logger.ParseConfig(appName)
-	if err != nil {
-		log.Fatalf("config error: %s: ", err)
+// putRetention overrides the limits of the logs kept for an app with those of the JSON body, e.g.
+// {"lines": 200, "max_age": "24h"}, and returns the app's resulting limits
+func (h requestHandler) putRetention(w http.ResponseWriter, r *http.Request) {
+	var retention storage.Retention
+	if err := json.NewDecoder(r.Body).Decode(&retention); err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("Invalid retention: %s", err))
+		return
 	}
+	h.setRetention(w, mux.Vars(r)["app"], retention)
+}
+
+// deleteRetention removes the override of the limits of the logs kept for an app and returns the
+// app's resulting limits
+func (h requestHandler) deleteRetention(w http.ResponseWriter, r *http.Request) {
+	h.setRetention(w, mux.Vars(r)["app"], storage.Retention{})
+}
 
-	sternCfg = &stern.Config{
-		KubeConfig:     cfg.KubeConfigPath,
-		ContextName:    cfg.KubeContextName,
-		Namespace:      "",
-		Writer:         nil,
-		PodQuery:       regexp.MustCompile(".*"),
-		ContainerQuery: regexp.MustCompile(".*"),
-		LabelSelector:  labels.Everything(),
+func (h requestHandler) setRetention(w http.ResponseWriter, app string, retention storage.Retention) {
+	if err := storage.SetRetention(h.storageAdapter, app, retention); err != nil {
+		log.Println(err)
+		writeError(w, err)
+		return
 	}
+	writeRetention(w, h.storageAdapter.(storage.RetentionSetter).Retention(app))
 }
 
-func (h requestHandler) tailLogs(w http.ResponseWriter, r *http.Request) {
-	reqContext := r.Context()
-	app := mux.Vars(r)["app"]
-	process := r.URL.Query().Get("process")
-
-	ctx, cancel := context.WithCancel(reqContext)
-	go func() {
-		<-reqContext.Done()
-		log.Println("Tail connection closed.")
-		cancel()
-	}()
-
-	log.Println("Tail started.")
-	go func() {
-		cfg := &stern.Config{}
-		*cfg = *sternCfg
-		cfg.Namespace = app
-		cfg.Writer = w
-		cfg.WriterMutex = &sync.Mutex{}
-
-		if process != "" {
-			cfg.PodQuery = regexp.MustCompile(fmt.Sprintf("-%s-", process))
-		}
+// errorBody is the JSON body of error responses
+type errorBody struct {
+	Error string `json:"error"`
+}
 
-		err := stern.Run(ctx, cfg)
-		if err != nil {
-			fmt.Printf("error: %#v\n", err)
+// writeError responds with the status code matching the kind of a storage error
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch e := err.(type) {
+	case storage.ErrNotFound:
+		code = http.StatusNotFound
+	case storage.ErrInvalidArgument:
+		code = http.StatusBadRequest
+	case storage.ErrQuotaExceeded:
+		code = http.StatusTooManyRequests
+	case storage.ErrUnavailable:
+		code = http.StatusServiceUnavailable
+		if timedOut(e.Err) {
+			code = http.StatusGatewayTimeout
 		}
-	}()
-	<-ctx.Done()
-	time.Sleep(1000 * time.Millisecond)
-	log.Println("Tail Closed.")
+	default:
+		if timedOut(err) {
+			code = http.StatusGatewayTimeout
+		}
+	}
+	writeErrorMessage(w, code, err.Error())
+}
+
+// timedOut reports whether an error is that of a request which ran out of time, such as
+// context.DeadlineExceeded or a network timeout
+func timedOut(err error) bool {
+	t, ok := err.(interface {
+		Timeout() bool
+	})
+	return ok && t.Timeout()
+}
+
+func writeErrorMessage(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(errorBody{Error: message}); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeRetention(w http.ResponseWriter, retention storage.Retention) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(retention); err != nil {
+		log.Println(err)
+	}
 }
@@ -0,0 +1,522 @@
+package weblog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deis/logger/storage"
+)
+
+func TestParseTimeParam(t *testing.T) {
+	now := time.Date(2017, 3, 1, 14, 10, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Time{
+		"":                     {},
+		"2017-03-01T14:02:00Z": time.Date(2017, 3, 1, 14, 2, 0, 0, time.UTC),
+		"15m":                  now.Add(-15 * time.Minute),
+		"1h30m":                now.Add(-90 * time.Minute),
+	} {
+		parsed, err := parseTimeParam(value, now)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %s", value, err)
+		}
+		if !parsed.Equal(expected) {
+			t.Errorf("expected %q to parse as %s, got %s", value, expected, parsed)
+		}
+	}
+	for _, value := range []string{"yesterday", "-5m", "2017-03-01 14:02"} {
+		if _, err := parseTimeParam(value, now); err == nil {
+			t.Errorf("expected an error parsing %q", value)
+		}
+	}
+}
+
+func TestGetLogsTimeRange(t *testing.T) {
+	storageAdapter := newTestStorageAdapter(t)
+	line := time.Now().Add(-10*time.Minute).Format(time.RFC3339) + " foo[web.v1]: message"
+	if err := storageAdapter.Write(context.Background(), "foo", line); err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(newRequestHandler(storageAdapter, nil))
+	for query, status := range map[string]int{
+		"since=15m":          http.StatusOK,
+		"since=5m":           http.StatusNoContent,
+		"until=5m":           http.StatusOK,
+		"since=5m&until=15m": http.StatusBadRequest,
+		"since=soon":         http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/foo?"+query, nil))
+		if w.Code != status {
+			t.Errorf("expected %d for %s, got %d", status, query, w.Code)
+		}
+		if status == http.StatusOK && strings.TrimSpace(w.Body.String()) != line {
+			t.Errorf("expected %q for %s, got %q", line, query, w.Body.String())
+		}
+	}
+}
+
+func TestGetLogsQuery(t *testing.T) {
+	storageAdapter, err := storage.NewAdapter("memory", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"starting", "GET /healthz 200", "GET /v2/apps 503", "GET /healthz 200"} {
+		if err := storageAdapter.Write(context.Background(), "foo", line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := newRouter(newRequestHandler(storageAdapter, nil))
+	tests := []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"q=healthz&log_lines=1", http.StatusOK, "GET /healthz 200\n"},
+		{"q=%205%5Cd%5Cd&regex=true&context=1", http.StatusOK, "GET /healthz 200\nGET /v2/apps 503\nGET /healthz 200\n"},
+		{"q=get%20/V2&ignore_case=1", http.StatusOK, "GET /v2/apps 503\n"},
+		{"q=post", http.StatusNoContent, ""},
+		{"q=(&regex=true", http.StatusBadRequest, ""},
+		{"q=get&ignore_case=maybe", http.StatusBadRequest, ""},
+		{"q=get&context=-1", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/foo?"+test.query, nil))
+		if w.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.query, test.code, w.Code)
+		}
+		if test.code == http.StatusOK && w.Body.String() != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.query, test.expected, w.Body.String())
+		}
+	}
+}
+
+func TestGetLogsFormat(t *testing.T) {
+	storageAdapter, err := storage.NewAdapter("memory", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"2017-03-01T14:02:00+00:00 foo[web.v2.nzf60]: GET /healthz 200",
+		"2017-03-01T14:03:00+00:00 deis[controller]: INFO admin deployed 2fd9226",
+		"not in a default format",
+	} {
+		if err := storageAdapter.Write(context.Background(), "foo", line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := newRouter(newRequestHandler(storageAdapter, nil))
+	for format, expected := range map[string]string{
+		`{{.Time | inZone "Asia/Tokyo" | formatTime "15:04"}} {{.Process}}: {{truncate 3 .Text}}`: "23:02 web: GET\n23:03 : adm\nnot in a default format\n",
+		`{{if .Controller}}{{.Level}}{{else}}{{.App}}.{{.PodSuffix}}{{end}}`:                      "foo.nzf60\nINFO\nnot in a default format\n",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/foo?format="+url.QueryEscape(format), nil))
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Errorf("%s: expected %q, got %d %q", format, expected, w.Code, w.Body.String())
+		}
+	}
+	for _, format := range []string{"{{.Time", "{{.Pod}}", `{{.Time | inZone "Mars/Olympus"}}`} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/foo?format="+url.QueryEscape(format), nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", format, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestGetLogsCustomFormat(t *testing.T) {
+	os.Setenv("DEIS_LOGGER_METADATA_ADAPTERS", "memory")
+	defer os.Unsetenv("DEIS_LOGGER_METADATA_ADAPTERS")
+	storageAdapter, err := storage.NewAdapter("memory", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lines rendered with DEIS_LOGGER_LOG_FORMAT="{{.Process}} said: {{.Text}}"
+	for i, process := range []string{"web", "worker"} {
+		metadata := storage.Metadata{
+			Time:      time.Date(2017, 3, 1, 14, 2+i, 0, 0, time.UTC),
+			Pod:       "foo-" + process + "-845861952-nzf60",
+			Container: "foo-" + process,
+			Process:   process,
+			Version:   "v2",
+			Stream:    "stdout",
+		}
+		if err := storage.WriteWithMetadata(context.Background(), storageAdapter, "foo", process+" said: hello", metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := newRouter(newRequestHandler(storageAdapter, nil))
+	format := `{{.Time | formatTime "15:04"}} {{.App}}[{{.Process}}.{{.Version}}.{{.PodSuffix}}] {{.Kubernetes.ContainerName}} {{.Stream}}: {{.Text}}`
+	for query, expected := range map[string]string{
+		"":                                  "web said: hello\nworker said: hello\n",
+		"since=2017-03-01T14:02:30Z":        "worker said: hello\n",
+		"until=2017-03-01T14:02:30Z":        "web said: hello\n",
+		"format=" + url.QueryEscape(format): "14:02 foo[web.v2.nzf60] foo-web stdout: web said: hello\n14:03 foo[worker.v2.nzf60] foo-worker stdout: worker said: hello\n",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/foo?"+query, nil))
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Errorf("%s: expected %q, got %d %q", query, expected, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestGetLogsOutput(t *testing.T) {
+	storageAdapter, err := storage.NewAdapter("memory", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		"2017-03-01T14:02:00+00:00 foo[web.v2.nzf60]: [warn] GET /healthz [200]",
+		"2017-03-01T14:03:00-05:00 deis[controller]: INFO admin deployed 2fd9226",
+		"not in a default format",
+	}
+	for _, line := range lines {
+		if err := storageAdapter.Write(context.Background(), "foo", line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := []logEntry{
+		{Time: "2017-03-01T14:02:00Z", App: "foo", Process: "web", Version: "v2", Pod: "nzf60", Message: "[warn] GET /healthz [200]"},
+		{Time: "2017-03-01T19:03:00Z", App: "foo", Level: "INFO", Message: "admin deployed 2fd9226"},
+		{App: "foo", Message: "not in a default format"},
+	}
+	router := newRouter(newRequestHandler(storageAdapter, nil))
+	tests := []struct {
+		query       string
+		accept      string
+		contentType string
+	}{
+		{"", "", ""},
+		{"", "text/plain, application/json", ""},
+		{"", "application/json; charset=utf-8", "application/json"},
+		{"", "text/html, application/x-ndjson;q=0.9", "application/x-ndjson"},
+		{"output=ndjson", "application/json", "application/x-ndjson"},
+		{"output=json", "", "application/json"},
+		{"output=text", "application/json", ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/logs/foo?"+test.query, nil)
+		r.Header.Set("Accept", test.accept)
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: expected %d, got %d", test.query, test.accept, http.StatusOK, w.Code)
+		}
+		if test.contentType != "" && w.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("%s %s: expected %s, got %s", test.query, test.accept, test.contentType, w.Header().Get("Content-Type"))
+		}
+		var got []logEntry
+		switch test.contentType {
+		case "":
+			if expected := strings.Join(lines, "\n") + "\n"; w.Body.String() != expected {
+				t.Errorf("%s %s: expected %q, got %q", test.query, test.accept, expected, w.Body.String())
+			}
+			continue
+		case "application/json":
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+				var entry logEntry
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, entry)
+			}
+		}
+		if !reflect.DeepEqual(got, entries) {
+			t.Errorf("%s %s: expected %+v, got %+v", test.query, test.accept, entries, got)
+		}
+	}
+	for _, query := range []string{"output=xml", "output=json&format={{.Text}}"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/foo?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestGetLogsOutputMetadata(t *testing.T) {
+	os.Setenv("DEIS_LOGGER_METADATA_ADAPTERS", "memory")
+	defer os.Unsetenv("DEIS_LOGGER_METADATA_ADAPTERS")
+	storageAdapter, err := storage.NewAdapter("memory", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := storage.Metadata{
+		Time:      time.Date(2017, 3, 1, 14, 2, 0, 0, time.UTC),
+		Namespace: "foo",
+		Pod:       "foo-web-845861952-nzf60",
+		Container: "foo-web",
+		Process:   "web",
+		Version:   "v2",
+		Stream:    "stderr",
+	}
+	line := "2017-03-01T14:02:00+00:00 foo[web.v2.nzf60]: [warn] GET /healthz [200]"
+	if err := storage.WriteWithMetadata(context.Background(), storageAdapter, "foo", line, metadata); err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(newRequestHandler(storageAdapter, nil))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/foo?output=json", nil))
+	var got []logEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := []logEntry{{
+		Time:      "2017-03-01T14:02:00Z",
+		App:       "foo",
+		Process:   "web",
+		Version:   "v2",
+		Pod:       "foo-web-845861952-nzf60",
+		Container: "foo-web",
+		Stream:    "stderr",
+		Message:   "[warn] GET /healthz [200]",
+	}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+	// text output is the line as it was written
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/foo", nil))
+	if w.Body.String() != line+"\n" {
+		t.Errorf("expected %q, got %q", line+"\n", w.Body.String())
+	}
+}
+
+func TestGetLogsCursors(t *testing.T) {
+	storageAdapter, err := storage.NewAdapter("memory", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := storageAdapter.Write(context.Background(), "foo", fmt.Sprintf("message %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := newRouter(newRequestHandler(storageAdapter, nil))
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/foo?"+query, nil))
+		return w
+	}
+	w := get("log_lines=2")
+	if w.Body.String() != "message 3\nmessage 4\n" {
+		t.Errorf("unexpected logs: %q", w.Body.String())
+	}
+	after := w.Header().Get(afterCursorHeader)
+	w = get("log_lines=2&before=" + w.Header().Get(beforeCursorHeader))
+	if w.Body.String() != "message 1\nmessage 2\n" {
+		t.Errorf("unexpected logs before the first page: %q", w.Body.String())
+	}
+	// Polling without new lines keeps the cursor
+	w = get("after=" + after)
+	if w.Code != http.StatusNoContent || w.Header().Get(afterCursorHeader) != after {
+		t.Errorf("expected %d with cursor %s, got %d with cursor %s", http.StatusNoContent, after, w.Code, w.Header().Get(afterCursorHeader))
+	}
+	if err := storageAdapter.Write(context.Background(), "foo", "message 5"); err != nil {
+		t.Fatal(err)
+	}
+	if w = get("after=" + after); w.Body.String() != "message 5\n" {
+		t.Errorf("unexpected logs after the first page: %q", w.Body.String())
+	}
+	for _, query := range []string{"before=!", "before=" + after + "&after=" + after} {
+		if w = get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("expected %d for %s, got %d", http.StatusBadRequest, query, w.Code)
+		}
+	}
+}
+
+func TestGetApps(t *testing.T) {
+	storageAdapter, err := storage.NewAdapter("memory", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(newRequestHandler(storageAdapter, nil))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/logs", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "[]\n" {
+		t.Errorf("expected an empty list, got %d: %q", w.Code, w.Body.String())
+	}
+	for _, app := range []string{"foo", "bar", "foo"} {
+		if err := storageAdapter.Write(context.Background(), app, "Hello, log!"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/", nil))
+	var apps []appInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &apps); err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 2 || apps[0].Name != "bar" || apps[1].Name != "foo" || apps[1].Lines != 2 || apps[1].Bytes != 22 {
+		t.Errorf("unexpected apps: %+v", apps)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, apps[0].LastWrite); err != nil {
+		t.Errorf("unexpected last write time: %s", err)
+	}
+}
+
+func TestGetHealthz(t *testing.T) {
+	router := newRouter(newRequestHandler(erroringAdapter{}, nil))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("expected an empty 200 response, got %d: %s", w.Code, w.Body.String())
+	}
+	// Storage adapters reporting their state have it described
+	primary, err := storage.NewAdapter("memory", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback, err := storage.NewAdapter("memory", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageAdapter, err := storage.NewBreakerAdapter(primary, fallback, 5, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router = newRouter(newRequestHandler(storageAdapter, nil))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	var body struct {
+		Storage struct {
+			Breaker struct {
+				State    string `json:"state"`
+				Failures int    `json:"failures"`
+			} `json:"breaker"`
+		} `json:"storage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || body.Storage.Breaker.State != "closed" || body.Storage.Breaker.Failures != 0 {
+		t.Errorf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetAdapters(t *testing.T) {
+	router := newRouter(newRequestHandler(erroringAdapter{}, nil))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/adapters", nil))
+	var names registeredNames
+	if err := json.Unmarshal(w.Body.Bytes(), &names); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names.StorageAdapters, storage.Adapters()) || !reflect.DeepEqual(names.Aggregators, []string{"noop", "nsq"}) {
+		t.Errorf("unexpected registered names: %+v", names)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	storageAdapter, err := storage.NewAdapter("memory", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(newRequestHandler(storageAdapter, nil))
+	do := func(method string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "/logs/foo/retention", strings.NewReader(body)))
+		return w
+	}
+	tests := []struct {
+		method       string
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{"GET", "", http.StatusOK, `{"lines":10}`},
+		{"PUT", `{"lines": 5, "max_age": "24h"}`, http.StatusOK, `{"lines":5,"max_age":"24h0m0s"}`},
+		{"GET", "", http.StatusOK, `{"lines":5,"max_age":"24h0m0s"}`},
+		{"PUT", `{"lines": -5}`, http.StatusBadRequest, ""},
+		{"PUT", `{"max_age": "a day"}`, http.StatusBadRequest, ""},
+		{"DELETE", "", http.StatusOK, `{"lines":10}`},
+	}
+	for _, test := range tests {
+		w := do(test.method, test.body)
+		if w.Code != test.expectedCode {
+			t.Errorf("%s %s: expected %d, got %d: %s", test.method, test.body, test.expectedCode, w.Code, w.Body.String())
+		}
+		if test.expectedBody != "" && strings.TrimSpace(w.Body.String()) != test.expectedBody {
+			t.Errorf("%s %s: expected %s, got %s", test.method, test.body, test.expectedBody, w.Body.String())
+		}
+	}
+	// Storage adapters that can't keep a different amount of logs for every app are rejected
+	router = newRouter(newRequestHandler(struct{ storage.Adapter }{storageAdapter}, nil))
+	if w := do("GET", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := do("PUT", `{"lines": 5}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+type erroringAdapter struct {
+	storage.Adapter
+	err error
+}
+
+func (a erroringAdapter) Read(ctx context.Context, app string, opts storage.ReadOptions) (*storage.Page, error) {
+	return nil, a.err
+}
+
+func (a erroringAdapter) Apps(context.Context) ([]storage.AppInfo, error) {
+	return nil, a.err
+}
+
+func TestStorageErrors(t *testing.T) {
+	tests := []struct {
+		err          error
+		expectedCode int
+	}{
+		{storage.ErrNotFound{App: "foo"}, http.StatusNoContent},
+		{storage.ErrInvalidArgument{Message: "Invalid cursor: x"}, http.StatusBadRequest},
+		{storage.ErrUnavailable{Adapter: "redis", Err: fmt.Errorf("connection refused")}, http.StatusServiceUnavailable},
+		{storage.ErrQuotaExceeded{Adapter: "loki", Err: fmt.Errorf("rate limited")}, http.StatusTooManyRequests},
+		{storage.ErrUnavailable{Adapter: "loki", Err: context.DeadlineExceeded}, http.StatusGatewayTimeout},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{fmt.Errorf("something else"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		router := newRouter(newRequestHandler(erroringAdapter{err: test.err}, nil))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/foo", nil))
+		if w.Code != test.expectedCode {
+			t.Errorf("%v: expected %d, got %d", test.err, test.expectedCode, w.Code)
+		}
+		if w.Code == http.StatusNoContent {
+			continue
+		}
+		var body errorBody
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error != test.err.Error() {
+			t.Errorf("%v: unexpected body %q", test.err, w.Body.String())
+		}
+	}
+	// Errors listing apps are mapped the same way
+	router := newRouter(newRequestHandler(erroringAdapter{err: storage.ErrNotFound{App: "foo"}}, nil))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/logs", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, w.Code)
+	}
+	// Invalid parameters are answered with a JSON error body too
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/foo?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected a JSON error, got %d: %s", w.Code, w.Body.String())
+	}
+}
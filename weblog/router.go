@@ -6,14 +6,22 @@ import (
 
 func newRouter(rh *requestHandler) *mux.Router {
 	r := mux.NewRouter()
-	initStern() // tailLogs
 	r.HandleFunc("/healthz", rh.getHealthz).Methods("GET")
 	r.HandleFunc("/healthz/", rh.getHealthz).Methods("GET")
+	r.HandleFunc("/adapters", rh.getAdapters).Methods("GET")
+	r.HandleFunc("/adapters/", rh.getAdapters).Methods("GET")
+	r.HandleFunc("/logs", rh.getApps).Methods("GET")
+	r.HandleFunc("/logs/", rh.getApps).Methods("GET")
 	r.HandleFunc("/logs/{app}", rh.getLogs).Methods("GET")
 	r.HandleFunc("/logs/{app}/", rh.getLogs).Methods("GET")
 	r.HandleFunc("/logs/{app}/tail", rh.tailLogs).Methods("GET")
 	r.HandleFunc("/logs/{app}/tail/", rh.tailLogs).Methods("GET")
+	r.HandleFunc("/tail", rh.tailSocket).Methods("GET")
+	r.HandleFunc("/tail/", rh.tailSocket).Methods("GET")
 	r.HandleFunc("/logs/{app}", rh.deleteLogs).Methods("DELETE")
 	r.HandleFunc("/logs/{app}/", rh.deleteLogs).Methods("DELETE")
+	r.HandleFunc("/logs/{app}/retention", rh.getRetention).Methods("GET")
+	r.HandleFunc("/logs/{app}/retention", rh.putRetention).Methods("PUT")
+	r.HandleFunc("/logs/{app}/retention", rh.deleteRetention).Methods("DELETE")
 	return r
 }
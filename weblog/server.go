@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 
+	logger "github.com/deis/logger/log"
 	"github.com/deis/logger/storage"
 )
 
@@ -25,11 +26,11 @@ type Server struct {
 }
 
 // NewServer returns a new HTTP Server. The caller should call Start to start it and Close
-// when finished to shut it down.
-func NewServer(storageAdapter storage.Adapter) *Server {
+// when finished to shut it down. Logs are tailed from the broker, if it isn't nil.
+func NewServer(storageAdapter storage.Adapter, broker *logger.Broker) *Server {
 	s := &Server{
 		Listener: defaultListener(),
-		Server:   &http.Server{Handler: newRouter(newRequestHandler(storageAdapter))},
+		Server:   &http.Server{Handler: newRouter(newRequestHandler(storageAdapter, broker))},
 	}
 	return s
 }
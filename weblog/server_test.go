@@ -39,7 +39,7 @@ func TestServerStart(t *testing.T) {
 
 	s := &Server{
 		Listener: newTestListener(t),
-		Server:   &http.Server{Handler: newRouter(newRequestHandler(storageAdapter))},
+		Server:   &http.Server{Handler: newRouter(newRequestHandler(storageAdapter, nil))},
 	}
 
 	s.Start()
@@ -70,7 +70,7 @@ func TestServerClose(t *testing.T) {
 
 	s := &Server{
 		Listener: newTestListener(t),
-		Server:   &http.Server{Handler: newRouter(newRequestHandler(storageAdapter))},
+		Server:   &http.Server{Handler: newRouter(newRequestHandler(storageAdapter, nil))},
 	}
 
 	s.Start()
@@ -91,7 +91,7 @@ func TestServerURL(t *testing.T) {
 
 	s := &Server{
 		Listener: newTestListener(t),
-		Server:   &http.Server{Handler: newRouter(newRequestHandler(storageAdapter))},
+		Server:   &http.Server{Handler: newRouter(newRequestHandler(storageAdapter, nil))},
 		URL:      "foo",
 	}
 
@@ -0,0 +1,210 @@
+package weblog
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	logger "github.com/deis/logger/log"
+	"github.com/gorilla/websocket"
+)
+
+// socketReadLimit is the size in bytes of the largest control frame accepted from a client
+const socketReadLimit = 4096
+
+// socketWriteTimeout is how long a frame may take to be sent before the client is given up on
+var socketWriteTimeout = 10 * time.Second
+
+// upgrader turns requests into WebSocket connections. It only accepts requests from pages of the
+// same origin, so that other sites can't read logs through the browsers of their visitors.
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+// tailControl is a control frame sent by a WebSocket client. "subscribe" tails App instead of the
+// app tailed so far. "process" only tails the lines of Process, and "grep" those whose text matches
+// the regular expression Grep, with empty values tailing every line. "pause" and "resume" stop and
+// start sending lines, which are kept in the buffer of the client meanwhile.
+type tailControl struct {
+	Action  string `json:"action"`
+	App     string `json:"app"`
+	Process string `json:"process"`
+	Grep    string `json:"grep"`
+}
+
+// tailFrame is a frame sent to a WebSocket client, whose type tells which of the other fields are
+// set
+type tailFrame struct {
+	Type string `json:"type"`
+	// ID and Entry are set for "log" frames. The ID is that of Server-Sent Events.
+	ID    string    `json:"id,omitempty"`
+	Entry *logEntry `json:"entry,omitempty"`
+	// Dropped is set for "dropped" frames, which tell how many lines couldn't be sent
+	Dropped uint64 `json:"dropped,omitempty"`
+	// Status is set for the "status" frames answering valid control frames
+	Status *tailStatus `json:"status,omitempty"`
+	// Error is set for the "error" frames answering invalid control frames
+	Error string `json:"error,omitempty"`
+}
+
+// tailStatus is the state of the tail of a WebSocket client once a control frame was applied
+type tailStatus struct {
+	App     string `json:"app"`
+	Process string `json:"process"`
+	Grep    string `json:"grep"`
+	Paused  bool   `json:"paused"`
+}
+
+// socketTail is the tail of a WebSocket client, which subscribes to an app at a time
+type socketTail struct {
+	conn         *websocket.Conn
+	broker       *logger.Broker
+	tail         tailRequest
+	subscription *logger.Subscription
+	paused       bool
+}
+
+// tailSocket streams the lines of apps over a WebSocket, as structured "log" frames, following the
+// control frames of the client. Idle clients are pinged every heartbeatInterval and dropped if they
+// don't answer. Lines that a slow or paused client can't keep up with are dropped, as for other
+// tails, and reported in "dropped" frames.
+func (h requestHandler) tailSocket(w http.ResponseWriter, r *http.Request) {
+	if h.broker == nil {
+		writeErrorMessage(w, http.StatusServiceUnavailable, "Tailing logs is not available")
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied with an error
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+	s := &socketTail{conn: conn, broker: h.broker}
+	defer s.unsubscribe()
+	log.Printf("WebSocket tail from %s started.", r.RemoteAddr)
+	defer log.Printf("WebSocket tail from %s closed.", r.RemoteAddr)
+	controls := make(chan []byte)
+	done := make(chan struct{})
+	defer close(done)
+	go s.readControls(controls, done, 2*heartbeatInterval)
+	ping := time.NewTicker(heartbeatInterval)
+	defer ping.Stop()
+	for {
+		// a nil channel is never ready, which keeps the lines of a paused client in its buffer
+		var messages <-chan logger.Published
+		var dropped <-chan struct{}
+		if s.subscription != nil && !s.paused {
+			messages, dropped = s.subscription.Messages(), s.subscription.Dropped()
+		}
+		var err error
+		select {
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteTimeout))
+		case data, ok := <-controls:
+			if !ok {
+				return
+			}
+			err = s.write(s.control(data))
+		case <-dropped:
+			if n := s.subscription.TakeDropped(); n > 0 {
+				err = s.write(tailFrame{Type: "dropped", Dropped: n})
+			}
+		case published, ok := <-messages:
+			if !ok {
+				return
+			}
+			if s.tail.matches(published.Line) {
+				entry := newLineEntry(s.tail.app, published.Line)
+				err = s.write(tailFrame{Type: "log", ID: published.ID, Entry: &entry})
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readControls passes the control frames of the client on until the connection fails or done is
+// closed. The client has pongWait to answer pings, or to send a frame, before it is given up on.
+func (s *socketTail) readControls(controls chan<- []byte, done <-chan struct{}, pongWait time.Duration) {
+	defer close(controls)
+	s.conn.SetReadLimit(socketReadLimit)
+	s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println(err)
+			}
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(pongWait))
+		select {
+		case controls <- data:
+		case <-done:
+			return
+		}
+	}
+}
+
+// control applies a control frame, returning the frame answering it
+func (s *socketTail) control(data []byte) tailFrame {
+	var control tailControl
+	if err := json.Unmarshal(data, &control); err != nil {
+		return errorFrame(fmt.Sprintf("Invalid control frame: %s", err))
+	}
+	switch control.Action {
+	case "subscribe":
+		if control.App == "" {
+			return errorFrame("An app is required to subscribe")
+		}
+		s.unsubscribe()
+		s.tail.app = control.App
+		s.subscription = s.broker.Subscribe(control.App)
+	case "process":
+		s.tail.process = control.Process
+	case "grep":
+		if control.Grep == "" {
+			s.tail.grep = nil
+			break
+		}
+		grep, err := regexp.Compile(control.Grep)
+		if err != nil {
+			return errorFrame(fmt.Sprintf("Invalid grep: %s", err))
+		}
+		s.tail.grep = grep
+	case "pause":
+		s.paused = true
+	case "resume":
+		s.paused = false
+	default:
+		return errorFrame(fmt.Sprintf("Invalid action: %s", control.Action))
+	}
+	status := &tailStatus{App: s.tail.app, Process: s.tail.process, Paused: s.paused}
+	if s.tail.grep != nil {
+		status.Grep = s.tail.grep.String()
+	}
+	return tailFrame{Type: "status", Status: status}
+}
+
+func errorFrame(message string) tailFrame {
+	return tailFrame{Type: "error", Error: message}
+}
+
+// unsubscribe closes the subscription to the app tailed so far, if any
+func (s *socketTail) unsubscribe() {
+	if s.subscription != nil {
+		s.subscription.Close()
+		s.subscription = nil
+	}
+}
+
+func (s *socketTail) write(frame tailFrame) error {
+	s.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	return s.conn.WriteJSON(frame)
+}
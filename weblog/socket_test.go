@@ -0,0 +1,150 @@
+package weblog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	logger "github.com/deis/logger/log"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// dialTail connects to the WebSocket tail of a test server, which is closed along with the
+// returned function
+func dialTail(t *testing.T, broker *logger.Broker) (*websocket.Conn, func()) {
+	server := httptest.NewServer(newRouter(newRequestHandler(newTestStorageAdapter(t), broker)))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/tail", nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return conn, func() {
+		conn.Close()
+		server.Close()
+	}
+}
+
+// sendControl sends a control frame and returns the frame answering it
+func sendControl(t *testing.T, conn *websocket.Conn, control tailControl) tailFrame {
+	assert.NoError(t, conn.WriteJSON(control))
+	return readFrame(t, conn)
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) tailFrame {
+	var frame tailFrame
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestTailSocket(t *testing.T) {
+	broker := logger.NewBroker(10, 0, time.Minute)
+	conn, stop := dialTail(t, broker)
+	defer stop()
+	frame := sendControl(t, conn, tailControl{Action: "subscribe", App: "foo"})
+	assert.Equal(t, tailFrame{Type: "status", Status: &tailStatus{App: "foo"}}, frame)
+	publishTestLine(broker, "web", "first")
+	frame = readFrame(t, conn)
+	assert.Equal(t, "log", frame.Type)
+	assert.NotEmpty(t, frame.ID)
+	assert.Equal(t, &logEntry{
+		Time:    "2017-03-01T14:02:00Z",
+		App:     "foo",
+		Process: "web",
+		Version: "v2",
+		Pod:     "nzf60",
+		Message: "first",
+	}, frame.Entry)
+	// the filters change without reconnecting
+	frame = sendControl(t, conn, tailControl{Action: "process", Process: "web"})
+	assert.Equal(t, &tailStatus{App: "foo", Process: "web"}, frame.Status)
+	frame = sendControl(t, conn, tailControl{Action: "grep", Grep: "^s"})
+	assert.Equal(t, &tailStatus{App: "foo", Process: "web", Grep: "^s"}, frame.Status)
+	publishTestLine(broker, "worker", "second")
+	publishTestLine(broker, "web", "not second")
+	publishTestLine(broker, "web", "second")
+	assert.Equal(t, "second", readFrame(t, conn).Entry.Message)
+	// invalid control frames are answered with errors, leaving the tail as it was
+	for _, control := range []tailControl{{Action: "subscribe"}, {Action: "grep", Grep: "("}, {Action: "follow"}} {
+		assert.Equal(t, "error", sendControl(t, conn, control).Type, "unexpected answer to %+v", control)
+	}
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("{")))
+	assert.Equal(t, "error", readFrame(t, conn).Type)
+	frame = sendControl(t, conn, tailControl{Action: "grep"})
+	assert.Equal(t, &tailStatus{App: "foo", Process: "web"}, frame.Status)
+}
+
+func TestTailSocketPause(t *testing.T) {
+	broker := logger.NewBroker(2, 0, time.Minute)
+	conn, stop := dialTail(t, broker)
+	defer stop()
+	sendControl(t, conn, tailControl{Action: "subscribe", App: "foo"})
+	frame := sendControl(t, conn, tailControl{Action: "pause"})
+	assert.True(t, frame.Status.Paused)
+	for _, text := range []string{"1", "2", "3", "4", "5"} {
+		publishTestLine(broker, "web", text)
+	}
+	sendControl(t, conn, tailControl{Action: "resume"})
+	// the buffered lines and the number of those dropped come in either order
+	var messages []string
+	var dropped uint64
+	for i := 0; i < 3; i++ {
+		frame := readFrame(t, conn)
+		switch frame.Type {
+		case "log":
+			messages = append(messages, frame.Entry.Message)
+		case "dropped":
+			dropped = frame.Dropped
+		}
+	}
+	assert.Equal(t, []string{"1", "2"}, messages)
+	assert.Equal(t, uint64(3), dropped)
+}
+
+func TestTailSocketSubscribe(t *testing.T) {
+	broker := logger.NewBroker(10, 0, time.Minute)
+	conn, stop := dialTail(t, broker)
+	defer stop()
+	sendControl(t, conn, tailControl{Action: "subscribe", App: "foo"})
+	sendControl(t, conn, tailControl{Action: "subscribe", App: "bar"})
+	assert.Equal(t, 0, broker.Subscribers("foo"))
+	assert.Equal(t, 1, broker.Subscribers("bar"))
+	conn.Close()
+	for broker.Subscribers("bar") > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTailSocketPing(t *testing.T) {
+	defer func(interval time.Duration) { heartbeatInterval = interval }(heartbeatInterval)
+	heartbeatInterval = 10 * time.Millisecond
+	conn, stop := dialTail(t, logger.NewBroker(10, 0, time.Minute))
+	defer stop()
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(data string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	// control frames are handled while reading
+	go conn.ReadMessage()
+	select {
+	case <-pinged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client wasn't pinged")
+	}
+}
+
+func TestTailSocketUnavailable(t *testing.T) {
+	router := newRouter(newRequestHandler(newTestStorageAdapter(t), nil))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/tail", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
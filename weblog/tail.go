@@ -0,0 +1,218 @@
+package weblog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	logger "github.com/deis/logger/log"
+	"github.com/gorilla/mux"
+)
+
+// eventStreamType is the media type of Server-Sent Events
+const eventStreamType = "text/event-stream"
+
+// heartbeatInterval is how often an idle event stream is sent a comment, which tells clients that
+// it is still alive and keeps proxies from timing it out
+var heartbeatInterval = 15 * time.Second
+
+// tailRequest tells which of the messages of an app a client tails and how they are rendered
+type tailRequest struct {
+	app     string
+	process string
+	// grep, when set, is matched against the text of the messages. Only WebSocket clients set it.
+	grep   *regexp.Regexp
+	format *logger.LineFormat
+}
+
+func newTailRequest(r *http.Request) (*tailRequest, error) {
+	t := &tailRequest{app: mux.Vars(r)["app"], process: r.URL.Query().Get("process")}
+	if value := r.URL.Query().Get("format"); value != "" {
+		var err error
+		if t.format, err = logger.NewLineFormat(value, ""); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// matches reports whether a message is of the process being tailed and matches grep. Controller
+// lines are those of the controller process, as when reading logs.
+func (t *tailRequest) matches(l *logger.Line) bool {
+	if t.process != "" && (l.Controller && t.process != "controller" || !l.Controller && l.Process != t.process) {
+		return false
+	}
+	return t.grep == nil || t.grep.MatchString(l.Text)
+}
+
+// line renders a message, or returns false if it doesn't match the tail
+func (t *tailRequest) line(published logger.Published) (string, bool) {
+	l := published.Line
+	if !t.matches(l) {
+		return "", false
+	}
+	if t.format != nil {
+		return t.format.Render(l), true
+	}
+	return strings.TrimSuffix(published.Rendered, "\n"), true
+}
+
+// tailLogs streams the lines of an app as they are aggregated, until the client goes away. Lines
+// that a slow client can't keep up with are dropped, and the client is told how many. Clients
+// accepting text/event-stream are sent Server-Sent Events, and other clients plain text lines.
+func (h requestHandler) tailLogs(w http.ResponseWriter, r *http.Request) {
+	if h.broker == nil {
+		writeErrorMessage(w, http.StatusServiceUnavailable, "Tailing logs is not available")
+		return
+	}
+	t, err := newTailRequest(r)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("Tail of %s started.", t.app)
+	defer log.Printf("Tail of %s closed.", t.app)
+	if acceptsEventStream(r) {
+		h.tailEvents(w, r, t)
+		return
+	}
+	h.tailText(w, r, t)
+}
+
+// acceptsEventStream reports whether the Accept header of a request names text/event-stream
+func acceptsEventStream(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted)); err == nil && mediaType == eventStreamType {
+			return true
+		}
+	}
+	return false
+}
+
+func (h requestHandler) tailText(w http.ResponseWriter, r *http.Request, t *tailRequest) {
+	subscription := h.broker.Subscribe(t.app)
+	defer subscription.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	for {
+		flush(w)
+		select {
+		case <-r.Context().Done():
+			return
+		case <-subscription.Dropped():
+			if n := subscription.TakeDropped(); n > 0 {
+				fmt.Fprintf(w, "%s\n", droppedNotice(n))
+			}
+		case published, ok := <-subscription.Messages():
+			if !ok {
+				return
+			}
+			line, ok := t.line(published)
+			if !ok {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%s\n", line); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// tailEvents streams the lines of an app as "message" events whose IDs can be passed back in the
+// Last-Event-ID header, or the last_event_id query parameter, to resume after them. Missed lines
+// that are still kept by the broker are sent first. The number of lines that couldn't be sent is
+// the data of a "dropped" event, and a "reset" event tells that the tail couldn't be resumed after
+// the given ID.
+func (h requestHandler) tailEvents(w http.ResponseWriter, r *http.Request, t *tailRequest) {
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	var subscription *logger.Subscription
+	var kept []logger.Published
+	var missed uint64
+	resumed := true
+	if lastID == "" {
+		subscription = h.broker.Subscribe(t.app)
+	} else {
+		subscription, kept, missed, resumed = h.broker.SubscribeAfter(t.app, lastID)
+	}
+	defer subscription.Close()
+	w.Header().Set("Content-Type", eventStreamType)
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx buffers responses unless told otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if !resumed {
+		writeEvent(w, "reset", "", "")
+	}
+	if missed > 0 {
+		writeEvent(w, "dropped", "", fmt.Sprint(missed))
+	}
+	for _, published := range kept {
+		if line, ok := t.line(published); ok {
+			writeEvent(w, "message", published.ID, line)
+		}
+	}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		flush(w)
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+		case <-subscription.Dropped():
+			if n := subscription.TakeDropped(); n > 0 {
+				err = writeEvent(w, "dropped", "", fmt.Sprint(n))
+			}
+		case published, ok := <-subscription.Messages():
+			if !ok {
+				return
+			}
+			if line, ok := t.line(published); ok {
+				err = writeEvent(w, "message", published.ID, line)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeEvent writes a Server-Sent Event, splitting its data into lines
+func writeEvent(w io.Writer, event string, id string, data string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "event: %s\n", event)
+	if id != "" {
+		fmt.Fprintf(&b, "id: %s\n", id)
+	}
+	data = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(data)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// flush sends what was written so far to the client, rather than letting it sit in buffers
+func flush(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// droppedNotice is the line telling a client tailing plain text how many lines it was too slow to
+// receive
+func droppedNotice(dropped uint64) string {
+	return fmt.Sprintf("%s deis[logger]: %d lines were dropped because the client is too slow", time.Now().Format(time.RFC3339), dropped)
+}
@@ -0,0 +1,205 @@
+package weblog
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	logger "github.com/deis/logger/log"
+)
+
+// tailWriter hands the lines written by a tail over to a test one at a time, so that the tail
+// blocks like one to a slow client. writing is signaled as every write starts.
+type tailWriter struct {
+	header  http.Header
+	lines   chan string
+	writing chan struct{}
+}
+
+func newTailWriter() *tailWriter {
+	return &tailWriter{header: make(http.Header), lines: make(chan string), writing: make(chan struct{}, 10)}
+}
+
+func (w *tailWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *tailWriter) WriteHeader(code int) {}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.writing <- struct{}{}
+	w.lines <- strings.TrimSuffix(string(p), "\n")
+	return len(p), nil
+}
+
+// startTail tails the logs of foo with the given request headers until the returned function is
+// called
+func startTail(t *testing.T, broker *logger.Broker, query string, header http.Header) (*tailWriter, func()) {
+	router := newRouter(newRequestHandler(newTestStorageAdapter(t), broker))
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/logs/foo/tail?"+query, nil).WithContext(ctx)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := newTailWriter()
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(w, r)
+		close(done)
+	}()
+	for broker.Subscribers("foo") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return w, func() {
+		cancel()
+		<-done
+	}
+}
+
+func publishTestLine(broker *logger.Broker, process string, text string) {
+	message := &logger.Message{
+		Log:  text,
+		Time: time.Date(2017, 3, 1, 14, 2, 0, 0, time.UTC),
+		Kubernetes: logger.Kubernetes{
+			PodName: "foo-" + process + "-845861952-nzf60",
+			Labels:  map[string]string{"app": "foo", "type": process, "version": "v2"},
+		},
+	}
+	format, _ := logger.NewLineFormat("", "")
+	l, _ := logger.ParseLine(format.Format("foo", message))
+	broker.Publish("foo", logger.Published{Line: l, Rendered: format.Format("foo", message)})
+}
+
+func TestTailLogs(t *testing.T) {
+	broker := logger.NewBroker(10, 0, time.Minute)
+	w, stop := startTail(t, broker, "process=web", nil)
+	publishTestLine(broker, "web", "first")
+	publishTestLine(broker, "worker", "skipped")
+	publishTestLine(broker, "web", "second")
+	for _, expected := range []string{
+		"2017-03-01T14:02:00+00:00 foo[web.v2.nzf60]: first",
+		"2017-03-01T14:02:00+00:00 foo[web.v2.nzf60]: second",
+	} {
+		if line := <-w.lines; line != expected {
+			t.Errorf("expected %q, got %q", expected, line)
+		}
+	}
+	stop()
+	if n := broker.Subscribers("foo"); n != 0 {
+		t.Errorf("expected the tail to unsubscribe once the client went away, got %d subscribers", n)
+	}
+	w, stop = startTail(t, broker, "format="+url.QueryEscape("{{.Process}}: {{.Text}}"), nil)
+	defer stop()
+	publishTestLine(broker, "worker", "formatted")
+	if line := <-w.lines; line != "worker: formatted" {
+		t.Errorf("expected %q, got %q", "worker: formatted", line)
+	}
+}
+
+func TestTailLogsDropsForSlowClients(t *testing.T) {
+	broker := logger.NewBroker(2, 0, time.Minute)
+	w, stop := startTail(t, broker, "", nil)
+	defer stop()
+	// the tail blocks writing the first line while the next two fill its buffer
+	publishTestLine(broker, "web", "1")
+	<-w.writing
+	for _, text := range []string{"2", "3", "4", "5"} {
+		publishTestLine(broker, "web", text)
+	}
+	var lines []string
+	for len(lines) < 4 {
+		lines = append(lines, <-w.lines)
+	}
+	var notices int
+	for _, line := range lines {
+		if strings.Contains(line, "deis[logger]: 2 lines were dropped") {
+			notices++
+		}
+	}
+	if notices != 1 || !strings.HasSuffix(lines[0], ": 1") {
+		t.Errorf("expected the first line and a notice of 2 dropped lines, got %q", lines)
+	}
+}
+
+func TestTailLogsUnavailable(t *testing.T) {
+	router := newRouter(newRequestHandler(newTestStorageAdapter(t), nil))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/logs/foo/tail", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestTailEvents(t *testing.T) {
+	broker := logger.NewBroker(10, 10, time.Minute)
+	header := http.Header{"Accept": {"text/html, text/event-stream"}}
+	w, stop := startTail(t, broker, "", header)
+	publishTestLine(broker, "web", "first")
+	event := <-w.lines
+	if ct := w.header.Get("Content-Type"); ct != eventStreamType {
+		t.Errorf("expected %s, got %s", eventStreamType, ct)
+	}
+	lines := strings.Split(event, "\n")
+	if len(lines) != 4 || lines[0] != "event: message" || !strings.HasPrefix(lines[1], "id: ") || lines[2] != "data: 2017-03-01T14:02:00+00:00 foo[web.v2.nzf60]: first" {
+		t.Fatalf("unexpected event %q", event)
+	}
+	firstID := strings.TrimPrefix(lines[1], "id: ")
+	publishTestLine(broker, "web", "multi\nline")
+	if event := <-w.lines; !strings.HasSuffix(event, "data: 2017-03-01T14:02:00+00:00 foo[web.v2.nzf60]: multi\ndata: line\n") {
+		t.Errorf("expected the lines of a message to be sent as separate data, got %q", event)
+	}
+	stop()
+	// a client reconnecting gets the lines it missed
+	publishTestLine(broker, "web", "missed")
+	header.Set("Last-Event-ID", firstID)
+	w, stop = startTail(t, broker, "", header)
+	for _, expected := range []string{"data: 2017-03-01T14:02:00+00:00 foo[web.v2.nzf60]: multi\n", "data: 2017-03-01T14:02:00+00:00 foo[web.v2.nzf60]: missed\n"} {
+		if event := <-w.lines; !strings.Contains(event, expected) {
+			t.Errorf("expected %q, got %q", expected, event)
+		}
+	}
+	stop()
+	// as long as the IDs are those of the running broker
+	header.Set("Last-Event-ID", "bogus-1")
+	w, stop = startTail(t, broker, "", header)
+	defer stop()
+	if event := <-w.lines; event != "event: reset\ndata: \n" {
+		t.Errorf("expected a reset event, got %q", event)
+	}
+}
+
+func TestTailEventsAfterDestroy(t *testing.T) {
+	broker := logger.NewBroker(10, 10, time.Minute)
+	header := http.Header{"Accept": {"text/event-stream"}}
+	w, stop := startTail(t, broker, "", header)
+	publishTestLine(broker, "web", "first")
+	lines := strings.Split(<-w.lines, "\n")
+	stop()
+	// destroyed lines can't be resumed after
+	rec := httptest.NewRecorder()
+	newRouter(newRequestHandler(newTestStorageAdapter(t), broker)).ServeHTTP(rec, httptest.NewRequest("DELETE", "/logs/foo", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rec.Code)
+	}
+	header.Set("Last-Event-ID", strings.TrimPrefix(lines[1], "id: "))
+	w, stop = startTail(t, broker, "", header)
+	defer stop()
+	if event := <-w.lines; event != "event: reset\ndata: \n" {
+		t.Errorf("expected a reset event, got %q", event)
+	}
+}
+
+func TestTailEventsHeartbeat(t *testing.T) {
+	defer func(interval time.Duration) { heartbeatInterval = interval }(heartbeatInterval)
+	heartbeatInterval = 10 * time.Millisecond
+	broker := logger.NewBroker(10, 0, time.Minute)
+	w, stop := startTail(t, broker, "", http.Header{"Accept": {eventStreamType}})
+	defer stop()
+	if event := <-w.lines; event != ": heartbeat\n" {
+		t.Errorf("expected a heartbeat, got %q", event)
+	}
+}